@@ -0,0 +1,332 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// outcome is how a command dispatch ended
+type outcome string
+
+const (
+	outcomeSuccess outcome = "success"
+	outcomeDenied  outcome = "denied"
+	outcomeError   outcome = "error"
+
+	// The arguments couldn't be parsed, so the command never ran
+	outcomeUsage outcome = "usage"
+)
+
+const (
+	// How long hourly and daily buckets are kept for
+	hourlyRetention = time.Hour * 48
+	dailyRetention  = time.Hour * 24 * 90
+
+	// Guild key used for commands run in DMs
+	dmGuild = "DM"
+)
+
+// usageCount counts dispatches and how they went. Uses includes denied,
+// misused and failed ones. Only failures of the bot itself count as errors.
+type usageCount struct {
+	Uses     int `json:"uses"`
+	Denied   int `json:"denied"`
+	BadUsage int `json:"bad_usage"`
+	Errors   int `json:"errors"`
+
+	// Summed over every use, for working out the average
+	Latency time.Duration `json:"latency"`
+}
+
+func (c *usageCount) add(o outcome, took time.Duration) {
+	c.Uses++
+	c.Latency += took
+	switch o {
+	case outcomeDenied:
+		c.Denied++
+	case outcomeUsage:
+		c.BadUsage++
+	case outcomeError:
+		c.Errors++
+	}
+}
+
+func (c *usageCount) merge(other usageCount) {
+	c.Uses += other.Uses
+	c.Denied += other.Denied
+	c.BadUsage += other.BadUsage
+	c.Errors += other.Errors
+	c.Latency += other.Latency
+}
+
+func (c usageCount) errorRate() float64 {
+	if c.Uses == 0 {
+		return 0
+	}
+	return float64(c.Errors) / float64(c.Uses)
+}
+
+func (c usageCount) avgLatency() time.Duration {
+	if c.Uses == 0 {
+		return 0
+	}
+	return c.Latency / time.Duration(c.Uses)
+}
+
+// usageBucket holds the counts for one hour or day
+type usageBucket struct {
+	Start time.Time `json:"start"`
+
+	// Keyed by the full command name
+	Commands map[string]*usageCount `json:"commands"`
+	Guilds   map[string]*usageCount `json:"guilds"`
+
+	// Number of dispatches per user ID
+	Users map[string]int `json:"users"`
+}
+
+func newUsageBucket(start time.Time) *usageBucket {
+	return &usageBucket{
+		Start:    start,
+		Commands: make(map[string]*usageCount),
+		Guilds:   make(map[string]*usageCount),
+		Users:    make(map[string]int),
+	}
+}
+
+func (b *usageBucket) add(name, guildID, userID string, took time.Duration, o outcome) {
+	countFor(b.Commands, name).add(o, took)
+	countFor(b.Guilds, guildID).add(o, took)
+	b.Users[userID]++
+}
+
+func countFor(counts map[string]*usageCount, key string) *usageCount {
+	c, ok := counts[key]
+	if !ok {
+		c = new(usageCount)
+		counts[key] = c
+	}
+	return c
+}
+
+// usageStats aggregates command dispatches into hourly and daily buckets,
+// oldest first
+type usageStats struct {
+	sync.Mutex
+
+	Hourly []*usageBucket `json:"hourly"`
+	Daily  []*usageBucket `json:"daily"`
+
+	// Whether anything was recorded since the last save
+	dirty bool
+}
+
+var commandStats = new(usageStats)
+
+// record counts a dispatch of the command with the given full name
+func (u *usageStats) record(name, guildID, userID string, took time.Duration, o outcome) {
+	u.add(time.Now(), name, guildID, userID, took, o)
+}
+
+func (u *usageStats) add(now time.Time, name, guildID, userID string, took time.Duration, o outcome) {
+	if guildID == "" {
+		guildID = dmGuild
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	now = now.UTC()
+	u.Hourly = addToBuckets(u.Hourly, now.Truncate(time.Hour), now.Add(-hourlyRetention))
+	u.Daily = addToBuckets(u.Daily, now.Truncate(time.Hour*24), now.Add(-dailyRetention))
+
+	u.Hourly[len(u.Hourly)-1].add(name, guildID, userID, took, o)
+	u.Daily[len(u.Daily)-1].add(name, guildID, userID, took, o)
+	u.dirty = true
+}
+
+// dayCount is how many commands were run in a day
+type dayCount struct {
+	Day  string `json:"day"`
+	Uses int    `json:"uses"`
+}
+
+// userActivity returns how many commands the user ran on each day that's
+// still kept, oldest first
+func (u *usageStats) userActivity(userID string) []dayCount {
+	u.Lock()
+	defer u.Unlock()
+
+	var out []dayCount
+	for _, b := range u.Daily {
+		if n := b.Users[userID]; n != 0 {
+			out = append(out, dayCount{Day: b.Start.Format("2006-01-02"), Uses: n})
+		}
+	}
+	return out
+}
+
+// forget removes the user from every bucket
+func (u *usageStats) forget(userID string) {
+	u.Lock()
+	defer u.Unlock()
+
+	for _, buckets := range [][]*usageBucket{u.Hourly, u.Daily} {
+		for _, b := range buckets {
+			if _, ok := b.Users[userID]; ok {
+				delete(b.Users, userID)
+				u.dirty = true
+			}
+		}
+	}
+}
+
+// addToBuckets makes sure the last bucket starts at start, dropping any that
+// started before cutoff
+func addToBuckets(buckets []*usageBucket, start, cutoff time.Time) []*usageBucket {
+	if len(buckets) == 0 || buckets[len(buckets)-1].Start.Before(start) {
+		buckets = append(buckets, newUsageBucket(start))
+	}
+
+	i := 0
+	for i < len(buckets)-1 && buckets[i].Start.Before(cutoff) {
+		i++
+	}
+	return buckets[i:]
+}
+
+// usagePeriod is a span of time that stats can be summarised over
+type usagePeriod struct {
+	Name   string
+	Span   time.Duration
+	Hourly bool
+}
+
+var usagePeriods = []usagePeriod{
+	{"hour", time.Hour, true},
+	{"day", time.Hour * 24, true},
+	{"week", time.Hour * 24 * 7, false},
+	{"month", time.Hour * 24 * 30, false},
+}
+
+func findUsagePeriod(name string) (usagePeriod, bool) {
+	for _, p := range usagePeriods {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return usagePeriod{}, false
+}
+
+type namedCount struct {
+	Name string `json:"name"`
+	usageCount
+}
+
+// usageSummary is the usage over a period, with the busiest commands and guilds first
+type usageSummary struct {
+	Period string    `json:"period"`
+	Since  time.Time `json:"since"`
+
+	Total usageCount `json:"total"`
+	Users int        `json:"users"`
+
+	Commands []namedCount `json:"commands"`
+	Guilds   []namedCount `json:"guilds"`
+}
+
+// summary adds up the buckets that started within the period before now
+func (u *usageStats) summary(p usagePeriod, now time.Time) usageSummary {
+	u.Lock()
+	defer u.Unlock()
+
+	buckets := u.Daily
+	if p.Hourly {
+		buckets = u.Hourly
+	}
+
+	since := now.UTC().Add(-p.Span)
+	commands := make(map[string]*usageCount)
+	guilds := make(map[string]*usageCount)
+	users := make(map[string]bool)
+
+	for _, b := range buckets {
+		if !b.Start.After(since) {
+			continue
+		}
+		mergeCounts(commands, b.Commands)
+		mergeCounts(guilds, b.Guilds)
+		for id := range b.Users {
+			users[id] = true
+		}
+	}
+
+	out := usageSummary{
+		Period:   p.Name,
+		Since:    since,
+		Users:    len(users),
+		Commands: sortedCounts(commands),
+		Guilds:   sortedCounts(guilds),
+	}
+	for _, c := range out.Commands {
+		out.Total.merge(c.usageCount)
+	}
+	return out
+}
+
+func mergeCounts(into, from map[string]*usageCount) {
+	for key, c := range from {
+		countFor(into, key).merge(*c)
+	}
+}
+
+func sortedCounts(counts map[string]*usageCount) []namedCount {
+	out := make([]namedCount, 0, len(counts))
+	for name, c := range counts {
+		out = append(out, namedCount{name, *c})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Uses != out[j].Uses {
+			return out[i].Uses > out[j].Uses
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// autosave periodically saves the stats if anything was recorded
+func (u *usageStats) autosave() {
+	for {
+		time.Sleep(time.Minute * 10)
+
+		u.Lock()
+		dirty := u.dirty
+		u.Unlock()
+
+		if dirty {
+			saveStats()
+		}
+	}
+}
+
+// statsMiddleware records every command that runs. Commands that panic or
+// fail are counted as errors.
+func statsMiddleware(c command, next execFunc) execFunc {
+	return func(s session, m *discordgo.MessageCreate, a args) {
+		start := time.Now()
+		finished := false
+		defer func() {
+			o := outcomeSuccess
+			if !finished || a.hasFailed() {
+				o = outcomeError
+			}
+			commandStats.record(c.FullName, m.GuildID, m.Author.ID, time.Since(start), o)
+		}()
+
+		next(s, m, a)
+		finished = true
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestUsageSummary(t *testing.T) {
+	now := time.Date(2020, 6, 15, 12, 30, 0, 0, time.UTC)
+
+	stats := new(usageStats)
+	stats.add(now.Add(-time.Hour*24*100), "help", testGuildID, testUserID, time.Second, outcomeSuccess)
+	stats.add(now.Add(-time.Hour*24*3), "help", testGuildID, testUserID, time.Second, outcomeSuccess)
+	stats.add(now.Add(-time.Hour*3), "purge", testGuildID, testOwnerID, time.Second, outcomeDenied)
+	stats.add(now.Add(-time.Minute*10), "help", "", testUserID, time.Second*3, outcomeError)
+	stats.add(now, "help", testGuildID, testOwnerID, time.Second, outcomeSuccess)
+
+	if len(stats.Daily) != 2 {
+		t.Errorf("expected daily buckets older than %s to be dropped, got %d buckets", dailyRetention, len(stats.Daily))
+	}
+
+	tests := []struct {
+		period   string
+		uses     int
+		users    int
+		commands []string
+	}{
+		{period: "hour", uses: 2, users: 2, commands: []string{"help"}},
+		{period: "day", uses: 3, users: 2, commands: []string{"help", "purge"}},
+		{period: "week", uses: 4, users: 2, commands: []string{"help", "purge"}},
+		{period: "month", uses: 4, users: 2, commands: []string{"help", "purge"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.period, func(t *testing.T) {
+			period, _ := findUsagePeriod(tt.period)
+			summary := stats.summary(period, now)
+
+			if summary.Total.Uses != tt.uses || summary.Users != tt.users {
+				t.Errorf("expected %d uses by %d users, got %+v", tt.uses, tt.users, summary)
+			}
+
+			var commands []string
+			for _, c := range summary.Commands {
+				commands = append(commands, c.Name)
+			}
+			if len(commands) != len(tt.commands) || commands[0] != tt.commands[0] {
+				t.Errorf("expected commands %v, got %v", tt.commands, commands)
+			}
+		})
+	}
+
+	period, _ := findUsagePeriod("hour")
+	summary := stats.summary(period, now)
+	help := summary.Commands[0]
+	if help.Errors != 1 || help.avgLatency() != time.Second*2 {
+		t.Errorf("expected 1 error and an average of 2s, got %+v", help)
+	}
+	if len(summary.Guilds) != 2 || summary.Guilds[1].Name != dmGuild {
+		t.Errorf("expected DMs to be counted as %q, got %+v", dmGuild, summary.Guilds)
+	}
+}
+
+func TestCommandStatsRecorded(t *testing.T) {
+	resetState()
+	f := newFakeSession()
+
+	f.run(testUserID, "tag list")
+	f.run(testUserID, "purge 5")
+	f.run(testOwnerID, "purge")
+	f.run(testUserID, "image")
+	f.run(testUserID, "notacommand")
+
+	period, _ := findUsagePeriod("hour")
+	summary := commandStats.summary(period, time.Now())
+
+	want := map[string]usageCount{
+		"tag list": {Uses: 1},
+		"purge":    {Uses: 2, Denied: 1, BadUsage: 1},
+		"image":    {Uses: 1},
+	}
+
+	if len(summary.Commands) != len(want) {
+		t.Fatalf("expected %d commands, got %+v", len(want), summary.Commands)
+	}
+	for _, c := range summary.Commands {
+		w := want[c.Name]
+		if c.Uses != w.Uses || c.Denied != w.Denied || c.BadUsage != w.BadUsage || c.Errors != w.Errors {
+			t.Errorf("expected %s to have %+v, got %+v", c.Name, w, c.usageCount)
+		}
+	}
+
+	if summary.Users != 2 || len(summary.Guilds) != 1 || summary.Guilds[0].Name != testGuildID {
+		t.Errorf("expected 2 users in 1 guild, got %+v", summary)
+	}
+}
+
+func TestStatsMiddlewareFailure(t *testing.T) {
+	resetState()
+	f := newFakeSession()
+
+	for _, exec := range []execFunc{
+		func(session, *discordgo.MessageCreate, args) {},
+		func(_ session, _ *discordgo.MessageCreate, a args) { a.fail() },
+	} {
+		c := newCommand("flaky", 0, false, exec)
+		c.FullName = c.Name
+		statsMiddleware(c, c.Exec)(f, f.message(testUserID, "flaky"), newArgs(nil))
+	}
+
+	period, _ := findUsagePeriod("hour")
+	summary := commandStats.summary(period, time.Now())
+	if len(summary.Commands) != 1 || summary.Commands[0].Uses != 2 || summary.Commands[0].Errors != 1 {
+		t.Errorf("expected only the failed use to be counted as an error, got %+v", summary.Commands)
+	}
+}
+
+func TestStatsAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		remote string
+		header string
+		code   int
+	}{
+		{name: "no token, local", remote: "127.0.0.1:5000", code: http.StatusOK},
+		{name: "no token, local ipv6", remote: "[::1]:5000", code: http.StatusOK},
+		{name: "no token, remote", remote: "203.0.113.5:5000", code: http.StatusForbidden},
+		{name: "token", token: "secret", remote: "203.0.113.5:5000", header: "Bearer secret", code: http.StatusOK},
+		{name: "wrong token", token: "secret", remote: "203.0.113.5:5000", header: "Bearer nope", code: http.StatusUnauthorized},
+		{name: "missing token", token: "secret", remote: "127.0.0.1:5000", code: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState()
+			updateConf(func(c *config) { c.StatsToken = tt.token })
+
+			r := httptest.NewRequest("GET", "/stats/storage", nil)
+			r.RemoteAddr = tt.remote
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+
+			w := httptest.NewRecorder()
+			statsAuth(httpStorageStats)(w, r)
+			if w.Code != tt.code {
+				t.Errorf("expected %d, got %d: %s", tt.code, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestHTTPCommandStats(t *testing.T) {
+	resetState()
+	commandStats.record("help", testGuildID, testUserID, time.Millisecond, outcomeSuccess)
+
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{query: "", code: http.StatusOK},
+		{query: "?period=week", code: http.StatusOK},
+		{query: "?period=year", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			httpCommandStats(w, httptest.NewRequest("GET", "/stats/commands"+tt.query, nil))
+
+			if w.Code != tt.code {
+				t.Fatalf("expected %d, got %d", tt.code, w.Code)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			var summary usageSummary
+			if err := json.NewDecoder(w.Body).Decode(&summary); err != nil {
+				t.Fatal(err)
+			}
+			if summary.Total.Uses != 1 || len(summary.Commands) != 1 || summary.Commands[0].Name != "help" {
+				t.Errorf("unexpected summary %+v", summary)
+			}
+		})
+	}
+}
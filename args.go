@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var roleRegex = regexp.MustCompile("<@&([0-9]+)>")
+var snowflakeRegex = regexp.MustCompile("^[0-9]{15,20}$")
+
+type argKind int
+
+const (
+	argWord argKind = iota
+	argInt
+	argUser
+	argChannel
+	argRole
+	argDuration
+	argGreedy
+	argPipe
+)
+
+// argument describes a single parameter a command accepts. Greedy and
+// pipe arguments consume the rest of the message, so they have to come last.
+type argument struct {
+	Name     string
+	Kind     argKind
+	Optional bool
+
+	// Range for argInt, or the allowed number of segments for argPipe.
+	// Ignored when Max is 0.
+	Min, Max int
+
+	// Segment names for argPipe, used in the usage line
+	Segments []string
+}
+
+func wordArg(name string) argument {
+	return argument{Name: name, Kind: argWord}
+}
+
+func intArg(name string, min, max int) argument {
+	return argument{Name: name, Kind: argInt, Min: min, Max: max}
+}
+
+func userArg(name string) argument {
+	return argument{Name: name, Kind: argUser}
+}
+
+func channelArg(name string) argument {
+	return argument{Name: name, Kind: argChannel}
+}
+
+func roleArg(name string) argument {
+	return argument{Name: name, Kind: argRole}
+}
+
+func durationArg(name string) argument {
+	return argument{Name: name, Kind: argDuration}
+}
+
+func greedyArg(name string) argument {
+	return argument{Name: name, Kind: argGreedy}
+}
+
+func pipeArg(name string, min int, segments ...string) argument {
+	return argument{Name: name, Kind: argPipe, Min: min, Max: len(segments), Segments: segments}
+}
+
+func (a argument) optional() argument {
+	a.Optional = true
+	return a
+}
+
+func (a argument) usage() string {
+	name := a.Name
+	switch a.Kind {
+	case argInt:
+		if a.Max != 0 {
+			name = fmt.Sprintf("%s:%d-%d", a.Name, a.Min, a.Max)
+		}
+	case argUser:
+		name = "@" + a.Name
+	case argChannel:
+		name = "#" + a.Name
+	case argRole:
+		name = "@&" + a.Name
+	case argGreedy:
+		name = a.Name + "..."
+	case argPipe:
+		var parts []string
+		for i, seg := range a.Segments {
+			if i < a.Min {
+				parts = append(parts, "<"+seg+">")
+			} else {
+				parts = append(parts, "["+seg+"]")
+			}
+		}
+		return strings.Join(parts, " | ")
+	}
+
+	if a.Optional {
+		return "[" + name + "]"
+	}
+	return "<" + name + ">"
+}
+
+// args holds the words of a message along with the typed values parsed
+// out of it according to the commands argument spec.
+type args struct {
+	raw    []string
+	values map[string]interface{}
+
+	// Set by fail. It's a pointer so every copy of the args shares it.
+	failed *bool
+}
+
+func newArgs(msglist []string) args {
+	return args{raw: msglist, values: make(map[string]interface{}), failed: new(bool)}
+}
+
+// fail marks the command as having failed, so it's counted as an error in
+// the command stats. Commands call it when something went wrong on the bots
+// end, not when the user got something wrong.
+func (a args) fail() {
+	if a.failed != nil {
+		*a.failed = true
+	}
+}
+
+func (a args) hasFailed() bool {
+	return a.failed != nil && *a.failed
+}
+
+func (a args) has(name string) bool {
+	_, ok := a.values[name]
+	return ok
+}
+
+// str returns word, greedy, user, channel and role arguments.
+// Mentions are returned as the bare ID.
+func (a args) str(name string) string {
+	val, _ := a.values[name].(string)
+	return val
+}
+
+func (a args) num(name string) int {
+	val, _ := a.values[name].(int)
+	return val
+}
+
+func (a args) dur(name string) time.Duration {
+	val, _ := a.values[name].(time.Duration)
+	return val
+}
+
+func (a args) list(name string) []string {
+	val, _ := a.values[name].([]string)
+	return val
+}
+
+type argError struct {
+	arg    argument
+	reason string
+}
+
+func (e argError) Error() string {
+	if e.arg.Name == "" {
+		return e.reason
+	}
+	return fmt.Sprintf("Invalid `%s`: %s", e.arg.Name, e.reason)
+}
+
+// parseArgs matches words against spec, starting after the first offset words
+// of msglist (the command name and any subcommands).
+func parseArgs(spec []argument, msglist []string, offset int) (args, error) {
+	parsed := newArgs(msglist)
+	words := msglist[offset:]
+
+	for _, arg := range spec {
+		if len(words) == 0 {
+			if arg.Optional {
+				continue
+			}
+			return parsed, argError{reason: fmt.Sprintf("Missing `%s`", arg.Name)}
+		}
+
+		switch arg.Kind {
+		case argWord:
+			parsed.values[arg.Name] = words[0]
+		case argInt:
+			num, err := strconv.Atoi(words[0])
+			if err != nil {
+				return parsed, argError{arg, "expected a number"}
+			}
+			if arg.Max != 0 && (num < arg.Min || num > arg.Max) {
+				return parsed, argError{arg, fmt.Sprintf("expected a number between %d and %d", arg.Min, arg.Max)}
+			}
+			parsed.values[arg.Name] = num
+		case argUser:
+			id, ok := matchID(userIDRegex, words[0])
+			if !ok {
+				return parsed, argError{arg, "expected a user mention or ID"}
+			}
+			parsed.values[arg.Name] = id
+		case argChannel:
+			id, ok := matchID(channelRegex, words[0])
+			if !ok {
+				return parsed, argError{arg, "expected a channel mention or ID"}
+			}
+			parsed.values[arg.Name] = id
+		case argRole:
+			id, ok := matchID(roleRegex, words[0])
+			if !ok {
+				return parsed, argError{arg, "expected a role mention or ID"}
+			}
+			parsed.values[arg.Name] = id
+		case argDuration:
+			dur, err := time.ParseDuration(words[0])
+			if err != nil || dur <= 0 {
+				return parsed, argError{arg, "expected a duration like `30s` or `5m`"}
+			}
+			parsed.values[arg.Name] = dur
+		case argGreedy:
+			parsed.values[arg.Name] = strings.Join(words, " ")
+			words = nil
+			continue
+		case argPipe:
+			segments := trimSlice(strings.Split(strings.Join(words, " "), "|"))
+			if len(segments) < arg.Min || (arg.Max != 0 && len(segments) > arg.Max) {
+				return parsed, argError{arg, fmt.Sprintf("expected %s", arg.usage())}
+			}
+			parsed.values[arg.Name] = segments
+			words = nil
+			continue
+		}
+
+		words = words[1:]
+	}
+
+	if len(words) != 0 {
+		return parsed, argError{reason: "Too many arguments given"}
+	}
+
+	return parsed, nil
+}
+
+func matchID(re *regexp.Regexp, word string) (string, bool) {
+	if submatch := re.FindStringSubmatch(word); len(submatch) == 2 && submatch[0] == word {
+		return submatch[1], true
+	}
+	if snowflakeRegex.MatchString(word) {
+		return word, true
+	}
+	return "", false
+}
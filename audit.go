@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// What the IDs of users who delete their data are replaced with
+const redactedID = "redacted"
+
+// Review actions recorded in the audit log
+const (
+	auditApprove          = "approve"
+	auditRetractApproval  = "retract approval"
+	auditReject           = "reject"
+	auditRetractRejection = "retract rejection"
+	auditApproved         = "approved"
+	auditRejected         = "rejected"
+	auditExpired          = "expired"
+)
+
+// auditEntry is one review decision. ReviewerID is empty for decisions the
+// bot made itself, like expiring an image.
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Image      int       `json:"image"`
+	ImageName  string    `json:"image_name"`
+	ImageHash  string    `json:"image_hash,omitempty"`
+	AuthorID   string    `json:"author_id"`
+	ReviewerID string    `json:"reviewer_id,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// auditLog is a file that review decisions are appended to, one JSON entry
+// per line
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+var reviewAudit = &auditLog{path: "json/review_audit.jsonl"}
+
+func (a *auditLog) append(entry auditEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// history returns every entry for images the user saved or decisions they
+// made, oldest first
+func (a *auditLog) history(userID string) ([]auditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []auditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Error("skipping invalid review audit entry", err)
+			continue
+		}
+		if entry.AuthorID == userID || entry.ReviewerID == userID {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// redact replaces the users ID in every entry. Entries about images they
+// saved also lose the images name and hash.
+func (a *auditLog) redact(userID string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	b, err := ioutil.ReadFile(a.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		var entry auditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			// Can't be redacted, so it's dropped if it might be about them
+			if !bytes.Contains(line, []byte(userID)) {
+				out.Write(append(line, '\n'))
+			}
+			continue
+		}
+
+		if entry.AuthorID == userID {
+			entry.AuthorID = redactedID
+			entry.ImageName = ""
+			entry.ImageHash = ""
+		}
+		if entry.ReviewerID == userID {
+			entry.ReviewerID = redactedID
+		}
+
+		line, err = json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		out.Write(append(line, '\n'))
+	}
+	return writeFileAtomic(a.path, out.Bytes())
+}
+
+// audit records the decision about the queued image
+func audit(action string, num int, img queuedImage, reviewerID string) {
+	err := reviewAudit.append(auditEntry{
+		Time:       time.Now().UTC(),
+		Action:     action,
+		Image:      num,
+		ImageName:  img.ImageName,
+		ImageHash:  img.Hash,
+		AuthorID:   img.AuthorID,
+		ReviewerID: reviewerID,
+		Reason:     img.Reason,
+	})
+	if err != nil {
+		log.Error("error writing review audit log", num, action, err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	backupDir        = "json/backups/"
+	backupTimeFormat = "20060102-150405"
+)
+
+// backup is a copy of one of the files in json/, named after the file and
+// the time it was made, e.g. servers.json.20171120-150405
+type backup struct {
+	Path string
+	Time time.Time
+	Size int64
+}
+
+func (b backup) name() string {
+	return b.Time.Format(backupTimeFormat)
+}
+
+// listBackups returns the backups of the file in json/, newest first
+func listBackups(path string) ([]backup, error) {
+	matches, err := filepath.Glob(backupDir + path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	var out []backup
+	for _, match := range matches {
+		// Skips temporary files left over from writing a backup
+		t, err := time.ParseInLocation(backupTimeFormat, strings.TrimPrefix(filepath.Base(match), path+"."), time.Local)
+		if err != nil {
+			continue
+		}
+
+		info, err := os.Stat(match)
+		if err != nil {
+			continue
+		}
+		out = append(out, backup{Path: match, Time: t, Size: info.Size()})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.After(out[j].Time) })
+	return out, nil
+}
+
+// findBackup returns the backup of the file in json/ with the given name
+func findBackup(path, name string) (backup, bool) {
+	backups, _ := listBackups(path)
+	for _, b := range backups {
+		if b.name() == name {
+			return b, true
+		}
+	}
+	return backup{}, false
+}
+
+// backupJSON saves data as a backup of the file in json/ if the newest
+// backup is older than the configured interval, or if force is set, and
+// removes the oldest backups over the configured count.
+func backupJSON(path string, data []byte, force bool) error {
+	count, every := conf().backups()
+
+	backups, err := listBackups(path)
+	if err != nil {
+		return err
+	}
+	if !force && len(backups) != 0 && time.Since(backups[0].Time) < every {
+		return nil
+	}
+
+	if err := os.MkdirAll(backupDir, 0700); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if err := writeFileAtomic(backupDir+path+"."+now.Format(backupTimeFormat), data); err != nil {
+		return err
+	}
+
+	if backups, err = listBackups(path); err != nil {
+		return err
+	}
+	for _, b := range backups[min(len(backups), count):] {
+		if err := os.Remove(b.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newestValidBackup returns the contents of the newest backup of the file
+// in json/ that's valid JSON
+func newestValidBackup(path string) ([]byte, error) {
+	backups, err := listBackups(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range backups {
+		data, err := ioutil.ReadFile(b.Path)
+		if err != nil || !json.Valid(data) {
+			continue
+		}
+		log.Info("using backup", b.Path, "for", path)
+		return data, nil
+	}
+	return nil, errors.New("no valid backups of " + path)
+}
+
+// eraseFromBackups removes userID from every backup of jsonStores files the
+// same way eraseUser does from the records themselves, so a corrupt file
+// being restored from a backup doesn't bring them back
+func eraseFromBackups(userID string) error {
+	for _, f := range jsonStoreFiles {
+		backups, err := listBackups(f.path)
+		if err != nil {
+			return err
+		}
+
+		for _, b := range backups {
+			if err := eraseFromBackup(b.Path, f.kind, userID); err != nil {
+				return fmt.Errorf("%s: %v", b.Path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// eraseFromBackup rewrites the backup at path without userID, migrated to
+// the current schema version. Backups that don't mention them are left alone.
+func eraseFromBackup(path, kind, userID string) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(raw, []byte(userID)) {
+		return nil
+	}
+	// It'd never be restored, and can't be picked apart to only remove them
+	if !json.Valid(raw) {
+		return os.Remove(path)
+	}
+
+	version, recs, err := decodeVersioned(raw)
+	if err != nil {
+		return err
+	}
+	if _, err := migrateRecords(kind, version, recs); err != nil {
+		return err
+	}
+	b, err := json.Marshal(recs)
+	if err != nil {
+		return err
+	}
+
+	var data interface{}
+	var changed bool
+	switch kind {
+	case recordUser:
+		var usrs users
+		if err := json.Unmarshal(b, &usrs); err != nil {
+			return err
+		}
+		_, changed = usrs[userID]
+		delete(usrs, userID)
+		data = usrs
+	case recordQueued:
+		var queue map[string]*queuedImage
+		if err := json.Unmarshal(b, &queue); err != nil {
+			return err
+		}
+		for num, img := range queue {
+			if img != nil && img.AuthorID == userID {
+				delete(queue, num)
+				changed = true
+			}
+		}
+		data = queue
+	case recordServer:
+		var guilds map[string]*server
+		if err := json.Unmarshal(b, &guilds); err != nil {
+			return err
+		}
+		for _, guild := range guilds {
+			if guild != nil && guild.forgetUser(userID) {
+				changed = true
+			}
+		}
+		data = guilds
+	}
+	if !changed {
+		return nil
+	}
+
+	if b, err = json.Marshal(versionedFile{SchemaVersion: schemaVersion, Data: data}); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeBackup makes a backup of the file in json/ from age ago
+func writeBackup(t *testing.T, path, data string, age time.Duration) backup {
+	name := time.Now().Add(-age).Format(backupTimeFormat)
+	if err := os.MkdirAll(backupDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(backupDir+path+"."+name, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := findBackup(path, name)
+	return b
+}
+
+func TestSaveJSONBackups(t *testing.T) {
+	resetState()
+	os.RemoveAll(backupDir)
+	defer os.RemoveAll(backupDir)
+
+	conf().BackupCount = 3
+	conf().BackupInterval = "1h"
+
+	for i := 0; i < 4; i++ {
+		writeBackup(t, "test.json", "{}", time.Hour*time.Duration(i+2))
+	}
+	// Left over from a crash while writing a backup
+	ioutil.WriteFile(backupDir+"test.json.tmp123", []byte("{"), 0600)
+
+	if err := saveJSON("test.json", map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, _ := listBackups("test.json")
+	if len(backups) != 3 {
+		t.Fatalf("expected 3 backups to be kept, got %d", len(backups))
+	}
+	if data, _ := ioutil.ReadFile(backups[0].Path); string(data) != `{"a":1}` {
+		t.Errorf("expected the newest backup to have the saved data, got %q", data)
+	}
+
+	// Too soon for another backup
+	saveJSON("test.json", map[string]int{"a": 2})
+	if data, _ := ioutil.ReadFile(backups[0].Path); string(data) != `{"a":1}` {
+		t.Errorf("expected no new backup, got %q", data)
+	}
+	if data, _ := ioutil.ReadFile("json/test.json"); string(data) != `{"a":2}` {
+		t.Errorf("expected the file to be saved, got %q", data)
+	}
+
+	files, _ := ioutil.ReadDir("json")
+	for _, f := range files {
+		if strings.Contains(f.Name(), ".tmp") {
+			t.Errorf("expected no temporary files to be left, found %s", f.Name())
+		}
+	}
+}
+
+func TestLoadJSONFallback(t *testing.T) {
+	resetState()
+	os.RemoveAll(backupDir)
+	defer os.RemoveAll(backupDir)
+
+	ioutil.WriteFile("json/test.json", []byte(`{"a": 1, "b"`), 0600)
+	writeBackup(t, "test.json", `{"a": 3`, time.Hour)
+	writeBackup(t, "test.json", `{"a": 2}`, time.Hour*2)
+	writeBackup(t, "test.json", `{"a": 1}`, time.Hour*3)
+
+	var got map[string]int
+	if err := loadJSON("test.json", &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["a"] != 2 || len(got) != 1 {
+		t.Errorf("expected the newest valid backup to be used, got %v", got)
+	}
+
+	os.RemoveAll(backupDir)
+	if err := loadJSON("test.json", &got); err == nil {
+		t.Error("expected an error with no valid backups")
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	resetState()
+	conf().OwnerID = testOwnerID
+	conf().Storage = storeJSON
+	os.RemoveAll(backupDir)
+	defer os.RemoveAll(backupDir)
+
+	writeJSON(t, "users.json", users{testUserID: {DiskQuota: 100}})
+	loadUsers()
+	old := writeBackup(t, "users.json", `{"`+testUserID+`": {"quota": 50}, "`+testOwnerID+`": {"quota": 10}}`, time.Hour)
+
+	f := newFakeSession()
+	f.run(testOwnerID, "backups restore users 20000101-000000")
+	f.run(testOwnerID, "backups restore users "+old.name())
+
+	sent := f.messages(testChannelID)
+	if len(sent) != 2 || !strings.HasPrefix(sent[0], "No backup called") {
+		t.Fatalf("expected an unknown backup to be rejected, got %q", sent)
+	}
+	if !strings.Contains(sent[1], "Restored users from") || !strings.Contains(sent[1], "users: 1 added, 1 changed") {
+		t.Errorf("expected the restore to be reported, got %q", sent[1])
+	}
+
+	if usr, _ := u.get(testUserID); u.len() != 2 || usr.DiskQuota != 50 {
+		t.Errorf("expected the restored users to be loaded, got %+v", u)
+	}
+
+	backups, _ := listBackups("users.json")
+	if len(backups) != 2 {
+		t.Fatalf("expected the current file to be backed up first, got %+v", backups)
+	}
+	if data, _ := ioutil.ReadFile(backups[0].Path); !strings.Contains(string(data), `"quota":100`) {
+		t.Errorf("expected the newest backup to be the file before restoring, got %q", data)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	serversBucket   = []byte("servers")
+	usersBucket     = []byte("users")
+	queueBucket     = []byte("queue")
+	playlistsBucket = []byte("playlists")
+	metaBucket      = []byte("meta")
+
+	schemaVersionKey = []byte("schema_version")
+)
+
+// boltStore keeps everything in a bbolt database, one JSON encoded record per
+// key, so only the record that changed is written. Playlists are kept in a
+// bucket per guild inside the playlists bucket. The schema version is kept
+// in the meta bucket.
+type boltStore struct {
+	db *bolt.DB
+
+	mu sync.Mutex
+
+	// Writes made during a Batch, run in one transaction once it's done
+	batching bool
+	pending  []func(tx *bolt.Tx) error
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		// Databases made before there were schema versions already have
+		// buckets, but no version
+		fresh := tx.Bucket(serversBucket) == nil
+
+		for _, name := range [][]byte{serversBucket, usersBucket, queueBucket, playlistsBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		if fresh {
+			return tx.Bucket(metaBucket).Put(schemaVersionKey, []byte(strconv.Itoa(schemaVersion)))
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+// update runs fn in a transaction of its own, or leaves it until the end of
+// the batch if one is running
+func (b *boltStore) update(fn func(tx *bolt.Tx) error) error {
+	b.mu.Lock()
+	if b.batching {
+		b.pending = append(b.pending, fn)
+		b.mu.Unlock()
+		return nil
+	}
+	b.mu.Unlock()
+	return b.db.Update(fn)
+}
+
+func (b *boltStore) put(bucket []byte, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+}
+
+func (b *boltStore) delete(bucket []byte, key string) error {
+	return b.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	})
+}
+
+func (b *boltStore) Servers() (map[string]*server, error) {
+	out := make(map[string]*server)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		playlists := tx.Bucket(playlistsBucket)
+		return tx.Bucket(serversBucket).ForEach(func(k, v []byte) error {
+			guild := new(server)
+			if err := json.Unmarshal(v, guild); err != nil {
+				return fmt.Errorf("server %s: %v", k, err)
+			}
+
+			lists, err := readPlaylists(playlists.Bucket(k))
+			if err != nil {
+				return fmt.Errorf("playlists for %s: %v", k, err)
+			}
+			guild.Playlists = lists
+
+			out[string(k)] = guild
+			return nil
+		})
+	})
+	return out, err
+}
+
+func (b *boltStore) PutServer(id string, s *server) error {
+	// Playlists are stored separately
+	guild := *s
+	guild.Playlists = nil
+	return b.put(serversBucket, id, guild)
+}
+
+func (b *boltStore) DeleteServer(id string) error {
+	return b.update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(serversBucket).Delete([]byte(id)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(playlistsBucket).DeleteBucket([]byte(id)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+func (b *boltStore) Users() (users, error) {
+	out := make(users)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(k, v []byte) error {
+			usr := new(user)
+			if err := json.Unmarshal(v, usr); err != nil {
+				return fmt.Errorf("user %s: %v", k, err)
+			}
+			out[string(k)] = usr
+			return nil
+		})
+	})
+	return out, err
+}
+
+func (b *boltStore) PutUser(id string, u *user) error {
+	return b.put(usersBucket, id, u)
+}
+
+func (b *boltStore) DeleteUser(id string) error {
+	return b.delete(usersBucket, id)
+}
+
+func (b *boltStore) Queue() (map[string]*queuedImage, error) {
+	out := make(map[string]*queuedImage)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(queueBucket).ForEach(func(k, v []byte) error {
+			img := new(queuedImage)
+			if err := json.Unmarshal(v, img); err != nil {
+				return fmt.Errorf("queued image %s: %v", k, err)
+			}
+			out[string(k)] = img
+			return nil
+		})
+	})
+	return out, err
+}
+
+func (b *boltStore) PutQueued(num string, img *queuedImage) error {
+	return b.put(queueBucket, num, img)
+}
+
+func (b *boltStore) DeleteQueued(num string) error {
+	return b.delete(queueBucket, num)
+}
+
+func (b *boltStore) Playlists(guildID string) (map[string][]song, error) {
+	var out map[string][]song
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		out, err = readPlaylists(tx.Bucket(playlistsBucket).Bucket([]byte(guildID)))
+		return err
+	})
+	return out, err
+}
+
+// readPlaylists decodes every playlist in a guilds bucket, which is nil if it has none
+func readPlaylists(bucket *bolt.Bucket) (map[string][]song, error) {
+	out := make(map[string][]song)
+	if bucket == nil {
+		return out, nil
+	}
+
+	err := bucket.ForEach(func(k, v []byte) error {
+		var songs []song
+		if err := json.Unmarshal(v, &songs); err != nil {
+			return err
+		}
+		out[string(k)] = songs
+		return nil
+	})
+	return out, err
+}
+
+func (b *boltStore) PutPlaylist(guildID, name string, songs []song) error {
+	data, err := json.Marshal(songs)
+	if err != nil {
+		return err
+	}
+	return b.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(playlistsBucket).CreateBucketIfNotExists([]byte(guildID))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(name), data)
+	})
+}
+
+func (b *boltStore) DeletePlaylist(guildID, name string) error {
+	return b.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(playlistsBucket).Bucket([]byte(guildID))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(name))
+	})
+}
+
+// Batch writes everything f puts and deletes in one transaction once it
+// returns, so either all of it is saved or none of it is. Nothing is saved
+// if f fails.
+func (b *boltStore) Batch(f func() error) error {
+	b.mu.Lock()
+	b.batching = true
+	b.pending = nil
+	b.mu.Unlock()
+
+	err := f()
+
+	b.mu.Lock()
+	pending := b.pending
+	b.batching = false
+	b.pending = nil
+	b.mu.Unlock()
+
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, fn := range pending {
+			if err := fn(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// boltSchemaVersion is the schema version the database was saved with
+func boltSchemaVersion(tx *bolt.Tx) (int, error) {
+	v := tx.Bucket(metaBucket).Get(schemaVersionKey)
+	if v == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(v))
+}
+
+func (b *boltStore) Migrate(dryRun bool) ([]string, error) {
+	var changes []string
+
+	run := b.db.Update
+	if dryRun {
+		run = b.db.View
+	}
+
+	err := run(func(tx *bolt.Tx) error {
+		version, err := boltSchemaVersion(tx)
+		if err != nil {
+			return fmt.Errorf("invalid schema version: %v", err)
+		}
+		if version == schemaVersion {
+			return nil
+		}
+		changes = append(changes, fmt.Sprintf("database is schema version %d, migrating to %d", version, schemaVersion))
+
+		for _, kind := range []struct {
+			name   string
+			bucket []byte
+		}{{recordServer, serversBucket}, {recordUser, usersBucket}, {recordQueued, queueBucket}} {
+			bucket := tx.Bucket(kind.bucket)
+
+			recs := make(map[string]json.RawMessage)
+			err := bucket.ForEach(func(k, v []byte) error {
+				// v is only valid for the life of the transaction
+				recs[string(k)] = append(json.RawMessage(nil), v...)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			migrated, err := migrateRecords(kind.name, version, recs)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, migrated...)
+
+			if dryRun {
+				continue
+			}
+			for k, v := range recs {
+				if err := bucket.Put([]byte(k), v); err != nil {
+					return err
+				}
+			}
+		}
+
+		if dryRun {
+			return nil
+		}
+		return tx.Bucket(metaBucket).Put(schemaVersionKey, []byte(strconv.Itoa(schemaVersion)))
+	})
+	return changes, err
+}
+
+func (b *boltStore) Close() error {
+	return b.db.Close()
+}
@@ -3,76 +3,287 @@ package main
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
 
+const (
+	categoryMusic      = "Music"
+	categoryImages     = "Images"
+	categoryModeration = "Moderation"
+	categoryUtility    = "Utility"
+	categoryNSFW       = "NSFW"
+	categoryOwner      = "Owner"
+)
+
+// commandContext is where a command can be used
+type commandContext int
+
+const (
+	// Subcommands without a context inherit their parents, top level commands default to contextGuild
+	contextUnset commandContext = iota
+	contextGuild
+	contextDM
+	contextAny
+)
+
 var (
 	activeCommands   = make(map[string]command)
 	disabledCommands = make(map[string]command)
+	commandAliases   = make(map[string]string)
+
+	categories = []string{categoryMusic, categoryImages, categoryModeration, categoryUtility, categoryNSFW, categoryOwner}
 )
 
 type command struct {
 	Name string
 	Help string
 
+	// Full path of the command, e.g. "yt skip". Set when the command is added.
+	FullName string
+
+	Aliases []string
+
+	Category string
+
 	OwnerOnly     bool
 	RequiresPerms bool
 
+	// Unrestricted commands ignore a guilds disabled commands and channel rules
+	Unrestricted bool
+
+	Context commandContext
+
 	PermsRequired int
 
-	Exec func(*discordgo.Session, *discordgo.MessageCreate, []string)
-}
+	Args []argument
+
+	// Example invocations without the prefix, e.g. "purge 300"
+	Examples []string
+
+	Cooldowns []cooldown
+
+	Subcommands []command
 
-/*
-	go-chi style command adding
-		- aliases
-		- nicer help text
-		- uh...MORE
-	also more here!
-*/
+	// Run around Exec, after the global middlewares
+	Middlewares []middleware
 
-func parseCommand(s *discordgo.Session, m *discordgo.MessageCreate, guildDetails *discordgo.Guild, message string) {
+	Exec execFunc
+}
+
+// parseCommand runs the command in message, which has had the prefix removed.
+// guildDetails is nil for messages sent in DMs.
+func parseCommand(s session, m *discordgo.MessageCreate, guildDetails *discordgo.Guild, message string) {
 	msglist := strings.Fields(message)
 	if len(msglist) == 0 {
 		return
 	}
 
-	log.Trace(fmt.Sprintf("%s %s#%s, %s %s: %s", m.Author.ID, m.Author.Username, m.Author.Discriminator, guildDetails.ID, guildDetails.Name, m.Content))
+	start := time.Now()
 
-	commandName := strings.ToLower(func() string {
-		if strings.HasPrefix(message, " ") {
-			return " " + msglist[0]
-		}
-		return msglist[0]
-	}())
+	var guildID string
+	if guildDetails != nil {
+		guildID = guildDetails.ID
+		log.Trace(fmt.Sprintf("%s %s#%s, %s %s: %s", m.Author.ID, m.Author.Username, m.Author.Discriminator, guildDetails.ID, guildDetails.Name, m.Content))
+	} else {
+		log.Trace(fmt.Sprintf("%s %s#%s, DM: %s", m.Author.ID, m.Author.Username, m.Author.Discriminator, m.Content))
+	}
 
-	if command, ok := activeCommands[commandName]; ok && commandName == strings.ToLower(command.Name) {
-		userPerms, err := permissionDetails(m.Author.ID, m.ChannelID, s)
-		if err != nil {
-			s.ChannelMessageSend(m.ChannelID, "Error verifying permissions :(")
+	command, ok := findCommand(msglist[0])
+	if !ok {
+		if guildDetails != nil && sendTag(s, m, guildDetails, msglist) {
 			return
 		}
 
-		isOwner := m.Author.ID == conf.OwnerID
-		hasPerms := userPerms&command.PermsRequired > 0
-		if (!command.OwnerOnly && !command.RequiresPerms) || (command.RequiresPerms && hasPerms) || isOwner {
-			command.Exec(s, m, msglist)
+		// Emoji can be sent without the bigmoji command
+		if bigmoji, ok := activeCommands["bigmoji"]; ok && isEmoji(msglist[0]) {
+			bigmoji.handler()(s, m, newArgs(msglist))
 			return
 		}
+
+		unknownCommand(s, m, guildID, msglist[0])
+		return
+	}
+
+	chain := command.resolve(msglist)
+	command = chain[len(chain)-1]
+
+	// Commands that run are recorded by statsMiddleware
+	record := func(o outcome) {
+		commandStats.record(command.FullName, guildID, m.Author.ID, time.Since(start), o)
+	}
+
+	if !command.usableIn(guildDetails != nil) {
+		record(outcomeDenied)
+		if guildDetails != nil {
+			s.ChannelMessageSend(m.ChannelID, codeSeg(command.FullName)+" can only be used in DMs")
+		} else {
+			s.ChannelMessageSend(m.ChannelID, codeSeg(command.FullName)+" can only be used in servers")
+		}
+		return
+	}
+
+	ok, err := permitted(s, m, guildID, chain)
+	if err != nil {
+		record(outcomeError)
+		s.ChannelMessageSend(m.ChannelID, "Error verifying permissions :(")
+		return
+	}
+
+	if !ok {
+		record(outcomeDenied)
 		s.ChannelMessageSend(m.ChannelID, "You don't have the correct permissions to run this!")
 		return
 	}
 
-	activeCommands["bigmoji"].Exec(s, m, msglist)
+	if !chain[0].Unrestricted && !checkRules(s, m, guildID, chain) {
+		record(outcomeDenied)
+		return
+	}
+
+	prefix, _ := activePrefix(m.ChannelID, s)
+
+	if command.Exec == nil {
+		record(outcomeSuccess)
+		command.listSubcommands(s, m, prefix, msglist[len(chain):])
+		return
+	}
+
+	parsed, err := parseArgs(command.Args, msglist, len(chain))
+	if err != nil {
+		record(outcomeUsage)
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s\nUsage: %s", err, codeSeg(command.usage(prefix))))
+		return
+	}
+
+	if !command.checkCooldown(s, m, guildID) {
+		record(outcomeDenied)
+		return
+	}
+
+	command.handler()(s, m, parsed)
+}
+
+// findCommand looks up a top level command by its name or one of its aliases
+func findCommand(name string) (command, bool) {
+	name = strings.ToLower(name)
+	if c, ok := activeCommands[name]; ok {
+		return c, true
+	}
+	if actual, ok := commandAliases[name]; ok {
+		c, ok := activeCommands[actual]
+		return c, ok
+	}
+	return command{}, false
+}
+
+// resolve walks down the subcommand tree following msglist, returning
+// every command matched along the way, starting with c itself.
+func (c command) resolve(msglist []string) []command {
+	chain := []command{c}
+	for _, word := range msglist[1:] {
+		sub, ok := c.subcommand(word)
+		if !ok {
+			break
+		}
+		chain = append(chain, sub)
+		c = sub
+	}
+	return chain
+}
+
+// lookupCommand finds the command with exactly the given path, e.g. "image save"
+func lookupCommand(path string) (command, bool) {
+	words := strings.Fields(path)
+	if len(words) == 0 {
+		return command{}, false
+	}
+
+	c, ok := findCommand(words[0])
+	if !ok {
+		return command{}, false
+	}
+
+	chain := c.resolve(words)
+	if len(chain) != len(words) {
+		return command{}, false
+	}
+	return chain[len(chain)-1], true
+}
+
+func (c command) subcommand(name string) (command, bool) {
+	name = strings.ToLower(name)
+	for _, sub := range c.Subcommands {
+		if strings.ToLower(sub.Name) == name || isIn(name, sub.Aliases) {
+			return sub, true
+		}
+	}
+	return command{}, false
+}
+
+// usableIn returns whether the command can be used in a guild, or in DMs if inGuild is false
+func (c command) usableIn(inGuild bool) bool {
+	switch c.Context {
+	case contextAny:
+		return true
+	case contextDM:
+		return !inGuild
+	}
+	return inGuild
+}
+
+func (c command) allowed(userPerms int, isOwner bool) bool {
+	hasPerms := userPerms&c.PermsRequired > 0
+	return (!c.OwnerOnly && !c.RequiresPerms) || (c.RequiresPerms && hasPerms) || isOwner
+}
+
+func (c command) listSubcommands(s session, m *discordgo.MessageCreate, prefix string, rest []string) {
+	var names []string
+	for _, sub := range c.Subcommands {
+		names = append(names, codeSeg(sub.Name))
+	}
+
+	var msg string
+	if len(rest) != 0 {
+		msg = fmt.Sprintf("Unknown sub-command %s for %s\n", codeSeg(rest[0]), codeSeg(c.FullName))
+	}
+
+	s.ChannelMessageSend(m.ChannelID, msg+fmt.Sprintf("Available sub-commands for %s:\n%s\nType %s to see more info about this command",
+		codeSeg(c.FullName), strings.Join(names, ", "), codeSeg(prefix+"help", c.FullName)))
 }
 
 func (c command) add() command {
+	if c.Context == contextUnset {
+		c.Context = contextGuild
+	}
+	c = c.withFullName("")
 	activeCommands[strings.ToLower(c.Name)] = c
+	for _, a := range c.Aliases {
+		commandAliases[strings.ToLower(a)] = strings.ToLower(c.Name)
+	}
 	return c
 }
 
-func newCommand(name string, permissions int, needsPerms bool, f func(*discordgo.Session, *discordgo.MessageCreate, []string)) command {
+// withFullName sets the full name of c and its subcommands, which also
+// inherit the category and context of their parent unless they set their own.
+func (c command) withFullName(parent string) command {
+	c.FullName = strings.TrimSpace(parent + " " + c.Name)
+	subs := make([]command, len(c.Subcommands))
+	for i, sub := range c.Subcommands {
+		if sub.Category == "" {
+			sub.Category = c.Category
+		}
+		if sub.Context == contextUnset {
+			sub.Context = c.Context
+		}
+		subs[i] = sub.withFullName(c.FullName)
+	}
+	c.Subcommands = subs
+	return c
+}
+
+func newCommand(name string, permissions int, needsPerms bool, f execFunc) command {
 	return command{
 		Name:          name,
 		PermsRequired: permissions,
@@ -81,8 +292,8 @@ func newCommand(name string, permissions int, needsPerms bool, f func(*discordgo
 	}
 }
 
-func (c command) alias(a string) command {
-	activeCommands[strings.ToLower(a)] = c
+func (c command) alias(a ...string) command {
+	c.Aliases = append(c.Aliases, a...)
 	return c
 }
 
@@ -91,7 +302,76 @@ func (c command) setHelp(help string) command {
 	return c
 }
 
+func (c command) setArgs(spec ...argument) command {
+	c.Args = spec
+	return c
+}
+
+func (c command) examples(ex ...string) command {
+	c.Examples = append(c.Examples, ex...)
+	return c
+}
+
+func (c command) subcommands(subs ...command) command {
+	c.Subcommands = append(c.Subcommands, subs...)
+	return c
+}
+
+func (c command) cooldown(scope cooldownScope, uses int, per time.Duration) command {
+	c.Cooldowns = append(c.Cooldowns, cooldown{Scope: scope, Uses: uses, Per: per})
+	return c
+}
+
+func (c command) setCategory(category string) command {
+	c.Category = category
+	return c
+}
+
+func (c command) unrestricted() command {
+	c.Unrestricted = true
+	return c
+}
+
+func (c command) use(mw ...middleware) command {
+	c.Middlewares = append(c.Middlewares, mw...)
+	return c
+}
+
 func (c command) ownerOnly() command {
 	c.OwnerOnly = true
 	return c
 }
+
+// allowDMs lets the command be used in DMs as well as in servers
+func (c command) allowDMs() command {
+	c.Context = contextAny
+	return c
+}
+
+func (c command) dmOnly() command {
+	c.Context = contextDM
+	return c
+}
+
+func (c command) guildOnly() command {
+	c.Context = contextGuild
+	return c
+}
+
+// usage builds a usage line such as `!owo purge <amount:1-1000> [@user]`
+// from the commands argument spec.
+func (c command) usage(prefix string) string {
+	name := c.FullName
+	if name == "" {
+		name = c.Name
+	}
+
+	out := []string{prefix + name}
+	if c.Exec == nil && len(c.Subcommands) != 0 {
+		out = append(out, "<sub-command>")
+	}
+	for _, arg := range c.Args {
+		out = append(out, arg.usage())
+	}
+	return strings.Join(out, " ")
+}
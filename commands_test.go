@@ -0,0 +1,263 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(g *server)
+		user    string
+		content string
+		// Expected to be in the last message sent, or no message at all if empty
+		want string
+	}{
+		{
+			name:    "missing argument",
+			user:    testOwnerID,
+			content: "purge",
+			want:    "Missing `amount`\nUsage: `!owo purge <amount:1-1000> [@user]`",
+		},
+		{
+			name:    "invalid argument",
+			user:    testOwnerID,
+			content: "purge 5000",
+			want:    "Invalid `amount`",
+		},
+		{
+			name:    "missing permissions",
+			user:    testUserID,
+			content: "purge 5",
+			want:    "You don't have the correct permissions to run this!",
+		},
+		{
+			name: "permission override",
+			setup: func(g *server) {
+				g.PermOverrides = map[string]*permOverrides{"purge": {AllowUsers: []string{testUserID}}}
+			},
+			user:    testUserID,
+			content: "purge 5000",
+			want:    "Invalid `amount`",
+		},
+		{
+			name: "overrides don't apply to the guild owner",
+			setup: func(g *server) {
+				g.PermOverrides = map[string]*permOverrides{"perms": {DenyRoles: []string{testGuildID}}}
+			},
+			user:    testOwnerID,
+			content: "perms",
+			want:    "Available sub-commands for `perms`",
+		},
+		{
+			name: "deny override",
+			setup: func(g *server) {
+				g.PermOverrides = map[string]*permOverrides{"tag": {DenyUsers: []string{testUserID}}}
+			},
+			user:    testUserID,
+			content: "tag list",
+			want:    "You don't have the correct permissions to run this!",
+		},
+		{
+			name:    "subcommand list",
+			user:    testUserID,
+			content: "image",
+			want:    "Available sub-commands for `image`",
+		},
+		{
+			name:    "unknown subcommand",
+			user:    testUserID,
+			content: "image nope",
+			want:    "Unknown sub-command `nope` for `image`",
+		},
+		{
+			name:    "subcommand",
+			user:    testUserID,
+			content: "tag list",
+			want:    "This server has no tags yet!",
+		},
+		{
+			name:    "subcommand alias",
+			user:    testOwnerID,
+			content: "TAG remove faq",
+			want:    "No tag called `faq`",
+		},
+		{
+			name: "disabled command",
+			setup: func(g *server) {
+				g.CommandRules = map[string]*commandRules{"tag": {Disabled: true}}
+			},
+			user:    testUserID,
+			content: "tag list",
+			want:    "`tag` is disabled in this server",
+		},
+		{
+			name: "disabled category",
+			setup: func(g *server) {
+				g.CategoryRules = map[string]*commandRules{"utility": {Disabled: true}}
+			},
+			user:    testUserID,
+			content: "tag list",
+			want:    "`Utility` is disabled in this server",
+		},
+		{
+			name: "unrestricted command ignores rules",
+			setup: func(g *server) {
+				g.CategoryRules = map[string]*commandRules{"moderation": {Disabled: true}}
+			},
+			user:    testOwnerID,
+			content: "settings",
+			want:    "Available sub-commands for `settings`",
+		},
+		{
+			name: "tag",
+			setup: func(g *server) {
+				g.Tags = map[string]*tag{"faq": {Content: "Hi {user}, see {args}"}}
+			},
+			user:    testUserID,
+			content: "faq @everyone",
+			want:    "Hi <@" + testUserID + ">, see @" + zerowidth + "everyone",
+		},
+		{
+			name:    "unknown command",
+			user:    testUserID,
+			content: "notacommand",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState()
+			if tt.setup != nil {
+				sMap.update(testGuildID, tt.setup)
+			}
+
+			f := newFakeSession()
+			f.run(tt.user, tt.content)
+
+			sent := f.messages(testChannelID)
+			if tt.want == "" {
+				if len(sent) != 0 {
+					t.Fatalf("expected no messages, got %q", sent)
+				}
+				return
+			}
+
+			if len(sent) == 0 {
+				t.Fatalf("expected a message containing %q, got none", tt.want)
+			}
+			if last := sent[len(sent)-1]; !strings.Contains(last, tt.want) {
+				t.Errorf("expected a message containing %q, got %q", tt.want, last)
+			}
+		})
+	}
+}
+
+func TestParseCommandCooldown(t *testing.T) {
+	resetState()
+	sMap.update(testGuildID, func(g *server) {
+		g.Cooldowns = map[string]cooldown{"tag list": {Scope: cooldownUser, Uses: 1, Per: time.Minute}}
+	})
+
+	f := newFakeSession()
+	f.run(testUserID, "tag list")
+	f.run(testUserID, "tag list")
+
+	sent := f.messages(testChannelID)
+	if len(sent) != 2 {
+		t.Fatalf("expected 2 messages, got %q", sent)
+	}
+	if !strings.HasPrefix(sent[1], "Slow down!") {
+		t.Errorf("expected the second use to be rate limited, got %q", sent[1])
+	}
+}
+
+func TestCooldownOverridePerGuild(t *testing.T) {
+	resetState()
+	const otherGuild = "100000000000000099"
+	sMap.setServer(otherGuild, server{})
+	for _, id := range []string{testGuildID, otherGuild} {
+		sMap.update(id, func(g *server) {
+			g.Cooldowns = map[string]cooldown{"tag list": {Scope: cooldownUser, Uses: 1, Per: time.Hour}}
+		})
+	}
+
+	tag, _ := findCommand("tag")
+	chain := tag.resolve([]string{"tag", "list"})
+	c := chain[len(chain)-1]
+
+	f := newFakeSession()
+	m := f.message(testUserID, "tag list")
+	if !c.checkCooldown(f, m, testGuildID) {
+		t.Fatal("expected the first use to be allowed")
+	}
+	if !c.checkCooldown(f, m, otherGuild) {
+		t.Error("expected the override in one guild not to count uses from another")
+	}
+	if c.checkCooldown(f, m, testGuildID) {
+		t.Error("expected the second use in the same guild to be rate limited")
+	}
+}
+
+func TestDirectMessages(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "global prefix",
+			content: "!owo image list",
+			want:    "You've no saved images! Get storin'!",
+		},
+		{
+			name:    "no prefix",
+			content: "image list",
+			want:    "You've no saved images! Get storin'!",
+		},
+		{
+			name:    "uses the global prefix",
+			content: "help nope",
+			want:    "No command called `nope`. Use `!owo help` to see every command",
+		},
+		{
+			name:    "no prefix chat",
+			content: "purg pls",
+		},
+		{
+			name:    "guild only",
+			content: "purge 5",
+			want:    "`purge` can only be used in servers",
+		},
+		{
+			name:    "guild only subcommand",
+			content: "tag list",
+			want:    "`tag list` can only be used in servers",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState()
+			f := newFakeSession()
+
+			m := f.message(testUserID, tt.content)
+			m.ChannelID = testDMChannel
+			m.GuildID = ""
+			messageCreateEvent(f, m)
+
+			sent := f.messages(testDMChannel)
+			if tt.want == "" {
+				if len(sent) != 0 {
+					t.Errorf("expected no reply, got %q", sent)
+				}
+				return
+			}
+			if len(sent) != 1 || sent[0] != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, sent)
+			}
+		})
+	}
+}
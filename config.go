@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultListenAddr = "0.0.0.0:8080"
+	defaultHappyEmoji = "https://cdn.discordapp.com/emojis/332968429210435585.png"
+	defaultDatabase   = "json/2bot.db"
+
+	// What 2Bot used before these were in the config, so configs from then
+	// still work
+	defaultClientID      = "301819949683572738"
+	defaultHomeServer    = "312292616089894924"
+	defaultReviewChannel = "334092230845267988"
+	defaultLogChannel    = "312352242504040448"
+
+	defaultBackupCount    = 5
+	defaultBackupInterval = time.Hour
+	defaultFlushInterval  = time.Second * 30
+)
+
+// config is loaded from json/config.json. Fields with an env tag can be
+// overridden by setting that environment variable. See config.example.json.
+type config struct {
+	Game    string `json:"game" env:"TWOBOT_GAME"`
+	Prefix  string `json:"prefix" env:"TWOBOT_PREFIX"`
+	Token   string `json:"token" env:"TWOBOT_TOKEN"`
+	OwnerID string `json:"owner_id" env:"TWOBOT_OWNER_ID"`
+
+	// Base URL that saved images are served from. With s3 image storage it
+	// defaults to the bucket on the endpoint.
+	URL string `json:"url" env:"TWOBOT_URL"`
+
+	// The bots application ID, used for its invite link
+	ClientID string `json:"client_id" env:"TWOBOT_CLIENT_ID"`
+
+	// The support server, channels in it that images are reviewed and
+	// errors are logged in, and the address the HTTP server listens on
+	HomeServer    string `json:"home_server" env:"TWOBOT_HOME_SERVER"`
+	ReviewChannel string `json:"review_channel" env:"TWOBOT_REVIEW_CHANNEL"`
+	LogChannel    string `json:"log_channel" env:"TWOBOT_LOG_CHANNEL"`
+	ListenAddr    string `json:"listen_addr" env:"TWOBOT_LISTEN_ADDR"`
+
+	// Bearer token needed for the /stats endpoints. Without one they're only
+	// served to requests from the same machine.
+	StatsToken string `json:"stats_token,omitempty" env:"TWOBOT_STATS_TOKEN"`
+
+	HappyEmoji string `json:"happy_emoji" env:"TWOBOT_HAPPY_EMOJI"`
+
+	// Who can review images: members of the home server with ReviewerRole
+	// and the users in Reviewers, as well as the owner. Anyone can if both
+	// are empty. ReviewQuorum is how many approvals an image needs.
+	ReviewerRole string   `json:"reviewer_role,omitempty" env:"TWOBOT_REVIEWER_ROLE"`
+	Reviewers    []string `json:"reviewers,omitempty" env:"TWOBOT_REVIEWERS"`
+	ReviewQuorum int      `json:"review_quorum,omitempty" env:"TWOBOT_REVIEW_QUORUM"`
+
+	// Where servers, users and the image queue are kept, either "json" or
+	// "bolt". DatabasePath is the file used by bolt.
+	Storage      string `json:"storage" env:"TWOBOT_STORAGE"`
+	DatabasePath string `json:"database_path" env:"TWOBOT_DATABASE_PATH"`
+
+	// Where saved images are kept, either "local" for images/ or "s3" for
+	// a bucket on an S3 compatible service like MinIO
+	ImageStorage string `json:"image_storage" env:"TWOBOT_IMAGE_STORAGE"`
+	S3Endpoint   string `json:"s3_endpoint,omitempty" env:"TWOBOT_S3_ENDPOINT"`
+	S3Region     string `json:"s3_region,omitempty" env:"TWOBOT_S3_REGION"`
+	S3Bucket     string `json:"s3_bucket,omitempty" env:"TWOBOT_S3_BUCKET"`
+	S3AccessKey  string `json:"s3_access_key,omitempty" env:"TWOBOT_S3_ACCESS_KEY"`
+	S3SecretKey  string `json:"s3_secret_key,omitempty" env:"TWOBOT_S3_SECRET_KEY"`
+
+	// How many backups of each JSON file to keep, and how often to make them,
+	// e.g. "30m". Both have defaults when left out.
+	BackupCount    int    `json:"backup_count,omitempty" env:"TWOBOT_BACKUP_COUNT"`
+	BackupInterval string `json:"backup_interval,omitempty" env:"TWOBOT_BACKUP_INTERVAL"`
+
+	// How often changes are written out, e.g. "10s". Defaults to 30 seconds.
+	FlushInterval string `json:"flush_interval,omitempty" env:"TWOBOT_FLUSH_INTERVAL"`
+
+	InDev bool `json:"indev" env:"TWOBOT_INDEV"`
+
+	// Where the server count is posted daily. Nothing is posted if it's empty.
+	ServerCountURL string `json:"server_count_url" env:"TWOBOT_SERVER_COUNT_URL"`
+	DiscordPWKey   string `json:"discord.pw_key" env:"TWOBOT_DISCORD_PW_KEY"`
+
+	CurrImg int `json:"curr_img_id"`
+	MaxProc int `json:"maxproc" env:"TWOBOT_MAXPROC"`
+
+	// Comma separated when set from the environment
+	Blacklist []string `json:"blacklist" env:"TWOBOT_BLACKLIST"`
+
+	// The config as it is in the file, without the environment overrides or
+	// defaults, which is what's saved
+	file *config
+}
+
+var (
+	// currConf holds the *config in use. Handlers read it without locking,
+	// so it's only ever swapped for a changed copy, never changed in place.
+	currConf atomic.Value
+
+	// Held while the config is swapped, so two changes can't lose each other
+	confMu sync.Mutex
+)
+
+func init() {
+	currConf.Store(new(config))
+}
+
+// conf returns the config in use. Don't change it, use updateConf instead.
+func conf() *config {
+	return currConf.Load().(*config)
+}
+
+// setConf starts using c, which mustn't be changed afterwards. If it wasn't
+// read from a file it's saved as it is.
+func setConf(c *config) {
+	if c.file == nil {
+		file := *c
+		c.file = &file
+	}
+
+	confMu.Lock()
+	defer confMu.Unlock()
+	currConf.Store(c)
+}
+
+// updateConf calls f with a copy of the config, and of what's saved to the
+// config file, and starts using them, returning the copy
+func updateConf(f func(c *config)) *config {
+	confMu.Lock()
+	defer confMu.Unlock()
+
+	next := *conf()
+	f(&next)
+
+	if next.file != nil {
+		file := *next.file
+		f(&file)
+		next.file = &file
+	}
+
+	currConf.Store(&next)
+	return &next
+}
+
+// replaceConf starts using next in place of the config read earlier,
+// returning the config it replaced. Image numbers handed out since then
+// can't be reused, so next keeps the latest one.
+func replaceConf(next *config) *config {
+	confMu.Lock()
+	defer confMu.Unlock()
+
+	old := conf()
+	if old.CurrImg > next.CurrImg {
+		next.CurrImg = old.CurrImg
+		if next.file != nil {
+			next.file.CurrImg = old.CurrImg
+		}
+	}
+	currConf.Store(next)
+	return old
+}
+
+// configError lists everything wrong with the config
+type configError []string
+
+func (e configError) Error() string {
+	return "invalid config:\n\t" + strings.Join(e, "\n\t")
+}
+
+// applyEnv overrides fields with the environment variables that are set
+func (c *config) applyEnv() (errs configError) {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("env")
+		val, ok := os.LookupEnv(name)
+		if name == "" || !ok {
+			continue
+		}
+
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(val)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s %q isn't true or false", name, val))
+				continue
+			}
+			field.SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s %q isn't a number", name, val))
+				continue
+			}
+			field.SetInt(int64(n))
+		case reflect.Slice:
+			field.Set(reflect.ValueOf(trimSlice(strings.Split(val, ","))))
+		}
+	}
+	return errs
+}
+
+// setDefaults fills in what was left out, returning a warning for each
+// field that older configs didn't have but should be set now
+func (c *config) setDefaults() (warnings []string) {
+	old := []struct {
+		name string
+		val  *string
+		def  string
+	}{
+		{"client_id", &c.ClientID, defaultClientID},
+		{"home_server", &c.HomeServer, defaultHomeServer},
+		{"review_channel", &c.ReviewChannel, defaultReviewChannel},
+		{"log_channel", &c.LogChannel, defaultLogChannel},
+	}
+	for _, field := range old {
+		if *field.val == "" {
+			*field.val = field.def
+			warnings = append(warnings, fmt.Sprintf("%s is missing, using 2Bots own %s", field.name, field.def))
+		}
+	}
+
+	if c.ListenAddr == "" {
+		c.ListenAddr = defaultListenAddr
+	}
+	if c.HappyEmoji == "" {
+		c.HappyEmoji = defaultHappyEmoji
+	}
+	if c.Storage == "" {
+		c.Storage = storeJSON
+	}
+	if c.DatabasePath == "" {
+		c.DatabasePath = defaultDatabase
+	}
+	if c.ImageStorage == "" {
+		c.ImageStorage = imagesLocal
+	}
+	if c.ImageStorage == imagesS3 && c.S3Region == "" {
+		c.S3Region = defaultS3Region
+	}
+	if c.ImageStorage == imagesLocal && c.URL == "" {
+		warnings = append(warnings, "url is missing, so links to saved images won't work")
+	}
+	return warnings
+}
+
+// validate returns every field that is missing or invalid
+func (c *config) validate() (errs configError) {
+	required := []struct {
+		name, val string
+	}{
+		{"token", c.Token},
+		{"prefix", strings.TrimSpace(c.Prefix)},
+		{"owner_id", c.OwnerID},
+		{"client_id", c.ClientID},
+		{"home_server", c.HomeServer},
+		{"review_channel", c.ReviewChannel},
+		{"log_channel", c.LogChannel},
+	}
+	switch c.ImageStorage {
+	case imagesLocal:
+	case imagesS3:
+		required = append(required, []struct{ name, val string }{
+			{"s3_endpoint", c.S3Endpoint},
+			{"s3_bucket", c.S3Bucket},
+			{"s3_access_key", c.S3AccessKey},
+			{"s3_secret_key", c.S3SecretKey},
+		}...)
+	default:
+		errs = append(errs, fmt.Sprintf("image_storage %q has to be %q or %q", c.ImageStorage, imagesLocal, imagesS3))
+	}
+	for _, field := range required {
+		if field.val == "" {
+			errs = append(errs, field.name+" is missing")
+		}
+	}
+
+	ids := []struct {
+		name, val string
+	}{
+		{"owner_id", c.OwnerID},
+		{"client_id", c.ClientID},
+		{"home_server", c.HomeServer},
+		{"review_channel", c.ReviewChannel},
+		{"log_channel", c.LogChannel},
+		{"reviewer_role", c.ReviewerRole},
+	}
+	for _, reviewer := range c.Reviewers {
+		ids = append(ids, struct{ name, val string }{"reviewers", reviewer})
+	}
+	for _, id := range ids {
+		if id.val != "" && !snowflakeRegex.MatchString(id.val) {
+			errs = append(errs, fmt.Sprintf("%s %q isn't a Discord ID", id.name, id.val))
+		}
+	}
+
+	urls := []struct {
+		name, val string
+	}{
+		{"url", c.URL},
+		{"s3_endpoint", c.S3Endpoint},
+		{"happy_emoji", c.HappyEmoji},
+		{"server_count_url", c.ServerCountURL},
+	}
+	for _, u := range urls {
+		if u.val == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u.val); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			errs = append(errs, fmt.Sprintf("%s %q isn't an http(s) URL", u.name, u.val))
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		errs = append(errs, fmt.Sprintf("listen_addr %q isn't a host:port address", c.ListenAddr))
+	}
+
+	if c.ServerCountURL != "" && c.DiscordPWKey == "" {
+		errs = append(errs, "discord.pw_key is needed to post to server_count_url")
+	}
+
+	if c.Storage != storeJSON && c.Storage != storeBolt {
+		errs = append(errs, fmt.Sprintf("storage %q has to be %q or %q", c.Storage, storeJSON, storeBolt))
+	}
+
+	if c.BackupCount < 0 {
+		errs = append(errs, fmt.Sprintf("backup_count %d can't be negative", c.BackupCount))
+	}
+	if c.BackupInterval != "" {
+		if d, err := time.ParseDuration(c.BackupInterval); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("backup_interval %q isn't a duration like \"1h\"", c.BackupInterval))
+		}
+	}
+	if c.FlushInterval != "" {
+		if d, err := time.ParseDuration(c.FlushInterval); err != nil || d <= 0 {
+			errs = append(errs, fmt.Sprintf("flush_interval %q isn't a duration like \"30s\"", c.FlushInterval))
+		}
+	}
+
+	if c.ReviewQuorum < 0 {
+		errs = append(errs, fmt.Sprintf("review_quorum %d can't be negative", c.ReviewQuorum))
+	}
+
+	if c.MaxProc < 0 {
+		errs = append(errs, fmt.Sprintf("maxproc %d can't be negative", c.MaxProc))
+	}
+
+	return errs
+}
+
+// backups returns how many backups to keep of each file and how often to make them
+func (c *config) backups() (int, time.Duration) {
+	count := c.BackupCount
+	if count == 0 {
+		count = defaultBackupCount
+	}
+
+	every, err := time.ParseDuration(c.BackupInterval)
+	if err != nil || c.BackupInterval == "" {
+		every = defaultBackupInterval
+	}
+	return count, every
+}
+
+// flushInterval is how often changes are written out
+func (c *config) flushInterval() time.Duration {
+	every, err := time.ParseDuration(c.FlushInterval)
+	if err != nil || every <= 0 {
+		return defaultFlushInterval
+	}
+	return every
+}
+
+// quorum is how many reviewers have to approve an image for it to be saved
+func (c *config) quorum() int {
+	if c.ReviewQuorum < 1 {
+		return 1
+	}
+	return c.ReviewQuorum
+}
+
+// inviteURL is the link people can add 2Bot to their server with
+func (c *config) inviteURL() string {
+	return "https://discordapp.com/oauth2/authorize?client_id=" + c.ClientID + "&scope=bot&permissions=3533824"
+}
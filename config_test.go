@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func validConfig() *config {
+	return &config{
+		Token:         "token",
+		Prefix:        "!owo ",
+		OwnerID:       testOwnerID,
+		ClientID:      testBotID,
+		URL:           "https://example.com/images/",
+		HomeServer:    testGuildID,
+		ReviewChannel: testReview,
+		LogChannel:    testLog,
+		ListenAddr:    defaultListenAddr,
+		Storage:       storeJSON,
+		ImageStorage:  imagesLocal,
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *config)
+		want   configError
+	}{
+		{
+			name:   "valid",
+			change: func(c *config) {},
+		},
+		{
+			name: "missing",
+			change: func(c *config) {
+				c.Token = ""
+				c.ReviewChannel = ""
+				c.URL = ""
+			},
+			want: configError{"token is missing", "review_channel is missing"},
+		},
+		{
+			name: "invalid",
+			change: func(c *config) {
+				c.LogChannel = "#logs"
+				c.URL = "example.com"
+				c.ListenAddr = "8080"
+				c.Reviewers = []string{testOwnerID, "someone"}
+				c.ReviewQuorum = -1
+				c.MaxProc = -1
+			},
+			want: configError{
+				`log_channel "#logs" isn't a Discord ID`,
+				`reviewers "someone" isn't a Discord ID`,
+				`url "example.com" isn't an http(s) URL`,
+				`listen_addr "8080" isn't a host:port address`,
+				"review_quorum -1 can't be negative",
+				"maxproc -1 can't be negative",
+			},
+		},
+		{
+			name: "s3 without bucket",
+			change: func(c *config) {
+				c.ImageStorage = imagesS3
+				c.URL = ""
+				c.S3Endpoint = "localhost:9000"
+				c.S3AccessKey = "minioadmin"
+				c.S3SecretKey = "minioadmin"
+			},
+			want: configError{"s3_bucket is missing", `s3_endpoint "localhost:9000" isn't an http(s) URL`},
+		},
+		{
+			name: "server count without key",
+			change: func(c *config) {
+				c.ServerCountURL = "https://bots.discord.pw/api/bots/1/stats"
+			},
+			want: configError{"discord.pw_key is needed to post to server_count_url"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig()
+			tt.change(c)
+
+			if got := c.validate(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	// A config from before the IDs and URLs were moved into it
+	c := &config{Token: "token", Prefix: "!owo ", OwnerID: testOwnerID}
+	warnings := c.setDefaults()
+
+	if c.ClientID != defaultClientID || c.HomeServer != defaultHomeServer || c.ReviewChannel != defaultReviewChannel || c.LogChannel != defaultLogChannel {
+		t.Errorf("expected the old IDs to be used, got %+v", c)
+	}
+	if len(warnings) != 5 {
+		t.Errorf("expected a warning for each ID and the url, got %q", warnings)
+	}
+	if errs := c.validate(); len(errs) != 0 {
+		t.Errorf("expected an old config to still be valid, got %q", errs)
+	}
+
+	c = validConfig()
+	if warnings := c.setDefaults(); len(warnings) != 0 || c.ReviewChannel != testReview {
+		t.Errorf("expected nothing to be filled in, got %q", warnings)
+	}
+}
+
+func TestConfigEnv(t *testing.T) {
+	env := map[string]string{
+		"TWOBOT_REVIEW_CHANNEL": "200000000000000000",
+		"TWOBOT_INDEV":          "true",
+		"TWOBOT_MAXPROC":        "2",
+		"TWOBOT_BLACKLIST":      "1, 2",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	c := validConfig()
+	if errs := c.applyEnv(); len(errs) != 0 {
+		t.Fatalf("unexpected errors %q", errs)
+	}
+
+	want := validConfig()
+	want.ReviewChannel = "200000000000000000"
+	want.InDev = true
+	want.MaxProc = 2
+	want.Blacklist = []string{"1", "2"}
+
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("expected %+v, got %+v", want, c)
+	}
+
+	os.Setenv("TWOBOT_INDEV", "maybe")
+	if errs := c.applyEnv(); !reflect.DeepEqual(errs, configError{`TWOBOT_INDEV "maybe" isn't true or false`}) {
+		t.Errorf("expected an error for TWOBOT_INDEV, got %q", errs)
+	}
+}
+
+func TestConfigSaveWithoutEnv(t *testing.T) {
+	resetState()
+	writeJSON(t, "config.json", validConfig())
+	before, err := ioutil.ReadFile("json/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range map[string]string{"TWOBOT_TOKEN": "secret token", "TWOBOT_S3_SECRET_KEY": "secret key", "TWOBOT_GAME": "env game"} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if conf().Token != "secret token" {
+		t.Fatalf("expected the environment to override the token, got %q", conf().Token)
+	}
+
+	persist.markConfig()
+	if err := persist.flush(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := ioutil.ReadFile("json/config.json")
+	var saved, orig map[string]interface{}
+	json.Unmarshal(before, &orig)
+	json.Unmarshal(after, &saved)
+	if !reflect.DeepEqual(saved, orig) {
+		t.Errorf("expected the config file to be unchanged, got\n%s", after)
+	}
+
+	// Only the image number and changes made through commands are saved
+	num := nextImageNumber()
+	updateConf(func(c *config) { c.Prefix = "?" })
+	if err := saveConfig(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ = ioutil.ReadFile("json/config.json")
+	saved = nil
+	json.Unmarshal(after, &saved)
+	orig["curr_img_id"], orig["prefix"] = float64(num), "?"
+	if !reflect.DeepEqual(saved, orig) {
+		t.Errorf("expected only curr_img_id and prefix to change, got\n%s", after)
+	}
+	if strings.Contains(string(after), "secret") || conf().Game != "env game" {
+		t.Errorf("expected the overrides to stay out of the file, got\n%s", after)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type cooldownScope string
+
+const (
+	cooldownUser    cooldownScope = "user"
+	cooldownChannel cooldownScope = "channel"
+	cooldownGuild   cooldownScope = "guild"
+)
+
+// cooldown allows Uses invocations of a command per Per, counted separately
+// for every user, channel or guild depending on Scope.
+type cooldown struct {
+	Scope cooldownScope `json:"scope"`
+	Uses  int           `json:"uses"`
+	Per   time.Duration `json:"per"`
+}
+
+func (c cooldown) String() string {
+	return fmt.Sprintf("%d per %s per %s", c.Uses, c.Per, c.Scope)
+}
+
+type bucket struct {
+	uses   []time.Time
+	per    time.Duration
+	warned bool
+}
+
+type rateLimiter struct {
+	sync.Mutex
+	buckets map[string]*bucket
+}
+
+var limiter = rateLimiter{buckets: make(map[string]*bucket)}
+
+// take records a use of the command in every bucket it falls under. If any of
+// the buckets is full, nothing is recorded and the time until a use frees up
+// is returned. warn is only true the first time a full bucket is hit, so that
+// people spamming a command only get told off once.
+func (r *rateLimiter) take(name string, cooldowns []cooldown, m *discordgo.MessageCreate, guildID string) (wait time.Duration, warn bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	var hit []*bucket
+	var buckets []*bucket
+
+	for _, cd := range cooldowns {
+		if cd.Uses <= 0 {
+			continue
+		}
+
+		key := fmt.Sprintf("%s:%s:%s", name, cd.Scope, func() string {
+			switch cd.Scope {
+			case cooldownChannel:
+				return m.ChannelID
+			case cooldownGuild:
+				// DMs have no guild, so they're limited per channel instead
+				if guildID == "" {
+					return m.ChannelID
+				}
+				return guildID
+			}
+			return m.Author.ID
+		}())
+
+		b, ok := r.buckets[key]
+		if !ok {
+			b = &bucket{per: cd.Per}
+			r.buckets[key] = b
+		}
+		b.prune(now)
+
+		if len(b.uses) >= cd.Uses {
+			if w := b.uses[len(b.uses)-cd.Uses].Add(cd.Per).Sub(now); w > wait {
+				wait = w
+			}
+			hit = append(hit, b)
+			continue
+		}
+		buckets = append(buckets, b)
+	}
+
+	if len(hit) != 0 {
+		for _, b := range hit {
+			if !b.warned {
+				warn = true
+			}
+			b.warned = true
+		}
+		return wait, warn
+	}
+
+	for _, b := range buckets {
+		b.uses = append(b.uses, now)
+		b.warned = false
+	}
+	return 0, false
+}
+
+func (b *bucket) prune(now time.Time) {
+	i := 0
+	for i < len(b.uses) && now.Sub(b.uses[i]) >= b.per {
+		i++
+	}
+	b.uses = b.uses[i:]
+}
+
+// cleanup periodically drops buckets that have no uses left in them
+func (r *rateLimiter) cleanup() {
+	for {
+		time.Sleep(time.Minute * 10)
+
+		r.Lock()
+		now := time.Now()
+		for key, b := range r.buckets {
+			if b.prune(now); len(b.uses) == 0 {
+				delete(r.buckets, key)
+			}
+		}
+		r.Unlock()
+	}
+}
+
+// activeCooldowns returns the cooldowns for the command in the given guild,
+// preferring any override set by the guilds admins, and whether there was one.
+func (c command) activeCooldowns(guildID string) ([]cooldown, bool) {
+	var override []cooldown
+	sMap.view(guildID, func(guild *server) {
+		if cd, ok := guild.Cooldowns[strings.ToLower(c.FullName)]; ok {
+			override = []cooldown{cd}
+		}
+	})
+	if override != nil {
+		return override, true
+	}
+	return c.Cooldowns, false
+}
+
+// checkCooldown returns false if the user has to wait before running the command again
+func (c command) checkCooldown(s session, m *discordgo.MessageCreate, guildID string) bool {
+	if m.Author.ID == conf().OwnerID {
+		return true
+	}
+
+	name := strings.ToLower(c.FullName)
+	cooldowns, overridden := c.activeCooldowns(guildID)
+	// An override only applies in its own guild, so its uses are counted apart
+	// from the same users uses anywhere else
+	if overridden {
+		name += "@" + guildID
+	}
+
+	wait, warn := limiter.take(name, cooldowns, m, guildID)
+	if wait == 0 {
+		return true
+	}
+
+	if warn {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Slow down! You can use %s again in %.0fs",
+			codeSeg(c.FullName), math.Ceil(wait.Seconds())))
+	}
+	return false
+}
@@ -8,36 +8,51 @@ import (
 	"github.com/bwmarrin/discordgo"
 )
 
-func messageCreateEvent(s *discordgo.Session, m *discordgo.MessageCreate) {
+func messageCreateEvent(s session, m *discordgo.MessageCreate) {
 	if m.Author.Bot {
 		return
 	}
 
-	guildDetails, err := guildDetails(m.ChannelID, "", s)
-	if err != nil {
+	if reviewReason(s, m) {
 		return
 	}
 
-	prefix, err := activePrefix(m.ChannelID, s)
-	if err != nil {
+	// Commands in DMs can use the global prefix or no prefix at all. Without
+	// one it's only a command if it names one, so chatting gets no replies.
+	if m.GuildID == "" {
+		content, ok := trimPrefix(s, m.Content, nil)
+		if !ok {
+			fields := strings.Fields(m.Content)
+			if len(fields) == 0 {
+				return
+			}
+			if _, known := findCommand(fields[0]); !known && !isEmoji(fields[0]) {
+				return
+			}
+			content = m.Content
+		}
+		parseCommand(s, m, nil, content)
 		return
 	}
 
-	if !strings.HasPrefix(m.Content, conf.Prefix) && !strings.HasPrefix(m.Content, prefix) {
+	guildDetails, err := guildDetails(m.ChannelID, m.GuildID, s)
+	if err != nil {
 		return
 	}
 
-	parseCommand(s, m, guildDetails, func() string {
-		if strings.HasPrefix(m.Content, conf.Prefix) {
-			return strings.TrimPrefix(m.Content, conf.Prefix)
-		}
-		return strings.TrimPrefix(m.Content, prefix)
-	}())
+	var content string
+	var ok bool
+	if !sMap.view(guildDetails.ID, func(guild *server) { content, ok = trimPrefix(s, m.Content, guild) }) {
+		content, ok = trimPrefix(s, m.Content, nil)
+	}
+	if ok {
+		parseCommand(s, m, guildDetails, content)
+	}
 }
 
-func readyEvent(s *discordgo.Session, m *discordgo.Ready) {
+func readyEvent(s session, m *discordgo.Ready) {
 	log.Trace("received ready event")
-	/* s.ChannelMessageSendEmbed(logChan, &discordgo.MessageEmbed{
+	/* s.ChannelMessageSendEmbed(conf().LogChannel, &discordgo.MessageEmbed{
 		Fields: []*discordgo.MessageEmbedField{
 			{Name: "Info:", Value: "Received ready payload"},
 		},
@@ -45,12 +60,12 @@ func readyEvent(s *discordgo.Session, m *discordgo.Ready) {
 	setBotGame(s)
 }
 
-func guildJoinEvent(s *discordgo.Session, m *discordgo.GuildCreate) {
+func guildJoinEvent(s session, m *discordgo.GuildCreate) {
 	if m.Unavailable {
 		log.Info("joined unavailable guild", m.Guild.ID)
-		s.ChannelMessageSendEmbed(logChan, &discordgo.MessageEmbed{
+		s.ChannelMessageSendEmbed(conf().LogChannel, &discordgo.MessageEmbed{
 			Fields: []*discordgo.MessageEmbedField{
-				{"Info", "Joined unavailable guild", true},
+				{Name: "Info", Value: "Joined unavailable guild", Inline: true},
 			},
 			Color: 0x00ff00,
 		})
@@ -73,39 +88,45 @@ func guildJoinEvent(s *discordgo.Session, m *discordgo.GuildCreate) {
 		Footer: footer,
 
 		Fields: []*discordgo.MessageEmbedField{
-			{"Name:", m.Guild.Name, true},
-			{"User Count:", strconv.Itoa(m.Guild.MemberCount), true},
-			{"Region:", m.Guild.Region, true},
-			{"Channel Count:", strconv.Itoa(len(m.Guild.Channels)), true},
-			{"ID:", m.Guild.ID, true},
-			{"Owner:", user.Username + "#" + user.Discriminator, true},
+			{Name: "Name:", Value: m.Guild.Name, Inline: true},
+			{Name: "User Count:", Value: strconv.Itoa(m.Guild.MemberCount), Inline: true},
+			{Name: "Region:", Value: m.Guild.Region, Inline: true},
+			{Name: "Channel Count:", Value: strconv.Itoa(len(m.Guild.Channels)), Inline: true},
+			{Name: "ID:", Value: m.Guild.ID, Inline: true},
+			{Name: "Owner:", Value: user.Username + "#" + user.Discriminator, Inline: true},
 		},
 	}
 
-	if _, ok := sMap.server(m.Guild.ID); !ok {
+	joined := sMap.add(m.Guild.ID, server{
+		LogChannel: m.Guild.ID,
+		Log:        false,
+		Nsfw:       false,
+	})
+
+	var rejoined bool
+	if !joined {
+		sMap.update(m.Guild.ID, func(val *server) {
+			rejoined = val.Kicked
+			val.Kicked = false
+		})
+	}
+
+	if joined {
 		//if newly joined
 		embed.Color = 0x00ff00
-		s.ChannelMessageSendEmbed(logChan, embed)
+		s.ChannelMessageSendEmbed(conf().LogChannel, embed)
 		log.Info("joined server", m.Guild.ID, m.Guild.Name)
-
-		sMap.setServer(m.Guild.ID, server{
-			LogChannel:  m.Guild.ID,
-			Log:         false,
-			Nsfw:        false,
-			JoinMessage: [3]string{"false", "", ""},
-		})
-	} else if val, _ := sMap.server(m.Guild.ID); val.Kicked {
+	} else if rejoined {
 		//If previously kicked and then readded
 		embed.Color = 0xff9a00
-		s.ChannelMessageSendEmbed(logChan, embed)
+		s.ChannelMessageSendEmbed(conf().LogChannel, embed)
 		log.Info("rejoined server", m.Guild.ID, m.Guild.Name)
-		val.Kicked = false
 	}
 
-	saveServers()
+	persist.markServer(m.Guild.ID)
 }
 
-func guildKickedEvent(s *discordgo.Session, m *discordgo.GuildDelete) {
+func guildKickedEvent(s session, m *discordgo.GuildDelete) {
 	if m.Unavailable {
 		guild, err := guildDetails("", m.Guild.ID, s)
 		if err != nil {
@@ -116,27 +137,30 @@ func guildKickedEvent(s *discordgo.Session, m *discordgo.GuildDelete) {
 		return
 	}
 
-	s.ChannelMessageSendEmbed(logChan, &discordgo.MessageEmbed{
+	s.ChannelMessageSendEmbed(conf().LogChannel, &discordgo.MessageEmbed{
 		Color:  0xff0000,
 		Footer: footer,
 		Fields: []*discordgo.MessageEmbedField{
-			{"Name:", m.Name, true},
-			{"ID:", m.Guild.ID, true},
+			{Name: "Name:", Value: m.Name, Inline: true},
+			{Name: "ID:", Value: m.Guild.ID, Inline: true},
 		},
 	})
 
 	log.Info("kicked from", m.Guild.ID, m.Name)
 
-	if guild, ok := sMap.server(m.Guild.ID); ok {
-		guild.Kicked = true
-	}
+	sMap.update(m.Guild.ID, func(guild *server) { guild.Kicked = true })
 
-	saveServers()
+	persist.markServer(m.Guild.ID)
 }
 
-func presenceChangeEvent(s *discordgo.Session, m *discordgo.PresenceUpdate) {
-	guild, ok := sMap.server(m.GuildID)
-	if !ok || guild.Kicked || !guild.Log {
+func presenceChangeEvent(s session, m *discordgo.PresenceUpdate) {
+	var logChannel string
+	sMap.view(m.GuildID, func(guild *server) {
+		if !guild.Kicked && guild.Log {
+			logChannel = guild.LogChannel
+		}
+	})
+	if logChannel == "" {
 		return
 	}
 
@@ -145,22 +169,17 @@ func presenceChangeEvent(s *discordgo.Session, m *discordgo.PresenceUpdate) {
 		return
 	}
 
-	s.ChannelMessageSend(guild.LogChannel, fmt.Sprintf("`%s is now %s`", memberStruct.User, status[m.Status]))
+	s.ChannelMessageSend(logChannel, fmt.Sprintf("`%s is now %s`", memberStruct.User, status[m.Status]))
 }
 
-func memberJoinEvent(s *discordgo.Session, m *discordgo.GuildMemberAdd) {
-	guild, ok := sMap.server(m.GuildID)
-	if !ok || guild.Kicked || len(guild.JoinMessage) != 3 {
-		return
-	}
-
-	isBool, err := strconv.ParseBool(guild.JoinMessage[0])
-	if err != nil {
-		log.Error("couldnt parse bool", err)
+func memberJoinEvent(s session, m *discordgo.GuildMemberAdd) {
+	var join joinMessage
+	var kicked bool
+	if !sMap.view(m.GuildID, func(guild *server) { join, kicked = guild.JoinMessage, guild.Kicked }) || kicked {
 		return
 	}
 
-	if !isBool || guild.JoinMessage[1] == "" {
+	if !join.Enabled || join.Message == "" {
 		return
 	}
 
@@ -169,5 +188,5 @@ func memberJoinEvent(s *discordgo.Session, m *discordgo.GuildMemberAdd) {
 		return
 	}
 
-	s.ChannelMessageSend(guild.JoinMessage[2], strings.Replace(guild.JoinMessage[1], "%s", membStruct.Mention(), -1))
+	s.ChannelMessageSend(join.Channel, strings.Replace(join.Message, "%s", membStruct.Mention(), -1))
 }
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	testGuildID   = "100000000000000000"
+	testChannelID = "100000000000000001"
+	testOtherChan = "100000000000000002"
+	testBotID     = "100000000000000003"
+	testOwnerID   = "100000000000000004"
+	testUserID    = "100000000000000005"
+	testAdminRole = "100000000000000006"
+	testDMChannel = "100000000000000007"
+	testReview    = "100000000000000008"
+	testLog       = "100000000000000009"
+)
+
+var errFake = errors.New("fake session: not found")
+
+type reaction struct {
+	ChannelID, MessageID, Emoji string
+}
+
+// fakeSession is an in-memory session that records everything the bot sends.
+// Lookups are served from a real discordgo.State populated by newFakeSession.
+type fakeSession struct {
+	mu sync.Mutex
+
+	st *discordgo.State
+
+	// Everything sent to a channel, in order. Embeds have Embeds set instead of Content.
+	sent      []*discordgo.Message
+	edited    []*discordgo.Message
+	deleted   []string
+	reactions []reaction
+
+	// Called by MessageReactionAdd, if set
+	onReaction func()
+
+	// Set by UpdateStatus
+	game string
+
+	// Files sent with ChannelFileSend, by name
+	files map[string][]byte
+
+	// Messages returned by ChannelMessages, newest first
+	history map[string][]*discordgo.Message
+
+	handlers   []*fakeHandler
+	registered chan struct{}
+
+	nextID int
+}
+
+// newFakeSession returns a session for a guild owned by testOwnerID with the
+// channels testChannelID and testOtherChan. testUserID is a member with no roles.
+func newFakeSession() *fakeSession {
+	st := discordgo.NewState()
+	st.User = &discordgo.User{ID: testBotID, Username: "2Bot", Bot: true}
+
+	member := func(id, name string, roles ...string) *discordgo.Member {
+		return &discordgo.Member{GuildID: testGuildID, User: &discordgo.User{ID: id, Username: name, Discriminator: "0001"}, Roles: roles}
+	}
+
+	st.GuildAdd(&discordgo.Guild{
+		ID:          testGuildID,
+		Name:        "Test Server",
+		OwnerID:     testOwnerID,
+		MemberCount: 3,
+		Roles: []*discordgo.Role{
+			{ID: testGuildID, Name: "@everyone"},
+			{ID: testAdminRole, Name: "Admins", Permissions: discordgo.PermissionAdministrator},
+		},
+		Channels: []*discordgo.Channel{
+			{ID: testChannelID, GuildID: testGuildID, Name: "general", Type: discordgo.ChannelTypeGuildText},
+			{ID: testOtherChan, GuildID: testGuildID, Name: "welcome", Type: discordgo.ChannelTypeGuildText},
+		},
+		Members: []*discordgo.Member{
+			member(testBotID, "2Bot"),
+			member(testOwnerID, "Owner"),
+			member(testUserID, "User"),
+		},
+	})
+
+	st.ChannelAdd(&discordgo.Channel{ID: testDMChannel, Type: discordgo.ChannelTypeDM})
+
+	return &fakeSession{
+		st:         st,
+		history:    make(map[string][]*discordgo.Message),
+		files:      make(map[string][]byte),
+		registered: make(chan struct{}, 100),
+	}
+}
+
+func (f *fakeSession) id() string {
+	f.nextID++
+	return strconv.Itoa(900000000000000000 + f.nextID)
+}
+
+func (f *fakeSession) record(msg *discordgo.Message) *discordgo.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	msg.ID = f.id()
+	f.sent = append(f.sent, msg)
+	return msg
+}
+
+// messages returns the content of every plain message sent to channelID
+func (f *fakeSession) messages(channelID string) (out []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, msg := range f.sent {
+		if msg.ChannelID == channelID && len(msg.Embeds) == 0 {
+			out = append(out, msg.Content)
+		}
+	}
+	return
+}
+
+// embeds returns every embed sent to channelID
+func (f *fakeSession) embeds(channelID string) (out []*discordgo.Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, msg := range f.sent {
+		if msg.ChannelID == channelID && len(msg.Embeds) != 0 {
+			out = append(out, msg)
+		}
+	}
+	return
+}
+
+// emit waits for a handler for the type of event to be added through
+// AddHandlerOnce, then runs it with event.
+func (f *fakeSession) emit(t *testing.T, event interface{}) {
+	t.Helper()
+
+	timeout := time.After(time.Second * 5)
+	for {
+		f.mu.Lock()
+		for i, h := range f.handlers {
+			fn := reflect.ValueOf(h.fn)
+			if fn.Type().In(1) != reflect.TypeOf(event) {
+				continue
+			}
+			f.handlers = append(f.handlers[:i], f.handlers[i+1:]...)
+			f.mu.Unlock()
+
+			fn.Call([]reflect.Value{reflect.Zero(fn.Type().In(0)), reflect.ValueOf(event)})
+			return
+		}
+		f.mu.Unlock()
+
+		select {
+		case <-f.registered:
+		case <-timeout:
+			t.Fatalf("timed out waiting for a %T handler", event)
+		}
+	}
+}
+
+// waitHandler blocks until something is waiting on an event
+func (f *fakeSession) waitHandler(t *testing.T) {
+	t.Helper()
+	for {
+		f.mu.Lock()
+		n := len(f.handlers)
+		f.mu.Unlock()
+		if n != 0 {
+			return
+		}
+
+		select {
+		case <-f.registered:
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting for a handler")
+		}
+	}
+}
+
+func (f *fakeSession) ChannelMessageSend(channelID, content string) (*discordgo.Message, error) {
+	return f.record(&discordgo.Message{ChannelID: channelID, Content: content}), nil
+}
+
+func (f *fakeSession) ChannelMessageSendEmbed(channelID string, embed *discordgo.MessageEmbed) (*discordgo.Message, error) {
+	return f.record(&discordgo.Message{ChannelID: channelID, Embeds: []*discordgo.MessageEmbed{embed}}), nil
+}
+
+func (f *fakeSession) ChannelMessageEdit(channelID, messageID, content string) (*discordgo.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	msg := &discordgo.Message{ID: messageID, ChannelID: channelID, Content: content}
+	f.edited = append(f.edited, msg)
+	return msg, nil
+}
+
+func (f *fakeSession) ChannelMessageDelete(channelID, messageID string) error {
+	return f.ChannelMessagesBulkDelete(channelID, []string{messageID})
+}
+
+func (f *fakeSession) ChannelMessagesBulkDelete(channelID string, messages []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, messages...)
+
+	var kept []*discordgo.Message
+	for _, msg := range f.history[channelID] {
+		if !isIn(msg.ID, messages) {
+			kept = append(kept, msg)
+		}
+	}
+	f.history[channelID] = kept
+	return nil
+}
+
+func (f *fakeSession) ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string) ([]*discordgo.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if limit < 1 || limit > 100 {
+		limit = 50
+	}
+	list := f.history[channelID]
+	return append([]*discordgo.Message{}, list[:min(len(list), limit)]...), nil
+}
+
+func (f *fakeSession) ChannelFileSend(channelID, name string, r io.Reader) (*discordgo.Message, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	f.files[name] = data
+	f.mu.Unlock()
+	return f.record(&discordgo.Message{ChannelID: channelID, Content: name}), nil
+}
+
+func (f *fakeSession) ChannelTyping(channelID string) error {
+	return nil
+}
+
+func (f *fakeSession) MessageReactionAdd(channelID, messageID, emojiID string) error {
+	f.mu.Lock()
+	f.reactions = append(f.reactions, reaction{channelID, messageID, emojiID})
+	onReaction := f.onReaction
+	f.mu.Unlock()
+
+	if onReaction != nil {
+		onReaction()
+	}
+	return nil
+}
+
+func (f *fakeSession) Channel(channelID string) (*discordgo.Channel, error) {
+	return f.st.Channel(channelID)
+}
+
+func (f *fakeSession) Guild(guildID string) (*discordgo.Guild, error) {
+	return f.st.Guild(guildID)
+}
+
+func (f *fakeSession) GuildMember(guildID, userID string) (*discordgo.Member, error) {
+	return f.st.Member(guildID, userID)
+}
+
+func (f *fakeSession) User(userID string) (*discordgo.User, error) {
+	if member, err := f.st.Member(testGuildID, userID); err == nil {
+		return member.User, nil
+	}
+	return &discordgo.User{ID: userID, Username: "user" + userID, Discriminator: "0000"}, nil
+}
+
+func (f *fakeSession) UserChannelCreate(recipientID string) (*discordgo.Channel, error) {
+	return &discordgo.Channel{ID: "dm" + recipientID, Type: discordgo.ChannelTypeDM}, nil
+}
+
+func (f *fakeSession) UserChannelPermissions(userID, channelID string) (int, error) {
+	return f.st.UserChannelPermissions(userID, channelID)
+}
+
+func (f *fakeSession) UpdateStatus(idle int, game string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.game = game
+	return nil
+}
+
+func (f *fakeSession) ChannelVoiceJoin(guildID, channelID string, mute, deaf bool) (*discordgo.VoiceConnection, error) {
+	return nil, errFake
+}
+
+// fakeHandler is a pointer so the func returned by AddHandlerOnce can find it
+type fakeHandler struct {
+	fn interface{}
+}
+
+func (f *fakeSession) AddHandlerOnce(handler interface{}) func() {
+	h := &fakeHandler{fn: handler}
+	f.mu.Lock()
+	f.handlers = append(f.handlers, h)
+	f.mu.Unlock()
+
+	// It's only a wake up, so a full buffer already has one waiting
+	select {
+	case f.registered <- struct{}{}:
+	default:
+	}
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for i := range f.handlers {
+			if f.handlers[i] == h {
+				f.handlers = append(f.handlers[:i], f.handlers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (f *fakeSession) state() *discordgo.State {
+	return f.st
+}
+
+func (f *fakeSession) discord() *discordgo.Session {
+	return nil
+}
+
+// message makes a message from userID in testChannelID
+func (f *fakeSession) message(userID, content string) *discordgo.MessageCreate {
+	author, _ := f.User(userID)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &discordgo.MessageCreate{Message: &discordgo.Message{
+		ID:        f.id(),
+		ChannelID: testChannelID,
+		GuildID:   testGuildID,
+		Content:   content,
+		Author:    author,
+	}}
+}
+
+// run parses and runs content as if userID had sent it
+func (f *fakeSession) run(userID, content string) {
+	f.runMessage(f.message(userID, content))
+}
+
+// runMessage parses and runs m, which shouldn't include the prefix
+func (f *fakeSession) runMessage(m *discordgo.MessageCreate) {
+	guild, _ := f.st.Guild(testGuildID)
+	parseCommand(f, m, guild, m.Content)
+}
+
+// testGuild returns the test guild, for checking it once the commands being
+// tested have finished
+func testGuild() *server {
+	var guild *server
+	sMap.view(testGuildID, func(g *server) { guild = g })
+	return guild
+}
+
+// resetState clears all the global state the bot keeps between tests and
+// adds an entry for the test guild.
+func resetState() {
+	setConf(&config{Prefix: "!owo ", ReviewChannel: testReview, LogChannel: testLog})
+	u.replace(make(users))
+	imageQueue.replace(make(map[string]*queuedImage))
+	limiter.Lock()
+	limiter.buckets = make(map[string]*bucket)
+	limiter.Unlock()
+	commandStats = new(usageStats)
+	persist.reset()
+	store = newJSONStore()
+	imgStore = localImageStore{dir: "images"}
+	os.Remove(reviewAudit.path)
+	sMap.replace(make(map[string]*server))
+	sMap.setServer(testGuildID, server{LogChannel: testGuildID})
+}
+
+// TestMain runs the tests from a temporary directory so that saving files
+// doesn't touch anything real.
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "2bot")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	for _, sub := range []string{"json", "images/temp"} {
+		if err := os.MkdirAll(dir+"/"+sub, 0755); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if err := os.Chdir(dir); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	purgeConfirmDelay = 0
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
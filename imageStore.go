@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ImageStore keeps the files of saved images. Keys are the file name for
+// confirmed images and temp/ followed by the file name for queued ones.
+type ImageStore interface {
+	Put(key string, b []byte) error
+	// Get returns errImageNotFound if there's nothing under key
+	Get(key string) (io.ReadCloser, error)
+	// Move returns errImageNotFound if there's nothing under from
+	Move(from, to string) error
+	// Delete doesn't return an error if there's nothing under key
+	Delete(key string) error
+	// Stat returns the size of the image, or errImageNotFound
+	Stat(key string) (int64, error)
+	// URL is where Discord and selfbots can get the image from
+	URL(key string) string
+}
+
+const (
+	imagesLocal = "local"
+	imagesS3    = "s3"
+
+	defaultS3Region = "us-east-1"
+)
+
+var errImageNotFound = errors.New("image not found")
+
+var imgStore ImageStore = localImageStore{dir: "images"}
+
+// tempImageKey is where an image is kept while it's waiting to be reviewed
+func tempImageKey(file string) string {
+	return "temp/" + file
+}
+
+// openImageStore returns the image storage chosen in the config
+func openImageStore(c *config) (ImageStore, error) {
+	switch c.ImageStorage {
+	case imagesS3:
+		return newS3ImageStore(c.S3Endpoint, c.S3Region, c.S3Bucket, c.S3AccessKey, c.S3SecretKey), nil
+	case imagesLocal, "":
+		return localImageStore{dir: "images"}, nil
+	}
+	return nil, fmt.Errorf("unknown image storage %q", c.ImageStorage)
+}
+
+// localImageStore keeps images on disk, to be served from url in the config
+type localImageStore struct {
+	dir string
+}
+
+func (l localImageStore) path(key string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(key))
+}
+
+func (l localImageStore) Put(key string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(l.path(key)), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(l.path(key), b, 0644)
+}
+
+func (l localImageStore) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(key))
+	if os.IsNotExist(err) {
+		return nil, errImageNotFound
+	}
+	return f, err
+}
+
+func (l localImageStore) Move(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(l.path(to)), 0755); err != nil {
+		return err
+	}
+	err := os.Rename(l.path(from), l.path(to))
+	if os.IsNotExist(err) {
+		return errImageNotFound
+	}
+	return err
+}
+
+func (l localImageStore) Delete(key string) error {
+	if err := os.Remove(l.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (l localImageStore) Stat(key string) (int64, error) {
+	info, err := os.Stat(l.path(key))
+	if os.IsNotExist(err) {
+		return 0, errImageNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (l localImageStore) URL(key string) string {
+	return conf().URL + url.PathEscape(key)
+}
+
+// s3ImageStore keeps images in a bucket of an S3 compatible service, like
+// MinIO. Requests are path style and signed with AWS signature version 4.
+type s3ImageStore struct {
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+
+	client *http.Client
+	now    func() time.Time
+}
+
+func newS3ImageStore(endpoint, region, bucket, accessKey, secretKey string) *s3ImageStore {
+	if region == "" {
+		region = defaultS3Region
+	}
+	return &s3ImageStore{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: time.Minute},
+		now:       time.Now,
+	}
+}
+
+// objectPath is the escaped path of key in the bucket
+func (s *s3ImageStore) objectPath(key string) string {
+	return "/" + s3Escape(s.bucket) + "/" + s3Escape(key)
+}
+
+// s3Escape escapes everything but unreserved characters and slashes, as
+// signatures need
+func s3Escape(str string) string {
+	var b strings.Builder
+	for _, c := range []byte(str) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Error is the body S3 sends with a failed request
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends a signed request for key. A 404 is returned as errImageNotFound
+// and any other failure as an error, with the body already closed.
+func (s *s3ImageStore) do(method, key string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.endpoint+s.objectPath(key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, vals := range header {
+		req.Header[name] = vals
+	}
+	s.sign(req, body, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errImageNotFound
+	}
+	var s3Err s3Error
+	if b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16)); xml.Unmarshal(b, &s3Err) == nil && s3Err.Code != "" {
+		return nil, fmt.Errorf("s3 %s %s: %s %s: %s", method, key, resp.Status, s3Err.Code, s3Err.Message)
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s", method, key, resp.Status)
+}
+
+// sign adds the Authorization header, signing the host and every header
+// already set on req
+func (s *s3ImageStore) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, vals := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(vals, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (s *s3ImageStore) Put(key string, b []byte) error {
+	header := http.Header{}
+	if contentType := mime.TypeByExtension(strings.ToLower(filepath.Ext(key))); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(http.MethodPut, key, b, header)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *s3ImageStore) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Move copies the image and then deletes the original, as S3 has no rename
+func (s *s3ImageStore) Move(from, to string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", s.objectPath(from))
+	resp, err := s.do(http.MethodPut, to, nil, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return s.Delete(from)
+}
+
+func (s *s3ImageStore) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil)
+	if err == errImageNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *s3ImageStore) Stat(key string) (int64, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// URL is under url in the config if it's set, so that the bucket can be
+// behind a CDN, and the bucket on the endpoint otherwise
+func (s *s3ImageStore) URL(key string) string {
+	if conf().URL != "" {
+		return conf().URL + url.PathEscape(key)
+	}
+	return s.endpoint + s.objectPath(key)
+}
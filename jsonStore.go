@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// jsonStore keeps everything in servers.json, users.json and queue.json,
+// with playlists inside the servers they belong to. Every change rewrites
+// the whole file the change is in, so it keeps its own copy of everything it
+// has loaded or been given, which the records in sMap, u and imageQueue can
+// change without locking it. Each file records the schema version it was
+// saved with, and older files are migrated as they're loaded.
+type jsonStore struct {
+	mu sync.Mutex
+
+	servers map[string]*server
+	users   users
+	queue   map[string]*queuedImage
+
+	// Files changed during a Batch, written once it's done
+	batching  bool
+	unwritten map[string]bool
+}
+
+func newJSONStore() *jsonStore {
+	return &jsonStore{
+		servers: make(map[string]*server),
+		users:   make(users),
+		queue:   make(map[string]*queuedImage),
+	}
+}
+
+// The files jsonStore keeps, and the kind of record in each
+var jsonStoreFiles = []struct {
+	path, kind string
+}{
+	{"servers.json", recordServer},
+	{"users.json", recordUser},
+	{"queue.json", recordQueued},
+}
+
+// versionedFile is how each of jsonStores files is saved. Files saved before
+// there were schema versions are only the data, and are version 0.
+type versionedFile struct {
+	SchemaVersion int         `json:"schema_version"`
+	Data          interface{} `json:"data"`
+}
+
+// loadJSONFile is like loadJSON, but a file that doesn't exist yet is fine
+func loadJSONFile(path string, v interface{}) error {
+	if _, err := os.Stat("json/" + path); os.IsNotExist(err) {
+		return nil
+	}
+	return loadJSON(path, v)
+}
+
+// readVersioned reads one of jsonStores files, returning the schema version
+// it was saved with, its records and the file as it was. A file that doesn't
+// exist yet is up to date.
+func readVersioned(path string) (int, map[string]json.RawMessage, []byte, error) {
+	var raw json.RawMessage
+	if err := loadJSONFile(path, &raw); err != nil {
+		return 0, nil, nil, err
+	}
+	if raw == nil {
+		return schemaVersion, make(map[string]json.RawMessage), nil, nil
+	}
+
+	version, recs, err := decodeVersioned(raw)
+	return version, recs, raw, err
+}
+
+// decodeVersioned splits the contents of one of jsonStores files, or a
+// backup of one, into its schema version and records
+func decodeVersioned(raw []byte) (int, map[string]json.RawMessage, error) {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &top); err != nil {
+		return 0, nil, err
+	}
+	if _, ok := top["schema_version"]; !ok {
+		if top == nil {
+			top = make(map[string]json.RawMessage)
+		}
+		return 0, top, nil
+	}
+
+	var file struct {
+		SchemaVersion int                        `json:"schema_version"`
+		Data          map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return 0, nil, err
+	}
+	if file.Data == nil {
+		file.Data = make(map[string]json.RawMessage)
+	}
+	return file.SchemaVersion, file.Data, nil
+}
+
+// loadVersioned decodes one of jsonStores files into v, migrating it first
+// if it was saved with an older schema version
+func loadVersioned(path, kind string, v interface{}) error {
+	version, recs, _, err := readVersioned(path)
+	if err != nil {
+		return err
+	}
+	if _, err := migrateRecords(kind, version, recs); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(recs)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// copyRecords deep copies src into dst, which jsonStore does with anything
+// it keeps hold of
+func copyRecords(src, dst interface{}) error {
+	b, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
+func saveVersioned(path string, data interface{}) error {
+	return saveJSON(path, versionedFile{SchemaVersion: schemaVersion, Data: data})
+}
+
+// Migrate rewrites any file saved with an older schema version, backing up
+// what was there first
+func (j *jsonStore) Migrate(dryRun bool) ([]string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var changes []string
+	for _, f := range jsonStoreFiles {
+		version, recs, raw, err := readVersioned(f.path)
+		if err != nil {
+			return changes, fmt.Errorf("%s: %v", f.path, err)
+		}
+		if version == schemaVersion {
+			continue
+		}
+
+		changes = append(changes, fmt.Sprintf("%s is schema version %d, migrating to %d", f.path, version, schemaVersion))
+		migrated, err := migrateRecords(f.kind, version, recs)
+		if err != nil {
+			return changes, fmt.Errorf("%s: %v", f.path, err)
+		}
+		changes = append(changes, migrated...)
+
+		if dryRun {
+			continue
+		}
+		if err := backupJSON(f.path, raw, true); err != nil {
+			return changes, fmt.Errorf("error backing up %s before migrating: %v", f.path, err)
+		}
+		if err := saveVersioned(f.path, recs); err != nil {
+			return changes, err
+		}
+	}
+	return changes, nil
+}
+
+func (j *jsonStore) Servers() (map[string]*server, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	next := make(map[string]*server)
+	if err := loadVersioned("servers.json", recordServer, &next); err != nil {
+		return nil, err
+	}
+
+	j.servers = make(map[string]*server, len(next))
+	if err := copyRecords(next, &j.servers); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+func (j *jsonStore) PutServer(id string, s *server) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	guild := new(server)
+	if err := copyRecords(s, guild); err != nil {
+		return err
+	}
+	j.servers[id] = guild
+	return j.write("servers.json")
+}
+
+func (j *jsonStore) DeleteServer(id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	delete(j.servers, id)
+	return j.write("servers.json")
+}
+
+func (j *jsonStore) Users() (users, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	next := make(users)
+	if err := loadVersioned("users.json", recordUser, &next); err != nil {
+		return nil, err
+	}
+
+	j.users = make(users, len(next))
+	if err := copyRecords(next, &j.users); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+func (j *jsonStore) PutUser(id string, u *user) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	usr := new(user)
+	if err := copyRecords(u, usr); err != nil {
+		return err
+	}
+	j.users[id] = usr
+	return j.write("users.json")
+}
+
+func (j *jsonStore) DeleteUser(id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	delete(j.users, id)
+	return j.write("users.json")
+}
+
+func (j *jsonStore) Queue() (map[string]*queuedImage, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	next := make(map[string]*queuedImage)
+	if err := loadVersioned("queue.json", recordQueued, &next); err != nil {
+		return nil, err
+	}
+
+	j.queue = make(map[string]*queuedImage, len(next))
+	if err := copyRecords(next, &j.queue); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+func (j *jsonStore) PutQueued(num string, img *queuedImage) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	queued := new(queuedImage)
+	if err := copyRecords(img, queued); err != nil {
+		return err
+	}
+	j.queue[num] = queued
+	return j.write("queue.json")
+}
+
+func (j *jsonStore) DeleteQueued(num string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	delete(j.queue, num)
+	return j.write("queue.json")
+}
+
+func (j *jsonStore) Playlists(guildID string) (map[string][]song, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	guild, ok := j.servers[guildID]
+	if !ok {
+		return nil, fmt.Errorf("no server %s", guildID)
+	}
+	playlists := make(map[string][]song, len(guild.Playlists))
+	for name, songs := range guild.Playlists {
+		playlists[name] = append([]song(nil), songs...)
+	}
+	return playlists, nil
+}
+
+func (j *jsonStore) PutPlaylist(guildID, name string, songs []song) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	guild, ok := j.servers[guildID]
+	if !ok {
+		return fmt.Errorf("no server %s", guildID)
+	}
+	if guild.Playlists == nil {
+		guild.Playlists = make(map[string][]song)
+	}
+	guild.Playlists[name] = append([]song(nil), songs...)
+	return j.write("servers.json")
+}
+
+func (j *jsonStore) DeletePlaylist(guildID, name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	guild, ok := j.servers[guildID]
+	if !ok {
+		return fmt.Errorf("no server %s", guildID)
+	}
+	delete(guild.Playlists, name)
+	return j.write("servers.json")
+}
+
+// write saves one of the files, or leaves it until the end of the batch if
+// one is running. j.mu has to be held.
+func (j *jsonStore) write(path string) error {
+	if j.batching {
+		j.unwritten[path] = true
+		return nil
+	}
+	return saveVersioned(path, j.data(path))
+}
+
+func (j *jsonStore) data(path string) interface{} {
+	switch path {
+	case "servers.json":
+		return j.servers
+	case "users.json":
+		return j.users
+	}
+	return j.queue
+}
+
+func (j *jsonStore) Batch(f func() error) error {
+	j.mu.Lock()
+	j.batching = true
+	j.unwritten = make(map[string]bool)
+	j.mu.Unlock()
+
+	err := f()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.batching = false
+	for _, file := range jsonStoreFiles {
+		if !j.unwritten[file.path] {
+			continue
+		}
+		if werr := saveVersioned(file.path, j.data(file.path)); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+func (j *jsonStore) Close() error {
+	return nil
+}
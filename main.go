@@ -19,6 +19,7 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"net/http"
 	"os"
 	"os/signal"
@@ -33,17 +34,12 @@ import (
 )
 
 const (
-	happyEmoji string = "https://cdn.discordapp.com/emojis/332968429210435585.png"
 	thinkEmoji string = "https://cdn.discordapp.com/emojis/333694872802426880.png"
-	reviewChan string = "334092230845267988"
-	logChan    string = "312352242504040448"
-	serverID   string = "312292616089894924"
 	xmark      string = "<:xmark:314349398824058880>"
 	zerowidth  string = "​"
 )
 
 var (
-	conf         = new(config)
 	dg           *discordgo.Session
 	lastReboot   string
 	log          = newLog()
@@ -66,68 +62,115 @@ func dailyJobs() {
 }
 
 func postServerCount() {
-	url := "https://bots.discord.pw/api/bots/301819949683572738/stats"
+	url := conf().ServerCountURL
+	if url == "" {
+		return
+	}
 
 	count := len(dg.State.Guilds)
 
 	jsonStr := []byte(`{"server_count":` + strconv.Itoa(count) + `}`)
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
 	if err != nil {
-		log.Error("error making bots.discord.pw request", err)
+		log.Error("error making server count request", err)
 		return
 	}
 
-	req.Header.Set("Authorization", conf.DiscordPWKey)
+	req.Header.Set("Authorization", conf().DiscordPWKey)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := new(http.Client).Do(req)
 	if err != nil {
-		log.Error("bots.discord.pw error", err)
+		log.Error("error posting server count to", url, err)
 		return
 	}
 	defer resp.Body.Close()
 
-	log.Info("POSTed " + strconv.Itoa(count) + " to bots.discord.pw")
+	log.Info("POSTed " + strconv.Itoa(count) + " to " + url)
 
 	if resp.StatusCode != http.StatusNoContent {
-		log.Error("received " + strconv.Itoa(resp.StatusCode) + " from bots.discord.pw")
+		log.Error("received " + strconv.Itoa(resp.StatusCode) + " from " + url)
 	}
 
 }
 
-func setBotGame(s *discordgo.Session) {
-	if err := s.UpdateStatus(0, conf.Game); err != nil {
+func setBotGame(s session) {
+	if err := s.UpdateStatus(0, conf().Game); err != nil {
 		log.Error("Update status err:", err)
 		return
 	}
-	log.Info("set initial game to", conf.Game)
+	log.Info("set initial game to", conf().Game)
 }
 
-// Set all handlers for queued images, in case the bot crashes with images still in queue
-func setQueuedImageHandlers() {
-	for imgNum := range imageQueue {
-		imgNumInt, err := strconv.Atoi(imgNum)
+func main() {
+	migrateJSON := flag.Bool("migrate", false, "copy servers.json, users.json and queue.json into the database in the config, then exit")
+	schemaDryRun := flag.Bool("schema-dry-run", false, "report what migrating the data to the current schema version would change, then exit")
+	flag.Parse()
+
+	log.Info("/*********BOT RESTARTING*********\\")
+
+	if err := loadConfig(); err != nil {
+		log.Error("error loading config", err)
+		os.Exit(1)
+	}
+	log.Trace("loaded config")
+
+	runtime.GOMAXPROCS(conf().MaxProc)
+
+	var err error
+	if store, err = openStore(conf()); err != nil {
+		log.Error("error opening storage", err)
+		os.Exit(1)
+	}
+
+	if imgStore, err = openImageStore(conf()); err != nil {
+		log.Error("error opening image storage", err)
+		os.Exit(1)
+	}
+
+	if *schemaDryRun {
+		changes, err := store.Migrate(true)
+		for _, change := range changes {
+			log.Info("would migrate:", change)
+		}
+		store.Close()
 		if err != nil {
-			log.Error("Error converting string to num for queue:", err)
-			continue
+			log.Error("error migrating", err)
+			os.Exit(1)
 		}
-		go fimageReview(dg, imgNumInt)
+		if len(changes) == 0 {
+			log.Info("nothing to migrate, everything is at schema version", schemaVersion)
+		}
+		return
 	}
-}
 
-func main() {
-	runtime.GOMAXPROCS(conf.MaxProc)
+	changes, err := store.Migrate(false)
+	for _, change := range changes {
+		log.Info("migrated:", change)
+	}
+	if err != nil {
+		log.Error("error migrating, nothing was loaded", err)
+		store.Close()
+		os.Exit(1)
+	}
 
-	log.Info("/*********BOT RESTARTING*********\\")
+	if *migrateJSON {
+		if conf().Storage == storeJSON {
+			log.Error("set storage to bolt in the config to migrate to it")
+			os.Exit(1)
+		}
+		if err := migrate(newJSONStore(), store); err != nil {
+			log.Error("error migrating", err)
+			store.Close()
+			os.Exit(1)
+		}
+		store.Close()
+		return
+	}
 
-	names := []string{"config", "users", "servers", "queue"}
-	for i, f := range []func() error{loadConfig, loadUsers, loadServers, loadQueue} {
+	names := []string{"users", "servers", "queue", "stats"}
+	for i, f := range []func() error{loadUsers, loadServers, loadQueue, loadStats} {
 		if err := f(); err != nil {
-			switch i {
-			case 0:
-				os.Exit(404)
-			default:
-			}
 			continue
 		}
 		log.Trace("loaded", names[i])
@@ -136,8 +179,14 @@ func main() {
 
 	log.Info("files loaded")
 
-	var err error
-	dg, err = discordgo.New("Bot " + conf.Token)
+	// The image number is only saved on the next flush, so if the bot went
+	// down before that it has to be moved past the images already queued
+	if nums := imageQueue.nums(); len(nums) != 0 && nums[len(nums)-1] > conf().CurrImg {
+		updateConf(func(c *config) { c.CurrImg = nums[len(nums)-1] })
+		persist.markConfig()
+	}
+
+	dg, err = discordgo.New("Bot " + conf().Token)
 	if err != nil {
 		log.Error("Error creating Discord session,", err)
 		return
@@ -145,12 +194,16 @@ func main() {
 
 	log.Trace("session created")
 
-	dg.AddHandler(messageCreateEvent)
-	dg.AddHandler(presenceChangeEvent)
-	dg.AddHandler(guildKickedEvent)
-	dg.AddHandler(memberJoinEvent)
-	dg.AddHandler(readyEvent)
-	dg.AddHandler(guildJoinEvent)
+	dg.AddHandler(func(s *discordgo.Session, m *discordgo.MessageCreate) { messageCreateEvent(discordSession{s}, m) })
+	dg.AddHandler(func(s *discordgo.Session, m *discordgo.MessageReactionAdd) { reviewReaction(discordSession{s}, m) })
+	dg.AddHandler(func(s *discordgo.Session, m *discordgo.MessageReactionRemove) {
+		reviewReactionRemove(discordSession{s}, m)
+	})
+	dg.AddHandler(func(s *discordgo.Session, m *discordgo.PresenceUpdate) { presenceChangeEvent(discordSession{s}, m) })
+	dg.AddHandler(func(s *discordgo.Session, m *discordgo.GuildDelete) { guildKickedEvent(discordSession{s}, m) })
+	dg.AddHandler(func(s *discordgo.Session, m *discordgo.GuildMemberAdd) { memberJoinEvent(discordSession{s}, m) })
+	dg.AddHandler(func(s *discordgo.Session, m *discordgo.Ready) { readyEvent(discordSession{s}, m) })
+	dg.AddHandler(func(s *discordgo.Session, m *discordgo.GuildCreate) { guildJoinEvent(discordSession{s}, m) })
 
 	if err := dg.Open(); err != nil {
 		log.Error("Error opening connection,", err)
@@ -160,11 +213,14 @@ func main() {
 
 	log.Trace("connection opened")
 
-	sMap.Count = len(sMap.serverMap)
+	sMap.Count = sMap.len()
 
-	go setQueuedImageHandlers()
+	go reviewLoop(discordSession{dg})
+	go limiter.cleanup()
+	go commandStats.autosave()
+	go persist.autoflush()
 
-	if !conf.InDev {
+	if !conf().InDev {
 		go dailyJobs()
 	}
 
@@ -172,12 +228,18 @@ func main() {
 	router := chi.NewRouter()
 	router.Get("/image/{id:[0-9]{18}}/recall/{img:[0-9a-z]{64}}", httpImageRecall)
 	router.Get("/inServer/{id:[0-9]{18}}", isInServer)
+	router.Get("/stats/commands", statsAuth(httpCommandStats))
+	router.Get("/stats/storage", statsAuth(httpStorageStats))
+
+	go func() { log.Error("error starting http server", http.ListenAndServe(conf().ListenAddr, router)) }()
 
-	go func() { log.Error("error starting http server", http.ListenAndServe("0.0.0.0:8080", router)) }()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go reloadOnSignal(hup)
 
-	log.Info("Bot is now running. Press CTRL-C to exit.")
+	log.Info("Bot is now running. Press CTRL-C to exit, or send SIGHUP to reload.")
 
 	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGSEGV, syscall.SIGHUP)
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGSEGV)
 	<-sc
 }
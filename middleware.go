@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type execFunc func(session, *discordgo.MessageCreate, args)
+
+// middleware wraps the Exec of a command. It should call next to run the
+// rest of the chain, or skip it to stop the command running.
+type middleware func(c command, next execFunc) execFunc
+
+// Middlewares that are run for every command, outermost first
+var middlewares = []middleware{recoverMiddleware, statsMiddleware, logMiddleware, timingMiddleware, typingMiddleware}
+
+const (
+	slowCommand     = time.Second * 5
+	typingThreshold = time.Millisecond * 500
+
+	// Longest message Discord lets the bot send
+	messageLimit = 2000
+)
+
+// use registers middlewares that are run for every command
+func use(mw ...middleware) {
+	middlewares = append(middlewares, mw...)
+}
+
+// handler builds the Exec of c wrapped in the global middlewares followed
+// by the ones registered on the command itself.
+func (c command) handler() execFunc {
+	chain := append(append([]middleware{}, middlewares...), c.Middlewares...)
+
+	exec := c.Exec
+	for i := len(chain) - 1; i >= 0; i-- {
+		exec = chain[i](c, exec)
+	}
+	return exec
+}
+
+// recoverMiddleware stops a panicking command from taking the bot down with it.
+// The user is told something went wrong and the stack trace is sent to the log channel.
+func recoverMiddleware(c command, next execFunc) execFunc {
+	return func(s session, m *discordgo.MessageCreate, a args) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+
+			stack := string(debug.Stack())
+			log.Error(fmt.Sprintf("panic running %s: %v\n%s", c.FullName, r, stack))
+
+			s.ChannelMessageSend(m.ChannelID, "Something went wrong running that command :( My creator has been told about it")
+
+			// The panic value can be arbitrarily long, so it's cut down first to
+			// leave room for the code block, then the stack fills whatever is left
+			limit := messageLimit - len(codeBlock())
+			report := fmt.Sprintf("Panic in %s from %s#%s (%s): %v\n", codeSeg(c.FullName), m.Author.Username, m.Author.Discriminator, m.Author.ID, r)
+			report = truncate(report, limit)
+			s.ChannelMessageSend(conf().LogChannel, report+codeBlock(truncate(stack, limit-len(report))))
+		}()
+
+		next(s, m, a)
+	}
+}
+
+// truncate cuts s down to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// logMiddleware logs every command invocation as key=value pairs
+func logMiddleware(c command, next execFunc) execFunc {
+	return func(s session, m *discordgo.MessageCreate, a args) {
+		log.Info(fmt.Sprintf("command=%q user=%s guild=%s channel=%s args=%q",
+			c.FullName, m.Author.ID, m.GuildID, m.ChannelID, strings.Join(a.raw, " ")))
+		next(s, m, a)
+	}
+}
+
+// timingMiddleware logs how long each command took, flagging slow ones
+func timingMiddleware(c command, next execFunc) execFunc {
+	return func(s session, m *discordgo.MessageCreate, a args) {
+		start := time.Now()
+		next(s, m, a)
+
+		took := time.Since(start)
+		if took > slowCommand {
+			log.Info(fmt.Sprintf("command=%q took=%s slow=true", c.FullName, took))
+			return
+		}
+		log.Trace(fmt.Sprintf("command=%q took=%s", c.FullName, took))
+	}
+}
+
+// typingMiddleware shows the typing indicator while a command is taking a
+// while to respond. Discord clears the indicator after 10 seconds, so it's
+// sent again until the command finishes.
+func typingMiddleware(c command, next execFunc) execFunc {
+	return func(s session, m *discordgo.MessageCreate, a args) {
+		done := make(chan struct{})
+		defer close(done)
+
+		go func() {
+			timer := time.NewTimer(typingThreshold)
+			defer timer.Stop()
+
+			for {
+				select {
+				case <-done:
+					return
+				case <-timer.C:
+					s.ChannelTyping(m.ChannelID)
+					timer.Reset(time.Second * 8)
+				}
+			}
+		}()
+
+		next(s, m, a)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestRecoverMiddleware(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{name: "short panic", value: "oh no"},
+		{name: "panic longer than a message", value: strings.Repeat("x", 3000)},
+		// The "a" puts the byte limit part way through an é
+		{name: "multi-byte panic", value: "a" + strings.Repeat("é", 1500)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState()
+			f := newFakeSession()
+
+			c := newCommand("explode", 0, false, func(session, *discordgo.MessageCreate, args) {
+				panic(tt.value)
+			})
+			c.FullName = c.Name
+			c.handler()(f, f.message(testUserID, "!owo explode"), newArgs(nil))
+
+			if got := f.messages(testChannelID); len(got) != 1 || !strings.Contains(got[0], "Something went wrong") {
+				t.Errorf("expected the user to be told it failed, got %q", got)
+			}
+
+			got := f.messages(testLog)
+			if len(got) != 1 {
+				t.Fatalf("expected the panic to be reported, got %q", got)
+			}
+			if !utf8.ValidString(got[0]) {
+				t.Errorf("expected the report to be valid UTF-8, got %q", got[0][len(got[0])-20:])
+			}
+			if report := got[0]; !strings.HasPrefix(report, "Panic in `explode` from User#0001 ("+testUserID+"): "+tt.value[:min(len(tt.value), 100)]) || len(report) > messageLimit {
+				t.Errorf("expected a report of at most %d characters, got %d: %.100q", messageLimit, len(report), report)
+			}
+		})
+	}
+}
@@ -5,24 +5,19 @@ import (
 )
 
 func init() {
-	newCommand("avatar", 0, false, msgAvatar).setHelp("Args: [@user]\n\nReturns the given users avatar.\nIf no user ID is given, your own avatar is sent.\n\nExample:\n`!owo avatar @Strum355#2298`").add()
+	newCommand("avatar", 0, false, msgAvatar).setArgs(userArg("user").optional()).setHelp("Returns the given users avatar.\nIf no user is given, your own avatar is sent.").examples("avatar @Strum355#2298").allowDMs().setCategory(categoryImages).add()
 }
 
-func msgAvatar(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	if len(msglist) == 1 {
+func msgAvatar(s session, m *discordgo.MessageCreate, a args) {
+	if !a.has("user") {
 		getAvatar(m.Author.ID, m, s)
 		return
 	}
 
-	if len(m.Mentions) != 0 {
-		getAvatar(m.Mentions[0].ID, m, s)
-		return
-	}
-
-	s.ChannelMessageSend(m.ChannelID, "User not found :(")
+	getAvatar(a.str("user"), m, s)
 }
 
-func getAvatar(userID string, m *discordgo.MessageCreate, s *discordgo.Session) {
+func getAvatar(userID string, m *discordgo.MessageCreate, s session) {
 	/* 	guild, err := guildDetails(m.ChannelID, "", s)
 	   	if err != nil {
 	   		s.ChannelMessageSend(m.ChannelID, "There was an error finding the user :( Please try again")
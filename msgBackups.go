@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Files in json/ whose backups can be listed and restored
+var backupFiles = []string{"config", "servers", "users", "queue", "stats"}
+
+func init() {
+	newCommand("backups", 0, false, nil).subcommands(
+		newCommand("list", 0, false, msgListBackups).setArgs(wordArg("file").optional()).
+			setHelp("Lists the backups of every file, or only the given one. The file can be "+strings.Join(backupFiles, ", ")).
+			examples("backups list", "backups list servers"),
+		newCommand("restore", 0, false, msgRestoreBackup).setArgs(wordArg("file"), wordArg("backup")).
+			setHelp("Restores a backup from `backups list` and reloads it. The current file is backed up first.").
+			examples("backups restore servers 20171120-150405"),
+	).ownerOnly().allowDMs().setCategory(categoryOwner).add()
+
+	newCommand("flush", 0, false, msgFlush).
+		setHelp("Saves every change now instead of waiting for the next flush").
+		ownerOnly().allowDMs().setCategory(categoryOwner).add()
+}
+
+func msgListBackups(s session, m *discordgo.MessageCreate, a args) {
+	files := backupFiles
+	if a.has("file") {
+		file := strings.ToLower(a.str("file"))
+		if !isIn(file, backupFiles) {
+			s.ChannelMessageSend(m.ChannelID, "Unknown file "+codeSeg(file)+". Use one of "+strings.Join(backupFiles, ", "))
+			return
+		}
+		files = []string{file}
+	}
+
+	var fields []*discordgo.MessageEmbedField
+	for _, file := range files {
+		backups, err := listBackups(file + ".json")
+		if err != nil {
+			log.Error("error listing backups", file, err)
+			s.ChannelMessageSend(m.ChannelID, "Error listing backups :(")
+			a.fail()
+			return
+		}
+
+		var lines []string
+		for _, b := range backups {
+			lines = append(lines, fmt.Sprintf("%s %.2fKB", codeSeg(b.name()), float64(b.Size)/1000))
+		}
+		if len(lines) == 0 {
+			lines = append(lines, "None")
+		}
+
+		fields = append(fields, &discordgo.MessageEmbedField{Name: file, Value: strings.Join(lines, "\n")})
+	}
+
+	s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
+		Color:  0,
+		Title:  "Backups",
+		Fields: fields,
+	})
+}
+
+func msgRestoreBackup(s session, m *discordgo.MessageCreate, a args) {
+	file := strings.ToLower(a.str("file"))
+	switch {
+	case !isIn(file, reloadFiles):
+		s.ChannelMessageSend(m.ChannelID, "Only "+strings.Join(reloadFiles, ", ")+" can be restored")
+		return
+	case file != "config" && conf().Storage != storeJSON:
+		s.ChannelMessageSend(m.ChannelID, codeSeg(file)+" is kept in the database, not in JSON files")
+		return
+	}
+
+	path := file + ".json"
+	b, ok := findBackup(path, a.str("backup"))
+	if !ok {
+		s.ChannelMessageSend(m.ChannelID, "No backup called "+codeSeg(a.str("backup"))+" for "+codeSeg(file)+". See "+codeSeg("backups list "+file))
+		return
+	}
+
+	// So the backup of the current file has everything in it
+	if err := persist.flush(); err != nil {
+		s.ChannelMessageSend(m.ChannelID, "Error saving changes before restoring, nothing was restored")
+		a.fail()
+		return
+	}
+
+	data, err := ioutil.ReadFile(b.Path)
+	if err != nil || !json.Valid(data) {
+		log.Error("error reading backup", b.Path, err)
+		s.ChannelMessageSend(m.ChannelID, "That backup is unreadable or corrupt :(")
+		a.fail()
+		return
+	}
+
+	current, err := ioutil.ReadFile("json/" + path)
+	if err == nil {
+		if err := backupJSON(path, current, true); err != nil {
+			log.Error("error backing up before restoring", path, err)
+			s.ChannelMessageSend(m.ChannelID, "Error backing up the current file, nothing was restored")
+			a.fail()
+			return
+		}
+	}
+
+	if err := writeFileAtomic("json/"+path, data); err != nil {
+		log.Error("error restoring", b.Path, err)
+		s.ChannelMessageSend(m.ChannelID, "Error restoring the backup :(")
+		a.fail()
+		return
+	}
+
+	changes, err := reload(s, []string{file})
+	if err != nil {
+		// Put the file back the way it was, so it matches what's running
+		if current != nil {
+			writeFileAtomic("json/"+path, current)
+		}
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s\nThe backup wasn't restored", err))
+		a.fail()
+		return
+	}
+
+	msg := fmt.Sprintf("Restored %s from %s", file, codeSeg(b.name()))
+	if len(changes) == 0 {
+		s.ChannelMessageSend(m.ChannelID, msg+". Nothing changed")
+		return
+	}
+	s.ChannelMessageSend(m.ChannelID, msg+codeBlock(strings.Join(changes, "\n")))
+}
+
+func msgFlush(s session, m *discordgo.MessageCreate, a args) {
+	pending := persist.pending()
+	if err := persist.flush(); err != nil {
+		s.ChannelMessageSend(m.ChannelID, "Error saving changes, they'll be tried again on the next flush\n"+codeBlock(err.Error()))
+		a.fail()
+		return
+	}
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Saved %d changes", pending))
+}
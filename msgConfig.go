@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Largest file config import will read
+const maxConfigImport = 1 << 20
+
+func init() {
+	newCommand("config",
+		discordgo.PermissionAdministrator|discordgo.PermissionManageServer,
+		true, nil).subcommands(
+		newCommand("export", 0, false, msgConfigExport).
+			setHelp("Sends this servers prefixes, log channel, logging, NSFW, join message and playlists as a file that `config import` can load in another server"),
+		newCommand("import", 0, false, msgConfigImport).
+			setHelp("Loads a file from `config export` attached to the message. Shows what would change and asks before changing anything. "+
+				"Channels that aren't in this server are skipped").
+			examples("config import"),
+	).setHelp("Copy settings between servers.").setCategory(categoryModeration).add()
+}
+
+// guildSettings are the parts of a server that can be copied to another one
+type guildSettings struct {
+	Prefixes    prefixes          `json:"server_prefix,omitempty"`
+	LogChannel  string            `json:"log_channel"`
+	Log         bool              `json:"log_active"`
+	Nsfw        bool              `json:"nsfw"`
+	JoinMessage joinMessage       `json:"join"`
+	Playlists   map[string][]song `json:"playlists"`
+}
+
+// guildConfigFile is the file config export sends. Settings are migrated
+// like any other server record when a file from an older version is imported.
+type guildConfigFile struct {
+	SchemaVersion int           `json:"schema_version"`
+	GuildID       string        `json:"guild_id"`
+	Exported      time.Time     `json:"exported"`
+	Settings      guildSettings `json:"settings"`
+}
+
+// settingsOf copies the settings out of a guild
+func settingsOf(guild *server) guildSettings {
+	settings := guildSettings{
+		Prefixes:    append(prefixes(nil), guild.Prefixes...),
+		LogChannel:  guild.LogChannel,
+		Log:         guild.Log,
+		Nsfw:        guild.Nsfw,
+		JoinMessage: guild.JoinMessage,
+		Playlists:   make(map[string][]song, len(guild.Playlists)),
+	}
+	for name, songs := range guild.Playlists {
+		settings.Playlists[name] = append([]song{}, songs...)
+	}
+	return settings
+}
+
+// apply replaces the guilds settings, returning the playlists that were
+// added, changed or removed
+func (g guildSettings) apply(guild *server) []string {
+	var playlists []string
+	for name, songs := range guild.Playlists {
+		if next, ok := g.Playlists[name]; !ok || !sameSongs(songs, next) {
+			playlists = append(playlists, name)
+		}
+	}
+	for name := range g.Playlists {
+		if _, ok := guild.Playlists[name]; !ok {
+			playlists = append(playlists, name)
+		}
+	}
+
+	imported := settingsOf(&server{Prefixes: g.Prefixes, Playlists: g.Playlists})
+	guild.Prefixes = imported.Prefixes
+	guild.LogChannel = g.LogChannel
+	guild.Log = g.Log
+	guild.Nsfw = g.Nsfw
+	guild.JoinMessage = g.JoinMessage
+	guild.Playlists = imported.Playlists
+	// Whoever made a playlist didn't make the one that replaced it
+	for _, name := range playlists {
+		delete(guild.PlaylistCreators, name)
+	}
+	return playlists
+}
+
+// validate checks the settings could have been made with 2Bots commands
+func (g guildSettings) validate() error {
+	if len(g.Prefixes) > maxPrefixes {
+		return fmt.Errorf("it has %d prefixes, but servers can only have %d", len(g.Prefixes), maxPrefixes)
+	}
+	for _, prefix := range g.Prefixes {
+		switch {
+		case strings.TrimSpace(prefix.Text) == "":
+			return errors.New("it has an empty prefix")
+		case len(prefix.Text) > maxPrefixSize, strings.Contains(prefix.Text, "`"):
+			return fmt.Errorf("prefix %q is longer than %d characters or has backticks in it", prefix.Text, maxPrefixSize)
+		}
+	}
+
+	if g.JoinMessage.Enabled && (g.JoinMessage.Message == "" || g.JoinMessage.Channel == "") {
+		return errors.New("its join message is enabled but has no message or channel")
+	}
+
+	for name, songs := range g.Playlists {
+		if strings.TrimSpace(name) == "" {
+			return errors.New("it has a playlist with no name")
+		}
+		for i, song := range songs {
+			if song.URL == "" {
+				return fmt.Errorf("song %d in playlist %q has no URL", i, name)
+			}
+		}
+	}
+	return nil
+}
+
+// keepMissingChannels puts back the current log channel and join message
+// where the imported ones are for channels that aren't text channels in the
+// guild, returning what was skipped
+func (g *guildSettings) keepMissingChannels(guild *discordgo.Guild, current guildSettings) []string {
+	inGuild := func(id string) bool {
+		for _, channel := range guild.Channels {
+			if channel.ID == id && channel.Type == discordgo.ChannelTypeGuildText {
+				return true
+			}
+		}
+		return false
+	}
+
+	var skipped []string
+	if g.LogChannel != "" && !inGuild(g.LogChannel) {
+		skipped = append(skipped, "Log channel "+codeSeg(g.LogChannel)+" isn't in this server, keeping the current one")
+		g.LogChannel = current.LogChannel
+	}
+	if g.JoinMessage.Enabled && !inGuild(g.JoinMessage.Channel) {
+		skipped = append(skipped, "Join message channel "+codeSeg(g.JoinMessage.Channel)+" isn't in this server, keeping the current join message")
+		g.JoinMessage = current.JoinMessage
+	}
+	return skipped
+}
+
+// parseGuildConfig reads a file from config export
+func parseGuildConfig(b []byte) (guildSettings, error) {
+	var file struct {
+		SchemaVersion int             `json:"schema_version"`
+		Settings      json.RawMessage `json:"settings"`
+	}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return guildSettings{}, errors.New("it isn't valid JSON")
+	}
+	if len(file.Settings) == 0 {
+		return guildSettings{}, errors.New("it has no settings in it")
+	}
+
+	recs := map[string]json.RawMessage{"settings": file.Settings}
+	if _, err := migrateRecords(recordServer, file.SchemaVersion, recs); err != nil {
+		return guildSettings{}, err
+	}
+
+	var settings guildSettings
+	if err := json.Unmarshal(recs["settings"], &settings); err != nil {
+		return guildSettings{}, fmt.Errorf("its settings are invalid: %v", err)
+	}
+	return settings, settings.validate()
+}
+
+// diffSettings lists what changes between from and to
+func diffSettings(from, to guildSettings) []string {
+	var changes []string
+	change := func(name, from, to string) {
+		if from != to {
+			changes = append(changes, fmt.Sprintf("%s: %s → %s", name, from, to))
+		}
+	}
+
+	change("Prefixes", describePrefixes(from.Prefixes), describePrefixes(to.Prefixes))
+	change("Log channel", describeChannel(from.LogChannel), describeChannel(to.LogChannel))
+	change("Logging", onOff(from.Log), onOff(to.Log))
+	change("NSFW", onOff(from.Nsfw), onOff(to.Nsfw))
+	change("Join message", describeJoin(from.JoinMessage), describeJoin(to.JoinMessage))
+
+	var names []string
+	for name := range from.Playlists {
+		names = append(names, name)
+	}
+	for name := range to.Playlists {
+		if _, ok := from.Playlists[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		old, hadOld := from.Playlists[name]
+		next, hasNext := to.Playlists[name]
+		switch {
+		case !hasNext:
+			changes = append(changes, fmt.Sprintf("Playlist %s: removed", codeSeg(name)))
+		case !hadOld:
+			changes = append(changes, fmt.Sprintf("Playlist %s: added with %d songs", codeSeg(name), len(next)))
+		case !sameSongs(old, next):
+			changes = append(changes, fmt.Sprintf("Playlist %s: %d songs → %d songs", codeSeg(name), len(old), len(next)))
+		}
+	}
+	return changes
+}
+
+func sameSongs(a, b []song) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func describePrefixes(p prefixes) string {
+	if len(p) == 0 {
+		return "none"
+	}
+	var out []string
+	for _, prefix := range p {
+		text := codeSeg(prefix.Text)
+		if prefix.IgnoreCase {
+			text += " (any case)"
+		}
+		out = append(out, text)
+	}
+	return strings.Join(out, ", ")
+}
+
+func describeChannel(id string) string {
+	if id == "" {
+		return "none"
+	}
+	return "<#" + id + ">"
+}
+
+func describeJoin(join joinMessage) string {
+	if !join.Enabled {
+		return "off"
+	}
+	return fmt.Sprintf("%q in %s", join.Message, describeChannel(join.Channel))
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+func msgConfigExport(s session, m *discordgo.MessageCreate, a args) {
+	var file guildConfigFile
+	if !viewSettings(s, m, func(guild *discordgo.Guild, srvr *server) {
+		file = guildConfigFile{SchemaVersion: schemaVersion, GuildID: guild.ID, Exported: time.Now().UTC(), Settings: settingsOf(srvr)}
+	}) {
+		return
+	}
+
+	b, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		log.Error("error encoding config export", err)
+		s.ChannelMessageSend(m.ChannelID, "There was a problem exporting the settings :( Try again please~")
+		a.fail()
+		return
+	}
+
+	if _, err := s.ChannelFileSend(m.ChannelID, "2bot-config-"+file.GuildID+".json", bytes.NewReader(b)); err != nil {
+		log.Error("error sending config export", err)
+		a.fail()
+	}
+}
+
+func msgConfigImport(s session, m *discordgo.MessageCreate, a args) {
+	if len(m.Attachments) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "Attach a file from "+codeSeg("config export")+" to import it")
+		return
+	}
+
+	guild, ok := settingsGuild(s, m)
+	if !ok {
+		return
+	}
+
+	if m.Attachments[0].Size > maxConfigImport {
+		s.ChannelMessageSend(m.ChannelID, "That file is too big to be from "+codeSeg("config export"))
+		return
+	}
+
+	resp, err := http.Get(m.Attachments[0].URL)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Error("error downloading config import", err)
+		s.ChannelMessageSend(m.ChannelID, "Error downloading the file :( Try again please~")
+		a.fail()
+		return
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxConfigImport+1))
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, "Error downloading the file :( Try again please~")
+		a.fail()
+		return
+	}
+	if len(b) > maxConfigImport {
+		s.ChannelMessageSend(m.ChannelID, "That file is too big to be from "+codeSeg("config export"))
+		return
+	}
+
+	settings, err := parseGuildConfig(b)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, "That file can't be imported, "+err.Error())
+		return
+	}
+
+	var current guildSettings
+	if !viewSettings(s, m, func(_ *discordgo.Guild, srvr *server) { current = settingsOf(srvr) }) {
+		return
+	}
+
+	skipped := settings.keepMissingChannels(guild, current)
+	changes := diffSettings(current, settings)
+
+	var msg string
+	if len(skipped) != 0 {
+		msg = strings.Join(skipped, "\n") + "\n\n"
+	}
+	if len(changes) == 0 {
+		s.ChannelMessageSend(m.ChannelID, msg+"Nothing would change, so nothing was imported")
+		return
+	}
+
+	s.ChannelMessageSend(m.ChannelID, msg+"Importing would change:\n"+strings.Join(changes, "\n")+
+		"\n\nReply `yes` to import it, or anything else to cancel")
+
+	if !confirmReply(s, m) {
+		s.ChannelMessageSend(m.ChannelID, "Import cancelled, nothing was changed")
+		return
+	}
+
+	var playlists []string
+	ok = sMap.update(guild.ID, func(srvr *server) { playlists = settings.apply(srvr) })
+	if !ok {
+		return
+	}
+
+	persist.markServer(guild.ID)
+	for _, name := range playlists {
+		persist.markPlaylist(guild.ID, name)
+	}
+
+	s.ChannelMessageSend(m.ChannelID, "Settings imported :ok_hand:")
+}
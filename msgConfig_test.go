@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestParseGuildConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    joinMessage
+		wantErr string
+	}{
+		{"current", `{"schema_version": 1, "settings": {"join": {"enabled": true, "message": "Hi", "channel": "1"}}}`, joinMessage{Enabled: true, Message: "Hi", Channel: "1"}, ""},
+		{"before versions", `{"settings": {"join": ["true", "Hi", "1"]}}`, joinMessage{Enabled: true, Message: "Hi", Channel: "1"}, ""},
+		{"not JSON", `server_prefix: "!"`, joinMessage{}, "isn't valid JSON"},
+		{"no settings", `{"schema_version": 1}`, joinMessage{}, "no settings"},
+		{"newer", `{"schema_version": 99, "settings": {}}`, joinMessage{}, "schema version 99"},
+		{"too many prefixes", `{"schema_version": 1, "settings": {"server_prefix": [` + strings.Repeat(`{"text": "!"},`, maxPrefixes) + `{"text": "?"}]}}`, joinMessage{}, "prefixes"},
+		{"backtick prefix", `{"schema_version": 1, "settings": {"server_prefix": [{"text": "!` + "`" + `"}]}}`, joinMessage{}, "backticks"},
+		{"join without channel", `{"schema_version": 1, "settings": {"join": {"enabled": true, "message": "Hi"}}}`, joinMessage{}, "no message or channel"},
+		{"song without URL", `{"schema_version": 1, "settings": {"playlists": {"chill": [{"name": "one"}]}}}`, joinMessage{}, "no URL"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings, err := parseGuildConfig([]byte(tt.file))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if settings.JoinMessage != tt.want {
+				t.Errorf("expected join message %+v, got %+v", tt.want, settings.JoinMessage)
+			}
+		})
+	}
+}
+
+func TestDiffSettings(t *testing.T) {
+	from := guildSettings{
+		Prefixes:   prefixes{{Text: "!"}},
+		LogChannel: testChannelID,
+		Playlists: map[string][]song{
+			"chill": {{URL: "https://youtu.be/1"}},
+			"old":   {},
+		},
+	}
+	to := guildSettings{
+		Prefixes:    prefixes{{Text: "?", IgnoreCase: true}},
+		LogChannel:  testChannelID,
+		Nsfw:        true,
+		JoinMessage: joinMessage{Enabled: true, Message: "Hi %s", Channel: testOtherChan},
+		Playlists: map[string][]song{
+			"chill": {{URL: "https://youtu.be/1"}, {URL: "https://youtu.be/2"}},
+			"new":   {{URL: "https://youtu.be/3"}},
+		},
+	}
+
+	want := []string{
+		"Prefixes: `!` → `?` (any case)",
+		"NSFW: off → on",
+		`Join message: off → "Hi %s" in <#` + testOtherChan + ">",
+		"Playlist `chill`: 1 songs → 2 songs",
+		"Playlist `new`: added with 1 songs",
+		"Playlist `old`: removed",
+	}
+	if got := diffSettings(from, to); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+
+	if got := diffSettings(from, settingsOf(&server{Prefixes: from.Prefixes, LogChannel: from.LogChannel, Playlists: from.Playlists})); len(got) != 0 {
+		t.Errorf("expected no changes between a guild and a copy of it, got %q", got)
+	}
+}
+
+// configFileServer serves the last file the fake session sent
+func configFileServer(f *fakeSession) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		w.Write(f.files[strings.TrimPrefix(r.URL.Path, "/")])
+	}))
+}
+
+func TestConfigExportImport(t *testing.T) {
+	resetState()
+	f := newFakeSession()
+	srv := configFileServer(f)
+	defer srv.Close()
+
+	exported := server{
+		Prefixes:    prefixes{{Text: "?"}},
+		LogChannel:  testOtherChan,
+		Log:         true,
+		Nsfw:        true,
+		JoinMessage: joinMessage{Enabled: true, Message: "Hi %s", Channel: testOtherChan},
+		Playlists: map[string][]song{
+			"chill": {{URL: "https://youtu.be/1", Name: "one"}},
+			"rock":  {{URL: "https://youtu.be/2", Name: "two"}},
+		},
+	}
+	sMap.setServer(testGuildID, exported)
+
+	f.run(testOwnerID, "config export")
+	name := "2bot-config-" + testGuildID + ".json"
+	if _, ok := f.files[name]; !ok {
+		t.Fatalf("expected %s to be sent, got %q", name, f.messages(testChannelID))
+	}
+
+	importFile := func(user, reply string) []string {
+		m := f.message(user, "config import")
+		m.Attachments = append(m.Attachments, &discordgo.MessageAttachment{URL: srv.URL + "/" + name, Size: len(f.files[name])})
+
+		done := make(chan struct{})
+		go func() {
+			f.runMessage(m)
+			close(done)
+		}()
+		if reply != "" {
+			f.waitHandler(t)
+			f.emit(t, f.message(user, reply))
+		}
+		<-done
+		return f.messages(testChannelID)
+	}
+
+	// Nothing to do when importing into the same settings
+	msgs := importFile(testOwnerID, "")
+	if got := msgs[len(msgs)-1]; !strings.Contains(got, "Nothing would change") {
+		t.Errorf("expected nothing to change, got %q", got)
+	}
+
+	sMap.setServer(testGuildID, server{
+		LogChannel: testChannelID,
+		Playlists: map[string][]song{
+			"old":   {},
+			"chill": {{URL: "https://youtu.be/3", Name: "three"}},
+			"rock":  exported.Playlists["rock"],
+		},
+		PlaylistCreators: map[string]string{"old": testUserID, "chill": testUserID, "rock": testOwnerID},
+	})
+	persist.reset()
+
+	msgs = importFile(testOwnerID, "no")
+	if got := msgs[len(msgs)-2]; !strings.Contains(got, "Importing would change:") || !strings.Contains(got, "Playlist `old`: removed") {
+		t.Errorf("expected a diff, got %q", got)
+	}
+	if got := msgs[len(msgs)-1]; !strings.Contains(got, "cancelled") {
+		t.Errorf("expected the import to be cancelled, got %q", got)
+	}
+	if guild := testGuild(); guild.Nsfw || persist.pending() != 0 {
+		t.Error("expected nothing to change when the import is cancelled")
+	}
+
+	importFile(testOwnerID, "yes")
+	if got := settingsOf(testGuild()); len(diffSettings(settingsOf(&exported), got)) != 0 {
+		t.Errorf("expected the exported settings to be imported, got %+v", got)
+	}
+	// The guild and both the replaced and removed playlists
+	if got := persist.pending(); got != 3 {
+		t.Errorf("expected 3 changes to be saved, got %d", got)
+	}
+	if got := testGuild().PlaylistCreators; len(got) != 1 || got["rock"] != testOwnerID {
+		t.Errorf("expected only the unchanged playlist to keep its creator, got %v", got)
+	}
+
+	// Only admins can import
+	before := len(f.messages(testChannelID))
+	f.run(testUserID, "config import")
+	if guild := testGuild(); !guild.Nsfw || len(f.messages(testChannelID)) == before {
+		t.Error("expected a user without permissions to be refused")
+	}
+}
+
+func TestConfigImportSkipsMissingChannels(t *testing.T) {
+	resetState()
+	f := newFakeSession()
+
+	guild, _ := f.st.Guild(testGuildID)
+	current := guildSettings{LogChannel: testChannelID, JoinMessage: joinMessage{Enabled: true, Message: "Hi", Channel: testChannelID}}
+
+	settings := guildSettings{
+		LogChannel:  "123456789012345678",
+		JoinMessage: joinMessage{Enabled: true, Message: "Welcome", Channel: "123456789012345678"},
+		Nsfw:        true,
+	}
+	skipped := settings.keepMissingChannels(guild, current)
+	if len(skipped) != 2 {
+		t.Errorf("expected both channels to be skipped, got %q", skipped)
+	}
+	if settings.LogChannel != testChannelID || settings.JoinMessage != current.JoinMessage || !settings.Nsfw {
+		t.Errorf("expected the current channels to be kept and the rest imported, got %+v", settings)
+	}
+
+	settings = guildSettings{LogChannel: testOtherChan, JoinMessage: joinMessage{Enabled: true, Message: "Welcome", Channel: testOtherChan}}
+	if skipped := settings.keepMissingChannels(guild, current); len(skipped) != 0 || settings.LogChannel != testOtherChan {
+		t.Errorf("expected channels in the guild to be imported, got %q %+v", skipped, settings)
+	}
+}
@@ -16,8 +16,8 @@ var (
 )
 
 func init() {
-	newCommand("bigMoji", 0, false, msgEmoji).setHelp("Args: [emoji]\n\nSends a large image of the given emoji.\n" +
-		"Command 'bigMoji' can be excluded for shorthand.\n\nExample:\n`!owo :smile:`\nor\n`!owo bigMoji :smile:`").add()
+	newCommand("bigMoji", 0, false, msgEmoji).setArgs(wordArg("emoji")).setHelp("Sends a large image of the given emoji.\n"+
+		"Command 'bigMoji' can be excluded for shorthand.").examples(":smile:", "bigMoji :smile:").allowDMs().setCategory(categoryImages).add()
 }
 
 // Thanks to iopred
@@ -40,7 +40,12 @@ func emojiFile(s string) string {
 	return found
 }
 
-func sendEmojiFromFile(s *discordgo.Session, m *discordgo.MessageCreate, e string) (file io.ReadCloser, err error) {
+// isEmoji returns whether word is a custom emoji or one we have an image for
+func isEmoji(word string) bool {
+	return emojiRegex.MatchString(word) || emojiFile(word) != ""
+}
+
+func sendEmojiFromFile(s session, m *discordgo.MessageCreate, e string) (file io.ReadCloser, err error) {
 	emoji := emojiFile(e)
 	if emoji == "" {
 		return nil, errNotEmoji
@@ -49,7 +54,8 @@ func sendEmojiFromFile(s *discordgo.Session, m *discordgo.MessageCreate, e strin
 	return os.Open(fmt.Sprintf("emoji/%s.png", emoji))
 }
 
-func msgEmoji(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
+func msgEmoji(s session, m *discordgo.MessageCreate, a args) {
+	msglist := a.raw
 	if len(msglist) < 1 {
 		return
 	}
@@ -108,6 +114,7 @@ errored:
 			return
 		}
 		s.ChannelMessageSend(m.ChannelID, "There was an error getting the emoji :(")
+		a.fail()
 		return
 	}
 
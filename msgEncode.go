@@ -6,22 +6,20 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"strings"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"golang.org/x/crypto/bcrypt"
 )
 
 func init() {
-	newCommand("encode", 0, false, msgEncode).setHelp("Args: [base] [text]\n\nBases: `base64`, `bcrypt`, `md5`, `sh256`\nEncodes the given text in the given base.\n\nExample:\n`!owo encode md5 some text`").add()
+	newCommand("encode", 0, false, msgEncode).setArgs(wordArg("base"), greedyArg("text")).
+		cooldown(cooldownUser, 3, time.Second*30).cooldown(cooldownGuild, 10, time.Minute).setHelp("Encodes the given text in the given base.\nBases: `base64`, `bcrypt`, `md5`, `sh256`").examples("encode md5 some text").allowDMs().setCategory(categoryUtility).add()
 }
 
-func msgEncode(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	if len(msglist) < 3 {
-		return
-	}
-
-	base := strings.ToLower(msglist[1])
-	text := strings.Join(msglist[2:], " ")
+func msgEncode(s session, m *discordgo.MessageCreate, a args) {
+	base := strings.ToLower(a.str("base"))
+	text := a.str("text")
 	var output []byte
 
 	s.ChannelTyping(m.ChannelID)
@@ -33,6 +31,7 @@ func msgEncode(s *discordgo.Session, m *discordgo.MessageCreate, msglist []strin
 		var err error
 		if output, err = bcrypt.GenerateFromPassword([]byte(text), 14); err != nil {
 			log.Error("bcrypt err", err)
+			a.fail()
 			return
 		}
 	case "md5":
@@ -17,16 +17,11 @@ type ibStruct struct {
 }
 
 func init() {
-	newCommand("ibsearch", 0, false, msgIbsearch).setHelp("Args: [search] | rating=[e,s,q] | format=[gif,png,jpg]\n\n" +
-		"Returns a random image from ibsearch for the given search term with the given filters applied.\n\n" +
-		"Example:\n`!owo ibsearch lewds | rating=e | format=gif`")
+	newCommand("ibsearch", 0, false, msgIbsearch).setArgs(greedyArg("search")).setHelp("Returns a random image from ibsearch for the given search term with the given filters applied.\n" +
+		"Filters: `rating=[e,s,q]`, `format=[gif,png,jpg]`, separated by `|`").examples("ibsearch lewds | rating=e | format=gif").setCategory(categoryNSFW)
 }
 
-func msgIbsearch(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	if len(msglist) < 2 {
-		return
-	}
-
+func msgIbsearch(s session, m *discordgo.MessageCreate, a args) {
 	channel, err := channelDetails(m.ChannelID, s)
 	if err != nil {
 		return
@@ -37,7 +32,8 @@ func msgIbsearch(s *discordgo.Session, m *discordgo.MessageCreate, msglist []str
 		return
 	}
 
-	if val, ok := sMap.server(guild.ID); ok && !val.Nsfw && !strings.Contains(channel.Name, "nsfw") && !channel.NSFW {
+	var nsfw bool
+	if sMap.view(guild.ID, func(val *server) { nsfw = val.Nsfw }) && !nsfw && !strings.Contains(channel.Name, "nsfw") && !channel.NSFW {
 		s.ChannelMessageSend(m.ChannelID, "NSFW is disabled on this server~")
 		return
 	}
@@ -47,12 +43,13 @@ func msgIbsearch(s *discordgo.Session, m *discordgo.MessageCreate, msglist []str
 	URL, err := url.Parse("https://ibsearch.xxx")
 	if err != nil {
 		log.Error("IBSearch query error", err)
+		a.fail()
 		return
 	}
 
 	var queries []string
 
-	queryList := strings.Split(strings.Join(remove(msglist, 0), " "), "|")
+	queryList := strings.Split(a.str("search"), "|")
 
 	for i, item := range queryList {
 		if strings.Contains(item, "=") {
@@ -88,12 +85,14 @@ func msgIbsearch(s *discordgo.Session, m *discordgo.MessageCreate, msglist []str
 	if err != nil {
 		log.Error("Ibsearch http error", err)
 		s.ChannelMessageSend(m.ChannelID, "Error getting results from ibsearch")
+		a.fail()
 		return
 	}
 	defer page.Body.Close()
 
 	if page.StatusCode != http.StatusOK {
 		s.ChannelMessageSend(m.ChannelID, "IBSearch didn't respond :(")
+		a.fail()
 		return
 	}
 
@@ -101,6 +100,7 @@ func msgIbsearch(s *discordgo.Session, m *discordgo.MessageCreate, msglist []str
 	if err := json.NewDecoder(page.Body).Decode(&ibsearchStruct); err != nil {
 		log.Error("IBSearch json unmarshal err", err)
 		s.ChannelMessageSend(m.ChannelID, "No results ¯\\_(ツ)_/¯")
+		a.fail()
 		return
 	}
 
@@ -2,61 +2,33 @@ package main
 
 import (
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/Necroforger/dgwidgets"
 	"github.com/bwmarrin/discordgo"
 	"github.com/go-chi/chi"
 
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"net/url"
 	"path"
-	"strconv"
 	"time"
 
 	"golang.org/x/crypto/blake2b"
 )
 
-var imageQueue = make(map[string]*queuedImage)
-
 func init() {
-	newCommand("image", 0, false, msgImageRecall).setHelp("Args: [save,recall,delete,list,status] [name]\n\nSave images and recall them at anytime! Everyone gets 8MB of image storage. Any name counts so long theres no `/` in it." +
-		"Only you can 'recall' your saved images. There's a review process to make sure nothing illegal is being uploaded but we're fairly relaxed for the most part\n\n" +
-		"Example:\n`!owo image save 2B Happy`\n2Bot downloads the image and sends it off for reviewing\n\n" +
-		"`!owo image recall 2B Happy`\nIf your image was confirmed, 2Bot will send the image named `2B Happy`\n\n" +
-		"`!owo image delete 2B Happy`\nThis will delete the image you saved called `2B Happy`\n\n" +
-		"`!owo image list`\nThis will list your saved images along with a preview!\n\n" +
-		"`!owo image status`\nShows some details on your saved images and quota").add()
-}
-
-func msgImageRecall(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	if len(msglist) < 2 {
-		prefix, err := activePrefix(m.ChannelID, s)
-		if err != nil {
-			return
-		}
-
-		s.ChannelMessageSend(m.ChannelID,
-			"Available sub-commands for `image`:\n`save`, `delete`, `recall`, `list`, `status`\n"+
-				"Type `"+prefix+"help image` to see more info about this command")
-		return
-	}
-
-	switch msglist[1] {
-	case "recall":
-		fimageRecall(s, m, msglist[2:])
-	case "save":
-		fimageSave(s, m, msglist[2:])
-	case "delete":
-		fimageDelete(s, m, msglist[2:])
-	case "list":
-		fimageList(s, m, nil)
-	case "status":
-		fimageInfo(s, m, nil)
-	}
+	newCommand("image", 0, false, nil).subcommands(
+		newCommand("save", 0, false, fimageSave).setArgs(greedyArg("name")).cooldown(cooldownUser, 3, time.Minute*5).setHelp("Sends the attached image off for review and saves it under the given name once confirmed"),
+		newCommand("recall", 0, false, fimageRecall).setArgs(greedyArg("name")).setHelp("Sends your saved image with the given name"),
+		newCommand("delete", 0, false, fimageDelete).setArgs(greedyArg("name")).setHelp("Deletes your saved image with the given name"),
+		newCommand("list", 0, false, fimageList).setHelp("Lists your saved images along with a preview"),
+		newCommand("status", 0, false, fimageInfo).setHelp("Shows some details on your saved images and quota"),
+	).setHelp("Save images and recall them at anytime! Everyone gets 8MB of image storage. Any name counts so long theres no `/` in it. "+
+		"Only you can 'recall' your saved images. There's a review process to make sure nothing illegal is being uploaded but we're fairly relaxed for the most part").
+		examples("image save 2B Happy", "image recall 2B Happy", "image delete 2B Happy", "image list", "image status").allowDMs().setCategory(categoryImages).add()
 }
 
 func httpImageRecall(w http.ResponseWriter, r *http.Request) {
@@ -68,12 +40,12 @@ func httpImageRecall(w http.ResponseWriter, r *http.Request) {
 
 	log.Info(fmt.Sprintf("image request from %s for %s", id, img))
 
-	if val, ok := u[id]; ok {
+	if val, ok := u.get(id); ok {
 		for _, val := range val.Images {
 			if strings.HasPrefix(val, img) {
 				w.WriteHeader(http.StatusOK)
 				log.Trace(fmt.Sprintf("user %s has image %s", id, img))
-				fmt.Fprint(w, conf.URL+val)
+				fmt.Fprint(w, imgStore.URL(val))
 				return
 			}
 		}
@@ -86,10 +58,12 @@ func httpImageRecall(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 }
 
-func fimageRecall(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
+func fimageRecall(s session, m *discordgo.MessageCreate, a args) {
+	imgName := a.str("name")
+
 	var filename string
-	if val, ok := u[m.Author.ID]; ok {
-		if val, ok := val.Images[strings.Join(msglist, " ")]; ok {
+	if val, ok := u.get(m.Author.ID); ok {
+		if val, ok := val.Images[imgName]; ok {
 			filename = val
 		} else {
 			s.ChannelMessageSend(m.ChannelID, "You dont have an image under that name saved with me <:2BThink:333694872802426880>")
@@ -100,94 +74,93 @@ func fimageRecall(s *discordgo.Session, m *discordgo.MessageCreate, msglist []st
 		return
 	}
 
-	imgURL := conf.URL + url.PathEscape(filename)
-
-	resp, err := http.Head(imgURL)
-	if err != nil {
-		log.Error("error recalling image", err)
-		s.ChannelMessageSend(m.ChannelID, "Error getting the image :( Please pester my creator about this")
-		return
-	} else if resp.StatusCode != http.StatusOK {
-		log.Error("non 200 status code " + imgURL)
+	if _, err := imgStore.Stat(filename); err != nil {
+		log.Error("error recalling image", filename, err)
 		s.ChannelMessageSend(m.ChannelID, "Error getting the image :( Please pester my creator about this")
+		a.fail()
 		return
 	}
 
 	s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
-		Description: strings.Join(msglist, " "),
+		Description: imgName,
 
 		Color: 0x000000,
 
 		Image: &discordgo.MessageEmbedImage{
-			URL: imgURL,
+			URL: imgStore.URL(filename),
 		},
 	})
 
 	return
 }
 
-func fimageSave(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	conf.CurrImg++
-	saveConfig()
+// savedImageName is the key an image is kept under once it's confirmed, and
+// under tempImageKey while it's queued
+func savedImageName(authorID, name, url string) string {
+	hash := blake2b.Sum256([]byte(authorID + "_" + name))
+	return hex.EncodeToString(hash[:]) + strings.ToLower(path.Ext(url))
+}
+
+// nextImageNumber hands out the number for a new image and saves it
+func nextImageNumber() int {
+	next := updateConf(func(c *config) { c.CurrImg++ })
+	persist.markConfig()
+	return next.CurrImg
+}
 
-	currentImageNumber := conf.CurrImg
+func fimageSave(s session, m *discordgo.MessageCreate, a args) {
+	currentImageNumber := nextImageNumber()
 
 	if len(m.Attachments) == 0 {
 		s.ChannelMessageSend(m.ChannelID, "No image sent. Please send me an image to save for you!")
 		return
 	}
 
-	if len(msglist) < 1 {
-		s.ChannelMessageSend(m.ChannelID, "Gotta name your image!")
-		return
-	}
-
 	if m.Attachments[0].Height == 0 {
 		s.ChannelMessageSend(m.ChannelID, "Either your image is corrupted or you didn't send me an image <:2BThink:333694872802426880> I can only save images for you~")
 		return
 	}
 
-	imgName := strings.Join(msglist, " ")
-	prefixedImgName := m.Author.ID + "_" + imgName
-
-	fileExtension := strings.ToLower(path.Ext(m.Attachments[0].URL))
-	hash := blake2b.Sum256([]byte(prefixedImgName))
-	imgFileName := hex.EncodeToString(hash[:]) + fileExtension
-
-	currUser, ok := u[m.Author.ID]
-	if !ok {
-		u[m.Author.ID] = &user{
-			Images:     map[string]string{},
-			TempImages: []string{},
-			DiskQuota:  8000000,
-			QueueSize:  0,
-		}
-		currUser = u[m.Author.ID]
-	}
-
-	_, ok = currUser.Images[imgName]
-	//if named image is in queue or already saved, abort
-	if isIn(imgName, currUser.TempImages) || ok {
-		s.ChannelMessageSend(m.ChannelID, "You've already saved an image under that name! Delete it first~")
-		return
-	}
+	imgName := a.str("name")
+	imgFileName := savedImageName(m.Author.ID, imgName, m.Attachments[0].URL)
 
 	fileSize := m.Attachments[0].Size
 
-	//if the image + current used space > quota
-	if fileSize+currUser.CurrDiskUsed > currUser.DiskQuota {
-		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("The image file size is too big by %.2fMB :(",
-			float32(fileSize+currUser.CurrDiskUsed-currUser.DiskQuota)/1000/1000))
+	// The name and space are reserved straight away, so that saving two
+	// images at once can't go over the quota
+	var refusal string
+	u.upsert(m.Author.ID, func(currUser *user) {
+		_, ok := currUser.Images[imgName]
+		switch {
+		//if named image is in queue or already saved, abort
+		case isIn(imgName, currUser.TempImages) || ok:
+			refusal = "You've already saved an image under that name! Delete it first~"
+		//if the image + current used space > quota
+		case fileSize+currUser.CurrDiskUsed > currUser.DiskQuota:
+			refusal = fmt.Sprintf("The image file size is too big by %.2fMB :(",
+				float32(fileSize+currUser.CurrDiskUsed-currUser.DiskQuota)/1000/1000)
+		//if when the image is added to the queue, the queue size + current used space > quota
+		case fileSize+currUser.QueueSize+currUser.CurrDiskUsed > currUser.DiskQuota:
+			refusal = fmt.Sprintf("The image file size is too big by %.2fMB :(\n"+
+				"Note, this only takes your queued (aka unconfirmed) images into account, so if one of them gets rejected, you can try adding this image again!",
+				float32(fileSize+currUser.QueueSize+currUser.CurrDiskUsed-currUser.DiskQuota)/1000/1000)
+		default:
+			currUser.TempImages = append(currUser.TempImages, imgName)
+			currUser.QueueSize += fileSize
+		}
+	})
+	if refusal != "" {
+		s.ChannelMessageSend(m.ChannelID, refusal)
 		return
 	}
 
-	//if when the image is added to the queue, the queue size + current used space > quota
-	if fileSize+currUser.QueueSize+currUser.CurrDiskUsed > currUser.DiskQuota {
-		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("The image file size is too big by %.2fMB :(\n"+
-			"Note, this only takes your queued (aka unconfirmed) images into account, so if one of them gets rejected, you can try adding this image again!",
-			float32(fileSize+currUser.QueueSize+currUser.CurrDiskUsed-currUser.DiskQuota)/1000/1000))
-		return
-	}
+	// Give the reservation back if the image doesn't make it into the queue
+	queued := false
+	defer func() {
+		if !queued {
+			u.update(m.Author.ID, func(currUser *user) { currUser.unqueue(imgName, fileSize) })
+		}
+	}()
 
 	dlMsg, _ := s.ChannelMessageSend(m.ChannelID, "<:update:264184209617321984> Downloading your image~")
 
@@ -195,37 +168,35 @@ func fimageSave(s *discordgo.Session, m *discordgo.MessageCreate, msglist []stri
 	if err != nil || resp.StatusCode != http.StatusOK {
 		s.ChannelMessageSend(m.ChannelID, "Error downloading the image :( Please pester creator about this")
 		log.Error("error downloading image ", err)
+		a.fail()
 		return
 	}
 	defer resp.Body.Close()
 
-	guild, err := guildDetails(m.ChannelID, "", s)
-	if err != nil {
-		guild = &discordgo.Guild{
-			Name: "error",
-			ID:   "error",
-		}
+	guild := &discordgo.Guild{
+		Name: "DM",
+		ID:   "none",
 	}
-
-	tempFilepath := "images/temp/" + imgFileName
-
-	//create temp file in temp path
-	tempFile, err := os.Create(tempFilepath)
-	if err != nil {
-		log.Error("error creating temp file", err)
-		s.ChannelMessageSend(m.ChannelID, "There was an error saving the image :( Please pester my creator about this")
-		return
+	if m.GuildID != "" {
+		if guild, err = guildDetails(m.ChannelID, m.GuildID, s); err != nil {
+			guild = &discordgo.Guild{
+				Name: "error",
+				ID:   "error",
+			}
+		}
 	}
-	defer tempFile.Close()
 
 	bodyImg, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.Error("error parsing body", err)
+		a.fail()
 		return
 	}
 
-	if _, err = tempFile.Write(bodyImg); err != nil {
-		log.Error("error writing image to file", err)
+	if err := imgStore.Put(tempImageKey(imgFileName), bodyImg); err != nil {
+		log.Error("error saving temp image", err)
+		s.ChannelMessageSend(m.ChannelID, "There was an error saving the image :( Please pester my creator about this")
+		a.fail()
 		return
 	}
 
@@ -237,7 +208,7 @@ func fimageSave(s *discordgo.Session, m *discordgo.MessageCreate, msglist []stri
 		deleteMessage(dlMsg, s)
 	}
 
-	reviewMsg, _ := s.ChannelMessageSendEmbed(reviewChan, &discordgo.MessageEmbed{
+	reviewMsg, _ := s.ChannelMessageSendEmbed(conf().ReviewChannel, &discordgo.MessageEmbed{
 		Description: fmt.Sprintf("Image ID: %d\nNew image from:\n`%s#%s` ID: %s\nfrom server `%s` `%s`\nnamed `%s`",
 			currentImageNumber,
 			m.Author.Username,
@@ -254,21 +225,8 @@ func fimageSave(s *discordgo.Session, m *discordgo.MessageCreate, msglist []stri
 		},
 	})
 
-	err = s.MessageReactionAdd(reviewMsg.ChannelID, reviewMsg.ID, "✅")
-	if err != nil {
-		s.ChannelMessageSend(reviewChan, "Couldn't add ✅ to message")
-		log.Error("error attaching reaction", err)
-	}
-	err = s.MessageReactionAdd(reviewMsg.ChannelID, reviewMsg.ID, "❌")
-	if err != nil {
-		s.ChannelMessageSend(reviewChan, "Couldn't add ❌ to message")
-		log.Error("error attaching reaction", err)
-	}
-
-	currUser.TempImages = append(currUser.TempImages, imgName)
-	currUser.QueueSize += fileSize
-
-	imageQueue[strconv.Itoa(currentImageNumber)] = &queuedImage{
+	queued = true
+	imageQueue.add(currentImageNumber, &queuedImage{
 		ReviewMsgID:   reviewMsg.ID,
 		AuthorID:      m.Author.ID,
 		AuthorDiscrim: m.Author.Discriminator,
@@ -276,153 +234,35 @@ func fimageSave(s *discordgo.Session, m *discordgo.MessageCreate, msglist []stri
 		ImageName:     imgName,
 		ImageURL:      m.Attachments[0].ProxyURL,
 		FileSize:      fileSize,
-	}
-
-	saveQueue()
-	saveUsers()
-
-	fimageReview(s, currentImageNumber)
-}
-
-func fimageReview(s *discordgo.Session, currentImageNumber int) {
-	imgInQueue := imageQueue[strconv.Itoa(currentImageNumber)]
-
-	fileSize := imgInQueue.FileSize
-	prefixedImgName := imgInQueue.AuthorID + "_" + imgInQueue.ImageName
-
-	fileExtension := strings.ToLower(path.Ext(imgInQueue.ImageURL))
-	hash := blake2b.Sum256([]byte(prefixedImgName))
-	imgFileName := hex.EncodeToString(hash[:]) + fileExtension
-	tempFilepath := "images/temp/" + imgFileName
-	currUser := u[imgInQueue.AuthorID]
-
-	//Wait here for a relevant reaction to the confirmation message
-	for {
-		confirm := <-nextReactionAdd(s)
-		if confirm.UserID == s.State.User.ID || confirm.MessageID != imgInQueue.ReviewMsgID {
-			continue
-		}
-
-		user, err := userDetails(confirm.UserID, s)
-		if err != nil {
-			s.ChannelMessageSend(reviewChan, "Error getting user for image confirming")
-			continue
-		}
+		Hash:          fmt.Sprintf("%x", sha256.Sum256(bodyImg)),
+		State:         reviewPending,
+		Queued:        time.Now().UTC(),
+	})
 
-		if confirm.MessageReaction.Emoji.Name == "✅" {
-			//IF CONFIRMED
-			s.ChannelMessageSend(reviewChan, fmt.Sprintf("%s confirmed image `%s` from `%s#%s` ID: `%s`",
-				func() string {
-					if user != nil {
-						return user.Username
-					}
-					return confirm.UserID
-				}(),
-				imgInQueue.ImageName,
-				imgInQueue.AuthorName,
-				imgInQueue.AuthorDiscrim,
-				imgInQueue.AuthorID))
-
-			break
-		} else if confirm.MessageReaction.Emoji.Name == "❌" {
-			//IF REJECTED
-			s.ChannelMessageSend(reviewChan, fmt.Sprintf("%s rejected image `%s` from `%s#%s` ID: `%s`\nGive a reason next! Enter `None` to give no reason",
-				func() string {
-					if user != nil {
-						return user.Username
-					}
-					return confirm.UserID
-				}(),
-				imgInQueue.ImageName,
-				imgInQueue.AuthorName,
-				imgInQueue.AuthorDiscrim,
-				imgInQueue.AuthorID))
-
-			var reason string
-			for {
-				rejectMsg := <-nextMessageCreate(s)
-				if rejectMsg.Author.ID == confirm.UserID {
-					rejectMsgList := strings.Fields(rejectMsg.Content)
-					if len(rejectMsgList) < 1 || rejectMsgList[0] != strconv.Itoa(currentImageNumber) {
-						continue
-					}
-
-					if strings.Join(rejectMsgList[1:], " ") != "None" {
-						reason = "Reason: " + strings.Join(rejectMsgList[1:], " ")
-					}
-
-					currUser.TempImages = remove(currUser.TempImages, findIndex(currUser.TempImages, imgInQueue.ImageName))
-					currUser.QueueSize -= fileSize
-					delete(imageQueue, strconv.Itoa(currentImageNumber))
-
-					saveUsers()
-					saveQueue()
-
-					if err := os.Remove(tempFilepath); err != nil {
-						log.Error("error deleting temp image", err)
-						s.ChannelMessageSend(reviewChan, "Error deleting temp image")
-					}
-
-					//Make PM channel to inform user that image was rejected
-					channel, err := s.UserChannelCreate(imgInQueue.AuthorID)
-					//Couldnt make PM channel
-					if err != nil {
-						s.ChannelMessageSend(reviewChan, fmt.Sprintf("Couldn't inform %s#%s ID: %s about rejection\n%s", imgInQueue.AuthorName, imgInQueue.AuthorDiscrim, imgInQueue.AuthorID, err))
-						return
-					}
-
-					//Try PMing
-					if _, err = s.ChannelMessageSend(channel.ID, "Your image got rejected :( Sorry\n"+reason); err != nil {
-						s.ChannelMessageSend(reviewChan, fmt.Sprintf("Couldn't inform %s#%s ID: %s about rejection\n%s", imgInQueue.AuthorName, imgInQueue.AuthorDiscrim, imgInQueue.AuthorID, err))
-					}
-
-					s.ChannelMessageSend(reviewChan, fmt.Sprintf("Reason for image `%s` from `%s#%s` ID: `%s`\n%s",
-						imgInQueue.ImageName,
-						imgInQueue.AuthorName,
-						imgInQueue.AuthorDiscrim,
-						imgInQueue.AuthorID,
-						reason))
-					return
-				}
-			}
-		}
-	}
+	// The image is in temp storage now, so its record can't wait
+	persist.markQueued(currentImageNumber)
+	persist.markUser(m.Author.ID)
+	persist.flush()
 
-	//If image has been reviewed and confirmed
-	channel, err := s.UserChannelCreate(imgInQueue.AuthorID)
+	// Only once it's queued, so reviewers reacting straight away aren't ignored
+	err = s.MessageReactionAdd(reviewMsg.ChannelID, reviewMsg.ID, "✅")
 	if err != nil {
-		s.ChannelMessageSend(reviewChan, fmt.Sprintf("Couldn't inform %s#%s ID: %s about confirmation\n%s", imgInQueue.AuthorName, imgInQueue.AuthorDiscrim, imgInQueue.AuthorID, err))
+		s.ChannelMessageSend(conf().ReviewChannel, "Couldn't add ✅ to message")
+		log.Error("error attaching reaction", err)
 	}
-
-	filepath := "images/" + imgFileName
-
-	if err := os.Rename(tempFilepath, filepath); err != nil {
-		s.ChannelMessageSend(reviewChan, "Error moving file from temp dir")
-		log.Error("error moving file from temp dir", err)
-	} else {
-		if err := os.Chmod(filepath, 0755); err != nil {
-			s.ChannelMessageSend(reviewChan, "Can't chmod "+err.Error())
-			log.Error("cant chmod", err)
-		}
+	err = s.MessageReactionAdd(reviewMsg.ChannelID, reviewMsg.ID, "❌")
+	if err != nil {
+		s.ChannelMessageSend(conf().ReviewChannel, "Couldn't add ❌ to message")
+		log.Error("error attaching reaction", err)
 	}
-
-	delete(imageQueue, strconv.Itoa(currentImageNumber))
-	currUser.TempImages = remove(currUser.TempImages, findIndex(currUser.TempImages, imgInQueue.ImageName))
-	currUser.CurrDiskUsed += fileSize
-	currUser.QueueSize -= fileSize
-	currUser.Images[imgInQueue.ImageName] = imgFileName
-
-	saveQueue()
-	saveUsers()
-
-	s.ChannelMessageSend(channel.ID, "Your image was confirmed and is now saved :D To \"recall\" it, type `[prefix] image recall "+imgInQueue.ImageName+"`")
 }
 
-func fimageDelete(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
+func fimageDelete(s session, m *discordgo.MessageCreate, a args) {
+	imgName := a.str("name")
+
 	var filename string
-	val, ok := u[m.Author.ID]
-	if ok {
-		if val, ok := val.Images[strings.Join(msglist, " ")]; ok {
+	if val, ok := u.get(m.Author.ID); ok {
+		if val, ok := val.Images[imgName]; ok {
 			filename = val
 		} else {
 			s.ChannelMessageSend(m.ChannelID, "You dont have an image under that name saved with me <:2BThink:333694872802426880>")
@@ -433,38 +273,37 @@ func fimageDelete(s *discordgo.Session, m *discordgo.MessageCreate, msglist []st
 		return
 	}
 
-	f, err := os.Open("images/" + filename)
-	if err != nil {
-		s.ChannelMessageSend(m.ChannelID, "Image couldnt be deleted :( Please pester my creator for me")
-		log.Error("error opening image for file size", err)
-		return
-	}
-
-	stats, err := f.Stat()
+	size, err := imgStore.Stat(filename)
 	if err != nil {
 		s.ChannelMessageSend(m.ChannelID, "Image couldnt be deleted :( Please pester my creator for me")
-		log.Error("error getting file stats", err)
+		log.Error("error getting image size", err)
+		a.fail()
 		return
 	}
 
-	if err := os.Remove("images/" + filename); err != nil {
+	if err := imgStore.Delete(filename); err != nil {
 		s.ChannelMessageSend(m.ChannelID, "Image couldnt be deleted :( Please pester my creator for me")
 		log.Error("error deleting image", err)
+		a.fail()
 		return
 	}
 
-	val.CurrDiskUsed -= int(stats.Size())
-
-	delete(val.Images, strings.Join(msglist, " "))
+	u.update(m.Author.ID, func(val *user) {
+		if _, ok := val.Images[imgName]; ok {
+			val.CurrDiskUsed -= int(size)
+			delete(val.Images, imgName)
+		}
+	})
 
-	saveUsers()
+	persist.markUser(m.Author.ID)
+	persist.flush()
 
 	s.ChannelMessageSend(m.ChannelID, "Image deleted~")
 }
 
-func fimageList(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	val, ok := u[m.Author.ID]
-	if (ok && len(u[m.Author.ID].Images) == 0) || !ok {
+func fimageList(s session, m *discordgo.MessageCreate, a args) {
+	val, ok := u.get(m.Author.ID)
+	if !ok || len(val.Images) == 0 {
 		s.ChannelMessageSend(m.ChannelID, "You've no saved images! Get storin'!")
 		return
 	}
@@ -478,11 +317,11 @@ func fimageList(s *discordgo.Session, m *discordgo.MessageCreate, msglist []stri
 
 	msg, err := s.ChannelMessageSend(m.ChannelID, "Assemblin' a preview your images!")
 
-	p := dgwidgets.NewPaginator(s, m.ChannelID)
+	p := dgwidgets.NewPaginator(s.discord(), m.ChannelID)
 
 	success := true
 	for i, img := range files {
-		imgURL, err := url.Parse(conf.URL + url.PathEscape(img))
+		imgURL, err := url.Parse(imgStore.URL(img))
 		if err != nil {
 			log.Error("error parsing img url", err)
 			success = false
@@ -509,6 +348,7 @@ func fimageList(s *discordgo.Session, m *discordgo.MessageCreate, msglist []stri
 	if err := p.Spawn(); err != nil {
 		log.Error("error creating image list", err)
 		s.ChannelMessageSend(m.ChannelID, "Couldn't make the list :( Go pester Strum355#1180 about this")
+		a.fail()
 		return
 	}
 
@@ -517,8 +357,8 @@ func fimageList(s *discordgo.Session, m *discordgo.MessageCreate, msglist []stri
 	}
 }
 
-func fimageInfo(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	if val, ok := u[m.Author.ID]; ok {
+func fimageInfo(s session, m *discordgo.MessageCreate, a args) {
+	if val, ok := u.get(m.Author.ID); ok {
 		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("```autohotkey\nTotal Images:%21d```"+
 			"```autohotkey\nTotal Space Used:%20.2f/%.2fMB (%.2f/%.2fKB)```"+
 			"```autohotkey\nQueued Images:%20d```"+
@@ -540,14 +380,8 @@ func fimageInfo(s *discordgo.Session, m *discordgo.MessageCreate, msglist []stri
 		return
 	}
 
-	u[m.Author.ID] = &user{
-		Images:     map[string]string{},
-		TempImages: []string{},
-		DiskQuota:  8000000,
-		QueueSize:  0,
-	}
-
-	saveUsers()
+	u.upsert(m.Author.ID, func(*user) {})
+	persist.markUser(m.Author.ID)
 
-	fimageInfo(s, m, msglist)
+	fimageInfo(s, m, a)
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/crypto/blake2b"
+)
+
+var testImage = []byte("\x89PNG not really a png")
+
+func imageServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cat.png" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(testImage)
+	}))
+}
+
+// saveMessage makes an `image save` message with an attachment at url
+func (f *fakeSession) saveMessage(name, url string, height, size int) *discordgo.MessageCreate {
+	m := f.message(testUserID, "image save "+name)
+	if url != "" {
+		m.Attachments = []*discordgo.MessageAttachment{{URL: url, ProxyURL: url, Height: height, Width: height, Size: size}}
+	}
+	return m
+}
+
+func imageFileName(userID, name string) string {
+	hash := blake2b.Sum256([]byte(userID + "_" + name))
+	return hex.EncodeToString(hash[:]) + ".png"
+}
+
+func TestImageSaveRejected(t *testing.T) {
+	srv := imageServer()
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		setup   func()
+		url     string
+		height  int
+		size    int
+		wantMsg string
+	}{
+		{
+			name:    "no attachment",
+			wantMsg: "No image sent.",
+		},
+		{
+			name:    "not an image",
+			url:     srv.URL + "/cat.png",
+			size:    100,
+			wantMsg: "Either your image is corrupted",
+		},
+		{
+			name: "name taken",
+			setup: func() {
+				u.m[testUserID] = &user{Images: map[string]string{"cat": "x.png"}, DiskQuota: 8000000}
+			},
+			url:     srv.URL + "/cat.png",
+			height:  10,
+			size:    100,
+			wantMsg: "You've already saved an image under that name!",
+		},
+		{
+			name: "name in queue",
+			setup: func() {
+				u.m[testUserID] = &user{Images: map[string]string{}, TempImages: []string{"cat"}, DiskQuota: 8000000}
+			},
+			url:     srv.URL + "/cat.png",
+			height:  10,
+			size:    100,
+			wantMsg: "You've already saved an image under that name!",
+		},
+		{
+			name:    "too big",
+			url:     srv.URL + "/cat.png",
+			height:  10,
+			size:    9000000,
+			wantMsg: "The image file size is too big by 1.00MB :(",
+		},
+		{
+			name: "too big with queue",
+			setup: func() {
+				u.m[testUserID] = &user{Images: map[string]string{}, DiskQuota: 8000000, QueueSize: 7999950}
+			},
+			url:     srv.URL + "/cat.png",
+			height:  10,
+			size:    100,
+			wantMsg: "only takes your queued (aka unconfirmed) images into account",
+		},
+		{
+			name:    "download failed",
+			url:     srv.URL + "/missing.png",
+			height:  10,
+			size:    100,
+			wantMsg: "Error downloading the image",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState()
+			if tt.setup != nil {
+				tt.setup()
+			}
+			before, _ := u.get(testUserID)
+			f := newFakeSession()
+
+			f.runMessage(f.saveMessage("cat", tt.url, tt.height, tt.size))
+
+			sent := f.messages(testChannelID)
+			if len(sent) == 0 || !strings.Contains(sent[len(sent)-1], tt.wantMsg) {
+				t.Errorf("expected a message containing %q, got %q", tt.wantMsg, sent)
+			}
+
+			if imageQueue.len() != 0 || len(f.embeds(conf().ReviewChannel)) != 0 {
+				t.Error("expected the image not to be sent for review")
+			}
+
+			after, _ := u.get(testUserID)
+			if len(after.TempImages) != len(before.TempImages) || after.QueueSize != before.QueueSize {
+				t.Errorf("expected nothing to stay queued, got %+v", after)
+			}
+		})
+	}
+}
+
+func TestImageSaveQueuedBeforeReactions(t *testing.T) {
+	resetState()
+	f := newFakeSession()
+	srv := imageServer()
+	defer srv.Close()
+
+	// A reviewer could react as soon as the bots reactions show up
+	var queued []int
+	f.onReaction = func() { queued = append(queued, imageQueue.len()) }
+
+	f.runMessage(f.saveMessage("my cat", srv.URL+"/cat.png", 10, len(testImage)))
+
+	if len(queued) != 2 || queued[0] != 1 || queued[1] != 1 {
+		t.Errorf("expected the image to be queued before both reactions, got queue lengths %v", queued)
+	}
+}
+
+func TestImageReview(t *testing.T) {
+	srv := imageServer()
+	defer srv.Close()
+
+	const name = "my cat"
+	filename := imageFileName(testUserID, name)
+
+	tests := []struct {
+		name string
+		// Run once the image is waiting for review
+		review  func(t *testing.T, f *fakeSession, reviewMsg *discordgo.Message)
+		saved   bool
+		wantDM  string
+		wantLog string
+	}{
+		{
+			name: "confirmed",
+			review: func(t *testing.T, f *fakeSession, reviewMsg *discordgo.Message) {
+				// The bots own reactions and reactions to other messages are ignored
+				reviewReaction(f, reactionAdd(testBotID, reviewMsg.ID, "✅"))
+				reviewReaction(f, reactionAdd(testOwnerID, "1", "✅"))
+				reviewReaction(f, reactionAdd(testOwnerID, reviewMsg.ID, "✅"))
+				// Only the first decision counts
+				reviewReaction(f, reactionAdd(testOwnerID, reviewMsg.ID, "❌"))
+			},
+			saved:   true,
+			wantDM:  "Your image was confirmed and is now saved :D",
+			wantLog: "Owner confirmed image `my cat` from `User#0001`",
+		},
+		{
+			name: "rejected with reason",
+			review: func(t *testing.T, f *fakeSession, reviewMsg *discordgo.Message) {
+				reviewReaction(f, reactionAdd(testOwnerID, reviewMsg.ID, "❌"))
+				// Only the reviewer can give the reason, for the right image
+				messageCreateEvent(f, f.message(testUserID, "1 it's fine"))
+				messageCreateEvent(f, f.message(testOwnerID, "2 wrong image"))
+				if img, _ := imageQueue.get(1); img.State != reviewRejected || !img.AwaitingReason {
+					t.Errorf("expected the image to wait for a reason, got %+v", img)
+				}
+				messageCreateEvent(f, f.message(testOwnerID, "1 too blurry"))
+			},
+			wantDM:  "Your image got rejected :( Sorry\nReason: too blurry",
+			wantLog: "Reason for image `my cat` from `User#0001`",
+		},
+		{
+			name: "rejected without reason",
+			review: func(t *testing.T, f *fakeSession, reviewMsg *discordgo.Message) {
+				reviewReaction(f, reactionAdd(testOwnerID, reviewMsg.ID, "❌"))
+				messageCreateEvent(f, f.message(testOwnerID, "1 None"))
+			},
+			wantDM:  "Your image got rejected :( Sorry\n",
+			wantLog: "Owner rejected image `my cat`",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState()
+			f := newFakeSession()
+
+			f.runMessage(f.saveMessage(name, srv.URL+"/cat.png", 10, len(testImage)))
+
+			reviews := f.embeds(conf().ReviewChannel)
+			if len(reviews) != 1 {
+				t.Fatalf("expected 1 image to review, got %d", len(reviews))
+			}
+			if !strings.Contains(reviews[0].Embeds[0].Description, "named `my cat`") {
+				t.Errorf("unexpected review message %q", reviews[0].Embeds[0].Description)
+			}
+			if len(f.reactions) != 2 {
+				t.Errorf("expected ✅ and ❌ to be added to the review message, got %v", f.reactions)
+			}
+
+			queued, _ := u.get(testUserID)
+			if !isIn(name, queued.TempImages) || queued.QueueSize != len(testImage) {
+				t.Errorf("expected the image to be queued, got %+v", queued)
+			}
+
+			tt.review(t, f, reviews[0])
+
+			dms := f.messages("dm" + testUserID)
+			if len(dms) != 1 || !strings.HasPrefix(dms[0], tt.wantDM) {
+				t.Errorf("expected a DM starting with %q, got %q", tt.wantDM, dms)
+			}
+
+			var found bool
+			for _, msg := range f.messages(conf().ReviewChannel) {
+				found = found || strings.Contains(msg, tt.wantLog)
+			}
+			if !found {
+				t.Errorf("expected a review log containing %q, got %q", tt.wantLog, f.messages(conf().ReviewChannel))
+			}
+
+			usr, _ := u.get(testUserID)
+			if imageQueue.len() != 0 || len(usr.TempImages) != 0 || usr.QueueSize != 0 {
+				t.Errorf("expected the image to be taken out of the queue, got %+v", usr)
+			}
+
+			if _, err := os.Stat("images/temp/" + filename); !os.IsNotExist(err) {
+				t.Errorf("expected the temp image to be removed, got %v", err)
+			}
+
+			_, err := os.Stat("images/" + filename)
+			if tt.saved {
+				if err != nil || usr.Images[name] != filename || usr.CurrDiskUsed != len(testImage) {
+					t.Errorf("expected the image to be saved, got %+v %v", usr, err)
+				}
+				os.Remove("images/" + filename)
+				return
+			}
+
+			if !os.IsNotExist(err) || len(usr.Images) != 0 || usr.CurrDiskUsed != 0 {
+				t.Errorf("expected the image not to be saved, got %+v %v", usr, err)
+			}
+		})
+	}
+}
+
+func reactionAdd(userID, messageID, emoji string) *discordgo.MessageReactionAdd {
+	return &discordgo.MessageReactionAdd{MessageReaction: &discordgo.MessageReaction{
+		UserID:    userID,
+		MessageID: messageID,
+		ChannelID: conf().ReviewChannel,
+		Emoji:     discordgo.Emoji{Name: emoji},
+	}}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Largest file Discord takes from bots. Exports bigger than this are sent
+// without the images in them.
+const maxDMFile = 8 << 20
+
+func init() {
+	newCommand("mydata", 0, false, nil).subcommands(
+		newCommand("export", 0, false, msgExportMyData).cooldown(cooldownUser, 1, time.Minute*10).
+			setHelp("DMs you a zip of everything 2Bot keeps about you: your saved and queued images, "+
+				"the playlists and tags you made, the review decisions about your images and how many commands you've run each day"),
+		newCommand("delete", 0, false, msgDeleteMyData).
+			setHelp("Deletes your saved and queued images and everything 2Bot keeps about you, after asking you to confirm. "+
+				"Playlists and tags you made stay in their servers, but stop being linked to you"),
+	).setHelp("See or delete the data 2Bot keeps about you.").examples("mydata export", "mydata delete").
+		allowDMs().setCategory(categoryUtility).add()
+}
+
+// dataExport is data.json in the zip mydata export sends
+type dataExport struct {
+	UserID   string    `json:"user_id"`
+	Exported time.Time `json:"exported"`
+
+	// nil if 2Bot has never saved an image for them
+	User *user `json:"user"`
+
+	Queued    []queuedExport   `json:"queued_images"`
+	Playlists []playlistExport `json:"playlists"`
+	Tags      []tagExport      `json:"tags"`
+
+	// Review decisions about images they saved, or that they made
+	ReviewHistory []auditEntry `json:"review_history"`
+
+	// Commands run each day, for as long as stats are kept
+	Activity []dayCount `json:"command_activity"`
+
+	// Why files are missing from the zip, if they are
+	Notes []string `json:"notes,omitempty"`
+}
+
+type queuedExport struct {
+	Number int `json:"number"`
+	queuedImage
+}
+
+type playlistExport struct {
+	GuildID string `json:"guild_id"`
+	Name    string `json:"name"`
+	Songs   []song `json:"songs"`
+}
+
+type tagExport struct {
+	GuildID string `json:"guild_id"`
+	Name    string `json:"name"`
+	tag
+}
+
+// zipName makes an image name safe to use as a file name in the zip
+func zipName(name, file string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+	return name + path.Ext(file)
+}
+
+// collectUserData gathers everything kept about the user, apart from image files
+func collectUserData(userID string) dataExport {
+	data := dataExport{UserID: userID, Exported: time.Now().UTC()}
+
+	if usr, ok := u.get(userID); ok {
+		data.User = &usr
+	}
+
+	for _, num := range imageQueue.nums() {
+		if img, ok := imageQueue.get(num); ok && img.AuthorID == userID {
+			data.Queued = append(data.Queued, queuedExport{Number: num, queuedImage: img})
+		}
+	}
+
+	sMap.viewAll(func(id string, guild *server) {
+		for name, creator := range guild.PlaylistCreators {
+			if creator == userID {
+				data.Playlists = append(data.Playlists, playlistExport{GuildID: id, Name: name, Songs: append([]song{}, guild.Playlists[name]...)})
+			}
+		}
+		for name, t := range guild.Tags {
+			if t.AuthorID == userID {
+				data.Tags = append(data.Tags, tagExport{GuildID: id, Name: name, tag: *t})
+			}
+		}
+	})
+	sort.Slice(data.Playlists, func(i, j int) bool {
+		return data.Playlists[i].GuildID+data.Playlists[i].Name < data.Playlists[j].GuildID+data.Playlists[j].Name
+	})
+	sort.Slice(data.Tags, func(i, j int) bool {
+		return data.Tags[i].GuildID+data.Tags[i].Name < data.Tags[j].GuildID+data.Tags[j].Name
+	})
+
+	history, err := reviewAudit.history(userID)
+	if err != nil {
+		log.Error("error reading review audit log", userID, err)
+		data.Notes = append(data.Notes, "Couldn't read the review history")
+	}
+	data.ReviewHistory = history
+
+	data.Activity = commandStats.userActivity(userID)
+	return data
+}
+
+// readImage reads the whole image kept under key
+func readImage(key string) ([]byte, error) {
+	r, err := imgStore.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// buildDataExport zips up data.json and, if withImages is set, the users
+// saved images in images/ and queued ones in queued/
+func buildDataExport(data dataExport, withImages bool) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	z := zip.NewWriter(buf)
+
+	add := func(name string, b []byte) error {
+		w, err := z.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+
+	if withImages {
+		var names []string
+		if data.User != nil {
+			for name := range data.User.Images {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			file := data.User.Images[name]
+			b, err := readImage(file)
+			if err != nil {
+				data.Notes = append(data.Notes, fmt.Sprintf("Couldn't read saved image %q", name))
+				continue
+			}
+			if err := add("images/"+zipName(name, file), b); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, q := range data.Queued {
+			file := savedImageName(q.AuthorID, q.ImageName, q.ImageURL)
+			b, err := readImage(tempImageKey(file))
+			if err != nil {
+				data.Notes = append(data.Notes, fmt.Sprintf("Couldn't read queued image %q", q.ImageName))
+				continue
+			}
+			if err := add("queued/"+zipName(q.ImageName, file), b); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	b, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := add("data.json", b); err != nil {
+		return nil, err
+	}
+
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func msgExportMyData(s session, m *discordgo.MessageCreate, a args) {
+	data := collectUserData(m.Author.ID)
+
+	b, err := buildDataExport(data, true)
+	if err == nil && len(b) > maxDMFile {
+		data.Notes = append(data.Notes, "Your images made the zip too big to send, so they were left out. Use `image recall` to get them")
+		b, err = buildDataExport(data, false)
+	}
+	if err != nil {
+		log.Error("error building data export", m.Author.ID, err)
+		s.ChannelMessageSend(m.ChannelID, "There was a problem putting your data together :( Try again please~")
+		a.fail()
+		return
+	}
+
+	channel, err := s.UserChannelCreate(m.Author.ID)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, "I couldn't DM you your data. Do you have DMs turned off?")
+		return
+	}
+
+	if _, err := s.ChannelFileSend(channel.ID, "2bot-data-"+m.Author.ID+".zip", bytes.NewReader(b)); err != nil {
+		log.Error("error sending data export", m.Author.ID, err)
+		s.ChannelMessageSend(m.ChannelID, "I couldn't DM you your data. Do you have DMs turned off?")
+		return
+	}
+
+	if channel.ID != m.ChannelID {
+		s.ChannelMessageSend(m.ChannelID, "Sent you your data in a DM~")
+	}
+}
+
+// eraseUser deletes the users images, withdraws their queued images and
+// forgets them, returning anything that couldn't be deleted
+func eraseUser(s session, userID string) []string {
+	var problems []string
+
+	for _, num := range imageQueue.nums() {
+		img, ok := imageQueue.get(num)
+		if !ok || img.AuthorID != userID {
+			continue
+		}
+
+		imageQueue.remove(num)
+		persist.markQueued(num)
+
+		if err := imgStore.Delete(tempImageKey(savedImageName(img.AuthorID, img.ImageName, img.ImageURL))); err != nil {
+			log.Error("error deleting queued image", num, err)
+			problems = append(problems, fmt.Sprintf("queued image %q", img.ImageName))
+		}
+
+		s.ChannelMessageSend(conf().ReviewChannel, fmt.Sprintf("Image `%s` from `%s#%s` ID: `%s` was withdrawn by its author",
+			img.ImageName, img.AuthorName, img.AuthorDiscrim, img.AuthorID))
+	}
+
+	if usr, ok := u.get(userID); ok {
+		for name, file := range usr.Images {
+			if err := imgStore.Delete(file); err != nil {
+				log.Error("error deleting image", userID, err)
+				problems = append(problems, fmt.Sprintf("image %q", name))
+			}
+		}
+	}
+	u.remove(userID)
+	persist.markUser(userID)
+
+	changed := sMap.updateAll(func(guild *server) bool {
+		return guild.forgetUser(userID)
+	})
+	for _, id := range changed {
+		persist.markServer(id)
+	}
+
+	if err := reviewAudit.redact(userID); err != nil {
+		log.Error("error redacting review audit log", userID, err)
+		problems = append(problems, "review history")
+	}
+
+	commandStats.forget(userID)
+	if err := saveStats(); err != nil {
+		log.Error("error saving stats", err)
+		problems = append(problems, "command stats")
+	}
+
+	if err := persist.flush(); err != nil {
+		problems = append(problems, "saved records")
+	}
+
+	// Only once they're gone from the files themselves, so the flush doesn't
+	// back them up again
+	if err := eraseFromBackups(userID); err != nil {
+		log.Error("error erasing user from backups", userID, err)
+		problems = append(problems, "backups")
+	}
+	return problems
+}
+
+func msgDeleteMyData(s session, m *discordgo.MessageCreate, a args) {
+	s.ChannelMessageSend(m.ChannelID, "This deletes your saved and queued images and everything else 2Bot keeps about you, and can't be undone. "+
+		"Reply `yes` to delete it, or anything else to cancel")
+
+	if !confirmReply(s, m) {
+		s.ChannelMessageSend(m.ChannelID, "Nothing was deleted")
+		return
+	}
+
+	if problems := eraseUser(s, m.Author.ID); len(problems) != 0 {
+		s.ChannelMessageSend(m.ChannelID, "Your data was deleted, except for these, which my creator has been told about :(\n"+strings.Join(problems, "\n"))
+		s.ChannelMessageSend(conf().LogChannel, fmt.Sprintf("Couldn't delete all the data of %s: %s", m.Author.ID, strings.Join(problems, ", ")))
+		a.fail()
+		return
+	}
+	s.ChannelMessageSend(m.ChannelID, "All your data was deleted. Bye for now~")
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMyData(t *testing.T) {
+	resetState()
+	f := newFakeSession()
+	srv := imageServer()
+	defer srv.Close()
+
+	// An image waiting for review
+	f.runMessage(f.saveMessage("my cat", srv.URL+"/cat.png", 10, len(testImage)))
+	reviewMsg := f.embeds(conf().ReviewChannel)[0]
+
+	// And one that's been confirmed
+	dog := imageFileName(testUserID, "dog")
+	if err := ioutil.WriteFile("images/"+dog, testImage, 0644); err != nil {
+		t.Fatal(err)
+	}
+	u.update(testUserID, func(usr *user) {
+		usr.Images["dog"] = dog
+		usr.CurrDiskUsed += len(testImage)
+	})
+
+	f.run(testUserID, "playlist create chill")
+	f.run(testOwnerID, "playlist create rock")
+	sMap.update(testGuildID, func(guild *server) {
+		guild.Tags = map[string]*tag{"hi": {Content: "hello", AuthorID: testUserID}, "bye": {AuthorID: testOwnerID}}
+	})
+
+	// Review decisions about their image, by them and not involving them at all
+	audit(auditRejected, 1, queuedImage{ImageName: "old", Hash: "abc", AuthorID: testUserID, Reason: "blurry"}, testOwnerID)
+	audit(auditApprove, 2, queuedImage{ImageName: "theirs", AuthorID: testOwnerID}, testUserID)
+	audit(auditApproved, 3, queuedImage{ImageName: "other", AuthorID: testOwnerID}, testOwnerID)
+
+	f.run(testUserID, "mydata export")
+
+	b, ok := f.files["2bot-data-"+testUserID+".zip"]
+	if !ok {
+		t.Fatalf("expected the zip to be DMed, got %q", f.messages(testChannelID))
+	}
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	var data dataExport
+	for _, file := range z.File {
+		names = append(names, file.Name)
+		if file.Name != "data.json" {
+			continue
+		}
+		r, _ := file.Open()
+		if err := json.NewDecoder(r).Decode(&data); err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+	}
+	sort.Strings(names)
+	if want := []string{"data.json", "images/dog.png", "queued/my cat.png"}; strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("expected the zip to have %q, got %q", want, names)
+	}
+
+	switch {
+	case data.User == nil || data.User.Images["dog"] != dog:
+		t.Errorf("expected the user record, got %+v", data.User)
+	case len(data.Queued) != 1 || data.Queued[0].ImageName != "my cat":
+		t.Errorf("expected the queued image, got %+v", data.Queued)
+	case len(data.Playlists) != 1 || data.Playlists[0].Name != "chill":
+		t.Errorf("expected only the playlist they made, got %+v", data.Playlists)
+	case len(data.Tags) != 1 || data.Tags[0].Name != "hi":
+		t.Errorf("expected only the tag they made, got %+v", data.Tags)
+	case len(data.ReviewHistory) != 2 || data.ReviewHistory[0].Image != 1 || data.ReviewHistory[1].Image != 2:
+		t.Errorf("expected the review decisions involving them, got %+v", data.ReviewHistory)
+	case len(data.Activity) != 1 || data.Activity[0].Uses == 0:
+		t.Errorf("expected the commands they ran today, got %+v", data.Activity)
+	}
+
+	deleteData := func(reply string) {
+		done := make(chan struct{})
+		go func() {
+			f.run(testUserID, "mydata delete")
+			close(done)
+		}()
+		f.emit(t, f.message(testUserID, reply))
+		<-done
+	}
+
+	deleteData("no")
+	if _, ok := u.get(testUserID); !ok || imageQueue.len() != 1 {
+		t.Fatal("expected nothing to be deleted without confirming")
+	}
+
+	// Backups that'd be restored if the files were corrupt
+	persist.markServer(testGuildID)
+	if err := persist.flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range jsonStoreFiles {
+		raw, err := ioutil.ReadFile("json/" + file.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := backupJSON(file.path, raw, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleteData("yes")
+
+	if _, ok := u.get(testUserID); ok {
+		t.Error("expected the user record to be deleted")
+	}
+	if imageQueue.len() != 0 {
+		t.Error("expected the queued image to be withdrawn")
+	}
+	for _, path := range []string{"images/" + dog, "images/temp/" + imageFileName(testUserID, "my cat")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be deleted, got %v", path, err)
+		}
+	}
+	guild := testGuild()
+	if _, ok := guild.PlaylistCreators["chill"]; ok || guild.PlaylistCreators["rock"] != testOwnerID {
+		t.Errorf("expected only their playlist to be unlinked, got %v", guild.PlaylistCreators)
+	}
+	if guild.Tags["hi"].AuthorID != "" || guild.Tags["hi"].Content != "hello" || guild.Tags["bye"].AuthorID != testOwnerID {
+		t.Errorf("expected only their tag to be unlinked, got %+v %+v", guild.Tags["hi"], guild.Tags["bye"])
+	}
+	if data := collectUserData(testUserID); len(data.Tags) != 0 || len(data.Playlists) != 0 {
+		t.Errorf("expected nothing to be exported about them any more, got %+v", data)
+	}
+	history, err := reviewAudit.history(redactedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].ImageName != "" || history[0].ImageHash != "" || history[0].Reason != "blurry" || history[1].ImageName != "theirs" {
+		t.Errorf("expected their IDs and image names to be redacted, got %+v", history)
+	}
+	if b, _ := ioutil.ReadFile(reviewAudit.path); bytes.Contains(b, []byte(testUserID)) || !bytes.Contains(b, []byte(`"image_name":"other"`)) {
+		t.Errorf("expected only their IDs to be removed from the audit log, got %s", b)
+	}
+	restored := restoreFromBackups(t)
+	if _, ok := restored.users[testUserID]; ok {
+		t.Error("expected the user record to be gone from the backups")
+	}
+	for num, img := range restored.queue {
+		if img.AuthorID == testUserID {
+			t.Errorf("expected the queued image to be gone from the backups, got %s", num)
+		}
+	}
+	if g := restored.servers[testGuildID]; g == nil || g.PlaylistCreators["chill"] != "" || g.Tags["hi"] == nil || g.Tags["hi"].AuthorID != "" {
+		t.Errorf("expected their playlist and tag to be unlinked in the backups, got %+v", g)
+	}
+	// Only the delete itself is counted, as it's recorded once it's finished
+	if got := commandStats.userActivity(testUserID); len(got) != 1 || got[0].Uses != 1 {
+		t.Errorf("expected their command activity to be forgotten, got %+v", got)
+	}
+	if got := f.messages(testChannelID); got[len(got)-1] != "All your data was deleted. Bye for now~" {
+		t.Errorf("unexpected reply %q", got[len(got)-1])
+	}
+
+	// The review notices the image is gone rather than saving it
+	reviewReaction(f, reactionAdd(testOwnerID, reviewMsg.ID, "✅"))
+	if _, ok := u.get(testUserID); ok {
+		t.Error("expected the withdrawn image not to be saved")
+	}
+	var withdrawn bool
+	for _, msg := range f.messages(conf().ReviewChannel) {
+		withdrawn = withdrawn || strings.Contains(msg, "`my cat` from `User#0001` ID: `"+testUserID+"` was withdrawn")
+		if strings.Contains(msg, "confirmed image") {
+			t.Errorf("expected the withdrawn image not to be confirmed, got %q", msg)
+		}
+	}
+	if !withdrawn {
+		t.Errorf("expected reviewers to be told the image was withdrawn, got %q", f.messages(conf().ReviewChannel))
+	}
+}
+
+func TestMyDataDeleteTimeout(t *testing.T) {
+	resetState()
+	f := newFakeSession()
+	u.upsert(testUserID, func(*user) {})
+
+	defer func(old time.Duration) { confirmTimeout = old }(confirmTimeout)
+	confirmTimeout = time.Millisecond * 50
+
+	f.run(testUserID, "mydata delete")
+
+	if got := f.messages(testChannelID); got[len(got)-1] != "Nothing was deleted" {
+		t.Errorf("expected nothing to be deleted without an answer, got %q", got[len(got)-1])
+	}
+	if _, ok := u.get(testUserID); !ok {
+		t.Error("expected the user record to be kept")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.handlers) != 0 {
+		t.Errorf("expected the reply handler to be removed, got %d left", len(f.handlers))
+	}
+}
+
+// restoredRecords is what jsonStore loads from the backups
+type restoredRecords struct {
+	servers map[string]*server
+	users   users
+	queue   map[string]*queuedImage
+}
+
+// restoreFromBackups loads everything as if each of jsonStores files was
+// corrupt, putting the files back afterwards
+func restoreFromBackups(t *testing.T) (out restoredRecords) {
+	t.Helper()
+
+	for _, file := range jsonStoreFiles {
+		path := "json/" + file.path
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ioutil.WriteFile(path, raw, 0644)
+
+		if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var err error
+	j := newJSONStore()
+	if out.servers, err = j.Servers(); err != nil {
+		t.Fatal(err)
+	}
+	if out.users, err = j.Users(); err != nil {
+		t.Fatal(err)
+	}
+	if out.queue, err = j.Queue(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func init() {
+	newCommand("perms",
+		discordgo.PermissionAdministrator|discordgo.PermissionManageServer,
+		true, nil).subcommands(
+		newCommand("list", 0, false, msgListPerms).setArgs(greedyArg("command").optional()).setHelp("Lists the permission overrides for every command, or just the given one"),
+		newCommand("allow", 0, false, msgAllowPerm).setArgs(wordArg("target"), greedyArg("command")).
+			setHelp("Lets a role or user run a command, even if they don't have the permissions it normally needs.").examples("perms allow @DJ yt skip", "perms allow @Moderators purge"),
+		newCommand("deny", 0, false, msgDenyPerm).setArgs(wordArg("target"), greedyArg("command")).
+			setHelp("Stops a role or user from running a command.").examples("perms deny everyone yt skip"),
+		newCommand("remove", 0, false, msgRemovePerm).setArgs(wordArg("target"), greedyArg("command")).setHelp("Removes the override for a role or user"),
+	).setHelp("Grant or deny commands to specific roles and users in this server.\n" +
+		"A target can be a role, a user or `everyone`.\n\n" +
+		"Overrides are checked in this order, the first match wins:\n" +
+		"1. The bot owner can run everything\n" +
+		"2. Owner only commands can't be overridden\n" +
+		"3. The server owner and administrators ignore overrides\n" +
+		"4. An allow or deny for the user\n" +
+		"5. An allow for any of the users roles\n" +
+		"6. A deny for any of the users roles\n" +
+		"7. An allow or deny for everyone\n" +
+		"8. The permissions the command normally needs\n\n" +
+		"Denying a command also denies all of its sub-commands.").setCategory(categoryModeration).unrestricted().add()
+}
+
+// permTarget works out which role or user word refers to in the guild.
+// Roles can be given as a mention, an ID, their name or `everyone`.
+func permTarget(word string, guild *discordgo.Guild) (id string, isRole bool, ok bool) {
+	if lower := strings.ToLower(word); lower == "everyone" || lower == "@everyone" {
+		return guild.ID, true, true
+	}
+
+	if id, ok := matchID(roleRegex, word); ok {
+		for _, role := range guild.Roles {
+			if role.ID == id {
+				return id, true, true
+			}
+		}
+	}
+
+	if id, ok := matchID(userIDRegex, word); ok {
+		return id, false, true
+	}
+
+	for _, role := range guild.Roles {
+		if strings.EqualFold(role.Name, word) {
+			return role.ID, true, true
+		}
+	}
+	return "", false, false
+}
+
+// describeTarget names a role or user without mentioning them
+func describeTarget(s session, guild *discordgo.Guild, id string, isRole bool) string {
+	if isRole {
+		if id == guild.ID {
+			return "everyone"
+		}
+		for _, role := range guild.Roles {
+			if role.ID == id {
+				return "@" + role.Name
+			}
+		}
+		return "role " + id
+	}
+
+	if member, err := memberDetails(guild.ID, id, s); err == nil {
+		return member.User.Username + "#" + member.User.Discriminator
+	}
+	return "user " + id
+}
+
+func msgAllowPerm(s session, m *discordgo.MessageCreate, a args) {
+	setPermOverride(s, m, a, true)
+}
+
+func msgDenyPerm(s session, m *discordgo.MessageCreate, a args) {
+	setPermOverride(s, m, a, false)
+}
+
+func setPermOverride(s session, m *discordgo.MessageCreate, a args, allow bool) {
+	guild, ok := settingsGuild(s, m)
+	if !ok {
+		return
+	}
+
+	id, isRole, ok := permTarget(a.str("target"), guild)
+	if !ok {
+		s.ChannelMessageSend(m.ChannelID, "Couldn't find a role or user called "+codeSeg(a.str("target")))
+		return
+	}
+
+	comm, ok := lookupCommand(a.str("command"))
+	if !ok {
+		s.ChannelMessageSend(m.ChannelID, "No command called "+codeSeg(a.str("command")))
+		return
+	}
+
+	if comm.OwnerOnly {
+		s.ChannelMessageSend(m.ChannelID, "Owner only commands can't be overridden")
+		return
+	}
+
+	verb := "can no longer"
+	if allow {
+		verb = "can now"
+	}
+	target := describeTarget(s, guild, id, isRole)
+
+	updateSettings(s, m, func(_ *discordgo.Guild, srvr *server) (string, bool) {
+		if srvr.PermOverrides == nil {
+			srvr.PermOverrides = make(map[string]*permOverrides)
+		}
+
+		name := strings.ToLower(comm.FullName)
+		if _, ok := srvr.PermOverrides[name]; !ok {
+			srvr.PermOverrides[name] = new(permOverrides)
+		}
+		srvr.PermOverrides[name].set(id, isRole, allow)
+		return fmt.Sprintf("%s %s use %s", codeSeg(target), verb, codeSeg(comm.FullName)), true
+	})
+}
+
+func msgRemovePerm(s session, m *discordgo.MessageCreate, a args) {
+	guild, ok := settingsGuild(s, m)
+	if !ok {
+		return
+	}
+
+	id, isRole, ok := permTarget(a.str("target"), guild)
+	if !ok {
+		s.ChannelMessageSend(m.ChannelID, "Couldn't find a role or user called "+codeSeg(a.str("target")))
+		return
+	}
+
+	name := strings.ToLower(strings.Join(strings.Fields(a.str("command")), " "))
+	target := describeTarget(s, guild, id, isRole)
+
+	updateSettings(s, m, func(_ *discordgo.Guild, srvr *server) (string, bool) {
+		overrides, ok := srvr.PermOverrides[name]
+		if !ok || !overrides.clear(id) {
+			return fmt.Sprintf("There's no override for %s on %s", codeSeg(target), codeSeg(name)), false
+		}
+
+		if overrides.empty() {
+			delete(srvr.PermOverrides, name)
+		}
+		return fmt.Sprintf("Removed the override for %s on %s", codeSeg(target), codeSeg(name)), true
+	})
+}
+
+func msgListPerms(s session, m *discordgo.MessageCreate, a args) {
+	var guild *discordgo.Guild
+	var names []string
+	overrides := make(map[string]permOverrides)
+	if !viewSettings(s, m, func(g *discordgo.Guild, srvr *server) {
+		guild = g
+		if a.has("command") {
+			name := strings.ToLower(strings.Join(strings.Fields(a.str("command")), " "))
+			if _, ok := srvr.PermOverrides[name]; ok {
+				names = append(names, name)
+			}
+		} else {
+			for name := range srvr.PermOverrides {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+
+		for _, name := range names {
+			overrides[name] = srvr.PermOverrides[name].clone()
+		}
+	}) {
+		return
+	}
+
+	if len(names) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "No permission overrides set")
+		return
+	}
+
+	describe := func(ids []string, isRole bool) string {
+		var out []string
+		for _, id := range ids {
+			out = append(out, describeTarget(s, guild, id, isRole))
+		}
+		return strings.Join(out, ", ")
+	}
+
+	var fields []*discordgo.MessageEmbedField
+	for _, name := range names {
+		overrides := overrides[name]
+
+		var lines []string
+		for _, line := range [][2]string{
+			{"Allowed users", describe(overrides.AllowUsers, false)},
+			{"Denied users", describe(overrides.DenyUsers, false)},
+			{"Allowed roles", describe(overrides.AllowRoles, true)},
+			{"Denied roles", describe(overrides.DenyRoles, true)},
+		} {
+			if line[1] != "" {
+				lines = append(lines, line[0]+": "+line[1])
+			}
+		}
+
+		fields = append(fields, &discordgo.MessageEmbedField{Name: name, Value: strings.Join(lines, "\n")})
+	}
+
+	s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
+		Title:  "Permission overrides",
+		Fields: fields,
+	})
+}
@@ -1,94 +1,126 @@
 package main
 
 import (
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/rylio/ytdl"
 )
 
 func init() {
-	newCommand("playlist", 0, false, msgPlaylist).setHelp("dab on em").add() //TODO
+	newCommand("playlist", 0, false, nil).subcommands(
+		newCommand("create", 0, false, createPlaylist).setArgs(greedyArg("playlist")).setHelp("Creates a new, empty playlist"),
+		newCommand("delete", 0, false, deletePlaylist).setArgs(greedyArg("playlist")).setHelp("Deletes a playlist"),
+		newCommand("add", 0, false, addToPlaylist).setArgs(wordArg("url"), greedyArg("playlist")).cooldown(cooldownUser, 5, time.Second*30).setHelp("Adds the given YouTube video to a playlist"),
+		newCommand("remove", 0, false, removeFromPlaylist).setArgs(intArg("index", 0, 1000), greedyArg("playlist")).setHelp("Removes the song at the given index from a playlist"),
+	).setHelp("Manage this servers playlists.").examples("playlist create chill", "playlist add https://www.youtube.com/watch?v=MvLdxtICOIY chill").setCategory(categoryMusic).add()
 }
 
-func msgPlaylist(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	if len(msglist) < 2 {
-		return
-	}
-
+// playlistGuild returns the ID of the server the message was sent in
+func playlistGuild(s session, m *discordgo.MessageCreate) (string, bool) {
 	guild, err := guildDetails(m.ChannelID, "", s)
 	if err != nil {
-		return
+		return "", false
 	}
+	return guild.ID, true
+}
 
-	server, ok := sMap.server(guild.ID)
+// updatePlaylists calls f with the server while nothing else can change its
+// playlists, making sure the map is initialised. f returns the reply and
+// whether the playlist changed, in which case it's saved.
+func updatePlaylists(s session, m *discordgo.MessageCreate, playlist string, f func(guild *server) (string, bool)) {
+	guildID, ok := playlistGuild(s, m)
 	if !ok {
 		return
 	}
 
-	if server.Playlists == nil {
-		server.Playlists = make(map[string][]song)
+	var reply string
+	var changed bool
+	ok = sMap.update(guildID, func(guild *server) {
+		if guild.Playlists == nil {
+			guild.Playlists = make(map[string][]song)
+		}
+		reply, changed = f(guild)
+	})
+	if !ok {
+		return
 	}
 
-	switch msglist[1] {
-	case "create":
-		createPlaylist(s, m, msglist, server)
-	case "delete":
-		deletePlaylist(s, m, msglist, server)
-	case "add":
-		addToPlaylist(s, m, msglist, server)
-	case "remove":
-		removeFromPlaylist(s, m, msglist, server)
+	if changed {
+		// The server has who created each playlist
+		persist.markServer(guildID)
+		persist.markPlaylist(guildID, playlist)
 	}
+	s.ChannelMessageSend(m.ChannelID, reply)
+}
 
-	saveServers()
+func createPlaylist(s session, m *discordgo.MessageCreate, a args) {
+	playlist := a.str("playlist")
+	updatePlaylists(s, m, playlist, func(guild *server) (string, bool) {
+		playlists := guild.Playlists
+		if _, ok := playlists[playlist]; ok {
+			return "Playlist `" + playlist + "` already exists!", false
+		}
+
+		playlists[playlist] = []song{}
+		if guild.PlaylistCreators == nil {
+			guild.PlaylistCreators = make(map[string]string)
+		}
+		guild.PlaylistCreators[playlist] = m.Author.ID
+		return "Created playlist `" + playlist + "`", true
+	})
 }
 
-func createPlaylist(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string, server *server) {
-	playlist := strings.Join(msglist[2:], " ")
-	if _, ok := server.Playlists[playlist]; ok {
-		s.ChannelMessageSend(m.ChannelID, "Playlist `"+playlist+"` already exists!")
-		return
-	}
+func deletePlaylist(s session, m *discordgo.MessageCreate, a args) {
+	playlist := a.str("playlist")
+	updatePlaylists(s, m, playlist, func(guild *server) (string, bool) {
+		playlists := guild.Playlists
+		if _, ok := playlists[playlist]; !ok {
+			return "Playlist `" + playlist + "` doesn't exist!", false
+		}
 
-	server.Playlists[playlist] = []song{}
-	s.ChannelMessageSend(m.ChannelID, "Created playlist `"+playlist+"`")
-	return
+		delete(playlists, playlist)
+		delete(guild.PlaylistCreators, playlist)
+		return "Playlist `" + playlist + "` was deleted", true
+	})
 }
 
-func deletePlaylist(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string, server *server) {
-	playlist := strings.Join(msglist[2:], " ")
-	if _, ok := server.Playlists[playlist]; !ok {
-		s.ChannelMessageSend(m.ChannelID, "Playlist `"+playlist+"` doesn't exist!")
-		return
+// checkPlaylistSong returns why url can't be added to the playlist, if it can't
+func checkPlaylistSong(playlists map[string][]song, playlist, url string) string {
+	songs, ok := playlists[playlist]
+	if !ok {
+		return "Playlist `" + playlist + "` doesn't exist!"
 	}
-	delete(server.Playlists, playlist)
-	s.ChannelMessageSend(m.ChannelID, "Playlist `"+playlist+"` was deleted")
+
+	for _, song := range songs {
+		if song.URL == url {
+			return "That song is already in the playlist!"
+		}
+	}
+	return ""
 }
 
-func addToPlaylist(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string, server *server) {
-	if len(msglist) < 3 {
+func addToPlaylist(s session, m *discordgo.MessageCreate, a args) {
+	guildID, ok := playlistGuild(s, m)
+	if !ok {
 		return
 	}
 
-	playlist := strings.Join(msglist[4:], " ")
-	url := msglist[3]
+	playlist := a.str("playlist")
+	url := a.str("url")
 	if !strings.HasPrefix(url, stdURL) && !strings.HasPrefix(url, shortURL) && !strings.HasPrefix(url, embedURL) {
 		s.ChannelMessageSend(m.ChannelID, "Please make sure the URL is a valid YouTube URL. If I got this wrong, please let my creator know~")
 		return
 	}
 
-	if _, ok := server.Playlists[playlist]; !ok {
-		s.ChannelMessageSend(m.ChannelID, "Playlist `"+playlist+"` doesn't exist!")
+	var problem string
+	if !sMap.view(guildID, func(guild *server) { problem = checkPlaylistSong(guild.Playlists, playlist, url) }) {
 		return
 	}
-
-	for _, song := range server.Playlists[playlist] {
-		if song.URL == url {
-			s.ChannelMessageSend(m.ChannelID, "That song is already in the playlist!")
-			return
-		}
+	if problem != "" {
+		s.ChannelMessageSend(m.ChannelID, problem)
+		return
 	}
 
 	vid, err := ytdl.GetVideoInfo(url)
@@ -105,22 +137,38 @@ func addToPlaylist(s *discordgo.Session, m *discordgo.MessageCreate, msglist []s
 		return
 	}
 
-	server.Playlists[playlist] = append(server.Playlists[playlist], song{
-		URL:      url,
-		Name:     vid.Title,
-		Duration: vid.Duration,
-	})
+	// The playlist could have changed while the video was being looked up
+	updatePlaylists(s, m, playlist, func(guild *server) (string, bool) {
+		playlists := guild.Playlists
+		if problem := checkPlaylistSong(playlists, playlist, url); problem != "" {
+			return problem, false
+		}
 
-	s.ChannelMessageSend(m.ChannelID, vid.Title+" added to playlist `"+playlist+"`")
+		playlists[playlist] = append(playlists[playlist], song{
+			URL:      url,
+			Name:     vid.Title,
+			Duration: vid.Duration,
+		})
+		return vid.Title + " added to playlist `" + playlist + "`", true
+	})
 }
 
-func removeFromPlaylist(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string, server *server) {
-	index, err := strconv.Atoi(msglist[2])
-	if err != nil {
-		s.ChannelMessageSend(m.ChannelID, "Please give the index of the song to delete~")
-		return
-	}
+func removeFromPlaylist(s session, m *discordgo.MessageCreate, a args) {
+	playlist := a.str("playlist")
+	index := a.num("index")
 
-	server.Playlists[msglist[1]] = append(server.Playlists[msglist[1]][:index], server.Playlists[msglist[1]][index+1:]...)
-	s.ChannelMessageSend(m.ChannelID, "Song removed from `"+msglist[1]+"`")
+	updatePlaylists(s, m, playlist, func(guild *server) (string, bool) {
+		playlists := guild.Playlists
+		songs, ok := playlists[playlist]
+		if !ok {
+			return "Playlist `" + playlist + "` doesn't exist!", false
+		}
+
+		if index >= len(songs) {
+			return "There's no song at that index in `" + playlist + "`", false
+		}
+
+		playlists[playlist] = append(songs[:index:index], songs[index+1:]...)
+		return "Song removed from `" + playlist + "`", true
+	})
 }
@@ -1,89 +1,224 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/bwmarrin/discordgo"
 )
 
-func init() {
-	newCommand("setGlobalPrefix", 0, false, msgGlobalPrefix).ownerOnly().add()
-	newCommand("setPrefix",
-		discordgo.PermissionAdministrator|discordgo.PermissionManageServer,
-		true, msgPrefix).setHelp("Args: [prefix]\n\nSets the servers prefix to 'prefix'\nAdmin only.\n\nExample:\n`!owo setPrefix .`\nNew Example command:\n`.help`").add()
+const (
+	maxPrefixes   = 10
+	maxPrefixSize = 32
+)
+
+// guildPrefix is one of the prefixes a guild can use for commands
+type guildPrefix struct {
+	Text       string `json:"text"`
+	IgnoreCase bool   `json:"ignore_case,omitempty"`
 }
 
-func prefixWorker(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) (prefix string, ok bool) {
-	prefix = strings.Join(msglist[1:], " ")
+type prefixes []guildPrefix
 
-	for {
-		next := <-nextMessageCreate(s)
-		if next.ChannelID != m.ChannelID || next.Author.ID != m.Author.ID {
-			continue
+// UnmarshalJSON also accepts the single prefix string guilds used to have
+func (p *prefixes) UnmarshalJSON(b []byte) error {
+	var old string
+	if err := json.Unmarshal(b, &old); err == nil {
+		*p = nil
+		if strings.TrimSpace(old) != "" {
+			*p = prefixes{{Text: strings.TrimSpace(old)}}
 		}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]guildPrefix)(p))
+}
 
-		response := strings.ToLower(next.Content)
-		if response != "yes" && response != "no" {
-			s.ChannelMessageSend(m.ChannelID, "Invalid response. Command cancelled.")
-			return
-		}
-
-		f := func() string {
-			if response == "yes" {
-				return " "
-			}
-			return ""
+func (p prefixes) find(text string) int {
+	for i, prefix := range p {
+		if prefix.Text == text {
+			return i
 		}
+	}
+	return -1
+}
 
-		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Prefix changed to %s %s a trailing space", codeSeg(prefix), func() string {
-			if f() == "" {
-				return "without"
-			}
-			return "with"
-		}()))
+// trim removes the prefix and any whitespace after it from content
+func (p guildPrefix) trim(content string) (string, bool) {
+	text := strings.TrimSpace(p.Text)
+	if text == "" || len(content) < len(text) {
+		return "", false
+	}
 
-		return prefix + f(), true
+	start := content[:len(text)]
+	if start != text && !(p.IgnoreCase && strings.EqualFold(start, text)) {
+		return "", false
 	}
+	return strings.TrimLeftFunc(content[len(text):], unicode.IsSpace), true
 }
 
-func msgPrefix(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	if len(msglist) < 2 {
-		s.ChannelMessageSend(m.ChannelID, "No prefix given :/")
-		return
+// display returns the prefix as it should be written before a command, adding
+// a space after prefixes that are words so examples stay readable
+func (p guildPrefix) display() string {
+	text := strings.TrimSpace(p.Text)
+	if r, _ := utf8.DecodeLastRuneInString(text); unicode.IsLetter(r) || unicode.IsDigit(r) {
+		return text + " "
 	}
+	return text
+}
 
-	guildDetails, err := guildDetails(m.ChannelID, "", s)
-	if err != nil {
-		s.ChannelMessageSend(m.ChannelID, "There was a problem changing the prefix :( Try again please~")
-		return
+// globalPrefix returns the global prefix as it should be written before a command
+func globalPrefix() string {
+	return guildPrefix{Text: conf().Prefix}.display()
+}
+
+// prefix returns the prefix shown in help and examples for the guild
+func (g *server) prefix() string {
+	if g == nil || len(g.Prefixes) == 0 {
+		return globalPrefix()
 	}
+	return g.Prefixes[0].display()
+}
 
-	guild, ok := sMap.server(guildDetails.ID)
-	if !ok || guild.Kicked {
-		return
+// trimPrefix removes whichever prefix content starts with, returning false
+// if there isn't one. Mentioning the bot and the global prefix work
+// everywhere. guild is nil in DMs.
+func trimPrefix(s session, content string, guild *server) (string, bool) {
+	botID := s.state().User.ID
+	for _, mention := range []string{"<@" + botID + ">", "<@!" + botID + ">"} {
+		if strings.HasPrefix(content, mention) {
+			return strings.TrimLeftFunc(content[len(mention):], unicode.IsSpace), true
+		}
 	}
 
-	prefix := strings.Join(msglist[1:], " ")
+	candidates := prefixes{{Text: conf().Prefix}}
+	if guild != nil {
+		candidates = append(candidates, guild.Prefixes...)
+	}
 
-	s.ChannelMessageSend(m.ChannelID, "Do you want trailing space? (yes/no)"+
-		"```"+
-		prefix+" help -> with trailing space\n"+
-		prefix+"help -> without trailing space```")
+	// Longest first so that `!` doesn't win over `!!`
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return len(strings.TrimSpace(candidates[i].Text)) > len(strings.TrimSpace(candidates[j].Text))
+	})
 
-	if prefix, ok = prefixWorker(s, m, msglist); ok {
-		guild.Prefix = prefix
-		saveServers()
+	for _, p := range candidates {
+		if rest, ok := p.trim(content); ok {
+			return rest, true
+		}
 	}
+	return "", false
+}
+
+func init() {
+	manage := discordgo.PermissionAdministrator | discordgo.PermissionManageServer
+
+	newCommand("setGlobalPrefix", 0, false, msgGlobalPrefix).setArgs(greedyArg("prefix")).ownerOnly().allowDMs().setCategory(categoryOwner).add()
+	newCommand("prefix", 0, false, nil).subcommands(
+		newCommand("list", 0, false, msgListPrefixes).setHelp("Lists the prefixes that can be used in this server"),
+		newCommand("add", manage, true, msgAddPrefix).setArgs(greedyArg("prefix")).setHelp("Adds a prefix for this server. Prefixes are case sensitive unless changed with `prefix ignorecase`").
+			examples("prefix add ?", "prefix add hey 2Bot"),
+		newCommand("remove", manage, true, msgRemovePrefix).setArgs(greedyArg("prefix")).setHelp("Removes one of this servers prefixes"),
+		newCommand("ignorecase", manage, true, msgTogglePrefixCase).setArgs(greedyArg("prefix")).setHelp("Toggles whether a prefix has to match upper and lower case exactly").
+			examples("prefix ignorecase owo"),
+		newCommand("reset", manage, true, msgResetPrefixes).setHelp("Removes all of this servers prefixes, leaving only the global prefix"),
+	).setHelp("Manage the prefixes for this server.\n"+
+		"Mentioning 2Bot and the global prefix always work, so you can use `@2Bot prefix list` if you forget them.").
+		examples("prefix list", "prefix add ?").setCategory(categoryModeration).unrestricted().add()
 }
 
-func msgGlobalPrefix(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	if len(msglist) < 2 {
+func msgListPrefixes(s session, m *discordgo.MessageCreate, _ args) {
+	lines := []string{
+		s.state().User.Mention(),
+		codeSeg(strings.TrimSpace(conf().Prefix)) + " (global)",
+	}
+	if !viewSettings(s, m, func(_ *discordgo.Guild, srvr *server) {
+		for _, p := range srvr.Prefixes {
+			line := codeSeg(p.Text)
+			if p.IgnoreCase {
+				line += " (ignores case)"
+			}
+			lines = append(lines, line)
+		}
+	}) {
 		return
 	}
 
-	if prefix, ok := prefixWorker(s, m, msglist); ok {
-		conf.Prefix = prefix
-		saveConfig()
+	s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
+		Color: 0,
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "Prefixes", Value: strings.Join(lines, "\n")},
+		},
+	})
+}
+
+func msgAddPrefix(s session, m *discordgo.MessageCreate, a args) {
+	text := a.str("prefix")
+	switch {
+	case len(text) > maxPrefixSize:
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Prefixes can be at most %d characters long", maxPrefixSize))
+		return
+	case strings.Contains(text, "`"):
+		s.ChannelMessageSend(m.ChannelID, "Prefixes can't contain backticks")
+		return
 	}
+
+	updateSettings(s, m, func(_ *discordgo.Guild, srvr *server) (string, bool) {
+		switch {
+		case srvr.Prefixes.find(text) != -1:
+			return codeSeg(text) + " is already a prefix", false
+		case len(srvr.Prefixes) >= maxPrefixes:
+			return fmt.Sprintf("This server already has %d prefixes. Remove some first!", maxPrefixes), false
+		}
+
+		srvr.Prefixes = append(srvr.Prefixes, guildPrefix{Text: text})
+		return fmt.Sprintf("Added prefix %s. Try %s", codeSeg(text), codeSeg(guildPrefix{Text: text}.display()+"help")), true
+	})
+}
+
+func msgRemovePrefix(s session, m *discordgo.MessageCreate, a args) {
+	text := a.str("prefix")
+	updateSettings(s, m, func(_ *discordgo.Guild, srvr *server) (string, bool) {
+		i := srvr.Prefixes.find(text)
+		if i == -1 {
+			return codeSeg(text) + " isn't one of this servers prefixes", false
+		}
+
+		srvr.Prefixes = append(srvr.Prefixes[:i], srvr.Prefixes[i+1:]...)
+		return "Removed prefix " + codeSeg(text), true
+	})
+}
+
+func msgTogglePrefixCase(s session, m *discordgo.MessageCreate, a args) {
+	text := a.str("prefix")
+	updateSettings(s, m, func(_ *discordgo.Guild, srvr *server) (string, bool) {
+		i := srvr.Prefixes.find(text)
+		if i == -1 {
+			return codeSeg(text) + " isn't one of this servers prefixes", false
+		}
+
+		srvr.Prefixes[i].IgnoreCase = !srvr.Prefixes[i].IgnoreCase
+
+		if srvr.Prefixes[i].IgnoreCase {
+			return "Prefix " + codeSeg(text) + " now ignores case", true
+		}
+		return "Prefix " + codeSeg(text) + " is now case sensitive", true
+	})
+}
+
+func msgResetPrefixes(s session, m *discordgo.MessageCreate, _ args) {
+	updateSettings(s, m, func(_ *discordgo.Guild, srvr *server) (string, bool) {
+		srvr.Prefixes = nil
+		return "Removed all prefixes. Use " + codeSeg(globalPrefix()+"help") + " or mention me instead", true
+	})
+}
+
+func msgGlobalPrefix(s session, m *discordgo.MessageCreate, a args) {
+	prefix := a.str("prefix")
+	updateConf(func(c *config) { c.Prefix = prefix })
+	persist.markConfig()
+
+	s.ChannelMessageSend(m.ChannelID, "Global prefix changed to "+codeSeg(prefix))
 }
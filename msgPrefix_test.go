@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestTrimPrefix(t *testing.T) {
+	guild := &server{Prefixes: prefixes{{Text: "!"}, {Text: "!!"}, {Text: "owo", IgnoreCase: true}, {Text: "Hey 2Bot"}}}
+
+	tests := []struct {
+		name    string
+		content string
+		guild   *server
+		want    string
+		wantOk  bool
+	}{
+		{"global", "!owo help", guild, "help", true},
+		{"global in DMs", "!owo help", nil, "help", true},
+		{"mention", "<@" + testBotID + "> help", guild, "help", true},
+		{"nickname mention", "<@!" + testBotID + ">help", nil, "help", true},
+		{"other mention", "<@" + testUserID + "> help", guild, "", false},
+		{"guild prefix", "!help", guild, "help", true},
+		{"longest prefix wins", "!!help", guild, "help", true},
+		{"space after prefix", "! help", guild, "help", true},
+		{"ignore case", "OwO help", guild, "help", true},
+		{"case sensitive", "hey 2bot help", guild, "", false},
+		{"multiple words", "Hey 2Bot help", guild, "help", true},
+		{"guild prefix in other guilds", "!help", &server{}, "", false},
+		{"no prefix", "help", guild, "", false},
+	}
+
+	f := newFakeSession()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState()
+
+			got, ok := trimPrefix(f, tt.content, tt.guild)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("expected (%q, %v), got (%q, %v)", tt.want, tt.wantOk, got, ok)
+			}
+		})
+	}
+}
+
+func TestPrefixCommands(t *testing.T) {
+	tests := []struct {
+		name    string
+		before  prefixes
+		content string
+		want    prefixes
+		wantMsg string
+	}{
+		{
+			name:    "add",
+			content: "prefix add hey 2Bot",
+			want:    prefixes{{Text: "hey 2Bot"}},
+			wantMsg: "Added prefix `hey 2Bot`. Try `hey 2Bot help`",
+		},
+		{
+			name:    "add duplicate",
+			before:  prefixes{{Text: "!"}},
+			content: "prefix add !",
+			want:    prefixes{{Text: "!"}},
+			wantMsg: "`!` is already a prefix",
+		},
+		{
+			name:    "add backtick",
+			content: "prefix add `",
+			wantMsg: "Prefixes can't contain backticks",
+		},
+		{
+			name:    "remove",
+			before:  prefixes{{Text: "!"}, {Text: "?"}},
+			content: "prefix remove !",
+			want:    prefixes{{Text: "?"}},
+			wantMsg: "Removed prefix `!`",
+		},
+		{
+			name:    "remove unknown",
+			before:  prefixes{{Text: "?"}},
+			content: "prefix remove !",
+			want:    prefixes{{Text: "?"}},
+			wantMsg: "`!` isn't one of this servers prefixes",
+		},
+		{
+			name:    "ignore case",
+			before:  prefixes{{Text: "owo"}},
+			content: "prefix ignorecase owo",
+			want:    prefixes{{Text: "owo", IgnoreCase: true}},
+			wantMsg: "Prefix `owo` now ignores case",
+		},
+		{
+			name:    "reset",
+			before:  prefixes{{Text: "!"}, {Text: "?"}},
+			content: "prefix reset",
+			wantMsg: "Removed all prefixes. Use `!owo help` or mention me instead",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState()
+			sMap.update(testGuildID, func(g *server) { g.Prefixes = tt.before })
+			f := newFakeSession()
+
+			f.run(testOwnerID, tt.content)
+
+			g := testGuild()
+			if len(g.Prefixes) != 0 || len(tt.want) != 0 {
+				if !reflect.DeepEqual(g.Prefixes, tt.want) {
+					t.Errorf("expected prefixes %v, got %v", tt.want, g.Prefixes)
+				}
+			}
+
+			sent := f.messages(testChannelID)
+			if len(sent) != 1 || sent[0] != tt.wantMsg {
+				t.Errorf("expected %q, got %q", tt.wantMsg, sent)
+			}
+		})
+	}
+}
+
+func TestPrefixesUnmarshal(t *testing.T) {
+	tests := []struct {
+		in   string
+		want prefixes
+	}{
+		{`{"server_prefix":"!owo "}`, prefixes{{Text: "!owo"}}},
+		{`{"server_prefix":""}`, nil},
+		{`{"server_prefix":[{"text":"!"},{"text":"owo","ignore_case":true}]}`, prefixes{{Text: "!"}, {Text: "owo", IgnoreCase: true}}},
+	}
+
+	for _, tt := range tests {
+		var g server
+		if err := json.Unmarshal([]byte(tt.in), &g); err != nil {
+			t.Fatalf("error unmarshalling %s: %v", tt.in, err)
+		}
+		if !reflect.DeepEqual(g.Prefixes, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.in, tt.want, g.Prefixes)
+		}
+	}
+}
@@ -1,62 +1,47 @@
 package main
 
 import (
-	"fmt"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
 
+// How long the confirmation stays up after purging
+var purgeConfirmDelay = time.Second * 5
+
 func init() {
 	newCommand("purge",
 		discordgo.PermissionAdministrator|discordgo.PermissionManageMessages|discordgo.PermissionManageServer,
-		true, msgPurge).setHelp("Args: [number] [@user]\n\nPurges 'number' amount of messages. Optionally, purge only the messages from a given user!\nAdmin only\n\nExample:\n`!owo purge 300`\n" +
-		"Example 2:\n`!owo purge 300 @Strum355#1180`").add()
+		true, msgPurge).setArgs(intArg("amount", 1, 1000), userArg("user").optional()).
+		cooldown(cooldownChannel, 1, time.Second*10).setHelp("Purges 'amount' messages. Optionally, purge only the messages from a given user!").
+		examples("purge 300", "purge 300 @Strum355#1180").setCategory(categoryModeration).add()
 }
 
-func msgPurge(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	if len(msglist) < 2 {
-		s.ChannelMessageSend(m.ChannelID, "Gotta specify a number of messages to delete~")
-		return
-	}
-
-	purgeAmount, err := strconv.Atoi(msglist[1])
-	if err != nil {
-		if strings.HasPrefix(msglist[1], "@") {
-			msglist[1] = "@" + zerowidth + strings.TrimPrefix(msglist[1], "@")
-		}
-		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("How do i delete %s messages? Please only give numbers!", msglist[1]))
-		return
-	}
-
-	var userToPurge string
-	if len(msglist) == 3 {
-		submatch := userIDRegex.FindStringSubmatch(msglist[2])
-		if len(submatch) == 0 {
-			s.ChannelMessageSend(m.ChannelID, "Couldn't find that user :(")
-			return
-		}
-		userToPurge = submatch[1]
-	}
+func msgPurge(s session, m *discordgo.MessageCreate, a args) {
+	purgeAmount := a.num("amount")
+	userToPurge := a.str("user")
 
 	deleteMessage(m.Message, s)
 
+	var err error
+
 	if userToPurge == "" {
 		err = standardPurge(purgeAmount, s, m)
 	} else {
 		err = userPurge(purgeAmount, s, m, userToPurge)
 	}
 
-	if err == nil {
-		msg, _ := s.ChannelMessageSend(m.ChannelID, "Successfully deleted :ok_hand:")
-		time.Sleep(time.Second * 5)
-		deleteMessage(msg, s)
+	if err != nil {
+		a.fail()
+		return
 	}
+
+	msg, _ := s.ChannelMessageSend(m.ChannelID, "Successfully deleted :ok_hand:")
+	time.Sleep(purgeConfirmDelay)
+	deleteMessage(msg, s)
 }
 
-func getMessages(amount int, id string, s *discordgo.Session) (list []*discordgo.Message, err error) {
+func getMessages(amount int, id string, s session) (list []*discordgo.Message, err error) {
 	list, err = s.ChannelMessages(id, amount, "", "", "")
 	if err != nil {
 		log.Error("error getting messages to delete", err)
@@ -64,7 +49,7 @@ func getMessages(amount int, id string, s *discordgo.Session) (list []*discordgo
 	return
 }
 
-func standardPurge(purgeAmount int, s *discordgo.Session, m *discordgo.MessageCreate) error {
+func standardPurge(purgeAmount int, s session, m *discordgo.MessageCreate) error {
 	var outOfDate bool
 	for purgeAmount > 0 {
 		list, err := getMessages(purgeAmount%100, m.ChannelID, s)
@@ -108,7 +93,7 @@ func standardPurge(purgeAmount int, s *discordgo.Session, m *discordgo.MessageCr
 	return nil
 }
 
-func userPurge(purgeAmount int, s *discordgo.Session, m *discordgo.MessageCreate, userToPurge string) error {
+func userPurge(purgeAmount int, s session, m *discordgo.MessageCreate, userToPurge string) error {
 	var outOfDate bool
 	for purgeAmount > 0 {
 		del := purgeAmount % 100
@@ -168,7 +153,7 @@ func userPurge(purgeAmount int, s *discordgo.Session, m *discordgo.MessageCreate
 	return nil
 }
 
-func massDelete(list []string, s *discordgo.Session, m *discordgo.MessageCreate) (err error) {
+func massDelete(list []string, s session, m *discordgo.MessageCreate) (err error) {
 	if err = s.ChannelMessagesBulkDelete(m.ChannelID, list); err != nil {
 		s.ChannelMessageSend(m.ChannelID, "There was an issue deleting messages :(")
 		log.Error("error purging", err)
@@ -176,7 +161,7 @@ func massDelete(list []string, s *discordgo.Session, m *discordgo.MessageCreate)
 	return
 }
 
-func getMessageAge(msg *discordgo.Message, s *discordgo.Session, m *discordgo.MessageCreate) (time.Duration, error) {
+func getMessageAge(msg *discordgo.Message, s session, m *discordgo.MessageCreate) (time.Duration, error) {
 	then, err := msg.Timestamp.Parse()
 	if err != nil {
 		log.Error("error parsing time", err)
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestPurge(t *testing.T) {
+	type msg struct {
+		author string
+		age    time.Duration
+	}
+
+	const other = "100000000000000099"
+	day := time.Hour * 24
+
+	tests := []struct {
+		name    string
+		content string
+		// Newest first
+		history []msg
+		// Indexes of the messages in history that should be left over
+		want []int
+	}{
+		{
+			name:    "some",
+			content: "purge 3",
+			history: []msg{{testUserID, 0}, {other, 0}, {testUserID, 0}, {other, 0}, {testUserID, 0}},
+			want:    []int{3, 4},
+		},
+		{
+			name:    "more than exist",
+			content: "purge 10",
+			history: []msg{{testUserID, 0}, {other, 0}, {testUserID, 0}},
+			want:    nil,
+		},
+		{
+			name:    "stops at two weeks old",
+			content: "purge 4",
+			history: []msg{{testUserID, day}, {other, day * 13}, {testUserID, day * 14}, {other, day * 20}},
+			want:    []int{2, 3},
+		},
+		{
+			name:    "single user",
+			content: "purge 2 <@" + testUserID + ">",
+			history: []msg{{testUserID, 0}, {other, 0}, {testUserID, 0}, {testUserID, 0}},
+			want:    []int{1, 3},
+		},
+		{
+			name:    "single user by ID",
+			content: "purge 1 " + other,
+			history: []msg{{testUserID, 0}, {other, 0}, {other, 0}},
+			want:    []int{0, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState()
+			f := newFakeSession()
+
+			var ids []string
+			for _, h := range tt.history {
+				m := f.message(h.author, "hello")
+				m.Timestamp = discordgo.Timestamp(time.Now().Add(-h.age).Format(time.RFC3339))
+				f.history[testChannelID] = append(f.history[testChannelID], m.Message)
+				ids = append(ids, m.ID)
+			}
+
+			f.run(testOwnerID, tt.content)
+
+			var want, got []string
+			for _, i := range tt.want {
+				want = append(want, ids[i])
+			}
+			for _, m := range f.history[testChannelID] {
+				got = append(got, m.ID)
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %v to be left, got %v", want, got)
+			}
+
+			sent := f.messages(testChannelID)
+			if len(sent) != 1 || sent[0] != "Successfully deleted :ok_hand:" {
+				t.Errorf("expected only a confirmation, got %q", sent)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Longest reason review history shows before cutting it off
+const maxHistoryReason = 100
+
+func init() {
+	newCommand("review", 0, false, nil).subcommands(
+		newCommand("history", 0, false, msgReviewHistory).setArgs(userArg("user")).
+			setHelp("Shows the latest review decisions about the users images, and the ones they made, from the review audit log").
+			examples("review history @User"),
+	).ownerOnly().allowDMs().setCategory(categoryOwner).add()
+}
+
+func (e auditEntry) String() string {
+	by := "2Bot"
+	if e.ReviewerID != "" {
+		by = codeSeg(e.ReviewerID)
+	}
+
+	line := fmt.Sprintf("`%s` %s image %d %s by %s, saved by %s",
+		e.Time.Format("2006-01-02 15:04"), e.Action, e.Image, codeSeg(e.ImageName), by, codeSeg(e.AuthorID))
+	if len(e.ImageHash) > 12 {
+		line += " hash " + codeSeg(e.ImageHash[:12])
+	}
+	if e.Reason != "" {
+		reason := e.Reason
+		if len(reason) > maxHistoryReason {
+			reason = reason[:maxHistoryReason] + "..."
+		}
+		line += "\nReason: " + reason
+	}
+	return line
+}
+
+func msgReviewHistory(s session, m *discordgo.MessageCreate, a args) {
+	userID := a.str("user")
+
+	entries, err := reviewAudit.history(userID)
+	if err != nil {
+		log.Error("error reading review audit log", err)
+		s.ChannelMessageSend(m.ChannelID, "There was a problem reading the review history :( Try again please~")
+		a.fail()
+		return
+	}
+	if len(entries) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "Nothing in the review history about "+codeSeg(userID))
+		return
+	}
+
+	// As many of the latest entries as fit in a message, oldest first
+	var lines []string
+	size := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		line := entries[i].String()
+		if size+len(line) > 1800 {
+			break
+		}
+		size += len(line) + 1
+		lines = append([]string{line}, lines...)
+	}
+
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Latest %d of %d review decisions about %s:\n%s",
+		len(lines), len(entries), codeSeg(userID), strings.Join(lines, "\n")))
+}
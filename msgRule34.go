@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
@@ -18,27 +19,26 @@ type rule34 struct {
 }
 
 func init() {
-	newCommand("r34", 0, false, msgRule34).setHelp("Args: [search]\n\nReturns a random image from rule34 for the given search term.\n\nExample:\n`!owo r34 lewds`").add()
+	newCommand("r34", 0, false, msgRule34).setArgs(greedyArg("search")).cooldown(cooldownUser, 3, time.Second*30).setHelp("Returns a random image from rule34 for the given search term.").examples("r34 lewds").setCategory(categoryNSFW).add()
 }
 
-func msgRule34(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	if len(msglist) < 2 {
-		return
-	}
-
+func msgRule34(s session, m *discordgo.MessageCreate, a args) {
 	channel, err := channelDetails(m.ChannelID, s)
 	if err != nil {
 		s.ChannelMessageSend(m.ChannelID, "There was a problem getting some details :( Please try again!")
+		a.fail()
 		return
 	}
 
 	guild, err := guildDetails("", channel.GuildID, s)
 	if err != nil {
 		s.ChannelMessageSend(m.ChannelID, "There was a problem getting some details :( Please try again!")
+		a.fail()
 		return
 	}
 
-	if val, ok := sMap.server(guild.ID); ok && !val.Nsfw && (!strings.HasPrefix(channel.Name, "nsfw") && !channel.NSFW) {
+	var nsfw bool
+	if sMap.view(guild.ID, func(val *server) { nsfw = val.Nsfw }) && !nsfw && (!strings.HasPrefix(channel.Name, "nsfw") && !channel.NSFW) {
 		s.ChannelMessageSend(m.ChannelID, "NSFW is disabled on this server~")
 		return
 	}
@@ -48,7 +48,7 @@ func msgRule34(s *discordgo.Session, m *discordgo.MessageCreate, msglist []strin
 
 	s.ChannelTyping(m.ChannelID)
 
-	for _, word := range msglist[1:] {
+	for _, word := range strings.Fields(a.str("search")) {
 		query += "+" + word
 	}
 
@@ -57,6 +57,7 @@ func msgRule34(s *discordgo.Session, m *discordgo.MessageCreate, msglist []strin
 	if err != nil {
 		s.ChannelMessageSend(m.ChannelID, "error getting data from Rule34 :(")
 		log.Error("error from r34", err)
+		a.fail()
 		return
 	}
 	defer page.Body.Close()
@@ -64,11 +65,13 @@ func msgRule34(s *discordgo.Session, m *discordgo.MessageCreate, msglist []strin
 	if page.StatusCode != http.StatusOK {
 		s.ChannelMessageSend(m.ChannelID, "Rule34 didn't respond :(")
 		log.Error("non 200 status code", url)
+		a.fail()
 		return
 	}
 
 	if err = xml.NewDecoder(page.Body).Decode(&r34); err != nil {
 		log.Error("error unmarshalling xml", err)
+		a.fail()
 		return
 	}
 
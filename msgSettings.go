@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func init() {
+	newCommand("settings",
+		discordgo.PermissionAdministrator|discordgo.PermissionManageServer,
+		true, nil).subcommands(
+		newCommand("cooldown", 0, false, nil).subcommands(
+			newCommand("set", 0, false, msgSetCooldown).setArgs(wordArg("scope"), intArg("uses", 0, 100), durationArg("per"), greedyArg("command")).
+				setHelp("Overrides a commands cooldown for this server. Scope is one of `user`, `channel` or `guild`. Set uses to 0 to remove the limit.").examples("settings cooldown set user 2 30s encode"),
+			newCommand("reset", 0, false, msgResetCooldown).setArgs(greedyArg("command")).setHelp("Goes back to the default cooldown for a command"),
+			newCommand("list", 0, false, msgListCooldowns).setHelp("Lists the cooldown overrides for this server"),
+		).setHelp("Manage command cooldowns for this server"),
+		newCommand("disable", 0, false, msgDisableForGuild).setArgs(greedyArg("target")).
+			setHelp("Disables a command or a whole category of commands in this server.").examples("settings disable r34", "settings disable NSFW"),
+		newCommand("enable", 0, false, msgEnableForGuild).setArgs(greedyArg("target")).setHelp("Enables a command or category that was disabled in this server"),
+		newCommand("channels", 0, false, nil).subcommands(
+			newCommand("allow", 0, false, msgAllowChannel).setArgs(channelArg("channel"), greedyArg("target")).
+				setHelp("Only allow a command or category in the given channels. Can be used multiple times to allow more channels.").examples("settings channels allow #music Music"),
+			newCommand("deny", 0, false, msgDenyChannel).setArgs(channelArg("channel"), greedyArg("target")).setHelp("Stops a command or category being used in the given channel"),
+			newCommand("clear", 0, false, msgClearChannels).setArgs(greedyArg("target")).setHelp("Removes all channel restrictions for a command or category"),
+		).setHelp("Restrict commands or categories to certain channels"),
+		newCommand("rules", 0, false, msgListRules).setHelp("Lists the disabled commands and channel restrictions in this server"),
+		newCommand("suggestions", 0, false, msgToggleSuggestions).setHelp("Toggles suggesting similar commands when someone uses one that doesn't exist"),
+	).setHelp("Change how 2Bot behaves in this server.").setCategory(categoryModeration).unrestricted().add()
+}
+
+// settingsGuild returns the server the message was sent in, or false if
+// there are no settings for it
+func settingsGuild(s session, m *discordgo.MessageCreate) (*discordgo.Guild, bool) {
+	guild, err := guildDetails(m.ChannelID, "", s)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, "There was a problem getting the server details :( Try again please~")
+		return nil, false
+	}
+	return guild, true
+}
+
+// viewSettings calls f with the settings of the server the message was sent
+// in while they can't be changed, returning false if there are none. f
+// shouldn't send anything, so copy out what's needed.
+func viewSettings(s session, m *discordgo.MessageCreate, f func(guild *discordgo.Guild, srvr *server)) bool {
+	guild, ok := settingsGuild(s, m)
+	if !ok {
+		return false
+	}
+
+	var kicked bool
+	ok = sMap.view(guild.ID, func(srvr *server) {
+		if kicked = srvr.Kicked; !kicked {
+			f(guild, srvr)
+		}
+	})
+	return ok && !kicked
+}
+
+// updateSettings calls f with the settings of the server the message was
+// sent in while nothing else can read or change them. f returns the reply
+// and whether it changed anything, in which case the server is saved.
+func updateSettings(s session, m *discordgo.MessageCreate, f func(guild *discordgo.Guild, srvr *server) (string, bool)) {
+	guild, ok := settingsGuild(s, m)
+	if !ok {
+		return
+	}
+
+	var reply string
+	var changed bool
+	sMap.update(guild.ID, func(srvr *server) {
+		if !srvr.Kicked {
+			reply, changed = f(guild, srvr)
+		}
+	})
+
+	if changed {
+		persist.markServer(guild.ID)
+	}
+	if reply != "" {
+		s.ChannelMessageSend(m.ChannelID, reply)
+	}
+}
+
+func msgSetCooldown(s session, m *discordgo.MessageCreate, a args) {
+	scope := cooldownScope(strings.ToLower(a.str("scope")))
+	if scope != cooldownUser && scope != cooldownChannel && scope != cooldownGuild {
+		s.ChannelMessageSend(m.ChannelID, "Scope has to be one of `user`, `channel` or `guild`")
+		return
+	}
+
+	comm, ok := lookupCommand(a.str("command"))
+	if !ok {
+		s.ChannelMessageSend(m.ChannelID, "No command called "+codeSeg(a.str("command")))
+		return
+	}
+
+	cd := cooldown{Scope: scope, Uses: a.num("uses"), Per: a.dur("per")}
+	updateSettings(s, m, func(_ *discordgo.Guild, srvr *server) (string, bool) {
+		if srvr.Cooldowns == nil {
+			srvr.Cooldowns = make(map[string]cooldown)
+		}
+		srvr.Cooldowns[strings.ToLower(comm.FullName)] = cd
+
+		if cd.Uses == 0 {
+			return fmt.Sprintf("Removed the cooldown for %s", codeSeg(comm.FullName)), true
+		}
+		return fmt.Sprintf("Cooldown for %s set to %s", codeSeg(comm.FullName), cd), true
+	})
+}
+
+func msgResetCooldown(s session, m *discordgo.MessageCreate, a args) {
+	name := strings.ToLower(strings.Join(strings.Fields(a.str("command")), " "))
+	updateSettings(s, m, func(_ *discordgo.Guild, srvr *server) (string, bool) {
+		if _, ok := srvr.Cooldowns[name]; !ok {
+			return "There's no cooldown override for " + codeSeg(name), false
+		}
+
+		delete(srvr.Cooldowns, name)
+		return "Reset the cooldown for " + codeSeg(name), true
+	})
+}
+
+func msgListCooldowns(s session, m *discordgo.MessageCreate, _ args) {
+	var out []string
+	if !viewSettings(s, m, func(_ *discordgo.Guild, srvr *server) {
+		for name, cd := range srvr.Cooldowns {
+			if cd.Uses == 0 {
+				out = append(out, fmt.Sprintf("%s: no limit", name))
+				continue
+			}
+			out = append(out, fmt.Sprintf("%s: %s", name, cd))
+		}
+	}) {
+		return
+	}
+
+	if len(out) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "No cooldown overrides set for this server")
+		return
+	}
+	sort.Strings(out)
+
+	s.ChannelMessageSend(m.ChannelID, codeBlock(strings.Join(out, "\n")))
+}
+
+func msgDisableForGuild(s session, m *discordgo.MessageCreate, a args) {
+	setGuildDisabled(s, m, a.str("target"), true)
+}
+
+func msgEnableForGuild(s session, m *discordgo.MessageCreate, a args) {
+	setGuildDisabled(s, m, a.str("target"), false)
+}
+
+func setGuildDisabled(s session, m *discordgo.MessageCreate, target string, disabled bool) {
+	updateSettings(s, m, func(_ *discordgo.Guild, srvr *server) (string, bool) {
+		rules, name, ok := srvr.rulesFor(target)
+		if !ok {
+			return "No command or category called " + codeSeg(target), false
+		}
+
+		rules.Disabled = disabled
+		srvr.pruneRules()
+
+		if disabled {
+			return fmt.Sprintf("Disabled %s in this server", codeSeg(name)), true
+		}
+		return fmt.Sprintf("Enabled %s in this server", codeSeg(name)), true
+	})
+}
+
+func msgAllowChannel(s session, m *discordgo.MessageCreate, a args) {
+	setChannelRule(s, m, a, (*commandRules).allow, "can now be used in")
+}
+
+func msgDenyChannel(s session, m *discordgo.MessageCreate, a args) {
+	setChannelRule(s, m, a, (*commandRules).deny, "can no longer be used in")
+}
+
+func setChannelRule(s session, m *discordgo.MessageCreate, a args, apply func(*commandRules, string), msg string) {
+	channelID := a.str("channel")
+	target := a.str("target")
+
+	updateSettings(s, m, func(guild *discordgo.Guild, srvr *server) (string, bool) {
+		var inGuild bool
+		for _, channel := range guild.Channels {
+			if channel.ID == channelID {
+				inGuild = true
+				break
+			}
+		}
+
+		if !inGuild {
+			return "That channel isn't in this server <:2BThink:333694872802426880>", false
+		}
+
+		rules, name, ok := srvr.rulesFor(target)
+		if !ok {
+			return "No command or category called " + codeSeg(target), false
+		}
+
+		apply(rules, channelID)
+		return fmt.Sprintf("%s %s <#%s>", codeSeg(name), msg, channelID), true
+	})
+}
+
+func msgClearChannels(s session, m *discordgo.MessageCreate, a args) {
+	target := a.str("target")
+	updateSettings(s, m, func(_ *discordgo.Guild, srvr *server) (string, bool) {
+		rules, name, ok := srvr.rulesFor(target)
+		if !ok {
+			return "No command or category called " + codeSeg(target), false
+		}
+
+		rules.Allowed = nil
+		rules.Denied = nil
+		srvr.pruneRules()
+		return fmt.Sprintf("Cleared channel restrictions for %s", codeSeg(name)), true
+	})
+}
+
+func msgToggleSuggestions(s session, m *discordgo.MessageCreate, _ args) {
+	updateSettings(s, m, func(_ *discordgo.Guild, srvr *server) (string, bool) {
+		srvr.NoSuggestions = !srvr.NoSuggestions
+
+		if srvr.NoSuggestions {
+			return "I'll no longer suggest commands when an unknown one is used", true
+		}
+		return "I'll suggest similar commands when an unknown one is used", true
+	})
+}
+
+func msgListRules(s session, m *discordgo.MessageCreate, _ args) {
+	var fields []*discordgo.MessageEmbedField
+	if !viewSettings(s, m, func(_ *discordgo.Guild, srvr *server) {
+		for _, category := range categories {
+			if rules, ok := srvr.CategoryRules[strings.ToLower(category)]; ok {
+				fields = append(fields, &discordgo.MessageEmbedField{Name: category + " (category)", Value: rules.String()})
+			}
+		}
+
+		var names []string
+		for name := range srvr.CommandRules {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fields = append(fields, &discordgo.MessageEmbedField{Name: name, Value: srvr.CommandRules[name].String()})
+		}
+	}) {
+		return
+	}
+
+	if len(fields) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "No commands are disabled or restricted in this server")
+		return
+	}
+
+	s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
+		Title:  "Command rules",
+		Fields: fields,
+	})
+}
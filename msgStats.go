@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const topStats = 10
+
+func init() {
+	newCommand("stats", 0, false, nil).subcommands(
+		newCommand("commands", 0, false, msgCommandStats).setArgs(wordArg("period").optional()).
+			setHelp("Shows the most used commands and servers and the commands that fail the most. "+
+				"The period can be `hour`, `day`, `week` or `month` and defaults to `day`").
+			examples("stats commands", "stats commands week"),
+		newCommand("storage", 0, false, msgStorageStats).
+			setHelp("Shows how many changes are waiting to be saved, and how long saving them takes and how often it fails"),
+	).ownerOnly().allowDMs().setCategory(categoryOwner).add()
+}
+
+func periodNames() string {
+	var names []string
+	for _, p := range usagePeriods {
+		names = append(names, codeSeg(p.Name))
+	}
+	return strings.Join(names, ", ")
+}
+
+func msgCommandStats(s session, m *discordgo.MessageCreate, a args) {
+	name := "day"
+	if a.has("period") {
+		name = strings.ToLower(a.str("period"))
+	}
+
+	period, ok := findUsagePeriod(name)
+	if !ok {
+		s.ChannelMessageSend(m.ChannelID, "Unknown period "+codeSeg(name)+". Use one of "+periodNames())
+		return
+	}
+
+	summary := commandStats.summary(period, time.Now())
+	if summary.Total.Uses == 0 {
+		s.ChannelMessageSend(m.ChannelID, "No commands have been used in the last "+period.Name)
+		return
+	}
+
+	var commands, guilds, failing []string
+	for _, c := range summary.Commands[:min(len(summary.Commands), topStats)] {
+		commands = append(commands, fmt.Sprintf("%s %d (avg %s)", codeSeg(c.Name), c.Uses, c.avgLatency().Round(time.Millisecond)))
+	}
+
+	for _, g := range summary.Guilds[:min(len(summary.Guilds), topStats)] {
+		name := g.Name
+		if guild, err := s.state().Guild(g.Name); err == nil {
+			name = guild.Name
+		}
+		guilds = append(guilds, fmt.Sprintf("%s %d", codeSeg(name), g.Uses))
+	}
+
+	for _, c := range byErrorRate(summary.Commands) {
+		failing = append(failing, fmt.Sprintf("%s %.0f%% of %d", codeSeg(c.Name), c.errorRate()*100, c.Uses))
+	}
+	if len(failing) == 0 {
+		failing = append(failing, "None :D")
+	}
+
+	s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
+		Color: 0,
+		Title: "Command usage in the last " + period.Name,
+		Description: fmt.Sprintf("%d commands by %d users. %.1f%% denied, %.1f%% bad usage, %.1f%% errors",
+			summary.Total.Uses, summary.Users,
+			float64(summary.Total.Denied)/float64(summary.Total.Uses)*100,
+			float64(summary.Total.BadUsage)/float64(summary.Total.Uses)*100, summary.Total.errorRate()*100),
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "Top commands", Value: strings.Join(commands, "\n"), Inline: true},
+			{Name: "Top servers", Value: strings.Join(guilds, "\n"), Inline: true},
+			{Name: "Highest error rates", Value: strings.Join(failing, "\n")},
+		},
+	})
+}
+
+// byErrorRate returns the commands that had errors, the highest error rate first
+func byErrorRate(counts []namedCount) []namedCount {
+	var out []namedCount
+	for _, c := range counts {
+		if c.Errors != 0 {
+			out = append(out, c)
+		}
+	}
+
+	// counts is sorted by uses, which breaks ties in favour of the busier command
+	sort.SliceStable(out, func(i, j int) bool { return out[i].errorRate() > out[j].errorRate() })
+	return out[:min(len(out), topStats)]
+}
+
+// statsAuth only lets requests through with the stats_token from the config
+// as a bearer token, or from loopback when there isn't one
+func statsAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := conf().StatsToken
+		if token == "" {
+			if !fromLoopback(r) {
+				http.Error(w, "stats are only served locally unless stats_token is set", http.StatusForbidden)
+				return
+			}
+		} else if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or wrong stats token", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// httpCommandStats serves the command usage over the period in the query, a day by default
+func httpCommandStats(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	name := r.URL.Query().Get("period")
+	if name == "" {
+		name = "day"
+	}
+
+	period, ok := findUsagePeriod(name)
+	if !ok {
+		http.Error(w, "unknown period "+name, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(commandStats.summary(period, time.Now())); err != nil {
+		log.Error("error encoding command stats", err)
+	}
+}
+
+func msgStorageStats(s session, m *discordgo.MessageCreate, _ args) {
+	stats := persist.metrics()
+
+	last := "Never"
+	if !stats.LastFlush.IsZero() {
+		last = stats.LastFlush.Format(time.RFC1123)
+	}
+	// Embed fields can't be longer than 1024
+	lastError := stats.LastError[:min(len(stats.LastError), 1000)]
+	if lastError == "" {
+		lastError = "None :D"
+	}
+
+	s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
+		Color: 0,
+		Title: "Storage",
+		Description: fmt.Sprintf("%d changes waiting, flushed every %s. Last flush %s",
+			stats.Pending, conf().flushInterval(), last),
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "Flushes", Value: fmt.Sprintf("%d, %d with errors", stats.Flushes, stats.Failures), Inline: true},
+			{Name: "Writes", Value: fmt.Sprintf("%d, %d failed", stats.Written, stats.FailedWrites), Inline: true},
+			{Name: "Latency", Value: fmt.Sprintf("Last %s\nAverage %s\nMax %s",
+				stats.LastLatency.Round(time.Microsecond), stats.avgLatency().Round(time.Microsecond), stats.MaxLatency.Round(time.Microsecond)), Inline: true},
+			{Name: "Last error", Value: lastError},
+		},
+	})
+}
+
+// httpStorageStats serves the flush metrics
+func httpStorageStats(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(persist.metrics()); err != nil {
+		log.Error("error encoding storage stats", err)
+	}
+}
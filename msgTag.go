@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	maxTags       = 100
+	maxTagNameLen = 32
+)
+
+// tag is a custom text command defined by a guilds admins
+type tag struct {
+	Content string `json:"content"`
+	Embed   bool   `json:"embed,omitempty"`
+
+	AuthorID  string    `json:"author_id"`
+	CreatedAt time.Time `json:"created_at"`
+	EditedAt  time.Time `json:"edited_at,omitempty"`
+
+	Uses int `json:"uses"`
+}
+
+func init() {
+	manage := discordgo.PermissionAdministrator | discordgo.PermissionManageServer
+
+	newCommand("tag", 0, false, nil).subcommands(
+		newCommand("add", manage, true, msgAddTag).setArgs(wordArg("name"), greedyArg("content")).
+			setHelp("Creates a new tag. The content can use these placeholders:\n"+
+				"`{user}` mentions whoever used the tag\n`{server}` the servers name\n`{channel}` the channel the tag was used in\n"+
+				"`{args}` anything written after the tags name\n`{membercount}` how many members the server has").
+			examples("tag add rules Welcome {user}! Please read the rules in #rules", "rules"),
+		newCommand("edit", manage, true, msgEditTag).setArgs(wordArg("name"), greedyArg("content")).setHelp("Changes the content of a tag"),
+		newCommand("embed", manage, true, msgToggleTagEmbed).setArgs(wordArg("name")).setHelp("Toggles whether a tag is sent as an embed or as plain text"),
+		newCommand("delete", manage, true, msgDeleteTag).alias("remove").setArgs(wordArg("name")).setHelp("Deletes a tag"),
+		newCommand("list", 0, false, msgListTags).setHelp("Lists the tags in this server"),
+		newCommand("info", 0, false, msgTagInfo).setArgs(wordArg("name")).setHelp("Shows who made a tag, when, and how often it's been used"),
+	).setHelp("Custom commands for this server that reply with some text.\n"+
+		"Tags are used just like commands.\nOnly admins can add, edit or delete tags.").
+		examples("tag add faq Check out #faq before asking!", "faq").setCategory(categoryUtility).add()
+}
+
+// renderTag fills in the placeholders in a tags content
+func renderTag(content string, m *discordgo.MessageCreate, guild *discordgo.Guild, msglist []string) string {
+	// Don't let people ping everyone through a tag that echoes what they wrote
+	tagArgs := strings.Join(msglist[1:], " ")
+	tagArgs = strings.NewReplacer("@everyone", "@"+zerowidth+"everyone", "@here", "@"+zerowidth+"here").Replace(tagArgs)
+
+	return strings.NewReplacer(
+		"{user}", m.Author.Mention(),
+		"{server}", guild.Name,
+		"{channel}", "<#"+m.ChannelID+">",
+		"{args}", tagArgs,
+		"{membercount}", strconv.Itoa(guild.MemberCount),
+	).Replace(content)
+}
+
+// sendTag sends the guilds tag named after the first word in msglist, returning false if there isn't one
+func sendTag(s session, m *discordgo.MessageCreate, guild *discordgo.Guild, msglist []string) bool {
+	var t tag
+	var found bool
+	sMap.update(guild.ID, func(srvr *server) {
+		if tg, ok := srvr.Tags[strings.ToLower(msglist[0])]; ok && !srvr.Kicked {
+			tg.Uses++
+			t, found = *tg, true
+		}
+	})
+	if !found {
+		return false
+	}
+	persist.markServer(guild.ID)
+
+	content := renderTag(t.Content, m, guild, msglist)
+	if t.Embed {
+		s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
+			Description: content,
+			Color:       0,
+		})
+	} else {
+		s.ChannelMessageSend(m.ChannelID, content)
+	}
+	return true
+}
+
+// validTagName returns why name can't be used for a new tag, or an empty string if it can
+func validTagName(name string) string {
+	switch {
+	case len(name) > maxTagNameLen:
+		return fmt.Sprintf("Tag names can be at most %d characters long", maxTagNameLen)
+	case strings.ContainsAny(name, "{}`"):
+		return "Tag names can't contain `{`, `}` or backticks"
+	}
+
+	if _, ok := findCommand(name); ok {
+		return "There's already a command called " + codeSeg(name)
+	}
+	return ""
+}
+
+func msgAddTag(s session, m *discordgo.MessageCreate, a args) {
+	name := strings.ToLower(a.str("name"))
+	if reason := validTagName(name); reason != "" {
+		s.ChannelMessageSend(m.ChannelID, reason)
+		return
+	}
+
+	updateSettings(s, m, func(_ *discordgo.Guild, srvr *server) (string, bool) {
+		if _, ok := srvr.Tags[name]; ok {
+			return "Tag " + codeSeg(name) + " already exists! Edit it instead~", false
+		}
+
+		if len(srvr.Tags) >= maxTags {
+			return fmt.Sprintf("This server already has %d tags. Delete some first!", maxTags), false
+		}
+
+		if srvr.Tags == nil {
+			srvr.Tags = make(map[string]*tag)
+		}
+
+		srvr.Tags[name] = &tag{
+			Content:   a.str("content"),
+			AuthorID:  m.Author.ID,
+			CreatedAt: time.Now(),
+		}
+		return "Added tag " + codeSeg(name), true
+	})
+}
+
+func msgEditTag(s session, m *discordgo.MessageCreate, a args) {
+	name := strings.ToLower(a.str("name"))
+	updateSettings(s, m, func(_ *discordgo.Guild, srvr *server) (string, bool) {
+		t, ok := srvr.Tags[name]
+		if !ok {
+			return "No tag called " + codeSeg(name), false
+		}
+
+		t.Content = a.str("content")
+		t.EditedAt = time.Now()
+		return "Edited tag " + codeSeg(name), true
+	})
+}
+
+func msgToggleTagEmbed(s session, m *discordgo.MessageCreate, a args) {
+	name := strings.ToLower(a.str("name"))
+	updateSettings(s, m, func(_ *discordgo.Guild, srvr *server) (string, bool) {
+		t, ok := srvr.Tags[name]
+		if !ok {
+			return "No tag called " + codeSeg(name), false
+		}
+
+		t.Embed = !t.Embed
+
+		if t.Embed {
+			return "Tag " + codeSeg(name) + " will now be sent as an embed", true
+		}
+		return "Tag " + codeSeg(name) + " will now be sent as plain text", true
+	})
+}
+
+func msgDeleteTag(s session, m *discordgo.MessageCreate, a args) {
+	name := strings.ToLower(a.str("name"))
+	updateSettings(s, m, func(_ *discordgo.Guild, srvr *server) (string, bool) {
+		if _, ok := srvr.Tags[name]; !ok {
+			return "No tag called " + codeSeg(name), false
+		}
+
+		delete(srvr.Tags, name)
+		return "Deleted tag " + codeSeg(name), true
+	})
+}
+
+func msgListTags(s session, m *discordgo.MessageCreate, _ args) {
+	var names []string
+	if !viewSettings(s, m, func(_ *discordgo.Guild, srvr *server) {
+		for name := range srvr.Tags {
+			names = append(names, codeSeg(name))
+		}
+	}) {
+		return
+	}
+
+	if len(names) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "This server has no tags yet!")
+		return
+	}
+	sort.Strings(names)
+
+	s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
+		Color: 0,
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: fmt.Sprintf("Tags (%d)", len(names)), Value: strings.Join(names, ", ")},
+		},
+	})
+}
+
+func msgTagInfo(s session, m *discordgo.MessageCreate, a args) {
+	name := strings.ToLower(a.str("name"))
+
+	var t tag
+	var found bool
+	if !viewSettings(s, m, func(_ *discordgo.Guild, srvr *server) {
+		if tg, ok := srvr.Tags[name]; ok {
+			t, found = *tg, true
+		}
+	}) {
+		return
+	}
+	if !found {
+		s.ChannelMessageSend(m.ChannelID, "No tag called "+codeSeg(name))
+		return
+	}
+
+	// Tags stay when their author deletes their data
+	author := "Unknown"
+	if t.AuthorID != "" {
+		author = t.AuthorID
+		if user, err := userDetails(t.AuthorID, s); err == nil {
+			author = user.Username + "#" + user.Discriminator
+		}
+	}
+
+	edited := "Never"
+	if !t.EditedAt.IsZero() {
+		edited = t.EditedAt.Format("02 Jan 06 15:04")
+	}
+
+	kind := "Text"
+	if t.Embed {
+		kind = "Embed"
+	}
+
+	s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
+		Color:  0,
+		Footer: footer,
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "Name:", Value: name, Inline: true},
+			{Name: "Created By:", Value: author, Inline: true},
+			{Name: "Uses:", Value: strconv.Itoa(t.Uses), Inline: true},
+			{Name: "Created:", Value: t.CreatedAt.Format("02 Jan 06 15:04"), Inline: true},
+			{Name: "Last Edited:", Value: edited, Inline: true},
+			{Name: "Type:", Value: kind, Inline: true},
+			{Name: "Content:", Value: t.Content[:min(len(t.Content), 1024)]},
+		},
+	})
+}
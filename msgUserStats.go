@@ -9,10 +9,10 @@ import (
 )
 
 func init() {
-	newCommand("whois", 0, false, msgUserStats).setHelp("Args: [@user]\n\nSome info about the given user.\n\nExample:\n`!owo whois @Strum355#2298`").add()
+	newCommand("whois", 0, false, msgUserStats).setArgs(userArg("user").optional()).setHelp("Some info about the given user.").examples("whois @Strum355#2298").setCategory(categoryUtility).add()
 }
 
-func msgUserStats(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
+func msgUserStats(s session, m *discordgo.MessageCreate, a args) {
 	channel, err := channelDetails(m.ChannelID, s)
 	if err != nil {
 		s.ChannelMessageSend(m.ChannelID, "There was an error getting the data :(")
@@ -25,16 +25,11 @@ func msgUserStats(s *discordgo.Session, m *discordgo.MessageCreate, msglist []st
 		return
 	}
 
-	var userID string
 	var nick string
 
-	if len(msglist) > 1 {
-		submatch := userIDRegex.FindStringSubmatch(msglist[1])
-		if len(submatch) != 0 {
-			userID = submatch[1]
-		}
-	} else {
-		userID = m.Author.ID
+	userID := m.Author.ID
+	if a.has("user") {
+		userID = a.str("user")
 	}
 
 	user, err := userDetails(userID, s)
@@ -80,7 +75,7 @@ func msgUserStats(s *discordgo.Session, m *discordgo.MessageCreate, msglist []st
 	}
 
 	s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
-		Color:       s.State.UserColor(userID, m.ChannelID),
+		Color:       s.state().UserColor(userID, m.ChannelID),
 		Description: fmt.Sprintf("%s is a loyal member of %s", user.Username, guild.Name),
 		Author: &discordgo.MessageEmbedAuthor{
 			Name:    user.Username,
@@ -3,35 +3,41 @@ package main
 import (
 	"fmt"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/Necroforger/dgwidgets"
 	"github.com/bwmarrin/discordgo"
 )
 
 var mem runtime.MemStats
 
 func init() {
-	newCommand("setGame", 0, false, msgSetGame).ownerOnly().add()
-	newCommand("listUsers", 0, false, msgListUsers).ownerOnly().add()
-	newCommand("reloadConfig", 0, false, msgReloadConfig).ownerOnly()
-	newCommand("command", 0, false, msgCommand).ownerOnly().add()
-	newCommand("help", 0, false, msgHelp).setHelp("ok").add()
-	newCommand("info", 0, false, msgInfo).setHelp("Args: none\n\nSome info about 2Bot.\n\nExample:\n`!owo info`").add()
-	newCommand("invite", 0, false, msgInvite).setHelp("Args: none\n\nSends an invite link for 2Bot!\n\nExample:\n`!owo invite`").add()
-	newCommand("git", 0, false, msgGit).setHelp("Args: none\n\nLinks 2Bots github page.\n\nExample:\n`!owo git`").add()
+	newCommand("setGame", 0, false, msgSetGame).setArgs(greedyArg("game")).ownerOnly().allowDMs().setCategory(categoryOwner).add()
+	newCommand("listUsers", 0, false, msgListUsers).setArgs(wordArg("guildID")).ownerOnly().allowDMs().setCategory(categoryOwner).add()
+	newCommand("reloadConfig", 0, false, msgReloadConfig).setArgs(greedyArg("files").optional()).alias("reload").
+		setHelp("Reloads the config, servers, users and queue files, or only the ones given. Nothing is changed if any of them fail to load.").
+		examples("reloadConfig", "reloadConfig config users").ownerOnly().allowDMs().setCategory(categoryOwner).add()
+	newCommand("command", 0, false, nil).ownerOnly().subcommands(
+		newCommand("enable", 0, false, msgEnableCommand).setArgs(wordArg("command")).setHelp("Enables a disabled command"),
+		newCommand("disable", 0, false, msgDisableCommand).setArgs(wordArg("command")).setHelp("Disables a command globally"),
+	).allowDMs().setCategory(categoryOwner).add()
+	newCommand("help", 0, false, msgHelp).setArgs(greedyArg("command").optional()).setHelp("Shows help for 2Bot or the given command.").examples("help", "help yt skip").allowDMs().setCategory(categoryUtility).add()
+	newCommand("info", 0, false, msgInfo).setHelp("Some info about 2Bot.").allowDMs().setCategory(categoryUtility).add()
+	newCommand("invite", 0, false, msgInvite).setHelp("Sends an invite link for 2Bot!").allowDMs().setCategory(categoryUtility).add()
+	newCommand("git", 0, false, msgGit).setHelp("Links 2Bots github page.").allowDMs().setCategory(categoryUtility).add()
 
 	newCommand("setNSFW",
 		discordgo.PermissionAdministrator|discordgo.PermissionManageServer,
-		true, msgNSFW).setHelp("Args: none\n\nToggles NSFW commands in NSFW channels.\nAdmin only.\n\nExample:\n`!owo setNSFW`").add()
+		true, msgNSFW).setHelp("Toggles NSFW commands in NSFW channels.").setCategory(categoryModeration).add()
 
 	newCommand("joinMessage",
 		discordgo.PermissionAdministrator|discordgo.PermissionManageServer,
-		true, msgJoinMessage).setHelp("Args: [true,false] | [message] | [channelID]\n\nEnables or disables join messages.\nthe message and channel that the bot welcomes new people in.\n" +
-		"To mention the user in the message, put `%s` where you want the user to be mentioned in the message.\nLeave message \n\nExample to set message:\n" +
-		"`!owo joinMessage true | Hey there %s! | 312294858582654978`\n>On member join\n`Hey there [@new member]`\n\n" +
-		"Example to disable:\n`!owo joinMessage false`").add()
+		true, msgJoinMessage).setArgs(pipeArg("settings", 1, "true/false", "message", "channelID")).setHelp("Enables or disables join messages, and sets the message and channel that the bot welcomes new people in.\n"+
+		"To mention the new member, put `%s` where you want them to be mentioned in the message.").
+		examples("joinMessage true | Hey there %s! | 312294858582654978", "joinMessage false").setCategory(categoryModeration).add()
 
 }
 
@@ -40,95 +46,213 @@ func init() {
 	or are only for me, the creator..usually
 */
 
-func msgCommand(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	if len(msglist) != 3 {
-		return
-	}
-
-	command := msglist[2]
-	switch msglist[1] {
-	case "enable":
-		if comm, ok := disabledCommands[command]; ok {
-			activeCommands[command] = comm
-			delete(disabledCommands, command)
-			s.ChannelMessageSend(m.ChannelID, "Enabled "+command)
-		}
-	case "disable":
-		if comm, ok := activeCommands[command]; ok {
-			disabledCommands[command] = comm
-			delete(activeCommands, command)
-			s.ChannelMessageSend(m.ChannelID, "Disabled "+command)
-		}
+func msgEnableCommand(s session, m *discordgo.MessageCreate, a args) {
+	command := strings.ToLower(a.str("command"))
+	if comm, ok := disabledCommands[command]; ok {
+		activeCommands[command] = comm
+		delete(disabledCommands, command)
+		s.ChannelMessageSend(m.ChannelID, "Enabled "+command)
 	}
 }
 
-func msgSetGame(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	if len(msglist) < 2 {
-		return
+func msgDisableCommand(s session, m *discordgo.MessageCreate, a args) {
+	command := strings.ToLower(a.str("command"))
+	if comm, ok := activeCommands[command]; ok {
+		disabledCommands[command] = comm
+		delete(activeCommands, command)
+		s.ChannelMessageSend(m.ChannelID, "Disabled "+command)
 	}
+}
 
-	game := strings.Join(msglist[1:], " ")
+func msgSetGame(s session, m *discordgo.MessageCreate, a args) {
+	game := a.str("game")
 
 	if err := s.UpdateStatus(0, game); err != nil {
 		log.Error("error changing game", err)
+		a.fail()
 		return
 	}
 
-	conf.Game = game
-	saveConfig()
+	updateConf(func(c *config) { c.Game = game })
+	persist.markConfig()
 
 	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Game changed to %s!", game))
 	return
 }
 
-func msgHelp(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	if len(msglist) == 2 {
-		if val, ok := activeCommands[strings.ToLower(msglist[1])]; ok {
-			val.helpCommand(s, m)
+// Permissions that commands can require, in the order they're shown in help
+var permissionNames = []struct {
+	perm int
+	name string
+}{
+	{discordgo.PermissionAdministrator, "Administrator"},
+	{discordgo.PermissionManageServer, "Manage Server"},
+	{discordgo.PermissionManageChannels, "Manage Channels"},
+	{discordgo.PermissionManageRoles, "Manage Roles"},
+	{discordgo.PermissionManageMessages, "Manage Messages"},
+	{discordgo.PermissionKickMembers, "Kick Members"},
+	{discordgo.PermissionBanMembers, "Ban Members"},
+}
+
+func msgHelp(s session, m *discordgo.MessageCreate, a args) {
+	prefix, err := activePrefix(m.ChannelID, s)
+	if err != nil {
+		return
+	}
+
+	isOwner := m.Author.ID == conf().OwnerID
+
+	if a.has("command") {
+		words := strings.Fields(a.str("command"))
+		comm, ok := findCommand(words[0])
+		if !ok || (comm.OwnerOnly && !isOwner) {
+			s.ChannelMessageSend(m.ChannelID, "No command called "+codeSeg(words[0])+". Use "+codeSeg(prefix+"help")+" to see every command")
 			return
 		}
+
+		chain := comm.resolve(words)
+		chain[len(chain)-1].helpCommand(s, m, prefix)
+		return
 	}
 
-	var commands []string
-	for _, val := range activeCommands {
-		if m.Author.ID == conf.OwnerID || !val.OwnerOnly {
-			commands = append(commands, "`"+val.Name+"`")
+	p := dgwidgets.NewPaginator(s.discord(), m.ChannelID)
+	p.Add(helpPages(prefix, isOwner)...)
+
+	p.SetPageFooters()
+	p.Loop = true
+	p.ColourWhenDone = 0xff0000
+	p.DeleteReactionsWhenDone = true
+	p.Widget.Timeout = time.Minute * 2
+
+	if err := p.Spawn(); err != nil {
+		log.Error("error creating help menu", err)
+		s.ChannelMessageSend(m.ChannelID, "Couldn't make the help menu :( Try again please~")
+		a.fail()
+	}
+}
+
+// helpPages lists the commands in each category, one page per category.
+// Owner only commands are left out unless isOwner is set.
+func helpPages(prefix string, isOwner bool) (pages []*discordgo.MessageEmbed) {
+	byCategory := make(map[string][]command)
+	for _, c := range activeCommands {
+		if c.OwnerOnly && !isOwner {
+			continue
 		}
+		byCategory[c.Category] = append(byCategory[c.Category], c)
 	}
 
-	prefix := conf.Prefix
-	if guild, err := guildDetails(m.ChannelID, "", s); err != nil {
-		if val, ok := sMap.server(guild.ID); ok {
-			prefix = val.Prefix
+	for _, category := range categories {
+		comms := byCategory[category]
+		if len(comms) == 0 {
+			continue
+		}
+
+		sort.Slice(comms, func(i, j int) bool {
+			return strings.ToLower(comms[i].Name) < strings.ToLower(comms[j].Name)
+		})
+
+		var lines []string
+		for _, c := range comms {
+			line := codeSeg(c.Name)
+			if c.Help != "" {
+				line += " - " + strings.SplitN(c.Help, "\n", 2)[0]
+			}
+			lines = append(lines, line)
 		}
+
+		pages = append(pages, &discordgo.MessageEmbed{
+			Title:       "2Bot help - " + category,
+			Color:       0,
+			Description: strings.Join(lines, "\n") + "\n\nUse " + codeSeg(prefix+"help", "[command]") + " for detailed info about a command.",
+		})
 	}
+	return
+}
 
-	s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
-		Color: 0,
+// permsHelp describes who is allowed to run the command
+func (c command) permsHelp() string {
+	if c.OwnerOnly {
+		return "Bot owner only"
+	}
+	if !c.RequiresPerms {
+		return "None"
+	}
 
-		Fields: []*discordgo.MessageEmbedField{
-			{Name: "2Bot help", Value: strings.Join(commands, ", ") + "\n\nUse `" + prefix + "help [command]` for detailed info about a command."},
-		},
-	})
+	var names []string
+	for _, p := range permissionNames {
+		if c.PermsRequired&p.perm != 0 {
+			names = append(names, p.name)
+		}
+	}
+	return "Any of: " + strings.Join(names, ", ")
 }
 
-func (c command) helpCommand(s *discordgo.Session, m *discordgo.MessageCreate) {
+// cooldownHelp describes the cooldowns the command has in the guild
+func (c command) cooldownHelp(guildID string) string {
+	var out []string
+	cooldowns, _ := c.activeCooldowns(guildID)
+	for _, cd := range cooldowns {
+		if cd.Uses > 0 {
+			out = append(out, cd.String())
+		}
+	}
+	if len(out) == 0 {
+		return "None"
+	}
+	return strings.Join(out, "\n")
+}
+
+func (c command) helpCommand(s session, m *discordgo.MessageCreate, prefix string) {
+	help := c.Help
+	if help == "" {
+		help = "No help available"
+	}
+
+	fields := []*discordgo.MessageEmbedField{
+		{Name: c.FullName, Value: help},
+		{Name: "Usage", Value: codeSeg(c.usage(prefix))},
+	}
+
+	if len(c.Examples) != 0 {
+		var examples []string
+		for _, ex := range c.Examples {
+			examples = append(examples, codeSeg(prefix+ex))
+		}
+		fields = append(fields, &discordgo.MessageEmbedField{Name: "Examples", Value: strings.Join(examples, "\n")})
+	}
+
+	if len(c.Aliases) != 0 {
+		fields = append(fields, &discordgo.MessageEmbedField{Name: "Aliases", Value: strings.Join(c.Aliases, ", ")})
+	}
+
+	fields = append(fields,
+		&discordgo.MessageEmbedField{Name: "Permissions", Value: c.permsHelp(), Inline: true},
+		&discordgo.MessageEmbedField{Name: "Cooldown", Value: c.cooldownHelp(m.GuildID), Inline: true},
+	)
+
+	if len(c.Subcommands) != 0 {
+		var subs []string
+		for _, sub := range c.Subcommands {
+			subs = append(subs, codeSeg(sub.Name))
+		}
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:  "Sub-commands",
+			Value: strings.Join(subs, ", ") + "\n\nUse " + codeSeg(prefix+"help", c.FullName, "[sub-command]") + " for more info",
+		})
+	}
+
 	s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
 		Color: 0,
 
-		Fields: []*discordgo.MessageEmbedField{
-			{
-				Name:  c.Name,
-				Value: c.Help,
-			},
-		},
+		Fields: fields,
 
 		Footer: footer,
 	})
 }
 
-func msgInfo(s *discordgo.Session, m *discordgo.MessageCreate, _ []string) {
-	ct1, err := getCreationTime(s.State.User.ID)
+func msgInfo(s session, m *discordgo.MessageCreate, _ args) {
+	ct1, err := getCreationTime(s.state().User.ID)
 	if err != nil {
 		s.ChannelMessageSend(m.ChannelID, "There was an error getting Bot info :(")
 		return
@@ -138,53 +262,51 @@ func msgInfo(s *discordgo.Session, m *discordgo.MessageCreate, _ []string) {
 
 	runtime.ReadMemStats(&mem)
 
-	var prefix string
-	guild, err := guildDetails(m.ChannelID, "", s)
-	if err == nil {
-		if val, ok := sMap.server(guild.ID); ok {
-			prefix = val.Prefix
+	prefix := "None"
+	sMap.view(m.GuildID, func(val *server) {
+		var list []string
+		for _, p := range val.Prefixes {
+			list = append(list, p.Text)
 		}
-	}
-	if prefix == "" {
-		prefix = "None"
-	}
+		if len(list) != 0 {
+			prefix = strings.Join(list, " ")
+		}
+	})
 
 	s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
 		Color: 0,
 		Author: &discordgo.MessageEmbedAuthor{
-			Name:    s.State.User.Username,
-			IconURL: discordgo.EndpointUserAvatar(s.State.User.ID, s.State.User.Avatar),
+			Name:    s.state().User.Username,
+			IconURL: discordgo.EndpointUserAvatar(s.state().User.ID, s.state().User.Avatar),
 		},
 		Footer: footer,
 
 		Fields: []*discordgo.MessageEmbedField{
-			{Name: "Bot Name:", Value: codeBlock(s.State.User.Username), Inline: true},
+			{Name: "Bot Name:", Value: codeBlock(s.state().User.Username), Inline: true},
 			{Name: "Creator:", Value: codeBlock("Strum355#0554"), Inline: true},
 			{Name: "Creation Date:", Value: codeBlock(creationTime), Inline: true},
-			{Name: "Global Prefix:", Value: codeBlock(conf.Prefix), Inline: true},
+			{Name: "Global Prefix:", Value: codeBlock(conf().Prefix), Inline: true},
 			{Name: "Local Prefix", Value: codeBlock(prefix), Inline: true},
 			{Name: "Programming Language:", Value: codeBlock("Go"), Inline: true},
 			{Name: "Library:", Value: codeBlock("Discordgo"), Inline: true},
-			{Name: "Server Count:", Value: codeBlock(strconv.Itoa(len(s.State.Guilds))), Inline: true},
+			{Name: "Server Count:", Value: codeBlock(strconv.Itoa(len(s.state().Guilds))), Inline: true},
 			{Name: "Memory Usage:", Value: codeBlock(strconv.Itoa(int(mem.Alloc/1024/1024)) + "MB"), Inline: true},
 			{Name: "My Server:", Value: "https://discord.gg/9T34Y6u\nJoin here for support amongst other things!", Inline: false},
 		},
 	})
 }
 
-func msgListUsers(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	if len(msglist) < 2 {
-		return
-	}
-
-	if guild, ok := sMap.server(msglist[1]); !ok || guild.Kicked {
+func msgListUsers(s session, m *discordgo.MessageCreate, a args) {
+	guildID := a.str("guildID")
+	var kicked bool
+	if !sMap.view(guildID, func(guild *server) { kicked = guild.Kicked }) || kicked {
 		s.ChannelMessageSend(m.ChannelID, "2Bot isn't in that server")
 		return
 	}
 
 	s.ChannelTyping(m.ChannelID)
 
-	guild, err := guildDetails(msglist[1], "", s)
+	guild, err := guildDetails("", guildID, s)
 	if err != nil {
 		return
 	}
@@ -199,113 +321,91 @@ func msgListUsers(s *discordgo.Session, m *discordgo.MessageCreate, msglist []st
 	s.ChannelMessageSend(m.ChannelID, "Users in: "+guild.Name+"\n`"+strings.Join(out, ", ")+"`")
 }
 
-func msgGit(s *discordgo.Session, m *discordgo.MessageCreate, _ []string) {
+func msgGit(s session, m *discordgo.MessageCreate, _ args) {
 	s.ChannelMessageSend(m.ChannelID, "Check me out here https://github.com/Strum355/2Bot-Discord-Bot\nGive it star to make my creators day! ⭐")
 }
 
-func msgNSFW(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	guild, err := guildDetails(m.ChannelID, "", s)
-	if err != nil {
-		s.ChannelMessageSend(m.ChannelID, "There was an error toggling NSFW :( Try again please~")
-		return
-	}
-
+func msgNSFW(s session, m *discordgo.MessageCreate, _ args) {
 	onOrOff := map[bool]string{true: "enabled", false: "disabled"}
 
-	if guild, ok := sMap.server(guild.ID); ok {
+	updateSettings(s, m, func(_ *discordgo.Guild, guild *server) (string, bool) {
 		guild.Nsfw = !guild.Nsfw
-		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("NSFW %s", onOrOff[guild.Nsfw]))
-		saveServers()
-	}
+		return fmt.Sprintf("NSFW %s", onOrOff[guild.Nsfw]), true
+	})
 }
 
-func msgJoinMessage(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	guild, err := guildDetails(m.ChannelID, "", s)
-	if err != nil {
-		s.ChannelMessageSend(m.ChannelID, "There was an error with discord :( Try again please~")
+func msgJoinMessage(s session, m *discordgo.MessageCreate, a args) {
+	split := a.list("settings")
+
+	if split[0] != "false" && split[0] != "true" {
+		s.ChannelMessageSend(m.ChannelID, "Please say either `true` or `false` for enabling or disabling join messages~")
 		return
 	}
 
-	split := trimSlice(strings.Split(strings.Join(msglist[1:], " "), "|"))
-
-	if len(split) == 0 {
-		split = append(split, msglist[1])
+	if split[0] == "false" {
+		updateSettings(s, m, func(_ *discordgo.Guild, guild *server) (string, bool) {
+			guild.JoinMessage = joinMessage{}
+			return "Join messages disabled! ", true
+		})
+		return
 	}
 
-	if len(split) > 0 {
-		if guild, ok := sMap.server(guild.ID); ok {
-			if split[0] != "false" && split[0] != "true" {
-				s.ChannelMessageSend(m.ChannelID, "Please say either `true` or `false` for enabling or disabling join messages~")
-				return
-			}
-
-			if split[0] == "false" {
-				guild.JoinMessage = [3]string{split[0]}
-				saveServers()
-				s.ChannelMessageSend(m.ChannelID, "Join messages disabled! ")
-				return
-			}
+	if len(split) != 3 {
+		s.ChannelMessageSend(m.ChannelID, "Not enough info given! :/\nMake sure the command only has two `|` in it.")
+		return
+	}
 
-			if len(split) != 3 {
-				s.ChannelMessageSend(m.ChannelID, "Not enough info given! :/\nMake sure the command only has two `|` in it.")
-				return
-			}
+	channelID, ok := matchID(channelRegex, split[2])
+	if !ok {
+		s.ChannelMessageSend(m.ChannelID, "Please give me a proper channel ID :(")
+		return
+	}
 
-			channelStruct, err := channelDetails(split[2], s)
-			if err != nil {
-				s.ChannelMessageSend(m.ChannelID, "Please give me a proper channel ID :(")
-				return
-			}
+	channelStruct, err := channelDetails(channelID, s)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, "Please give me a proper channel ID :(")
+		return
+	}
 
-			if split[1] == "" {
-				s.ChannelMessageSend(m.ChannelID, "No message given :/")
-				return
-			}
+	if split[1] == "" {
+		s.ChannelMessageSend(m.ChannelID, "No message given :/")
+		return
+	}
 
-			guild.JoinMessage = [3]string{split[0], split[1], split[2]}
-			saveServers()
+	updateSettings(s, m, func(_ *discordgo.Guild, guild *server) (string, bool) {
+		guild.JoinMessage = joinMessage{Enabled: true, Message: split[1], Channel: channelID}
+		return fmt.Sprintf("Join message set to:\n%s\nin %s", split[1], channelStruct.Name), true
+	})
+}
 
-			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Join message set to:\n%s\nin %s", split[1], channelStruct.Name))
-		}
+func msgReloadConfig(s session, m *discordgo.MessageCreate, a args) {
+	files := reloadFiles
+	if a.has("files") {
+		files = strings.Fields(strings.ToLower(a.str("files")))
 	}
-}
 
-func msgReloadConfig(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	if len(msglist) < 2 {
+	changes, err := reload(s, files)
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s\nNothing was changed", err))
 		return
 	}
 
-	var reloaded string
-	switch msglist[1] {
-	case "c":
-		conf = new(config)
-		if err := loadConfig(); err != nil {
-			log.Error("error reloading config", err)
-			s.ChannelMessageSend(m.ChannelID, "Error reloading config")
-			return
-		}
-		reloaded = "config"
-	case "u":
-		u = make(users)
-		if err := loadUsers(); err != nil {
-			log.Error("error reloading config", err)
-			s.ChannelMessageSend(m.ChannelID, "Error reloading config")
-			return
-		}
-		reloaded = "users"
+	msg := "Reloaded " + strings.Join(files, ", ")
+	if len(changes) == 0 {
+		s.ChannelMessageSend(m.ChannelID, msg+". Nothing changed")
+		return
 	}
-
-	s.ChannelMessageSend(m.ChannelID, "Reloaded "+reloaded)
+	s.ChannelMessageSend(m.ChannelID, msg+codeBlock(strings.Join(changes, "\n")))
 }
 
-func msgInvite(s *discordgo.Session, m *discordgo.MessageCreate, _ []string) {
+func msgInvite(s session, m *discordgo.MessageCreate, _ args) {
 	s.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
 		Color: 0,
 		Image: &discordgo.MessageEmbedImage{
-			URL: happyEmoji,
+			URL: conf().HappyEmoji,
 		},
 		Fields: []*discordgo.MessageEmbedField{
-			{Name: "Invite me with this link!", Value: "https://discordapp.com/oauth2/authorize?client_id=301819949683572738&scope=bot&permissions=3533824", Inline: true},
+			{Name: "Invite me with this link!", Value: conf().inviteURL(), Inline: true},
 		},
 	})
 }
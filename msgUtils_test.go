@@ -0,0 +1,190 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJoinMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    joinMessage
+		wantMsg string
+	}{
+		{
+			name:    "disable",
+			content: "joinMessage false",
+			want:    joinMessage{},
+			wantMsg: "Join messages disabled!",
+		},
+		{
+			name:    "enable",
+			content: "joinMessage true | Welcome %s! | <#" + testOtherChan + ">",
+			want:    joinMessage{Enabled: true, Message: "Welcome %s!", Channel: testOtherChan},
+			wantMsg: "Join message set to:\nWelcome %s!\nin welcome",
+		},
+		{
+			name:    "enable with channel ID",
+			content: "joinMessage true | Hi %s | " + testOtherChan,
+			want:    joinMessage{Enabled: true, Message: "Hi %s", Channel: testOtherChan},
+			wantMsg: "Join message set to:\nHi %s\nin welcome",
+		},
+		{
+			name:    "not a bool",
+			content: "joinMessage yes | Hi | " + testOtherChan,
+			want:    joinMessage{},
+			wantMsg: "Please say either `true` or `false`",
+		},
+		{
+			name:    "missing channel",
+			content: "joinMessage true | Hi",
+			want:    joinMessage{},
+			wantMsg: "Not enough info given!",
+		},
+		{
+			name:    "unknown channel",
+			content: "joinMessage true | Hi | 123456789012345678",
+			want:    joinMessage{},
+			wantMsg: "Please give me a proper channel ID :(",
+		},
+		{
+			name:    "not a channel",
+			content: "joinMessage true | Hi | general",
+			want:    joinMessage{},
+			wantMsg: "Please give me a proper channel ID :(",
+		},
+		{
+			name:    "empty message",
+			content: "joinMessage true | | " + testOtherChan,
+			want:    joinMessage{},
+			wantMsg: "No message given :/",
+		},
+		{
+			name:    "too many segments",
+			content: "joinMessage true | a | b | c",
+			want:    joinMessage{},
+			wantMsg: "Usage:",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState()
+			f := newFakeSession()
+
+			f.run(testOwnerID, tt.content)
+
+			if g := testGuild(); g.JoinMessage != tt.want {
+				t.Errorf("expected join message %+v, got %+v", tt.want, g.JoinMessage)
+			}
+
+			sent := f.messages(testChannelID)
+			if len(sent) != 1 || !strings.Contains(sent[0], tt.wantMsg) {
+				t.Errorf("expected a message containing %q, got %q", tt.wantMsg, sent)
+			}
+		})
+	}
+}
+
+func TestHelpCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    string
+		content string
+		// Expected embed fields, or the message sent if there's no embed
+		want    map[string]string
+		wantMsg string
+	}{
+		{
+			name:    "command",
+			user:    testUserID,
+			content: "help purge",
+			want: map[string]string{
+				"Usage":       "`.purge <amount:1-1000> [@user]`",
+				"Examples":    "`.purge 300`\n`.purge 300 @Strum355#1180`",
+				"Permissions": "Any of: Administrator, Manage Server, Manage Messages",
+				"Cooldown":    "1 per 10s per channel",
+			},
+		},
+		{
+			name:    "subcommand",
+			user:    testUserID,
+			content: "help yt SKIP",
+			want: map[string]string{
+				"Usage":       "`.yt skip`",
+				"Aliases":     "next",
+				"Permissions": "None",
+				"Cooldown":    "None",
+			},
+		},
+		{
+			name:    "owner only",
+			user:    testOwnerID,
+			content: "help setGame",
+			wantMsg: "No command called `setGame`. Use `.help` to see every command",
+		},
+		{
+			name:    "unknown",
+			user:    testUserID,
+			content: "help nope",
+			wantMsg: "No command called `nope`. Use `.help` to see every command",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState()
+			sMap.update(testGuildID, func(g *server) { g.Prefixes = prefixes{{Text: "."}} })
+			f := newFakeSession()
+
+			f.run(tt.user, tt.content)
+
+			if tt.wantMsg != "" {
+				sent := f.messages(testChannelID)
+				if len(sent) != 1 || sent[0] != tt.wantMsg {
+					t.Errorf("expected %q, got %q", tt.wantMsg, sent)
+				}
+				return
+			}
+
+			embeds := f.embeds(testChannelID)
+			if len(embeds) != 1 {
+				t.Fatalf("expected 1 embed, got %d", len(embeds))
+			}
+
+			fields := make(map[string]string)
+			for _, field := range embeds[0].Embeds[0].Fields {
+				fields[field.Name] = field.Value
+			}
+
+			for name, want := range tt.want {
+				if fields[name] != want {
+					t.Errorf("expected %s to be %q, got %q", name, want, fields[name])
+				}
+			}
+		})
+	}
+}
+
+func TestHelpPages(t *testing.T) {
+	for _, isOwner := range []bool{false, true} {
+		var titles []string
+		for _, page := range helpPages("!", isOwner) {
+			titles = append(titles, strings.TrimPrefix(page.Title, "2Bot help - "))
+
+			if !isOwner && strings.Contains(page.Description, "`setGame`") {
+				t.Errorf("owner only commands should only be shown to the owner")
+			}
+		}
+
+		want := []string{categoryMusic, categoryImages, categoryModeration, categoryUtility, categoryNSFW}
+		if isOwner {
+			want = append(want, categoryOwner)
+		}
+
+		if strings.Join(titles, ",") != strings.Join(want, ",") {
+			t.Errorf("expected pages %v, got %v", want, titles)
+		}
+	}
+}
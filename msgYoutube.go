@@ -45,61 +45,43 @@ type song struct {
 }
 
 func init() {
-	newCommand("yt", 0, false, msgYoutube).setHelp("Args: [play,stop] [url]\n\nWork In Progress!!! Play music from Youtube straight to your Discord Server!\n\n" +
-		"Example 1: `!owo yt play https://www.youtube.com/watch?v=MvLdxtICOIY`\n" +
-		"Example 2: `!owo yt stop`\n\n" +
-		"SubCommands:\nplay\nstop\nlist, queue, songs\npause\nresume, unpause\nskip, next").add()
+	newCommand("yt", 0, false, nil).subcommands(
+		newCommand("play", 0, false, addToQueue).setArgs(wordArg("url")).cooldown(cooldownUser, 5, time.Second*30).setHelp("Adds the given YouTube video to the queue"),
+		newCommand("stop", 0, false, stopQueue).setHelp("Stops playing and clears the queue"),
+		newCommand("list", 0, false, listQueue).alias("queue", "songs").setHelp("Lists the songs in the queue"),
+		newCommand("pause", 0, false, pauseQueue).setHelp("Pauses the current song"),
+		newCommand("resume", 0, false, unpauseQueue).alias("unpause").setHelp("Resumes the current song"),
+		newCommand("skip", 0, false, skipSong).alias("next").setHelp("Skips to the next song in the queue"),
+	).setHelp("Work In Progress!!! Play music from Youtube straight to your Discord Server!").
+		examples("yt play https://www.youtube.com/watch?v=MvLdxtICOIY", "yt stop").setCategory(categoryMusic).add()
 }
 
-func msgYoutube(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	if len(msglist) == 1 {
-		return
-	}
-
-	switch msglist[1] {
-	case "play":
-		addToQueue(s, m, msglist[2:])
-	case "stop":
-		stopQueue(s, m)
-	case "list", "queue", "songs":
-		listQueue(s, m)
-	case "pause":
-		pauseQueue(s, m)
-	case "resume", "unpause":
-		unpauseQueue(s, m)
-	case "skip", "next":
-		skipSong(s, m)
-	default:
-		s.ChannelMessageSend(m.ChannelID, activeCommands["youtube"].Help)
-	}
-}
-
-func addToQueue(s *discordgo.Session, m *discordgo.MessageCreate, msglist []string) {
-	if len(msglist) == 0 {
-		return
-	}
-
+func addToQueue(s session, m *discordgo.MessageCreate, a args) {
 	guild, err := guildDetails(m.ChannelID, "", s)
 	if err != nil {
 		s.ChannelMessageSend(m.ChannelID, "There was a problem adding to queue :( please try again")
+		a.fail()
 		return
 	}
 
-	srvr, ok := sMap.server(guild.ID)
+	var inst *voiceInst
+	ok := sMap.update(guild.ID, func(srvr *server) {
+		if srvr.VoiceInst == nil {
+			srvr.newVoiceInstance()
+		}
+		inst = srvr.VoiceInst
+	})
 	if !ok {
 		s.ChannelMessageSend(m.ChannelID, "An error occurred that really shouldn't have happened...")
 		log.Error("not in server map?", guild.ID)
+		a.fail()
 		return
 	}
 
-	if srvr.VoiceInst == nil {
-		srvr.newVoiceInstance()
-	}
-
-	srvr.VoiceInst.Lock()
-	defer srvr.VoiceInst.Unlock()
+	inst.Lock()
+	defer inst.Unlock()
 
-	url := msglist[0]
+	url := a.str("url")
 
 	if !strings.HasPrefix(url, stdURL) && !strings.HasPrefix(url, shortURL) && !strings.HasPrefix(url, embedURL) {
 		s.ChannelMessageSend(m.ChannelID, "Please make sure the URL is a valid YouTube URL. If I got this wrong, please let my creator know~")
@@ -111,12 +93,12 @@ func addToQueue(s *discordgo.Session, m *discordgo.MessageCreate, msglist []stri
 		return
 	}
 
-	vc, err := createVoiceConnection(s, m, guild, srvr)
+	vc, err := createVoiceConnection(s, m, guild, inst)
 	if err != nil {
 		return
 	}
 
-	srvr.addSong(song{
+	inst.addSong(song{
 		URL:      url,
 		Name:     vid.Title,
 		Duration: vid.Duration,
@@ -125,19 +107,19 @@ func addToQueue(s *discordgo.Session, m *discordgo.MessageCreate, msglist []stri
 
 	s.ChannelMessageSend(m.ChannelID, "Added "+vid.Title+" to the queue!")
 
-	if !srvr.VoiceInst.Playing {
-		srvr.VoiceInst.VoiceCon = vc
-		srvr.VoiceInst.Playing = true
-		srvr.VoiceInst.ChannelID = vc.ChannelID
-		go play(s, m, srvr, vc)
+	if !inst.Playing {
+		inst.VoiceCon = vc
+		inst.Playing = true
+		inst.ChannelID = vc.ChannelID
+		go play(s, m, inst, vc)
 	}
 
 	s.ChannelMessageSend(m.ChannelID, "Need to be in a voice channel!")
 }
 
-func createVoiceConnection(s *discordgo.Session, m *discordgo.MessageCreate, guild *discordgo.Guild, srvr *server) (*discordgo.VoiceConnection, error) {
+func createVoiceConnection(s session, m *discordgo.MessageCreate, guild *discordgo.Guild, inst *voiceInst) (*discordgo.VoiceConnection, error) {
 	for _, vs := range guild.VoiceStates {
-		if vs.UserID == m.Author.ID && (vs.ChannelID == srvr.VoiceInst.ChannelID || !srvr.VoiceInst.Playing) {
+		if vs.UserID == m.Author.ID && (vs.ChannelID == inst.ChannelID || !inst.Playing) {
 			vc, err := s.ChannelVoiceJoin(guild.ID, vs.ChannelID, false, true)
 			if err != nil {
 				s.ChannelMessageSend(m.ChannelID, "Error joining voice channel")
@@ -150,7 +132,7 @@ func createVoiceConnection(s *discordgo.Session, m *discordgo.MessageCreate, gui
 	return nil, errors.New("not in voice channel")
 }
 
-func getVideoInfo(url string, s *discordgo.Session, m *discordgo.MessageCreate) (*ytdl.VideoInfo, error) {
+func getVideoInfo(url string, s session, m *discordgo.MessageCreate) (*ytdl.VideoInfo, error) {
 	vid, err := ytdl.GetVideoInfo(url)
 	if err != nil {
 		s.ChannelMessageSend(m.ChannelID, "Error getting video info")
@@ -160,17 +142,17 @@ func getVideoInfo(url string, s *discordgo.Session, m *discordgo.MessageCreate)
 	return vid, nil
 }
 
-func play(s *discordgo.Session, m *discordgo.MessageCreate, srvr *server, vc *discordgo.VoiceConnection) {
-	if srvr.queueLength() == 0 {
-		srvr.youtubeCleanup()
+func play(s session, m *discordgo.MessageCreate, inst *voiceInst, vc *discordgo.VoiceConnection) {
+	if inst.queueLength() == 0 {
+		inst.cleanup()
 		s.ChannelMessageSend(m.ChannelID, "🔇 Done queue!")
 		return
 	}
 
-	srvr.VoiceInst.Lock()
-	vid, err := getVideoInfo(srvr.nextSong().URL, s, m)
+	inst.Lock()
+	vid, err := getVideoInfo(inst.nextSong().URL, s, m)
 	if err != nil {
-		srvr.VoiceInst.Unlock()
+		inst.Unlock()
 		return
 	}
 
@@ -184,7 +166,7 @@ func play(s *discordgo.Session, m *discordgo.MessageCreate, srvr *server, vc *di
 			if err := vid.Download(formats[0], writer); err != nil && err != io.ErrClosedPipe {
 				s.ChannelMessageSend(m.ChannelID, xmark+" Error downloading the music")
 				log.Error("error downloading YouTube video", err)
-				srvr.VoiceInst.Done <- err
+				inst.Done <- err
 				return
 			}
 		}()
@@ -193,74 +175,69 @@ func play(s *discordgo.Session, m *discordgo.MessageCreate, srvr *server, vc *di
 	encSesh, err := dca.EncodeMem(reader, dca.StdEncodeOptions)
 	if err != nil {
 		s.ChannelMessageSend(m.ChannelID, xmark+" Error starting the stream")
-		srvr.youtubeCleanup()
-		srvr.VoiceInst.Unlock()
+		inst.Unlock()
+		inst.cleanup()
 		// will only return non nill error if options arent valid
 		log.Error("error validating options", err)
 		return
 	}
 	defer encSesh.Cleanup()
 
-	srvr.VoiceInst.StreamingSession = dca.NewStream(encSesh, vc, srvr.VoiceInst.Done)
+	inst.StreamingSession = dca.NewStream(encSesh, vc, inst.Done)
 
 	s.ChannelMessageSend(m.ChannelID, "🔊 Playing: "+vid.Title)
 
-	srvr.VoiceInst.Unlock()
+	inst.Unlock()
 
 Outer:
 	for {
-		err = <-srvr.VoiceInst.Done
+		err = <-inst.Done
 
-		done, _ := srvr.VoiceInst.StreamingSession.Finished()
+		done, _ := inst.StreamingSession.Finished()
 
 		switch {
 		case err.Error() == "stop":
-			srvr.youtubeCleanup()
+			inst.cleanup()
 			s.ChannelMessageSend(m.ChannelID, "🔇 Stopped")
 			return
 		case err.Error() == "skip":
 			s.ChannelMessageSend(m.ChannelID, "⏩ Skipping")
 			break Outer
 		case !done && err != io.EOF:
-			srvr.youtubeCleanup()
+			inst.cleanup()
 			s.ChannelMessageSend(m.ChannelID, "There was an error streaming music :(")
 			log.Error("error streaming music", err)
 			return
 		case done && err == io.EOF:
 			// Remove the currently playing song from the queue and then start the next one
-			srvr.finishedSong()
+			inst.finishedSong()
 			break Outer
 		}
 	}
 
-	go play(s, m, srvr, vc)
+	go play(s, m, inst, vc)
 }
 
-func listQueue(s *discordgo.Session, m *discordgo.MessageCreate) {
+func listQueue(s session, m *discordgo.MessageCreate, a args) {
 	guild, err := guildDetails(m.ChannelID, "", s)
 	if err != nil {
 		s.ChannelMessageSend(m.ChannelID, "There was an issue loading the list :( please try again")
+		a.fail()
 		return
 	}
 
-	srvr, ok := sMap.server(guild.ID)
-	if !ok {
-		s.ChannelMessageSend(m.ChannelID, "An error occurred that really shouldn't have happened...")
-		log.Error("not in server map?", guild.ID)
-		return
-	}
-
-	if srvr.queueLength() == 0 {
+	inst, ok := voiceInstance(guild.ID)
+	if !ok || inst.queueLength() == 0 {
 		s.ChannelMessageSend(m.ChannelID, "No songs in queue!")
 		return
 	}
 
-	p := dgwidgets.NewPaginator(s, m.ChannelID)
+	p := dgwidgets.NewPaginator(s.discord(), m.ChannelID)
 	p.Add(&discordgo.MessageEmbed{
 		Title: guild.Name + "'s queue",
 
 		Fields: func() (out []*discordgo.MessageEmbedField) {
-			for i, song := range srvr.iterateQueue() {
+			for i, song := range inst.iterateQueue() {
 				out = append(out, &discordgo.MessageEmbedField{
 					Name:  fmt.Sprintf("%d - %s", i, song.Name),
 					Value: song.Duration.String(),
@@ -270,7 +247,7 @@ func listQueue(s *discordgo.Session, m *discordgo.MessageCreate) {
 		}(),
 	})
 
-	for _, song := range srvr.iterateQueue() {
+	for _, song := range inst.iterateQueue() {
 		p.Add(&discordgo.MessageEmbed{
 			Title: fmt.Sprintf("Title: %s\nDuration: %s\nURL: %s", song.Name, song.Duration, song.URL),
 
@@ -288,75 +265,91 @@ func listQueue(s *discordgo.Session, m *discordgo.MessageCreate) {
 	p.Spawn()
 }
 
-func stopQueue(s *discordgo.Session, m *discordgo.MessageCreate) {
+func stopQueue(s session, m *discordgo.MessageCreate, a args) {
 	guild, err := guildDetails(m.ChannelID, "", s)
 	if err != nil {
 		s.ChannelMessageSend(m.ChannelID, "There was an error stopping the queue :( Please try again.")
+		a.fail()
 		return
 	}
 
-	if srvr, ok := sMap.server(guild.ID); ok {
-		srvr.VoiceInst.Done <- errors.New("stop")
+	if inst, ok := voiceInstance(guild.ID); ok {
+		inst.Done <- errors.New("stop")
 	}
 }
 
-func pauseQueue(s *discordgo.Session, m *discordgo.MessageCreate) {
+func pauseQueue(s session, m *discordgo.MessageCreate, a args) {
 	guild, err := guildDetails(m.ChannelID, "", s)
 	if err != nil {
 		s.ChannelMessageSend(m.ChannelID, "There was an error pausing the video :( Please try again.")
+		a.fail()
 		return
 	}
 
-	srvr, ok := sMap.server(guild.ID)
+	inst, ok := voiceInstance(guild.ID)
 	if !ok {
 		return
 	}
 
-	srvr.VoiceInst.Lock()
-	defer srvr.VoiceInst.Unlock()
+	var prefix string
+	sMap.view(guild.ID, func(srvr *server) { prefix = srvr.prefix() })
 
-	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("⏸ Paused. To unpause, use the command `%syt unpause`", func() string {
-		if srvr.Prefix == "" {
-			return conf.Prefix
-		}
-		return srvr.Prefix
-	}()))
+	inst.Lock()
+	defer inst.Unlock()
+
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("⏸ Paused. To unpause, use the command `%syt unpause`", prefix))
 
-	srvr.VoiceInst.StreamingSession.SetPaused(true)
+	inst.StreamingSession.SetPaused(true)
 }
 
-func unpauseQueue(s *discordgo.Session, m *discordgo.MessageCreate) {
+func unpauseQueue(s session, m *discordgo.MessageCreate, a args) {
 	guild, err := guildDetails(m.ChannelID, "", s)
 	if err != nil {
 		s.ChannelMessageSend(m.ChannelID, "There was an error unpausing the song :( please try again")
+		a.fail()
 		return
 	}
 
-	if srvr, ok := sMap.server(guild.ID); ok {
-		srvr.VoiceInst.Lock()
-		defer srvr.VoiceInst.Unlock()
-		srvr.VoiceInst.StreamingSession.SetPaused(false)
+	if inst, ok := voiceInstance(guild.ID); ok {
+		inst.Lock()
+		defer inst.Unlock()
+		inst.StreamingSession.SetPaused(false)
 	}
 }
 
-func skipSong(s *discordgo.Session, m *discordgo.MessageCreate) {
+func skipSong(s session, m *discordgo.MessageCreate, a args) {
 	guild, err := guildDetails(m.ChannelID, "", s)
 	if err != nil {
 		s.ChannelMessageSend(m.ChannelID, "There was an error skipping the song :( please try again")
+		a.fail()
 		return
 	}
 
-	if srvr, ok := sMap.server(guild.ID); ok {
-		srvr.VoiceInst.Lock()
-		defer srvr.VoiceInst.Unlock()
-		srvr.VoiceInst.Done <- errors.New("skip")
+	if inst, ok := voiceInstance(guild.ID); ok {
+		inst.Lock()
+		defer inst.Unlock()
+		inst.Done <- errors.New("skip")
 	}
 }
 
-func (s *server) youtubeCleanup() {
-	s.VoiceInst.Lock()
-	defer s.VoiceInst.Unlock()
-	s.VoiceInst.VoiceCon.Disconnect()
-	s.newVoiceInstance()
+// voiceInstance returns the guilds voice instance, if it's ever played anything
+func voiceInstance(guildID string) (inst *voiceInst, ok bool) {
+	sMap.view(guildID, func(srvr *server) { inst = srvr.VoiceInst })
+	return inst, inst != nil
+}
+
+// cleanup leaves the voice channel and empties the queue. The instance is
+// reset rather than replaced, as the guild and anything playing share it.
+func (v *voiceInst) cleanup() {
+	v.Lock()
+	defer v.Unlock()
+	if v.VoiceCon != nil {
+		v.VoiceCon.Disconnect()
+	}
+	v.ChannelID = ""
+	v.Playing = false
+	v.Queue = queue.New()
+	v.VoiceCon = nil
+	v.StreamingSession = nil
 	//sMap.VoiceInsts--
 }
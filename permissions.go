@@ -0,0 +1,174 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// permOverrides grant or deny a single command to roles and users in a guild,
+// regardless of the Discord permissions the command normally needs.
+//
+// Whether someone can run a command is decided in this order, stopping at
+// the first rule that matches:
+//  1. the bot owner can run everything
+//  2. owner only commands can't be overridden
+//  3. the guild owner and administrators ignore overrides, so they can't be
+//     locked out of `perms` itself
+//  4. a deny or allow for the user themselves
+//  5. an allow for any of the users roles
+//  6. a deny for any of the users roles
+//  7. an allow or deny for @everyone
+//  8. the Discord permissions the command requires by default
+//
+// For subcommands every command along the way has to be allowed, so denying
+// `yt` also denies `yt skip`.
+type permOverrides struct {
+	AllowUsers []string `json:"allow_users,omitempty"`
+	DenyUsers  []string `json:"deny_users,omitempty"`
+	AllowRoles []string `json:"allow_roles,omitempty"`
+	DenyRoles  []string `json:"deny_roles,omitempty"`
+}
+
+// clone copies the overrides, so they can be used once the guild is unlocked
+func (p *permOverrides) clone() permOverrides {
+	return permOverrides{
+		AllowUsers: append([]string(nil), p.AllowUsers...),
+		DenyUsers:  append([]string(nil), p.DenyUsers...),
+		AllowRoles: append([]string(nil), p.AllowRoles...),
+		DenyRoles:  append([]string(nil), p.DenyRoles...),
+	}
+}
+
+func (p *permOverrides) empty() bool {
+	return len(p.AllowUsers) == 0 && len(p.DenyUsers) == 0 && len(p.AllowRoles) == 0 && len(p.DenyRoles) == 0
+}
+
+// set allows or denies id, removing it from the opposite list
+func (p *permOverrides) set(id string, isRole, allow bool) {
+	p.clear(id)
+	switch {
+	case isRole && allow:
+		p.AllowRoles = append(p.AllowRoles, id)
+	case isRole:
+		p.DenyRoles = append(p.DenyRoles, id)
+	case allow:
+		p.AllowUsers = append(p.AllowUsers, id)
+	default:
+		p.DenyUsers = append(p.DenyUsers, id)
+	}
+}
+
+// clear removes any override for id, returning whether there was one
+func (p *permOverrides) clear(id string) (found bool) {
+	for _, list := range []*[]string{&p.AllowUsers, &p.DenyUsers, &p.AllowRoles, &p.DenyRoles} {
+		if i := findIndex(*list, id); i != -1 {
+			*list = remove(*list, i)
+			found = true
+		}
+	}
+	return
+}
+
+// decide returns whether the overrides allow or deny the member, and false
+// for decided if none of them apply. everyoneID is the ID of the guilds @everyone role.
+func (p *permOverrides) decide(member *discordgo.Member, everyoneID string) (allowed, decided bool) {
+	switch {
+	case isIn(member.User.ID, p.DenyUsers):
+		return false, true
+	case isIn(member.User.ID, p.AllowUsers):
+		return true, true
+	}
+
+	for _, role := range member.Roles {
+		if isIn(role, p.AllowRoles) {
+			return true, true
+		}
+	}
+
+	for _, role := range member.Roles {
+		if isIn(role, p.DenyRoles) {
+			return false, true
+		}
+	}
+
+	switch {
+	case isIn(everyoneID, p.AllowRoles):
+		return true, true
+	case isIn(everyoneID, p.DenyRoles):
+		return false, true
+	}
+	return false, false
+}
+
+// permitted checks whether the author of m can run every command in chain,
+// taking the guilds permission overrides into account.
+func permitted(s session, m *discordgo.MessageCreate, guildID string, chain []command) (bool, error) {
+	if m.Author.ID == conf().OwnerID {
+		return true, nil
+	}
+
+	// There are no permissions or overrides in DMs
+	if guildID == "" {
+		return allowedByDefault(chain, 0), nil
+	}
+
+	userPerms, err := permissionDetails(m.Author.ID, m.ChannelID, s)
+	if err != nil {
+		return false, err
+	}
+
+	// The guild owner has every permission, including this one
+	if userPerms&discordgo.PermissionAdministrator != 0 {
+		return allowedByDefault(chain, userPerms), nil
+	}
+
+	// Copied so the guild isn't locked while the member is looked up
+	overrides := make([]*permOverrides, len(chain))
+	sMap.view(guildID, func(guild *server) {
+		for i, c := range chain {
+			if o, ok := guild.PermOverrides[strings.ToLower(c.FullName)]; ok && !c.OwnerOnly {
+				clone := o.clone()
+				overrides[i] = &clone
+			}
+		}
+	})
+
+	var member *discordgo.Member
+	for i, c := range chain {
+		overrides := overrides[i]
+		if overrides == nil {
+			if !c.allowed(userPerms, false) {
+				return false, nil
+			}
+			continue
+		}
+
+		if member == nil {
+			if member, err = memberDetails(guildID, m.Author.ID, s); err != nil {
+				return false, err
+			}
+		}
+
+		allowed, decided := overrides.decide(member, guildID)
+		if !decided {
+			allowed = c.allowed(userPerms, false)
+		}
+
+		if !allowed {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// allowedByDefault checks whether every command in chain can be run with
+// userPerms, ignoring any overrides
+func allowedByDefault(chain []command, userPerms int) bool {
+	for _, c := range chain {
+		if !c.allowed(userPerms, false) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var persist = newPersister()
+
+type playlistKey struct {
+	guildID, name string
+}
+
+// dirtySet is everything that changed since it was last written
+type dirtySet struct {
+	servers   map[string]bool
+	playlists map[playlistKey]bool
+	users     map[string]bool
+	queue     map[int]bool
+	config    bool
+}
+
+func newDirtySet() dirtySet {
+	return dirtySet{
+		servers:   make(map[string]bool),
+		playlists: make(map[playlistKey]bool),
+		users:     make(map[string]bool),
+		queue:     make(map[int]bool),
+	}
+}
+
+func (d dirtySet) len() int {
+	n := len(d.servers) + len(d.playlists) + len(d.users) + len(d.queue)
+	if d.config {
+		n++
+	}
+	return n
+}
+
+// merge adds everything in other to d
+func (d *dirtySet) merge(other dirtySet) {
+	for id := range other.servers {
+		d.servers[id] = true
+	}
+	for key := range other.playlists {
+		d.playlists[key] = true
+	}
+	for id := range other.users {
+		d.users[id] = true
+	}
+	for num := range other.queue {
+		d.queue[num] = true
+	}
+	d.config = d.config || other.config
+}
+
+// flushStats are how flushes have gone since the bot started. Failures
+// counts flushes where anything failed to be written.
+type flushStats struct {
+	Flushes      int       `json:"flushes"`
+	Failures     int       `json:"failures"`
+	Written      int       `json:"written"`
+	FailedWrites int       `json:"failed_writes"`
+	Pending      int       `json:"pending"`
+	LastFlush    time.Time `json:"last_flush"`
+	LastError    string    `json:"last_error,omitempty"`
+
+	LastLatency  time.Duration `json:"last_latency_ns"`
+	MaxLatency   time.Duration `json:"max_latency_ns"`
+	TotalLatency time.Duration `json:"total_latency_ns"`
+}
+
+func (f flushStats) avgLatency() time.Duration {
+	if f.Flushes == 0 {
+		return 0
+	}
+	return f.TotalLatency / time.Duration(f.Flushes)
+}
+
+// persister keeps track of the servers, playlists, users, queued images and
+// config that changed, and writes them out together every flush interval
+// rather than on every change. Anything that fails to be written is tried
+// again on the next flush.
+type persister struct {
+	mu    sync.Mutex
+	dirty dirtySet
+	stats flushStats
+
+	// Held for the whole of a flush, so they don't overlap
+	flushing sync.Mutex
+}
+
+func newPersister() *persister {
+	return &persister{dirty: newDirtySet()}
+}
+
+// markServer marks the guild to be saved, or deleted if it's gone. Its
+// playlists are marked separately with markPlaylist.
+func (p *persister) markServer(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dirty.servers[id] = true
+}
+
+// markPlaylist marks one of the guilds playlists to be saved, or deleted if it's gone
+func (p *persister) markPlaylist(guildID, name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dirty.playlists[playlistKey{guildID, name}] = true
+}
+
+// markUser marks the user to be saved, or deleted if they're gone
+func (p *persister) markUser(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dirty.users[id] = true
+}
+
+// markQueued marks the queued image to be saved, or deleted if it's no longer queued
+func (p *persister) markQueued(num int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dirty.queue[num] = true
+}
+
+func (p *persister) markConfig() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dirty.config = true
+}
+
+func (p *persister) pending() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dirty.len()
+}
+
+func (p *persister) metrics() flushStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Pending = p.dirty.len()
+	return stats
+}
+
+// reset forgets everything that's pending and every flush so far
+func (p *persister) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dirty = newDirtySet()
+	p.stats = flushStats{}
+}
+
+// flush writes everything that's changed. Call it straight after a change
+// that mustn't be lost if the bot goes down before the next flush.
+func (p *persister) flush() error {
+	p.flushing.Lock()
+	defer p.flushing.Unlock()
+
+	p.mu.Lock()
+	batch := p.dirty
+	p.dirty = newDirtySet()
+	p.mu.Unlock()
+
+	if batch.len() == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	failed, errs := writeDirty(batch)
+	took := time.Since(start)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dirty.merge(failed)
+
+	p.stats.Flushes++
+	p.stats.Written += batch.len() - failed.len()
+	p.stats.LastFlush = start
+	p.stats.LastLatency = took
+	p.stats.TotalLatency += took
+	if took > p.stats.MaxLatency {
+		p.stats.MaxLatency = took
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	p.stats.Failures++
+	p.stats.FailedWrites += failed.len()
+	p.stats.LastError = strings.Join(errs, "; ")
+	log.Error("error flushing", p.stats.LastError)
+	return errors.New(p.stats.LastError)
+}
+
+// autoflush flushes every flush interval if anything has changed
+func (p *persister) autoflush() {
+	for {
+		time.Sleep(conf().flushInterval())
+
+		if p.pending() != 0 {
+			p.flush()
+		}
+	}
+}
+
+// writeDirty writes everything in batch, returning what couldn't be written
+// and why. The guilds, users and queue are kept from changing while they're
+// written.
+func writeDirty(batch dirtySet) (dirtySet, []string) {
+	failed := newDirtySet()
+	var errs []string
+
+	if batch.config {
+		if err := saveConfig(); err != nil {
+			failed.config = true
+			errs = append(errs, "config: "+err.Error())
+		}
+	}
+
+	sMap.mu.RLock()
+	defer sMap.mu.RUnlock()
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	imageQueue.mu.RLock()
+	defer imageQueue.mu.RUnlock()
+
+	err := store.Batch(func() error {
+		for id := range batch.servers {
+			var err error
+			if guild, ok := sMap.serverMap[id]; ok {
+				err = store.PutServer(id, guild)
+			} else {
+				err = store.DeleteServer(id)
+			}
+			if err != nil {
+				failed.servers[id] = true
+				errs = append(errs, "server "+id+": "+err.Error())
+			}
+		}
+
+		for key := range batch.playlists {
+			var songs []song
+			var ok bool
+			if guild, found := sMap.serverMap[key.guildID]; found {
+				songs, ok = guild.Playlists[key.name]
+			}
+
+			var err error
+			if ok {
+				err = store.PutPlaylist(key.guildID, key.name, songs)
+			} else {
+				err = store.DeletePlaylist(key.guildID, key.name)
+			}
+			if err != nil {
+				failed.playlists[key] = true
+				errs = append(errs, "playlist "+key.name+" in "+key.guildID+": "+err.Error())
+			}
+		}
+
+		for id := range batch.users {
+			var err error
+			if usr, ok := u.m[id]; ok {
+				err = store.PutUser(id, usr)
+			} else {
+				err = store.DeleteUser(id)
+			}
+			if err != nil {
+				failed.users[id] = true
+				errs = append(errs, "user "+id+": "+err.Error())
+			}
+		}
+
+		for num := range batch.queue {
+			key := strconv.Itoa(num)
+
+			var err error
+			if img, ok := imageQueue.m[key]; ok {
+				err = store.PutQueued(key, img)
+			} else {
+				err = store.DeleteQueued(key)
+			}
+			if err != nil {
+				failed.queue[num] = true
+				errs = append(errs, "queued image "+key+": "+err.Error())
+			}
+		}
+		return nil
+	})
+
+	// Nothing written in the batch made it to disk
+	if err != nil {
+		config := failed.config
+		failed = newDirtySet()
+		failed.merge(batch)
+		failed.config = config
+		errs = append(errs, err.Error())
+	}
+	return failed, errs
+}
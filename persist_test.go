@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPersistFlush(t *testing.T) {
+	for name, st := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			resetState()
+			store = st
+
+			songs := []song{{URL: "https://youtu.be/1", Name: "one"}}
+			sMap.update(testGuildID, func(guild *server) {
+				guild.Nsfw = true
+				guild.Playlists = map[string][]song{"chill": songs}
+			})
+			u.upsert(testUserID, func(usr *user) { usr.Images["cat"] = "cat.png" })
+			imageQueue.add(3, &queuedImage{AuthorID: testUserID, ImageName: "dog"})
+
+			persist.markServer(testGuildID)
+			persist.markPlaylist(testGuildID, "chill")
+			persist.markUser(testUserID)
+			persist.markQueued(3)
+			// Marking twice is still one write
+			persist.markUser(testUserID)
+
+			if got := persist.pending(); got != 4 {
+				t.Errorf("expected 4 pending changes, got %d", got)
+			}
+			if usrs, _ := st.Users(); len(usrs) != 0 {
+				t.Fatal("expected nothing to be written before a flush")
+			}
+
+			if err := persist.flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			serverMap, _ := st.Servers()
+			if guild, ok := serverMap[testGuildID]; !ok || !guild.Nsfw || len(guild.Playlists["chill"]) != 1 {
+				t.Errorf("expected the guild and its playlist to be written, got %+v", guild)
+			}
+			if usrs, _ := st.Users(); usrs[testUserID] == nil || usrs[testUserID].Images["cat"] != "cat.png" {
+				t.Errorf("expected the user to be written, got %+v", usrs)
+			}
+			if queue, _ := st.Queue(); queue["3"] == nil {
+				t.Errorf("expected the queued image to be written, got %+v", queue)
+			}
+
+			// Anything that's gone when it's flushed is deleted
+			imageQueue.remove(3)
+			persist.markQueued(3)
+			if err := persist.flush(); err != nil {
+				t.Fatal(err)
+			}
+			if queue, _ := st.Queue(); len(queue) != 0 {
+				t.Errorf("expected the queued image to be deleted, got %+v", queue)
+			}
+
+			stats := persist.metrics()
+			if stats.Flushes != 2 || stats.Written != 5 || stats.Failures != 0 || stats.Pending != 0 {
+				t.Errorf("unexpected metrics %+v", stats)
+			}
+			if stats.LastFlush.IsZero() || stats.MaxLatency < stats.LastLatency || stats.avgLatency() > stats.MaxLatency {
+				t.Errorf("unexpected latencies %+v", stats)
+			}
+		})
+	}
+}
+
+// failingStore fails to write users until fixed
+type failingStore struct {
+	Store
+	fixed bool
+}
+
+func (f *failingStore) PutUser(id string, usr *user) error {
+	if !f.fixed {
+		return errors.New("disk full")
+	}
+	return f.Store.PutUser(id, usr)
+}
+
+func TestPersistFailure(t *testing.T) {
+	resetState()
+	testStores(t)
+	st := &failingStore{Store: newJSONStore()}
+	store = st
+
+	u.upsert(testUserID, func(*user) {})
+	persist.markUser(testUserID)
+	persist.markServer(testGuildID)
+
+	err := persist.flush()
+	if err == nil || !strings.Contains(err.Error(), "user "+testUserID+": disk full") {
+		t.Fatalf("expected the user to fail to be written, got %v", err)
+	}
+
+	stats := persist.metrics()
+	if stats.Failures != 1 || stats.FailedWrites != 1 || stats.Written != 1 || stats.Pending != 1 || stats.LastError == "" {
+		t.Errorf("unexpected metrics %+v", stats)
+	}
+	if serverMap, _ := st.Servers(); serverMap[testGuildID] == nil {
+		t.Error("expected the guild to be written even though the user wasn't")
+	}
+
+	// The user is tried again on the next flush
+	st.fixed = true
+	if err := persist.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if usrs, _ := st.Users(); usrs[testUserID] == nil {
+		t.Error("expected the user to be written once the store works")
+	}
+	if got := persist.pending(); got != 0 {
+		t.Errorf("expected nothing pending, got %d", got)
+	}
+}
+
+func TestJSONStoreBatch(t *testing.T) {
+	testStores(t)
+	st := newJSONStore()
+
+	err := st.Batch(func() error {
+		for _, id := range []string{testGuildID, testOtherChan} {
+			if err := st.PutServer(id, &server{}); err != nil {
+				return err
+			}
+		}
+		if _, err := os.Stat("json/servers.json"); !os.IsNotExist(err) {
+			t.Error("expected servers.json not to be written until the batch is done")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverMap, err := newJSONStore().Servers()
+	if err != nil || len(serverMap) != 2 {
+		t.Errorf("expected both guilds to be written, got %+v %v", serverMap, err)
+	}
+	if _, err := os.Stat("json/users.json"); !os.IsNotExist(err) {
+		t.Error("expected files that didn't change not to be written")
+	}
+}
+
+// The store mustn't share the guilds it's given, or writing a playlist
+// changes them while handlers read them
+func TestPersistPlaylistRace(t *testing.T) {
+	resetState()
+	testStores(t)
+
+	persist.markServer(testGuildID)
+	if err := persist.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			sMap.update(testGuildID, func(guild *server) {
+				guild.Playlists = map[string][]song{"chill": {{URL: "https://youtu.be/1", Name: "one"}}}
+			})
+			persist.markPlaylist(testGuildID, "chill")
+			persist.flush()
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		sMap.view(testGuildID, func(guild *server) {
+			for name := range guild.Playlists {
+				_ = guild.Playlists[name]
+			}
+		})
+	}
+}
+
+// Settings, tag and prefix commands change the guild while it's being
+// written, so they have to go through sMap
+func TestPersistCommandsRace(t *testing.T) {
+	resetState()
+	testStores(t)
+	f := newFakeSession()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			persist.markServer(testGuildID)
+			persist.flush()
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		for _, content := range []string{
+			"settings cooldown set user 2 30s tag list", "settings disable r34", "settings rules", "settings cooldown reset tag list",
+			"tag add faq Read #faq", "faq", "tag info faq", "tag delete faq",
+			"prefix add ?", "prefix ignorecase ?", "prefix list", "prefix remove ?",
+			"perms deny everyone tag list", "perms list", "perms remove everyone tag list",
+			"nsfw", "logging",
+		} {
+			f.run(testOwnerID, content)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Files that can be reloaded while the bot is running, in the order they're reloaded
+var reloadFiles = []string{"config", "servers", "users", "queue"}
+
+// Config fields whose values shouldn't end up in logs or messages
+var secretConfig = []string{"token", "discord.pw_key", "s3_secret_key"}
+
+// reload reads the given files again and swaps them in, returning what
+// changed. If any of them fail to load, nothing is changed.
+func reload(s session, files []string) ([]string, error) {
+	var (
+		nextConf    *config
+		nextServers map[string]*server
+		nextUsers   users
+		nextQueue   map[string]*queuedImage
+		err         error
+	)
+
+	// Anything that hasn't been flushed yet would be lost once the files are swapped in
+	if err := persist.flush(); err != nil {
+		err = fmt.Errorf("error saving changes before reloading: %v", err)
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	for _, file := range files {
+		switch file {
+		case "config":
+			nextConf, err = readConfig()
+		case "servers":
+			nextServers, err = store.Servers()
+		case "users":
+			nextUsers, err = store.Users()
+		case "queue":
+			nextQueue, err = store.Queue()
+		default:
+			err = fmt.Errorf("unknown file, expected one of %s", strings.Join(reloadFiles, ", "))
+		}
+		if err != nil {
+			err = fmt.Errorf("error reloading %s: %v", file, err)
+			log.Error(err.Error())
+			return nil, err
+		}
+	}
+
+	var changes []string
+
+	if nextConf != nil {
+		old := replaceConf(nextConf)
+		changes = append(changes, configChanges(old, nextConf)...)
+		if nextConf.Storage != old.Storage || nextConf.DatabasePath != old.DatabasePath {
+			changes = append(changes, "storage and database_path only take effect after a restart")
+		}
+		if nextConf.ImageStorage != old.ImageStorage || nextConf.S3Endpoint != old.S3Endpoint || nextConf.S3Region != old.S3Region ||
+			nextConf.S3Bucket != old.S3Bucket || nextConf.S3AccessKey != old.S3AccessKey || nextConf.S3SecretKey != old.S3SecretKey {
+			changes = append(changes, "image_storage and the s3 settings only take effect after a restart")
+		}
+		setBotGame(s)
+	}
+
+	if nextServers != nil {
+		changes = append(changes, mapChanges("servers", &sMap, nextServers)...)
+		sMap.replace(nextServers)
+	}
+
+	if nextUsers != nil {
+		changes = append(changes, mapChanges("users", u, nextUsers)...)
+		u.replace(nextUsers)
+	}
+
+	if nextQueue != nil {
+		imageQueue.keep(nextQueue)
+		changes = append(changes, mapChanges("queue", imageQueue, nextQueue)...)
+		imageQueue.replace(nextQueue)
+
+		go resumeReviews(s)
+	}
+
+	log.Info("reloaded", strings.Join(files, ", "))
+	for _, change := range changes {
+		log.Info("reload:", change)
+	}
+	return changes, nil
+}
+
+// configChanges lists the config fields that differ between old and next
+func configChanges(old, next *config) []string {
+	var changes []string
+
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < ov.NumField(); i++ {
+		name := strings.Split(ov.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "curr_img_id" {
+			continue
+		}
+
+		before, after := ov.Field(i).Interface(), nv.Field(i).Interface()
+		switch {
+		case reflect.DeepEqual(before, after):
+		case isIn(name, secretConfig):
+			changes = append(changes, name+" changed")
+		default:
+			changes = append(changes, fmt.Sprintf("%s changed from %s to %s", name, formatConfigValue(before), formatConfigValue(after)))
+		}
+	}
+	return changes
+}
+
+func formatConfigValue(v interface{}) string {
+	if str, ok := v.(string); ok {
+		return strconv.Quote(str)
+	}
+	return fmt.Sprint(v)
+}
+
+// mapChanges counts the entries that were added, removed or changed between
+// two maps, comparing entries by their JSON
+func mapChanges(name string, old, next interface{}) []string {
+	before, err := jsonEntries(old)
+	if err != nil {
+		return []string{name + " changed"}
+	}
+	after, err := jsonEntries(next)
+	if err != nil {
+		return []string{name + " changed"}
+	}
+
+	var added, removed, changed int
+	for key, val := range after {
+		prev, ok := before[key]
+		switch {
+		case !ok:
+			added++
+		case !bytes.Equal(prev, val):
+			changed++
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			removed++
+		}
+	}
+
+	var counts []string
+	for _, c := range []struct {
+		n    int
+		verb string
+	}{{added, "added"}, {removed, "removed"}, {changed, "changed"}} {
+		if c.n != 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", c.n, c.verb))
+		}
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+	return []string{name + ": " + strings.Join(counts, ", ")}
+}
+
+func jsonEntries(m interface{}) (map[string]json.RawMessage, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries map[string]json.RawMessage
+	err = json.Unmarshal(b, &entries)
+	return entries, err
+}
+
+// reloadOnSignal reloads every file each time a signal is received
+func reloadOnSignal(sig <-chan os.Signal) {
+	for range sig {
+		log.Info("received SIGHUP, reloading")
+		reload(discordSession{dg}, reloadFiles)
+	}
+}
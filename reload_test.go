@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func writeJSON(t *testing.T, path string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("json/"+path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	resetState()
+	setConf(validConfig())
+	conf().Game = "old game"
+	conf().CurrImg = 5
+
+	playing := &voiceInst{RWMutex: new(sync.RWMutex)}
+	sMap.update(testGuildID, func(g *server) { g.VoiceInst = playing })
+
+	next := validConfig()
+	next.Prefix = "!"
+	next.Token = "new token"
+	next.Game = "new game"
+	next.CurrImg = 3
+	writeJSON(t, "config.json", next)
+
+	writeJSON(t, "servers.json", map[string]*server{
+		testGuildID:          {LogChannel: testOtherChan},
+		"200000000000000000": {},
+	})
+	writeJSON(t, "users.json", users{testUserID: {DiskQuota: 100}})
+	writeJSON(t, "queue.json", map[string]*queuedImage{})
+
+	f := newFakeSession()
+	f.run(testOwnerID, "reloadConfig")
+
+	sent := f.messages(testChannelID)
+	want := []string{
+		"Reloaded config, servers, users, queue",
+		`prefix changed from "!owo " to "!"`,
+		"token changed\n",
+		`game changed from "old game" to "new game"`,
+		"servers: 1 added, 1 changed",
+		"users: 1 added",
+	}
+	for _, w := range want {
+		if len(sent) != 1 || !strings.Contains(sent[0], w) {
+			t.Errorf("expected a message containing %q, got %q", w, sent)
+		}
+	}
+	if len(sent) == 1 && strings.Contains(sent[0], "new token") {
+		t.Error("expected the token not to be shown")
+	}
+
+	if conf().Prefix != "!" || conf().CurrImg != 5 || f.game != "new game" {
+		t.Errorf("expected the new config to be used, got %+v and game %q", conf(), f.game)
+	}
+
+	if g := testGuild(); g.LogChannel != testOtherChan || g.VoiceInst != playing {
+		t.Errorf("expected the new servers to be used with the voice instance kept, got %+v", g)
+	}
+	if usr, ok := u.get(testUserID); !ok || usr.DiskQuota != 100 {
+		t.Errorf("expected the new users to be used, got %+v", u)
+	}
+}
+
+func TestReloadFailure(t *testing.T) {
+	resetState()
+	setConf(validConfig())
+
+	broken := validConfig()
+	broken.Token = ""
+	broken.LogChannel = "nope"
+	writeJSON(t, "config.json", broken)
+	writeJSON(t, "servers.json", map[string]*server{})
+
+	f := newFakeSession()
+	f.run(testOwnerID, "reload servers config")
+
+	sent := f.messages(testChannelID)
+	if len(sent) != 1 || !strings.Contains(sent[0], "token is missing") || !strings.Contains(sent[0], `log_channel "nope"`) {
+		t.Errorf("expected every problem with the config to be reported, got %q", sent)
+	}
+
+	if conf().Token != "token" {
+		t.Error("expected the old config to be kept")
+	}
+	if testGuild() == nil {
+		t.Error("expected the old servers to be kept")
+	}
+}
+
+func TestReloadFlushesFirst(t *testing.T) {
+	resetState()
+	testStores(t)
+	setConf(validConfig())
+
+	persist.markServer(testGuildID)
+	if err := persist.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	sMap.update(testGuildID, func(g *server) { g.Nsfw = true })
+	persist.markServer(testGuildID)
+
+	f := newFakeSession()
+	f.run(testOwnerID, "reload servers")
+	if !testGuild().Nsfw {
+		t.Error("expected changes that weren't flushed yet to be kept")
+	}
+
+	// Nothing is reloaded if they can't be saved
+	store = &failingStore{Store: store}
+	u.upsert(testUserID, func(usr *user) { usr.DiskQuota = 100 })
+	persist.markUser(testUserID)
+
+	f.run(testOwnerID, "reload users")
+	sent := f.messages(testChannelID)
+	if got := sent[len(sent)-1]; !strings.Contains(got, "error saving changes before reloading") || !strings.Contains(got, "Nothing was changed") {
+		t.Errorf("expected the reload to be refused, got %q", got)
+	}
+	if usr, ok := u.get(testUserID); !ok || usr.DiskQuota != 100 {
+		t.Errorf("expected the user to be kept, got %+v", usr)
+	}
+}
+
+// Handlers read the config while it's reloaded
+func TestReloadConfigRace(t *testing.T) {
+	resetState()
+	setConf(validConfig())
+	writeJSON(t, "config.json", validConfig())
+	f := newFakeSession()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			reload(f, []string{"config"})
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		f.run(testUserID, "prefix list")
+		f.run(testUserID, "invite")
+		nextImageNumber()
+	}
+}
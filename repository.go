@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const defaultDiskQuota = 8000000
+
+var (
+	u          = &userRepo{m: make(users)}
+	imageQueue = &reviewQueue{m: make(map[string]*queuedImage), msgs: make(map[string]int)}
+)
+
+// userRepo holds every user. Commands, the HTTP server and image reviews all
+// run on their own goroutines, so records are handed out as copies by get and
+// only changed inside update or upsert.
+type userRepo struct {
+	mu sync.RWMutex
+	m  users
+}
+
+func newUser() *user {
+	return &user{
+		Images:     map[string]string{},
+		TempImages: []string{},
+		DiskQuota:  defaultDiskQuota,
+	}
+}
+
+// clone copies the user so it can be read without holding the lock
+func (usr *user) clone() user {
+	c := *usr
+	c.Images = make(map[string]string, len(usr.Images))
+	for name, file := range usr.Images {
+		c.Images[name] = file
+	}
+	c.TempImages = append([]string(nil), usr.TempImages...)
+	return c
+}
+
+// unqueue takes an image that was waiting for review off the users queue
+func (usr *user) unqueue(name string, size int) {
+	if i := findIndex(usr.TempImages, name); i != -1 {
+		usr.TempImages = remove(usr.TempImages, i)
+		usr.QueueSize -= size
+	}
+}
+
+// get returns a copy of the user
+func (r *userRepo) get(id string) (user, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	usr, ok := r.m[id]
+	if !ok {
+		return user{}, false
+	}
+	return usr.clone(), true
+}
+
+// update calls f with the user while nothing else can read or change them,
+// returning false if there's no such user. Mark them to be saved afterwards with persist.markUser.
+func (r *userRepo) update(id string, f func(usr *user)) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	usr, ok := r.m[id]
+	if ok {
+		f(usr)
+	}
+	return ok
+}
+
+// upsert is like update, but creates the user with the default quota if
+// they don't exist yet
+func (r *userRepo) upsert(id string, f func(usr *user)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	usr, ok := r.m[id]
+	if !ok {
+		usr = newUser()
+		r.m[id] = usr
+	}
+	f(usr)
+}
+
+// remove deletes the user, returning false if there was no such user
+func (r *userRepo) remove(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.m[id]
+	delete(r.m, id)
+	return ok
+}
+
+func (r *userRepo) replace(next users) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.m = next
+}
+
+func (r *userRepo) len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.m)
+}
+
+func (r *userRepo) MarshalJSON() ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return json.Marshal(r.m)
+}
+
+// reviewQueue holds the images waiting for review, keyed by image number
+// and indexed by their review message. Images are handed out as copies by
+// get and only changed inside update, as reviews change their state.
+type reviewQueue struct {
+	mu   sync.RWMutex
+	m    map[string]*queuedImage
+	msgs map[string]int
+}
+
+func (img *queuedImage) clone() queuedImage {
+	c := *img
+	c.Approvals = append([]string(nil), img.Approvals...)
+	return c
+}
+
+// get returns a copy of the queued image
+func (q *reviewQueue) get(num int) (queuedImage, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	img, ok := q.m[strconv.Itoa(num)]
+	if !ok {
+		return queuedImage{}, false
+	}
+	return img.clone(), true
+}
+
+// reviewing returns the number of the image with the review message
+func (q *reviewQueue) reviewing(msgID string) (int, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	num, ok := q.msgs[msgID]
+	return num, ok
+}
+
+func (q *reviewQueue) add(num int, img *queuedImage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.m[strconv.Itoa(num)] = img
+	q.msgs[img.ReviewMsgID] = num
+}
+
+// update runs f on the queued image while holding the lock, returning false
+// if it isn't queued. Mark it to be saved afterwards with persist.markQueued.
+func (q *reviewQueue) update(num int, f func(img *queuedImage)) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	img, ok := q.m[strconv.Itoa(num)]
+	if !ok {
+		return false
+	}
+	f(img)
+	return true
+}
+
+func (q *reviewQueue) remove(num int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if img, ok := q.m[strconv.Itoa(num)]; ok {
+		delete(q.msgs, img.ReviewMsgID)
+		delete(q.m, strconv.Itoa(num))
+	}
+}
+
+// nums returns the number of every queued image, lowest first
+func (q *reviewQueue) nums() []int {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	var out []int
+	for num := range q.m {
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			log.Error("queued image has an invalid number", num)
+			continue
+		}
+		out = append(out, n)
+	}
+	sort.Ints(out)
+	return out
+}
+
+// keep copies the images that are already queued into next, as their
+// reviews may have got further than what was saved
+func (q *reviewQueue) keep(next map[string]*queuedImage) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	for num := range next {
+		if old, ok := q.m[num]; ok {
+			next[num] = old
+		}
+	}
+}
+
+func (q *reviewQueue) replace(next map[string]*queuedImage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.m = next
+	q.msgs = make(map[string]int, len(next))
+	for num, img := range next {
+		if n, err := strconv.Atoi(num); err == nil && img != nil {
+			q.msgs[img.ReviewMsgID] = n
+		}
+	}
+}
+
+func (q *reviewQueue) len() int {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return len(q.m)
+}
+
+func (q *reviewQueue) MarshalJSON() ([]byte, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return json.Marshal(q.m)
+}
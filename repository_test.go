@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-chi/chi"
+)
+
+func TestUserRepo(t *testing.T) {
+	resetState()
+
+	if _, ok := u.get(testUserID); ok {
+		t.Fatal("expected no user before one is added")
+	}
+	if u.update(testUserID, func(*user) { t.Error("expected update not to run for a missing user") }) {
+		t.Error("expected update to report a missing user")
+	}
+
+	u.upsert(testUserID, func(usr *user) { usr.Images["cat"] = "cat.png" })
+
+	usr, ok := u.get(testUserID)
+	if !ok || usr.DiskQuota != defaultDiskQuota || usr.Images["cat"] != "cat.png" {
+		t.Fatalf("expected a new user with the default quota, got %+v", usr)
+	}
+
+	// Changing the copy doesn't change the record
+	usr.Images["dog"] = "dog.png"
+	usr.TempImages = append(usr.TempImages, "dog")
+	if again, _ := u.get(testUserID); len(again.Images) != 1 || len(again.TempImages) != 0 {
+		t.Errorf("expected get to return a copy, got %+v", again)
+	}
+}
+
+func TestUserUnqueue(t *testing.T) {
+	usr := newUser()
+	usr.TempImages = []string{"cat", "dog"}
+	usr.QueueSize = 30
+
+	usr.unqueue("cat", 10)
+	usr.unqueue("bird", 10)
+
+	if len(usr.TempImages) != 1 || usr.TempImages[0] != "dog" || usr.QueueSize != 20 {
+		t.Errorf("expected only cat to be taken off the queue, got %+v", usr)
+	}
+}
+
+// TestConcurrentAccess saves, reviews and deletes images while guild events,
+// playlist commands and image lookups run alongside them. Run it with -race.
+func TestConcurrentAccess(t *testing.T) {
+	resetState()
+	conf().URL = "https://example.com/"
+	// Lets testUserID skip the image save cooldown
+	conf().OwnerID = testUserID
+
+	srv := imageServer()
+	defer srv.Close()
+
+	router := chi.NewRouter()
+	router.Get("/image/{id}/recall/{img}", httpImageRecall)
+
+	f := newFakeSession()
+	const images = 8
+
+	stop := make(chan struct{})
+	var churn sync.WaitGroup
+	loop := func(f func(i int)) {
+		churn.Add(1)
+		go func() {
+			defer churn.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+					f(i)
+				}
+			}
+		}()
+	}
+
+	const otherGuild = "200000000000000000"
+	loop(func(i int) {
+		for _, id := range []string{testGuildID, otherGuild} {
+			guild := &discordgo.Guild{ID: id, Name: "Guild", OwnerID: testOwnerID}
+			guildJoinEvent(f, &discordgo.GuildCreate{Guild: guild})
+			guildKickedEvent(f, &discordgo.GuildDelete{Guild: guild})
+		}
+		guildJoinEvent(f, &discordgo.GuildCreate{Guild: &discordgo.Guild{ID: testGuildID, OwnerID: testOwnerID}})
+	})
+	loop(func(i int) {
+		presenceChangeEvent(f, &discordgo.PresenceUpdate{GuildID: testGuildID, Presence: discordgo.Presence{User: &discordgo.User{ID: testUserID}}})
+		memberJoinEvent(f, &discordgo.GuildMemberAdd{Member: &discordgo.Member{GuildID: testGuildID, User: &discordgo.User{ID: testUserID}}})
+	})
+	loop(func(i int) {
+		f.run(testOwnerID, "playlist create chill")
+		f.run(testOwnerID, "playlist remove 0 chill")
+		f.run(testOwnerID, "playlist delete chill")
+	})
+	loop(func(i int) {
+		m := f.message(testUserID, "!owo image status")
+		messageCreateEvent(f, m)
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/image/"+testUserID+"/recall/"+imageFileName(testUserID, "cat 0")[:64], nil))
+	})
+
+	var saves sync.WaitGroup
+	for i := 0; i < images; i++ {
+		saves.Add(1)
+		go func(i int) {
+			defer saves.Done()
+			f.runMessage(f.saveMessage(fmt.Sprintf("cat %d", i), srv.URL+"/cat.png", 10, len(testImage)))
+		}(i)
+	}
+
+	saves.Wait()
+	if imageQueue.len() != images {
+		t.Fatalf("expected %d images to be queued, %d are", images, imageQueue.len())
+	}
+
+	// Two reviewers confirming each image at once only saves it once
+	var reviews sync.WaitGroup
+	for _, num := range imageQueue.nums() {
+		img, _ := imageQueue.get(num)
+		for i := 0; i < 2; i++ {
+			reviews.Add(1)
+			go func() {
+				defer reviews.Done()
+				reviewReaction(f, reactionAdd(testOwnerID, img.ReviewMsgID, "✅"))
+			}()
+		}
+	}
+	reviews.Wait()
+
+	var deletes sync.WaitGroup
+	for i := 0; i < images/2; i++ {
+		deletes.Add(1)
+		go func(i int) {
+			defer deletes.Done()
+			f.run(testUserID, fmt.Sprintf("image delete cat %d", i))
+		}(i)
+	}
+	deletes.Wait()
+
+	close(stop)
+	churn.Wait()
+
+	usr, _ := u.get(testUserID)
+	if len(usr.Images) != images/2 || usr.CurrDiskUsed != images/2*len(testImage) || usr.QueueSize != 0 || len(usr.TempImages) != 0 {
+		t.Errorf("expected %d saved images and nothing queued, got %+v", images/2, usr)
+	}
+	if imageQueue.len() != 0 {
+		t.Errorf("expected the queue to be empty, got %d", imageQueue.len())
+	}
+
+	var kicked bool
+	sMap.view(testGuildID, func(guild *server) { kicked = guild.Kicked })
+	if kicked {
+		t.Error("expected the guild to have been rejoined last")
+	}
+}
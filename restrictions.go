@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// commandRules restrict where a command, or every command in a category, can be used in a guild.
+// A channel that is denied always wins over one that is allowed, and an empty allow list means every channel.
+type commandRules struct {
+	Disabled bool     `json:"disabled,omitempty"`
+	Allowed  []string `json:"allowed_channels,omitempty"`
+	Denied   []string `json:"denied_channels,omitempty"`
+}
+
+func (r *commandRules) empty() bool {
+	return !r.Disabled && len(r.Allowed) == 0 && len(r.Denied) == 0
+}
+
+func (r *commandRules) allows(channelID string) bool {
+	if isIn(channelID, r.Denied) {
+		return false
+	}
+	return len(r.Allowed) == 0 || isIn(channelID, r.Allowed)
+}
+
+func (r *commandRules) allow(channelID string) {
+	if i := findIndex(r.Denied, channelID); i != -1 {
+		r.Denied = remove(r.Denied, i)
+	}
+	if !isIn(channelID, r.Allowed) {
+		r.Allowed = append(r.Allowed, channelID)
+	}
+}
+
+func (r *commandRules) deny(channelID string) {
+	if i := findIndex(r.Allowed, channelID); i != -1 {
+		r.Allowed = remove(r.Allowed, i)
+	}
+	if !isIn(channelID, r.Denied) {
+		r.Denied = append(r.Denied, channelID)
+	}
+}
+
+func (r *commandRules) String() string {
+	var out []string
+	if r.Disabled {
+		out = append(out, "disabled")
+	}
+	if len(r.Allowed) != 0 {
+		out = append(out, "only in "+mentionChannels(r.Allowed))
+	}
+	if len(r.Denied) != 0 {
+		out = append(out, "not in "+mentionChannels(r.Denied))
+	}
+	return strings.Join(out, ", ")
+}
+
+func mentionChannels(ids []string) string {
+	var out []string
+	for _, id := range ids {
+		out = append(out, "<#"+id+">")
+	}
+	return strings.Join(out, " ")
+}
+
+// checkRules returns false, after telling the user why, if the guilds rules
+// stop the command from running in the channel the message was sent in
+func checkRules(s session, m *discordgo.MessageCreate, guildID string, chain []command) bool {
+	var reason string
+	sMap.view(guildID, func(guild *server) { reason = guild.blockedBy(m.ChannelID, chain) })
+	if reason == "" {
+		return true
+	}
+
+	s.ChannelMessageSend(m.ChannelID, reason)
+	return false
+}
+
+// blockedBy returns why the guilds rules stop the command from running in
+// the channel, or an empty string if they don't. The rules for the commands
+// category are checked first, followed by the rules for the command and
+// each of its subcommands.
+func (g *server) blockedBy(channelID string, chain []command) string {
+	check := func(name string, rules *commandRules) string {
+		if rules == nil {
+			return ""
+		}
+
+		if rules.Disabled {
+			return fmt.Sprintf("%s is disabled in this server", codeSeg(name))
+		}
+
+		if !rules.allows(channelID) {
+			msg := fmt.Sprintf("%s can't be used in this channel", codeSeg(name))
+			if len(rules.Allowed) != 0 {
+				msg += ". Try " + mentionChannels(rules.Allowed)
+			}
+			return msg
+		}
+		return ""
+	}
+
+	if category := chain[0].Category; category != "" {
+		if reason := check(category, g.CategoryRules[strings.ToLower(category)]); reason != "" {
+			return reason
+		}
+	}
+
+	for _, c := range chain {
+		if reason := check(c.FullName, g.CommandRules[strings.ToLower(c.FullName)]); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// rulesFor returns the rules for the category or command called target,
+// creating them if they don't exist yet.
+func (g *server) rulesFor(target string) (rules *commandRules, name string, ok bool) {
+	target = strings.ToLower(strings.Join(strings.Fields(target), " "))
+
+	for _, category := range categories {
+		if strings.ToLower(category) == target {
+			if g.CategoryRules == nil {
+				g.CategoryRules = make(map[string]*commandRules)
+			}
+			if _, ok := g.CategoryRules[target]; !ok {
+				g.CategoryRules[target] = new(commandRules)
+			}
+			return g.CategoryRules[target], category, true
+		}
+	}
+
+	comm, ok := lookupCommand(target)
+	if !ok || comm.Unrestricted {
+		return nil, "", false
+	}
+
+	if g.CommandRules == nil {
+		g.CommandRules = make(map[string]*commandRules)
+	}
+	if _, ok := g.CommandRules[target]; !ok {
+		g.CommandRules[target] = new(commandRules)
+	}
+	return g.CommandRules[target], comm.FullName, true
+}
+
+// pruneRules removes any rules that no longer restrict anything
+func (g *server) pruneRules() {
+	for _, rules := range []map[string]*commandRules{g.CategoryRules, g.CommandRules} {
+		for key, r := range rules {
+			if r.empty() {
+				delete(rules, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Review states of a queued image. Pending images wait for reviewers to
+// react to their review message, until as many as the quorum approve it or
+// any of them rejects it. Approved and expired images are finished
+// and taken out of the queue straight away, and rejected ones once their
+// reviewer gives a reason. Each state is saved before anything is done
+// about it, so reviews the bot went down in the middle of are finished when
+// it starts again.
+const (
+	reviewPending  = "pending"
+	reviewApproved = "approved"
+	reviewRejected = "rejected"
+	reviewExpired  = "expired"
+)
+
+var (
+	// How long an image waits for review before it expires
+	reviewExpiry = time.Hour * 24 * 7
+	// How long a reviewer has to give the reason for a rejection before
+	// it's rejected without one
+	reasonTimeout = time.Hour
+	// How often expired reviews are looked for
+	reviewSweepInterval = time.Minute * 10
+)
+
+// finishing holds the images whose reviews are being finished, so that a
+// review is only finished once
+var finishing = struct {
+	sync.Mutex
+	m map[int]bool
+}{m: make(map[int]bool)}
+
+func reviewerName(s session, id string) string {
+	if reviewer, err := userDetails(id, s); err == nil && reviewer != nil {
+		return reviewer.Username
+	}
+	return id
+}
+
+// setReviewState runs f on the image if it's in the state from, saving it
+// straight away if f changed it. It returns the image as it now is, or false
+// if nothing changed.
+func setReviewState(num int, from string, f func(img *queuedImage) bool) (queuedImage, bool) {
+	var img queuedImage
+	var changed bool
+	imageQueue.update(num, func(q *queuedImage) {
+		if q.State == from && f(q) {
+			img, changed = q.clone(), true
+		}
+	})
+	if !changed {
+		return img, false
+	}
+
+	persist.markQueued(num)
+	persist.flush()
+	return img, true
+}
+
+// isReviewer reports whether the user can review images
+func isReviewer(s session, userID string) bool {
+	switch {
+	case userID == conf().OwnerID, isIn(userID, conf().Reviewers):
+		return true
+	case conf().ReviewerRole == "":
+		return len(conf().Reviewers) == 0
+	}
+	member, err := s.GuildMember(conf().HomeServer, userID)
+	return err == nil && isIn(conf().ReviewerRole, member.Roles)
+}
+
+// reviewReaction approves or rejects the image whose review message a
+// reviewer reacted to
+func reviewReaction(s session, r *discordgo.MessageReactionAdd) {
+	if r.UserID == s.state().User.ID {
+		return
+	}
+	num, ok := imageQueue.reviewing(r.MessageID)
+	if !ok || !isReviewer(s, r.UserID) {
+		return
+	}
+
+	switch r.Emoji.Name {
+	case "✅":
+		approveImage(s, num, r.UserID)
+	case "❌":
+		rejectImage(s, num, r.UserID)
+	}
+}
+
+// reviewReactionRemove retracts the reviewers approval, or their rejection
+// if they haven't given a reason for it yet
+func reviewReactionRemove(s session, r *discordgo.MessageReactionRemove) {
+	num, ok := imageQueue.reviewing(r.MessageID)
+	if !ok {
+		return
+	}
+
+	switch r.Emoji.Name {
+	case "✅":
+		img, ok := setReviewState(num, reviewPending, func(img *queuedImage) bool {
+			i := findIndex(img.Approvals, r.UserID)
+			if i == -1 {
+				return false
+			}
+			img.Approvals = append(append([]string(nil), img.Approvals[:i]...), img.Approvals[i+1:]...)
+			return true
+		})
+		if !ok {
+			return
+		}
+		audit(auditRetractApproval, num, img, r.UserID)
+		s.ChannelMessageSend(conf().ReviewChannel, fmt.Sprintf("%s retracted their approval of image `%s` from `%s#%s` ID: `%s`, %d of %d approvals",
+			reviewerName(s, r.UserID), img.ImageName, img.AuthorName, img.AuthorDiscrim, img.AuthorID, len(img.Approvals), conf().quorum()))
+	case "❌":
+		img, ok := setReviewState(num, reviewRejected, func(img *queuedImage) bool {
+			if !img.AwaitingReason || img.ReviewerID != r.UserID {
+				return false
+			}
+			img.State = reviewPending
+			img.ReviewerID = ""
+			img.Reviewed = time.Time{}
+			img.AwaitingReason = false
+			return true
+		})
+		if !ok {
+			return
+		}
+		audit(auditRetractRejection, num, img, r.UserID)
+		s.ChannelMessageSend(conf().ReviewChannel, fmt.Sprintf("%s retracted their rejection of image `%s` from `%s#%s` ID: `%s`, it's waiting for review again",
+			reviewerName(s, r.UserID), img.ImageName, img.AuthorName, img.AuthorDiscrim, img.AuthorID))
+	}
+}
+
+// approveImage adds the reviewers approval, and saves the image once it has
+// as many as the quorum
+func approveImage(s session, num int, reviewerID string) {
+	quorum := conf().quorum()
+	img, ok := setReviewState(num, reviewPending, func(img *queuedImage) bool {
+		if isIn(reviewerID, img.Approvals) {
+			return false
+		}
+		img.Approvals = append(img.Approvals, reviewerID)
+		if len(img.Approvals) >= quorum {
+			img.State = reviewApproved
+			img.ReviewerID = reviewerID
+			img.Reviewed = time.Now().UTC()
+		}
+		return true
+	})
+	if !ok {
+		return
+	}
+
+	audit(auditApprove, num, img, reviewerID)
+	if img.State != reviewApproved {
+		s.ChannelMessageSend(conf().ReviewChannel, fmt.Sprintf("%s approved image `%s` from `%s#%s` ID: `%s`, %d of %d approvals",
+			reviewerName(s, reviewerID), img.ImageName, img.AuthorName, img.AuthorDiscrim, img.AuthorID, len(img.Approvals), quorum))
+		return
+	}
+
+	s.ChannelMessageSend(conf().ReviewChannel, fmt.Sprintf("%s confirmed image `%s` from `%s#%s` ID: `%s`",
+		reviewerName(s, reviewerID), img.ImageName, img.AuthorName, img.AuthorDiscrim, img.AuthorID))
+	finishReview(s, num)
+}
+
+// rejectImage rejects the image, which only takes one reviewer, and waits
+// for them to give a reason
+func rejectImage(s session, num int, reviewerID string) {
+	img, ok := setReviewState(num, reviewPending, func(img *queuedImage) bool {
+		img.State = reviewRejected
+		img.ReviewerID = reviewerID
+		img.Reviewed = time.Now().UTC()
+		img.AwaitingReason = true
+		return true
+	})
+	if !ok {
+		return
+	}
+
+	audit(auditReject, num, img, reviewerID)
+	s.ChannelMessageSend(conf().ReviewChannel, fmt.Sprintf("%s rejected image `%s` from `%s#%s` ID: `%s`\n"+
+		"Give a reason next, as `%d <reason>`! Enter `%d None` to give no reason",
+		reviewerName(s, reviewerID), img.ImageName, img.AuthorName, img.AuthorDiscrim, img.AuthorID, num, num))
+}
+
+// reviewReason takes the reason for a rejection from its reviewer, as the
+// image number followed by the reason, returning whether m was one
+func reviewReason(s session, m *discordgo.MessageCreate) bool {
+	fields := strings.Fields(m.Content)
+	if len(fields) == 0 {
+		return false
+	}
+	num, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return false
+	}
+
+	img, ok := setReviewState(num, reviewRejected, func(img *queuedImage) bool {
+		if !img.AwaitingReason || img.ReviewerID != m.Author.ID {
+			return false
+		}
+		img.AwaitingReason = false
+		if reason := strings.Join(fields[1:], " "); reason != "None" {
+			img.Reason = reason
+		}
+		return true
+	})
+	if !ok {
+		return false
+	}
+
+	audit(auditRejected, num, img, m.Author.ID)
+	finishReview(s, num)
+	return true
+}
+
+// expireReviews expires the images that have waited for review for longer
+// than reviewExpiry, and rejects without a reason the ones that have waited
+// for a reason for longer than reasonTimeout
+func expireReviews(s session, now time.Time) {
+	for _, num := range imageQueue.nums() {
+		img, ok := imageQueue.get(num)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case img.State == reviewPending && now.Sub(img.Queued) > reviewExpiry:
+			img, ok = setReviewState(num, reviewPending, func(img *queuedImage) bool {
+				img.State = reviewExpired
+				img.Reviewed = now.UTC()
+				return true
+			})
+			if ok {
+				audit(auditExpired, num, img, "")
+			}
+		case img.State == reviewRejected && img.AwaitingReason && now.Sub(img.Reviewed) > reasonTimeout:
+			img, ok = setReviewState(num, reviewRejected, func(img *queuedImage) bool {
+				img.AwaitingReason = false
+				return true
+			})
+			if ok {
+				audit(auditRejected, num, img, img.ReviewerID)
+			}
+		default:
+			ok = false
+		}
+
+		if ok {
+			finishReview(s, num)
+		}
+	}
+}
+
+// resumeReviews finishes the reviews that were decided, but not finished,
+// before the bot went down
+func resumeReviews(s session) {
+	for _, num := range imageQueue.nums() {
+		if img, ok := imageQueue.get(num); ok && img.State != reviewPending && !img.AwaitingReason {
+			finishReview(s, num)
+		}
+	}
+}
+
+// reviewLoop resumes any reviews left unfinished and then expires reviews
+// every reviewSweepInterval
+func reviewLoop(s session) {
+	resumeReviews(s)
+	for {
+		time.Sleep(reviewSweepInterval)
+		expireReviews(s, time.Now())
+	}
+}
+
+// finishReview saves or drops the image depending on its state, tells its
+// author and takes it out of the queue. Doing it again after it was cut off
+// part way through is safe.
+func finishReview(s session, num int) {
+	finishing.Lock()
+	if finishing.m[num] {
+		finishing.Unlock()
+		return
+	}
+	finishing.m[num] = true
+	finishing.Unlock()
+
+	defer func() {
+		finishing.Lock()
+		delete(finishing.m, num)
+		finishing.Unlock()
+	}()
+
+	img, ok := imageQueue.get(num)
+	if !ok || img.State == reviewPending || img.AwaitingReason {
+		return
+	}
+
+	file := savedImageName(img.AuthorID, img.ImageName, img.ImageURL)
+
+	var dm string
+	switch img.State {
+	case reviewApproved:
+		err := imgStore.Move(tempImageKey(file), file)
+		if err == errImageNotFound {
+			// Already moved before the bot went down
+			_, err = imgStore.Stat(file)
+		}
+		if err != nil {
+			log.Error("error moving image out of temp storage", num, err)
+
+			// Nothing is saved, so it can be approved again once the image store works
+			setReviewState(num, reviewApproved, func(img *queuedImage) bool {
+				img.State = reviewPending
+				img.ReviewerID = ""
+				img.Reviewed = time.Time{}
+				img.Approvals = nil
+				return true
+			})
+			s.ChannelMessageSend(conf().ReviewChannel, fmt.Sprintf("Error moving image `%s` from `%s#%s` ID: `%s` out of temp storage, it's waiting for review again",
+				img.ImageName, img.AuthorName, img.AuthorDiscrim, img.AuthorID))
+			return
+		}
+
+		// Only logged once it's saved, as a failed move puts it back up for review
+		audit(auditApproved, num, img, img.ReviewerID)
+
+		u.update(img.AuthorID, func(usr *user) {
+			usr.unqueue(img.ImageName, img.FileSize)
+			if _, ok := usr.Images[img.ImageName]; !ok {
+				usr.CurrDiskUsed += img.FileSize
+				usr.Images[img.ImageName] = file
+			}
+		})
+		dm = "Your image was confirmed and is now saved :D To \"recall\" it, type `[prefix] image recall " + img.ImageName + "`"
+	case reviewRejected, reviewExpired:
+		if err := imgStore.Delete(tempImageKey(file)); err != nil {
+			log.Error("error deleting temp image", num, err)
+			s.ChannelMessageSend(conf().ReviewChannel, "Error deleting temp image")
+		}
+		u.update(img.AuthorID, func(usr *user) { usr.unqueue(img.ImageName, img.FileSize) })
+
+		if img.State == reviewExpired {
+			dm = fmt.Sprintf("Your image `%s` wasn't reviewed in time, so it wasn't saved :( Sorry! Try saving it again~", img.ImageName)
+			s.ChannelMessageSend(conf().ReviewChannel, fmt.Sprintf("Image `%s` from `%s#%s` ID: `%s` expired before it was reviewed",
+				img.ImageName, img.AuthorName, img.AuthorDiscrim, img.AuthorID))
+			break
+		}
+
+		var reason string
+		if img.Reason != "" {
+			reason = "Reason: " + img.Reason
+		}
+		dm = "Your image got rejected :( Sorry\n" + reason
+		s.ChannelMessageSend(conf().ReviewChannel, fmt.Sprintf("Reason for image `%s` from `%s#%s` ID: `%s`\n%s",
+			img.ImageName, img.AuthorName, img.AuthorDiscrim, img.AuthorID, reason))
+	default:
+		log.Error("queued image has an unknown review state", num, img.State)
+		return
+	}
+
+	imageQueue.remove(num)
+	persist.markQueued(num)
+	persist.markUser(img.AuthorID)
+	persist.flush()
+
+	channel, err := s.UserChannelCreate(img.AuthorID)
+	if err == nil {
+		_, err = s.ChannelMessageSend(channel.ID, dm)
+	}
+	if err != nil {
+		s.ChannelMessageSend(conf().ReviewChannel, fmt.Sprintf("Couldn't inform %s#%s ID: %s about the review\n%s",
+			img.AuthorName, img.AuthorDiscrim, img.AuthorID, err))
+	}
+}
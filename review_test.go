@@ -0,0 +1,345 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// restart drops the queue and loads it back from the store, like the bot
+// going down and starting again
+func restart(t *testing.T) {
+	t.Helper()
+	imageQueue.replace(make(map[string]*queuedImage))
+	if err := loadQueue(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReviewSurvivesRestart(t *testing.T) {
+	resetState()
+	f := newFakeSession()
+	srv := imageServer()
+	defer srv.Close()
+
+	var reviewMsgs []*discordgo.Message
+	for _, name := range []string{"cat", "dog", "bird"} {
+		f.runMessage(f.saveMessage(name, srv.URL+"/cat.png", 10, len(testImage)))
+		reviews := f.embeds(conf().ReviewChannel)
+		reviewMsgs = append(reviewMsgs, reviews[len(reviews)-1])
+	}
+
+	// Rejected before the restart, with the reason given after it
+	reviewReaction(f, reactionAdd(testOwnerID, reviewMsgs[0].ID, "❌"))
+	if queue, _ := store.Queue(); queue["1"].State != reviewRejected || !queue["1"].AwaitingReason {
+		t.Errorf("expected the rejection to be saved straight away, got %+v", queue["1"])
+	}
+
+	// Approved, but the bot went down before it was saved
+	imageQueue.update(2, func(img *queuedImage) { img.State = reviewApproved })
+	persist.markQueued(2)
+	persist.flush()
+
+	restart(t)
+	resumeReviews(f)
+	messageCreateEvent(f, f.message(testOwnerID, "1 too blurry"))
+	// The last one is still waiting for a reaction
+	reviewReaction(f, reactionAdd(testOwnerID, reviewMsgs[2].ID, "✅"))
+	resumeReviews(f)
+
+	want := []string{
+		"Your image got rejected :( Sorry\nReason: too blurry",
+		"Your image was confirmed and is now saved :D To \"recall\" it, type `[prefix] image recall dog`",
+		"Your image was confirmed and is now saved :D To \"recall\" it, type `[prefix] image recall bird`",
+	}
+	dms := f.messages("dm" + testUserID)
+	if len(dms) != len(want) {
+		t.Fatalf("expected each review to be finished once, got %q", dms)
+	}
+	for _, msg := range want {
+		if !isIn(msg, dms) {
+			t.Errorf("expected a DM %q, got %q", msg, dms)
+		}
+	}
+
+	usr, _ := u.get(testUserID)
+	if len(usr.Images) != 2 || usr.CurrDiskUsed != 2*len(testImage) || usr.QueueSize != 0 || len(usr.TempImages) != 0 {
+		t.Errorf("expected dog and bird to be saved and nothing queued, got %+v", usr)
+	}
+	if queue, _ := store.Queue(); imageQueue.len() != 0 || len(queue) != 0 {
+		t.Errorf("expected the queue to be empty, got %d in memory and %d saved", imageQueue.len(), len(queue))
+	}
+	for _, name := range []string{"dog", "bird"} {
+		os.Remove("images/" + imageFileName(testUserID, name))
+	}
+}
+
+func TestReviewExpiry(t *testing.T) {
+	resetState()
+	f := newFakeSession()
+	srv := imageServer()
+	defer srv.Close()
+
+	f.runMessage(f.saveMessage("cat", srv.URL+"/cat.png", 10, len(testImage)))
+	f.runMessage(f.saveMessage("dog", srv.URL+"/cat.png", 10, len(testImage)))
+	reviewReaction(f, reactionAdd(testOwnerID, f.embeds(conf().ReviewChannel)[1].ID, "❌"))
+
+	expireReviews(f, time.Now())
+	if imageQueue.len() != 2 {
+		t.Fatal("expected nothing to expire yet")
+	}
+
+	// The rejection times out first
+	expireReviews(f, time.Now().Add(reasonTimeout+time.Minute))
+	if _, ok := imageQueue.get(2); ok || imageQueue.len() != 1 {
+		t.Error("expected the rejection to go through without a reason")
+	}
+
+	expireReviews(f, time.Now().Add(reviewExpiry+time.Minute))
+	if imageQueue.len() != 0 {
+		t.Error("expected the pending image to expire")
+	}
+
+	dms := f.messages("dm" + testUserID)
+	if len(dms) != 2 || dms[0] != "Your image got rejected :( Sorry\n" || !strings.HasPrefix(dms[1], "Your image `cat` wasn't reviewed in time") {
+		t.Errorf("unexpected DMs %q", dms)
+	}
+	if got := f.messages(conf().ReviewChannel); !strings.Contains(got[len(got)-1], "`cat` from `User#0001` ID: `"+testUserID+"` expired") {
+		t.Errorf("expected reviewers to be told it expired, got %q", got[len(got)-1])
+	}
+
+	usr, _ := u.get(testUserID)
+	if len(usr.Images) != 0 || usr.QueueSize != 0 || len(usr.TempImages) != 0 {
+		t.Errorf("expected nothing to be saved or queued, got %+v", usr)
+	}
+	for _, name := range []string{"cat", "dog"} {
+		if _, err := os.Stat("images/temp/" + imageFileName(testUserID, name)); !os.IsNotExist(err) {
+			t.Errorf("expected the temp image for %s to be deleted, got %v", name, err)
+		}
+	}
+}
+
+func reactionRemove(userID, messageID, emoji string) *discordgo.MessageReactionRemove {
+	return &discordgo.MessageReactionRemove{MessageReaction: reactionAdd(userID, messageID, emoji).MessageReaction}
+}
+
+func TestIsReviewer(t *testing.T) {
+	const stranger = "100000000000000010"
+	resetState()
+	f := newFakeSession()
+	f.st.MemberAdd(&discordgo.Member{GuildID: testGuildID, User: &discordgo.User{ID: stranger}, Roles: []string{testAdminRole}})
+
+	tests := []struct {
+		name      string
+		role      string
+		reviewers []string
+		want      map[string]bool
+	}{
+		{"anyone", "", nil, map[string]bool{testUserID: true, stranger: true}},
+		{"list", "", []string{testUserID}, map[string]bool{testOwnerID: true, testUserID: true, stranger: false}},
+		{"role", testAdminRole, nil, map[string]bool{testOwnerID: true, testUserID: false, stranger: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf().OwnerID = testOwnerID
+			conf().HomeServer = testGuildID
+			conf().ReviewerRole = tt.role
+			conf().Reviewers = tt.reviewers
+			for id, want := range tt.want {
+				if got := isReviewer(f, id); got != want {
+					t.Errorf("expected isReviewer(%s) to be %t", id, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReviewQuorum(t *testing.T) {
+	const reviewer, stranger = "100000000000000010", "100000000000000011"
+	resetState()
+	conf().OwnerID = testOwnerID
+	conf().HomeServer = testGuildID
+	conf().ReviewerRole = testAdminRole
+	conf().ReviewQuorum = 2
+
+	f := newFakeSession()
+	f.st.MemberAdd(&discordgo.Member{GuildID: testGuildID, User: &discordgo.User{ID: reviewer, Username: "Reviewer"}, Roles: []string{testAdminRole}})
+	srv := imageServer()
+	defer srv.Close()
+
+	f.runMessage(f.saveMessage("cat", srv.URL+"/cat.png", 10, len(testImage)))
+	f.runMessage(f.saveMessage("dog", srv.URL+"/cat.png", 10, len(testImage)))
+	cat, dog := f.embeds(conf().ReviewChannel)[0].ID, f.embeds(conf().ReviewChannel)[1].ID
+
+	approvals := func(num int) []string {
+		img, _ := imageQueue.get(num)
+		return img.Approvals
+	}
+
+	reviewReaction(f, reactionAdd(stranger, cat, "✅"))
+	reviewReaction(f, reactionAdd(testOwnerID, cat, "✅"))
+	reviewReaction(f, reactionAdd(testOwnerID, cat, "✅"))
+	if got := approvals(1); len(got) != 1 || got[0] != testOwnerID {
+		t.Fatalf("expected only the owners approval to count once, got %q", got)
+	}
+
+	reviewReactionRemove(f, reactionRemove(testOwnerID, cat, "✅"))
+	if got := approvals(1); len(got) != 0 {
+		t.Fatalf("expected the approval to be retracted, got %q", got)
+	}
+
+	reviewReaction(f, reactionAdd(testOwnerID, cat, "✅"))
+	reviewReaction(f, reactionAdd(reviewer, cat, "✅"))
+	if _, ok := imageQueue.get(1); ok {
+		t.Fatal("expected the image to be saved once it had two approvals")
+	}
+
+	// One rejection is enough, and can be taken back until there's a reason
+	reviewReaction(f, reactionAdd(testOwnerID, dog, "✅"))
+	reviewReaction(f, reactionAdd(reviewer, dog, "❌"))
+	reviewReactionRemove(f, reactionRemove(testOwnerID, dog, "❌"))
+	if img, _ := imageQueue.get(2); img.State != reviewRejected {
+		t.Fatalf("expected only the reviewer that rejected it to take it back, got %+v", img)
+	}
+	reviewReactionRemove(f, reactionRemove(reviewer, dog, "❌"))
+	if img, _ := imageQueue.get(2); img.State != reviewPending || len(img.Approvals) != 1 {
+		t.Fatalf("expected the image to be pending again with its approval, got %+v", img)
+	}
+	reviewReaction(f, reactionAdd(reviewer, dog, "❌"))
+	messageCreateEvent(f, &discordgo.MessageCreate{Message: &discordgo.Message{
+		ChannelID: conf().ReviewChannel, Content: "2 too blurry", Author: &discordgo.User{ID: reviewer},
+	}})
+	if imageQueue.len() != 0 {
+		t.Fatal("expected the rejection to go through")
+	}
+
+	usr, _ := u.get(testUserID)
+	if _, ok := usr.Images["cat"]; !ok || len(usr.Images) != 1 {
+		t.Errorf("expected only cat to be saved, got %+v", usr)
+	}
+	os.Remove("images/" + imageFileName(testUserID, "cat"))
+
+	history, err := reviewAudit.history(testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, entry := range history {
+		actions = append(actions, entry.ImageName+" "+entry.Action)
+		if len(entry.ImageHash) != 64 {
+			t.Errorf("expected the image hash to be logged, got %+v", entry)
+		}
+	}
+	want := []string{
+		"cat approve", "cat retract approval", "cat approve", "cat approve", "cat approved",
+		"dog approve", "dog reject", "dog retract rejection", "dog reject", "dog rejected",
+	}
+	if strings.Join(actions, ", ") != strings.Join(want, ", ") {
+		t.Errorf("expected the audit log to have\n%s\ngot\n%s", strings.Join(want, ", "), strings.Join(actions, ", "))
+	}
+	if last := history[len(history)-1]; last.ReviewerID != reviewer || last.Reason != "too blurry" {
+		t.Errorf("expected the rejection to record its reviewer and reason, got %+v", last)
+	}
+}
+
+func TestReviewHistory(t *testing.T) {
+	resetState()
+	conf().OwnerID = testOwnerID
+	f := newFakeSession()
+
+	img := queuedImage{ImageName: "cat", AuthorID: testUserID, Hash: strings.Repeat("ab", 32), Reason: "blurry"}
+	audit(auditRejected, 7, img, testOwnerID)
+
+	f.run(testOwnerID, "review history "+testUserID)
+	got := f.messages(testChannelID)
+	if want := "rejected image 7 `cat` by `" + testOwnerID + "`, saved by `" + testUserID + "` hash `abababababab`\nReason: blurry"; !strings.Contains(got[len(got)-1], want) {
+		t.Errorf("expected the history to contain %q, got %q", want, got[len(got)-1])
+	}
+
+	// The reviewer's history has it too
+	f.run(testOwnerID, "review history "+testOwnerID)
+	if got := f.messages(testChannelID); !strings.HasPrefix(got[len(got)-1], "Latest 1 of 1") {
+		t.Errorf("unexpected history %q", got[len(got)-1])
+	}
+
+	f.run(testOwnerID, "review history "+testOtherChan)
+	if got := f.messages(testChannelID); !strings.HasPrefix(got[len(got)-1], "Nothing in the review history") {
+		t.Errorf("unexpected history %q", got[len(got)-1])
+	}
+
+	before := len(f.messages(testChannelID))
+	f.run(testUserID, "review history "+testUserID)
+	for _, msg := range f.messages(testChannelID)[before:] {
+		if strings.Contains(msg, "blurry") {
+			t.Error("expected only the owner to see the history")
+		}
+	}
+}
+
+// failingImageStore can't move images until fixed
+type failingImageStore struct {
+	ImageStore
+	fixed bool
+}
+
+func (f *failingImageStore) Move(from, to string) error {
+	if !f.fixed {
+		return errors.New("bucket unreachable")
+	}
+	return f.ImageStore.Move(from, to)
+}
+
+func TestReviewMoveFailure(t *testing.T) {
+	resetState()
+	st := &failingImageStore{ImageStore: imgStore}
+	imgStore = st
+	f := newFakeSession()
+	srv := imageServer()
+	defer srv.Close()
+
+	f.runMessage(f.saveMessage("cat", srv.URL+"/cat.png", 10, len(testImage)))
+	review := f.embeds(conf().ReviewChannel)[0].ID
+
+	reviewReaction(f, reactionAdd(testOwnerID, review, "✅"))
+	if img, ok := imageQueue.get(1); !ok || img.State != reviewPending || len(img.Approvals) != 0 {
+		t.Fatalf("expected the image to wait for review again, got %+v", img)
+	}
+	if queue, _ := store.Queue(); queue["1"] == nil || queue["1"].State != reviewPending {
+		t.Errorf("expected it to be saved as pending, got %+v", queue["1"])
+	}
+	if usr, _ := u.get(testUserID); len(usr.Images) != 0 || len(usr.TempImages) != 1 {
+		t.Errorf("expected nothing to be saved, got %+v", usr)
+	}
+	if dms := f.messages("dm" + testUserID); len(dms) != 0 {
+		t.Errorf("expected the author not to be told yet, got %q", dms)
+	}
+	actions := func() (out []string) {
+		history, err := reviewAudit.history(testUserID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range history {
+			out = append(out, entry.Action)
+		}
+		return
+	}
+	if got := actions(); len(got) != 1 || got[0] != auditApprove {
+		t.Errorf("expected only the approval to be logged, got %q", got)
+	}
+
+	st.fixed = true
+	reviewReactionRemove(f, reactionRemove(testOwnerID, review, "✅"))
+	reviewReaction(f, reactionAdd(testOwnerID, review, "✅"))
+	if usr, _ := u.get(testUserID); usr.Images["cat"] == "" || imageQueue.len() != 0 {
+		t.Errorf("expected the image to be saved once it's approved again, got %+v", usr)
+	}
+	if got := actions(); len(got) != 3 || got[1] != auditApprove || got[2] != auditApproved {
+		t.Errorf("expected the image to be logged as approved once it's saved, got %q", got)
+	}
+	os.Remove("images/" + imageFileName(testUserID, "cat"))
+}
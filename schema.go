@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// schemaVersion is the version of the servers, users and queue data this
+// build reads and writes. Data saved by older builds is brought up to date
+// by running every migration after the version it was saved with.
+const schemaVersion = 2
+
+// Kinds of record that migrations can change
+const (
+	recordServer = "servers"
+	recordUser   = "users"
+	recordQueued = "queue"
+)
+
+// record is a single server, user or queued image as its JSON fields
+type record map[string]json.RawMessage
+
+// migration brings records from the version before it up to version. Each
+// func changes one record of its kind in place and reports whether it did.
+type migration struct {
+	version     int
+	description string
+	migrate     map[string]func(rec record) (bool, error)
+}
+
+// migrations run in order, and each one's version is one more than the last
+var migrations = []migration{
+	{
+		version:     1,
+		description: "join messages become an object instead of a [enabled, message, channel] array",
+		migrate: map[string]func(record) (bool, error){
+			recordServer: migrateJoinMessage,
+		},
+	},
+	{
+		version:     2,
+		description: "queued images get a review state and the time they were queued",
+		migrate: map[string]func(record) (bool, error){
+			recordQueued: migrateReviewState,
+		},
+	},
+}
+
+// migrateRecords runs the migrations after version from on every record of
+// the given kind, replacing the ones that change. It returns a line for each
+// migration that changed anything.
+func migrateRecords(kind string, from int, recs map[string]json.RawMessage) ([]string, error) {
+	if from > schemaVersion {
+		return nil, fmt.Errorf("%s was saved with schema version %d, but this build only knows up to %d", kind, from, schemaVersion)
+	}
+
+	var changes []string
+	for _, m := range migrations {
+		f, ok := m.migrate[kind]
+		if m.version <= from || !ok {
+			continue
+		}
+
+		var n int
+		for key, raw := range recs {
+			var rec record
+			if err := json.Unmarshal(raw, &rec); err != nil {
+				return nil, fmt.Errorf("migration %d: %s %s: %v", m.version, kind, key, err)
+			}
+			if rec == nil {
+				continue
+			}
+
+			changed, err := f(rec)
+			if err != nil {
+				return nil, fmt.Errorf("migration %d: %s %s: %v", m.version, kind, key, err)
+			}
+			if !changed {
+				continue
+			}
+
+			b, err := json.Marshal(rec)
+			if err != nil {
+				return nil, err
+			}
+			recs[key] = b
+			n++
+		}
+
+		if n != 0 {
+			changes = append(changes, fmt.Sprintf("%s: migration %d changes %d of %d (%s)", kind, m.version, n, len(recs), m.description))
+		}
+	}
+	return changes, nil
+}
+
+// migrateJoinMessage turns ["true", message, channel] into a joinMessage
+func migrateJoinMessage(rec record) (bool, error) {
+	raw, ok := rec["join"]
+	if !ok || !bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+		return false, nil
+	}
+
+	var old []string
+	if err := json.Unmarshal(raw, &old); err != nil {
+		return false, err
+	}
+
+	var join joinMessage
+	if len(old) > 0 {
+		join.Enabled, _ = strconv.ParseBool(old[0])
+	}
+	if len(old) > 1 {
+		join.Message = old[1]
+	}
+	if len(old) > 2 {
+		join.Channel = old[2]
+	}
+
+	b, err := json.Marshal(join)
+	if err != nil {
+		return false, err
+	}
+	rec["join"] = b
+	return true, nil
+}
+
+// migrateReviewState makes images queued before there were review states
+// pending. They're counted as queued now, so they don't all expire at once.
+func migrateReviewState(rec record) (bool, error) {
+	if _, ok := rec["state"]; ok {
+		return false, nil
+	}
+
+	state, err := json.Marshal(reviewPending)
+	if err != nil {
+		return false, err
+	}
+	queued, err := json.Marshal(time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	rec["state"] = state
+	rec["queued"] = queued
+	return true, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const legacyServers = `{"` + testGuildID + `": {"log_channel": "1", "join": ["true", "Hi %s", "` + testOtherChan + `"]}, "` + testOtherChan + `": {"join": ["false", "", ""]}}`
+
+func TestMigrationsInOrder(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("expected migration %d to have version %d, got %d", i, i+1, m.version)
+		}
+	}
+	if len(migrations) == 0 || migrations[len(migrations)-1].version != schemaVersion {
+		t.Errorf("expected the last migration to be schemaVersion %d", schemaVersion)
+	}
+}
+
+func TestMigrateJoinMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    joinMessage
+		changed bool
+	}{
+		{"enabled", `["true", "Hi %s", "` + testOtherChan + `"]`, joinMessage{Enabled: true, Message: "Hi %s", Channel: testOtherChan}, true},
+		{"disabled", `["false", "", ""]`, joinMessage{}, true},
+		{"only disabled", `["false"]`, joinMessage{}, true},
+		{"not a bool", `["yes", "Hi", "` + testOtherChan + `"]`, joinMessage{Message: "Hi", Channel: testOtherChan}, true},
+		{"already migrated", `{"enabled": true, "message": "Hi"}`, joinMessage{Enabled: true, Message: "Hi"}, false},
+		{"null", `null`, joinMessage{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := record{"join": json.RawMessage(tt.in)}
+			changed, err := migrateJoinMessage(rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != tt.changed {
+				t.Errorf("expected changed to be %t", tt.changed)
+			}
+
+			var got joinMessage
+			if err := json.Unmarshal(rec["join"], &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+
+	if changed, _ := migrateJoinMessage(record{"log_channel": json.RawMessage(`"1"`)}); changed {
+		t.Error("expected a server without a join message to be left alone")
+	}
+}
+
+func TestMigrateReviewState(t *testing.T) {
+	recs := map[string]json.RawMessage{
+		"1": json.RawMessage(`{"reviewMsgID": "10", "image_name": "cat"}`),
+		"2": json.RawMessage(`{"reviewMsgID": "20", "state": "rejected", "awaiting_reason": true}`),
+	}
+	changes, err := migrateRecords(recordQueued, 1, recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || !strings.HasPrefix(changes[0], "queue: migration 2 changes 1 of 2") {
+		t.Errorf("unexpected changes %q", changes)
+	}
+
+	var old, rejected queuedImage
+	json.Unmarshal(recs["1"], &old)
+	json.Unmarshal(recs["2"], &rejected)
+	if old.State != reviewPending || old.Queued.IsZero() || old.ImageName != "cat" {
+		t.Errorf("expected the old image to be pending from now, got %+v", old)
+	}
+	if rejected.State != reviewRejected || !rejected.AwaitingReason {
+		t.Errorf("expected an image with a state to be left alone, got %+v", rejected)
+	}
+}
+
+func TestMigrateRecords(t *testing.T) {
+	recs := map[string]json.RawMessage{
+		testGuildID:   json.RawMessage(`{"join": ["true", "Hi", "1"]}`),
+		testOtherChan: json.RawMessage(`{"join": {"enabled": false}}`),
+		"empty":       json.RawMessage(`null`),
+	}
+
+	changes, err := migrateRecords(recordServer, 0, recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || !strings.HasPrefix(changes[0], "servers: migration 1 changes 1 of 3") {
+		t.Errorf("unexpected changes %q", changes)
+	}
+
+	// Nothing to do for data that's up to date, or for kinds without migrations
+	if changes, _ := migrateRecords(recordServer, schemaVersion, recs); len(changes) != 0 {
+		t.Errorf("expected no changes from the current version, got %q", changes)
+	}
+	if changes, _ := migrateRecords(recordUser, 0, map[string]json.RawMessage{testUserID: json.RawMessage(`{"quota": 1}`)}); len(changes) != 0 {
+		t.Errorf("expected users not to change, got %q", changes)
+	}
+
+	if _, err := migrateRecords(recordServer, schemaVersion+1, recs); err == nil {
+		t.Error("expected data from a newer version to be refused")
+	}
+}
+
+func TestJSONStoreMigrate(t *testing.T) {
+	testStores(t)
+	os.RemoveAll(backupDir)
+	defer os.RemoveAll(backupDir)
+
+	if err := ioutil.WriteFile("json/servers.json", []byte(legacyServers), 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeJSON(t, "users.json", users{testUserID: {DiskQuota: 100}})
+
+	st := newJSONStore()
+	changes, err := st.Migrate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"servers.json is schema version 0, migrating to 2",
+		"servers: migration 1 changes 2 of 2 (join messages become an object instead of a [enabled, message, channel] array)",
+		"users.json is schema version 0, migrating to 2",
+	}
+	if strings.Join(changes, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected the dry run to report\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(changes, "\n"))
+	}
+	if data, _ := ioutil.ReadFile("json/servers.json"); string(data) != legacyServers {
+		t.Errorf("expected a dry run not to change the file, got %s", data)
+	}
+
+	// Old files can be loaded before they're migrated
+	serverMap, err := st.Servers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := serverMap[testGuildID].JoinMessage; got != (joinMessage{Enabled: true, Message: "Hi %s", Channel: testOtherChan}) {
+		t.Errorf("expected the join message to be migrated as it's loaded, got %+v", got)
+	}
+
+	if _, err := st.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+
+	var file struct {
+		SchemaVersion int                        `json:"schema_version"`
+		Data          map[string]json.RawMessage `json:"data"`
+	}
+	data, _ := ioutil.ReadFile("json/servers.json")
+	if err := json.Unmarshal(data, &file); err != nil || file.SchemaVersion != schemaVersion || len(file.Data) != 2 {
+		t.Errorf("expected servers.json to be saved with the schema version, got %s", data)
+	}
+
+	backups, _ := listBackups("servers.json")
+	if len(backups) == 0 {
+		t.Fatal("expected servers.json to be backed up before migrating")
+	}
+	if data, _ := ioutil.ReadFile(backups[0].Path); string(data) != legacyServers {
+		t.Errorf("expected the backup to be the old file, got %s", data)
+	}
+
+	if changes, _ := st.Migrate(true); len(changes) != 0 {
+		t.Errorf("expected nothing left to migrate, got %q", changes)
+	}
+
+	newer := `{"schema_version": 99, "data": {}}`
+	if err := ioutil.WriteFile("json/queue.json", []byte(newer), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Migrate(false); err == nil {
+		t.Error("expected a file from a newer version to be refused")
+	}
+	if data, _ := ioutil.ReadFile("json/queue.json"); string(data) != newer {
+		t.Errorf("expected the newer file to be left alone, got %s", data)
+	}
+}
+
+func TestBoltStoreMigrate(t *testing.T) {
+	st := testStores(t)[storeBolt].(*boltStore)
+
+	if changes, err := st.Migrate(true); err != nil || len(changes) != 0 {
+		t.Fatalf("expected a new database to be up to date, got %q %v", changes, err)
+	}
+
+	// Make it look like it was saved before there were versions
+	var guilds map[string]json.RawMessage
+	json.Unmarshal([]byte(legacyServers), &guilds)
+	err := st.db.Update(func(tx *bolt.Tx) error {
+		for id, guild := range guilds {
+			if err := tx.Bucket(serversBucket).Put([]byte(id), guild); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(metaBucket).Delete(schemaVersionKey)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := st.Migrate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0] != "database is schema version 0, migrating to 2" || !strings.HasPrefix(changes[1], "servers: migration 1 changes 2 of 2") {
+		t.Errorf("unexpected dry run %q", changes)
+	}
+	if _, err := st.Servers(); err == nil {
+		t.Error("expected a dry run to leave the old records in place")
+	}
+
+	if _, err := st.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+
+	serverMap, err := st.Servers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := serverMap[testGuildID].JoinMessage; got != (joinMessage{Enabled: true, Message: "Hi %s", Channel: testOtherChan}) {
+		t.Errorf("expected the join message to be migrated, got %+v", got)
+	}
+	if changes, _ := st.Migrate(true); len(changes) != 0 {
+		t.Errorf("expected nothing left to migrate, got %q", changes)
+	}
+}
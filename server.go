@@ -1,43 +1,178 @@
 package main
 
 import (
+	"encoding/json"
 	"sync"
 
 	"github.com/Strum355/go-queue/queue"
 )
 
+// servers holds every guild. Handlers, image reviews and flushes run on their
+// own goroutines, so records are only read with view and changed with update,
+// which hold the lock while the given function runs. Copy out anything that's
+// needed afterwards rather than keeping hold of the guild.
 type servers struct {
 	Count      int `json:"-"`
 	VoiceInsts int `json:"-"`
 
-	Mutex sync.RWMutex `json:"-"`
+	mu sync.RWMutex
 
 	serverMap map[string]*server
 }
 
-func (s *servers) server(id string) (val *server, ok bool) {
-	val, ok = s.serverMap[id]
-	return
+// view calls f with the guild while it can't be changed, returning false if
+// there's no such guild
+func (s *servers) view(id string, f func(guild *server)) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	guild, ok := s.serverMap[id]
+	if ok {
+		f(guild)
+	}
+	return ok
+}
+
+// update calls f with the guild while nothing else can read or change it,
+// returning false if there's no such guild. Mark it to be saved afterwards
+// with persist.markServer or persist.markPlaylist.
+func (s *servers) update(id string, f func(guild *server)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	guild, ok := s.serverMap[id]
+	if ok {
+		f(guild)
+	}
+	return ok
+}
+
+// viewAll calls f with every guild while none of them can be changed
+func (s *servers) viewAll(f func(id string, guild *server)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for id, guild := range s.serverMap {
+		f(id, guild)
+	}
+}
+
+// updateAll calls f with every guild while nothing else can read or change
+// them, returning the IDs of the ones f reports it changed
+func (s *servers) updateAll(f func(guild *server) bool) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var changed []string
+	for id, guild := range s.serverMap {
+		if f(guild) {
+			changed = append(changed, id)
+		}
+	}
+	return changed
 }
 
 func (s *servers) setServer(id string, serv server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serverMap[id] = &serv
+}
+
+// add adds the guild unless it's already there, returning whether it was added
+func (s *servers) add(id string, serv server) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.serverMap[id]; ok {
+		return false
+	}
 	s.serverMap[id] = &serv
+	return true
+}
+
+// replace swaps in a new set of guilds, keeping anything that's playing
+func (s *servers) replace(next map[string]*server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, guild := range s.serverMap {
+		if n, ok := next[id]; ok {
+			n.VoiceInst = guild.VoiceInst
+		}
+	}
+	s.serverMap = next
+}
+
+func (s *servers) len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.serverMap)
+}
+
+func (s *servers) MarshalJSON() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return json.Marshal(s.serverMap)
+}
+
+func (s *servers) UnmarshalJSON(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Unmarshal(b, &s.serverMap)
 }
 
 type server struct {
-	LogChannel string `json:"log_channel"`
-	Prefix     string `json:"server_prefix,omitempty"`
+	LogChannel string   `json:"log_channel"`
+	Prefixes   prefixes `json:"server_prefix,omitempty"`
+
+	// Custom text commands keyed by their lowercase name
+	Tags map[string]*tag `json:"tags,omitempty"`
 
 	Log    bool `json:"log_active"`
 	Kicked bool `json:"kicked"`
 	Nsfw   bool `json:"nsfw"`
 
-	//Enabled, Message, Channel
-	JoinMessage [3]string `json:"join"`
+	// Don't suggest similar commands when an unknown one is used
+	NoSuggestions bool `json:"no_suggestions,omitempty"`
+
+	JoinMessage joinMessage `json:"join"`
 
 	VoiceInst *voiceInst `json:"-"`
 
 	Playlists map[string][]song `json:"playlists"`
+
+	// Who created each playlist, by playlist name
+	PlaylistCreators map[string]string `json:"playlist_creators,omitempty"`
+
+	// Cooldown overrides keyed by the full command name
+	Cooldowns map[string]cooldown `json:"cooldowns,omitempty"`
+
+	// Keyed by the lowercase command or category name
+	CommandRules  map[string]*commandRules `json:"command_rules,omitempty"`
+	CategoryRules map[string]*commandRules `json:"category_rules,omitempty"`
+
+	// Keyed by the lowercase full command name
+	PermOverrides map[string]*permOverrides `json:"perm_overrides,omitempty"`
+}
+
+// forgetUser unlinks userID from the playlists and tags they made, which
+// stay in the server. It returns whether they had made any.
+func (s *server) forgetUser(userID string) (found bool) {
+	for name, creator := range s.PlaylistCreators {
+		if creator == userID {
+			delete(s.PlaylistCreators, name)
+			found = true
+		}
+	}
+	for _, t := range s.Tags {
+		if t.AuthorID == userID {
+			t.AuthorID = ""
+			found = true
+		}
+	}
+	return
+}
+
+// joinMessage is sent to Channel when someone joins the server, with %s
+// replaced by a mention of them
+type joinMessage struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+	Channel string `json:"channel,omitempty"`
 }
 
 func (s *servers) getCount() int {
@@ -59,29 +194,29 @@ func (s *server) newVoiceInstance() {
 	}
 }
 
-func (s server) nextSong() song {
-	return s.VoiceInst.Queue.Front().(song)
+func (v *voiceInst) nextSong() song {
+	return v.Queue.Front().(song)
 }
 
-func (s server) finishedSong() {
-	s.VoiceInst.Queue.PopFront()
+func (v *voiceInst) finishedSong() {
+	v.Queue.PopFront()
 }
 
-func (s server) addSong(song song) {
-	s.VoiceInst.Queue.PushBack(song)
+func (v *voiceInst) addSong(song song) {
+	v.Queue.PushBack(song)
 }
 
-func (s server) queueLength() int {
-	s.VoiceInst.RLock()
-	defer s.VoiceInst.RUnlock()
-	return s.VoiceInst.Queue.Len()
+func (v *voiceInst) queueLength() int {
+	v.RLock()
+	defer v.RUnlock()
+	return v.Queue.Len()
 }
 
-func (s server) iterateQueue() []song {
-	s.VoiceInst.RLock()
-	defer s.VoiceInst.RUnlock()
-	ret := make([]song, s.VoiceInst.Queue.Len())
-	for i, val := range s.VoiceInst.Queue.List() {
+func (v *voiceInst) iterateQueue() []song {
+	v.RLock()
+	defer v.RUnlock()
+	ret := make([]song, v.Queue.Len())
+	for i, val := range v.Queue.List() {
 		ret[i] = val.(song)
 	}
 	return ret
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// session is the part of a discordgo session that 2Bot uses. Handlers take
+// this instead of *discordgo.Session so that they can be run against a fake in tests.
+type session interface {
+	ChannelMessageSend(channelID, content string) (*discordgo.Message, error)
+	ChannelMessageSendEmbed(channelID string, embed *discordgo.MessageEmbed) (*discordgo.Message, error)
+	ChannelMessageEdit(channelID, messageID, content string) (*discordgo.Message, error)
+	ChannelMessageDelete(channelID, messageID string) error
+	ChannelMessagesBulkDelete(channelID string, messages []string) error
+	ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string) ([]*discordgo.Message, error)
+	ChannelFileSend(channelID, name string, r io.Reader) (*discordgo.Message, error)
+	ChannelTyping(channelID string) error
+	MessageReactionAdd(channelID, messageID, emojiID string) error
+
+	Channel(channelID string) (*discordgo.Channel, error)
+	Guild(guildID string) (*discordgo.Guild, error)
+	GuildMember(guildID, userID string) (*discordgo.Member, error)
+	User(userID string) (*discordgo.User, error)
+	UserChannelCreate(recipientID string) (*discordgo.Channel, error)
+	UserChannelPermissions(userID, channelID string) (int, error)
+
+	UpdateStatus(idle int, game string) error
+	ChannelVoiceJoin(guildID, channelID string, mute, deaf bool) (*discordgo.VoiceConnection, error)
+	AddHandlerOnce(handler interface{}) func()
+
+	state() *discordgo.State
+
+	// discord returns the underlying session for libraries that need it, such as dgwidgets.
+	// This is nil in tests.
+	discord() *discordgo.Session
+}
+
+// discordSession adapts a real discordgo session to the session interface
+type discordSession struct {
+	*discordgo.Session
+}
+
+func (d discordSession) state() *discordgo.State {
+	return d.State
+}
+
+func (d discordSession) discord() *discordgo.Session {
+	return d.Session
+}
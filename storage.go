@@ -2,36 +2,90 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
-var (
-	u    = make(users)
-	sMap = servers{serverMap: make(map[string]*server)}
-)
+var sMap = servers{serverMap: make(map[string]*server)}
 
+// saveJSON atomically replaces the file in json/ with data, backing it up
+// if the last backup is old enough
 func saveJSON(path string, data interface{}) error {
-	f, err := os.OpenFile("json/"+path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	b, err := json.Marshal(data)
 	if err != nil {
 		log.Error("error saving", path, err)
 		return err
 	}
 
-	if err = json.NewEncoder(f).Encode(data); err != nil {
+	if err := writeFileAtomic("json/"+path, b); err != nil {
 		log.Error("error saving", path, err)
 		return err
 	}
+
+	if err := backupJSON(path, b, false); err != nil {
+		log.Error("error backing up", path, err)
+	}
 	return nil
 }
 
+// writeFileAtomic writes data to a temporary file next to path, syncs it to
+// disk and renames it over path, so path is never left half written
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+
+	f, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	// Make sure the rename itself is on disk
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// loadJSON decodes the file in json/ into v. If the file is corrupt, the
+// newest backup that's valid JSON is used instead.
 func loadJSON(path string, v interface{}) error {
-	f, err := os.OpenFile("json/"+path, os.O_RDONLY, 0600)
+	b, err := ioutil.ReadFile("json/" + path)
 	if err != nil {
 		log.Error("error loading", path, err)
 		return err
 	}
 
-	if err := json.NewDecoder(f).Decode(v); err != nil {
+	if !json.Valid(b) {
+		log.Error(path, "is corrupt, trying backups")
+		if b, err = newestValidBackup(path); err != nil {
+			log.Error("error loading", path, err)
+			return err
+		}
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
 		log.Error("error loading", path, err)
 		return err
 	}
@@ -39,7 +93,7 @@ func loadJSON(path string, v interface{}) error {
 }
 
 func cleanup() {
-	for _, f := range []func() error{saveConfig, saveQueue, saveServers, saveUsers} {
+	for _, f := range []func() error{persist.flush, saveConfig, saveStats, store.Close} {
 		if err := f(); err != nil {
 			log.Error("error cleaning up files", err)
 		}
@@ -48,35 +102,86 @@ func cleanup() {
 }
 
 func loadConfig() error {
-	return loadJSON("config.json", conf)
+	c, err := readConfig()
+	if err != nil {
+		return err
+	}
+	setConf(c)
+	return nil
 }
 
-func saveConfig() error {
-	return saveJSON("config.json", conf)
+// readConfig reads the config file, if there is one, and then the
+// environment variable overrides, returning a configError if anything is
+// missing or invalid.
+func readConfig() (*config, error) {
+	c := new(config)
+	if _, err := os.Stat("json/config.json"); err == nil {
+		if err := loadJSON("config.json", c); err != nil {
+			return nil, err
+		}
+	}
+
+	file := *c
+	c.file = &file
+
+	errs := c.applyEnv()
+	for _, warning := range c.setDefaults() {
+		log.Info("config:", warning)
+	}
+	if errs = append(errs, c.validate()...); len(errs) != 0 {
+		return nil, errs
+	}
+	return c, nil
 }
 
-func loadServers() error {
-	sMap = servers{serverMap: make(map[string]*server)}
-	return loadJSON("servers.json", &sMap)
+// saveConfig saves the config as it was in the file, so environment
+// overrides like the token never end up in it
+func saveConfig() error {
+	c := conf()
+	if c.file == nil {
+		return saveJSON("config.json", c)
+	}
+	return saveJSON("config.json", c.file)
 }
 
-func saveServers() error {
-	return saveJSON("servers.json", sMap)
+func loadServers() error {
+	serverMap, err := store.Servers()
+	if err != nil {
+		log.Error("error loading servers", err)
+		return err
+	}
+	sMap.replace(serverMap)
+	return nil
 }
 
 func loadUsers() error {
-	u = make(map[string]*user)
-	return loadJSON("users.json", &u)
+	next, err := store.Users()
+	if err != nil {
+		log.Error("error loading users", err)
+		return err
+	}
+	u.replace(next)
+	return nil
 }
 
-func saveUsers() error {
-	return saveJSON("users.json", u)
+func loadQueue() error {
+	next, err := store.Queue()
+	if err != nil {
+		log.Error("error loading queue", err)
+		return err
+	}
+	imageQueue.replace(next)
+	return nil
 }
 
-func loadQueue() error {
-	return loadJSON("queue.json", &imageQueue)
+func loadStats() error {
+	return loadJSON("stats.json", commandStats)
 }
 
-func saveQueue() error {
-	return saveJSON("queue.json", imageQueue)
+func saveStats() error {
+	commandStats.Lock()
+	defer commandStats.Unlock()
+
+	commandStats.dirty = false
+	return saveJSON("stats.json", commandStats)
 }
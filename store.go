@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Store persists guilds, users, the image queue and playlists. Servers
+// returns every guild with its playlists filled in, but playlists are saved
+// on their own with PutPlaylist rather than with PutServer.
+type Store interface {
+	Servers() (map[string]*server, error)
+	PutServer(id string, s *server) error
+	DeleteServer(id string) error
+
+	Users() (users, error)
+	PutUser(id string, u *user) error
+	DeleteUser(id string) error
+
+	// Queue is keyed by the image number
+	Queue() (map[string]*queuedImage, error)
+	PutQueued(num string, img *queuedImage) error
+	DeleteQueued(num string) error
+
+	Playlists(guildID string) (map[string][]song, error)
+	PutPlaylist(guildID, name string, songs []song) error
+	DeletePlaylist(guildID, name string) error
+
+	// Batch runs f, which puts and deletes records. Nothing is written until
+	// f returns. bolt then writes everything in one transaction, so a failure
+	// leaves none of it saved, while json rewrites each file that changed once.
+	Batch(f func() error) error
+
+	// Migrate brings everything saved with an older schema version up to
+	// schemaVersion, returning what it changed. With dryRun nothing is
+	// saved, and it returns what would change.
+	Migrate(dryRun bool) ([]string, error)
+
+	Close() error
+}
+
+const (
+	storeJSON = "json"
+	storeBolt = "bolt"
+)
+
+var store Store = newJSONStore()
+
+// openStore opens the storage backend chosen in the config
+func openStore(c *config) (Store, error) {
+	switch c.Storage {
+	case storeBolt:
+		return openBoltStore(c.DatabasePath)
+	case storeJSON, "":
+		return newJSONStore(), nil
+	}
+	return nil, fmt.Errorf("unknown storage %q", c.Storage)
+}
+
+// migrate copies everything in from into to, which has to be empty
+func migrate(from, to Store) error {
+	existingServers, err := to.Servers()
+	if err != nil {
+		return err
+	}
+	existingUsers, err := to.Users()
+	if err != nil {
+		return err
+	}
+	if len(existingServers) != 0 || len(existingUsers) != 0 {
+		return errors.New("the store being migrated to already has data in it")
+	}
+
+	serverMap, err := from.Servers()
+	if err != nil {
+		return err
+	}
+	userMap, err := from.Users()
+	if err != nil {
+		return err
+	}
+	queue, err := from.Queue()
+	if err != nil {
+		return err
+	}
+
+	var playlists int
+	for id, guild := range serverMap {
+		if err := to.PutServer(id, guild); err != nil {
+			return fmt.Errorf("error migrating server %s: %v", id, err)
+		}
+
+		lists, err := from.Playlists(id)
+		if err != nil {
+			return err
+		}
+		for name, songs := range lists {
+			if err := to.PutPlaylist(id, name, songs); err != nil {
+				return fmt.Errorf("error migrating playlist %s in %s: %v", name, id, err)
+			}
+			playlists++
+		}
+	}
+
+	for id, usr := range userMap {
+		if err := to.PutUser(id, usr); err != nil {
+			return fmt.Errorf("error migrating user %s: %v", id, err)
+		}
+	}
+
+	for num, img := range queue {
+		if err := to.PutQueued(num, img); err != nil {
+			return fmt.Errorf("error migrating queued image %s: %v", num, err)
+		}
+	}
+
+	log.Info(fmt.Sprintf("migrated servers=%d playlists=%d users=%d queued=%d", len(serverMap), playlists, len(userMap), len(queue)))
+	return nil
+}
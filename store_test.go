@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// testStores returns a fresh store of every kind, removing any files they
+// leave behind once the test is done
+func testStores(t *testing.T) map[string]Store {
+	for _, f := range []string{"json/servers.json", "json/users.json", "json/queue.json", "json/test.db"} {
+		os.Remove(f)
+	}
+
+	bolt, err := openBoltStore("json/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		bolt.Close()
+		os.Remove("json/test.db")
+	})
+
+	return map[string]Store{storeJSON: newJSONStore(), storeBolt: bolt}
+}
+
+func TestStore(t *testing.T) {
+	songs := []song{{URL: "https://youtu.be/1", Name: "one"}, {URL: "https://youtu.be/2", Name: "two"}}
+
+	for name, st := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			guild := &server{LogChannel: testChannelID, Prefixes: prefixes{{Text: "?"}}}
+			if err := st.PutServer(testGuildID, guild); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.PutServer(testOtherChan, &server{Nsfw: true}); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.PutPlaylist(testGuildID, "chill", songs); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.PutPlaylist(testGuildID, "loud", songs[:1]); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.DeletePlaylist(testGuildID, "loud"); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.DeleteServer(testOtherChan); err != nil {
+				t.Fatal(err)
+			}
+
+			serverMap, err := st.Servers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(serverMap) != 1 || serverMap[testGuildID].LogChannel != testChannelID || serverMap[testGuildID].Prefixes[0].Text != "?" {
+				t.Errorf("expected only the test guild, got %+v", serverMap)
+			}
+
+			want := map[string][]song{"chill": songs}
+			if got := serverMap[testGuildID].Playlists; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected the servers playlists to be %+v, got %+v", want, got)
+			}
+			if got, err := st.Playlists(testGuildID); err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("expected playlists %+v, got %+v %v", want, got, err)
+			}
+
+			usr := &user{Images: map[string]string{"cat": "cat.png"}, DiskQuota: 100}
+			if err := st.PutUser(testUserID, usr); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.PutUser(testOwnerID, &user{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.DeleteUser(testOwnerID); err != nil {
+				t.Fatal(err)
+			}
+
+			userMap, err := st.Users()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(userMap) != 1 || !reflect.DeepEqual(userMap[testUserID], usr) {
+				t.Errorf("expected only %+v, got %+v", usr, userMap)
+			}
+
+			img := &queuedImage{AuthorID: testUserID, ImageName: "cat", FileSize: 10}
+			if err := st.PutQueued("1", img); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.PutQueued("2", img); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.DeleteQueued("2"); err != nil {
+				t.Fatal(err)
+			}
+
+			queue, err := st.Queue()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(queue) != 1 || !reflect.DeepEqual(queue["1"], img) {
+				t.Errorf("expected only image 1 to be queued, got %+v", queue)
+			}
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	stores := testStores(t)
+	from, to := stores[storeJSON], stores[storeBolt]
+
+	from.PutServer(testGuildID, &server{LogChannel: testChannelID})
+	from.PutPlaylist(testGuildID, "chill", []song{{URL: "https://youtu.be/1"}})
+	from.PutUser(testUserID, &user{DiskQuota: 100})
+	from.PutQueued("1", &queuedImage{AuthorID: testUserID})
+
+	// Everything is read back from the files, like the migration on startup
+	if err := migrate(newJSONStore(), to); err != nil {
+		t.Fatal(err)
+	}
+
+	serverMap, _ := to.Servers()
+	userMap, _ := to.Users()
+	queue, _ := to.Queue()
+
+	if len(serverMap) != 1 || len(serverMap[testGuildID].Playlists["chill"]) != 1 {
+		t.Errorf("expected the server and its playlist to be migrated, got %+v", serverMap)
+	}
+	if len(userMap) != 1 || userMap[testUserID].DiskQuota != 100 {
+		t.Errorf("expected the user to be migrated, got %+v", userMap)
+	}
+	if len(queue) != 1 || queue["1"].AuthorID != testUserID {
+		t.Errorf("expected the queue to be migrated, got %+v", queue)
+	}
+
+	if err := migrate(newJSONStore(), to); err == nil {
+		t.Error("expected migrating into a store with data in it to fail")
+	}
+}
+
+// A batch that fails part way through mustn't leave some of its records saved
+func TestBoltStoreBatch(t *testing.T) {
+	st := testStores(t)[storeBolt]
+
+	err := st.Batch(func() error {
+		if err := st.PutUser(testUserID, newUser()); err != nil {
+			return err
+		}
+		// bolt can't make a bucket without a name, so this fails once it's written
+		return st.PutPlaylist("", "chill", nil)
+	})
+	if err == nil {
+		t.Fatal("expected the batch to fail")
+	}
+
+	if usrs, err := st.Users(); err != nil || len(usrs) != 0 {
+		t.Errorf("expected nothing from the failed batch to be saved, got %+v %v", usrs, err)
+	}
+
+	if err := st.Batch(func() error { return st.PutUser(testUserID, newUser()) }); err != nil {
+		t.Fatal(err)
+	}
+	if usrs, err := st.Users(); err != nil || usrs[testUserID] == nil {
+		t.Errorf("expected the user to be saved once the batch is done, got %+v %v", usrs, err)
+	}
+}
@@ -1,21 +1,6 @@
 package main
 
-type config struct {
-	Game    string `json:"game"`
-	Prefix  string `json:"prefix"`
-	Token   string `json:"token"`
-	OwnerID string `json:"owner_id"`
-	URL     string `json:"url"`
-
-	InDev bool `json:"indev"`
-
-	DiscordPWKey string `json:"discord.pw_key"`
-
-	CurrImg int `json:"curr_img_id"`
-	MaxProc int `json:"maxproc"`
-
-	Blacklist []string `json:"blacklist"`
-}
+import "time"
 
 type queuedImage struct {
 	ReviewMsgID   string `json:"reviewMsgID"`
@@ -26,6 +11,22 @@ type queuedImage struct {
 	ImageURL      string `json:"image_url"`
 
 	FileSize int `json:"file_size"`
+	// SHA-256 of the image, for the review audit log
+	Hash string `json:"hash,omitempty"`
+
+	// One of the review states, and when the image was queued
+	State  string    `json:"state"`
+	Queued time.Time `json:"queued"`
+
+	// Reviewers that have approved the image so far
+	Approvals []string `json:"approvals,omitempty"`
+
+	// Who approved or rejected the image, and when. A rejected image waits
+	// for its reviewer to give a reason before it's taken out of the queue.
+	ReviewerID     string    `json:"reviewer_id,omitempty"`
+	Reviewed       time.Time `json:"reviewed"`
+	AwaitingReason bool      `json:"awaiting_reason,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
 }
 
 type users map[string]*user
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	maxSuggestions = 3
+
+	// How many different unknown names are counted. They're whatever people
+	// typed, so the counts would otherwise grow forever.
+	maxUnknownCommands = 1000
+)
+
+// unknownCommands counts how often each unknown command name is used, to
+// see which commands people expect to exist. Names beyond the first
+// maxUnknownCommands aren't counted.
+var unknownCommands = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: make(map[string]int)}
+
+// levenshtein returns the edit distance between a and b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(min(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// suggestCommands returns the command names, aliases and tags closest to
+// name, closest first. Owner only commands are only suggested to the owner.
+func suggestCommands(name string, isOwner bool, tags []string) []string {
+	name = strings.ToLower(name)
+
+	// Allow more typos in longer names
+	maxDist := min(len(name)/4+1, 3)
+
+	dists := make(map[string]int)
+	consider := func(candidate string) {
+		if d := levenshtein(name, strings.ToLower(candidate)); d <= maxDist {
+			dists[candidate] = d
+		}
+	}
+
+	for _, c := range activeCommands {
+		if c.OwnerOnly && !isOwner {
+			continue
+		}
+		consider(c.Name)
+		for _, a := range c.Aliases {
+			consider(a)
+		}
+	}
+
+	for _, tag := range tags {
+		consider(tag)
+	}
+
+	var out []string
+	for candidate := range dists {
+		out = append(out, candidate)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if dists[out[i]] != dists[out[j]] {
+			return dists[out[i]] < dists[out[j]]
+		}
+		return out[i] < out[j]
+	})
+
+	if len(out) > maxSuggestions {
+		out = out[:maxSuggestions]
+	}
+	return out
+}
+
+// unknownCommand logs the use of a command that doesn't exist and suggests
+// similar ones, unless the guild has turned suggestions off. guildID is empty in DMs.
+func unknownCommand(s session, m *discordgo.MessageCreate, guildID string, name string) {
+	name = strings.ToLower(name)
+
+	unknownCommands.Lock()
+	if _, ok := unknownCommands.counts[name]; ok || len(unknownCommands.counts) < maxUnknownCommands {
+		unknownCommands.counts[name]++
+	}
+	count := unknownCommands.counts[name]
+	unknownCommands.Unlock()
+
+	log.Info(fmt.Sprintf("unknown command=%q count=%d user=%s guild=%s", name, count, m.Author.ID, m.GuildID))
+
+	var tags []string
+	var noSuggestions bool
+	sMap.view(guildID, func(guild *server) {
+		noSuggestions = guild.NoSuggestions
+		for tag := range guild.Tags {
+			tags = append(tags, tag)
+		}
+	})
+	if noSuggestions {
+		return
+	}
+
+	suggestions := suggestCommands(name, m.Author.ID == conf().OwnerID, tags)
+	if len(suggestions) == 0 {
+		return
+	}
+
+	for i, suggestion := range suggestions {
+		suggestions[i] = codeSeg(suggestion)
+	}
+
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Unknown command %s. Did you mean %s?", codeSeg(name), strings.Join(suggestions, " or ")))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"purge", "purge", 0},
+		{"purg", "purge", 1},
+		{"prg", "purge", 2},
+		{"", "abc", 3},
+		{"kitten", "sitting", 3},
+		{"héllo", "hello", 1},
+	}
+
+	for _, tt := range tests {
+		if got := levenshtein(tt.a, tt.b); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(g *server)
+		content string
+		want    []string
+	}{
+		{
+			name:    "typo",
+			content: "purg 10",
+			want:    []string{"Unknown command `purg`. Did you mean `purge`?"},
+		},
+		{
+			name:    "transposed letters",
+			content: "hlep",
+			want:    []string{"Unknown command `hlep`. Did you mean `help`?"},
+		},
+		{
+			name: "tag",
+			setup: func(g *server) {
+				g.Tags = map[string]*tag{"rules": {Content: "be nice"}}
+			},
+			content: "rulez",
+			want:    []string{"Unknown command `rulez`. Did you mean `rules`?"},
+		},
+		{
+			name:    "owner only commands aren't suggested",
+			content: "setgam",
+		},
+		{
+			name:    "nothing close",
+			content: "abcdefgh",
+		},
+		{
+			name: "turned off",
+			setup: func(g *server) {
+				g.NoSuggestions = true
+			},
+			content: "purg 10",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState()
+			if tt.setup != nil {
+				sMap.update(testGuildID, tt.setup)
+			}
+			f := newFakeSession()
+
+			f.run(testUserID, tt.content)
+
+			if sent := f.messages(testChannelID); !reflect.DeepEqual(sent, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, sent)
+			}
+		})
+	}
+
+	unknownCommands.Lock()
+	defer unknownCommands.Unlock()
+	if unknownCommands.counts["purg"] != 2 {
+		t.Errorf("expected purg to have been counted twice, got %d", unknownCommands.counts["purg"])
+	}
+}
+
+func TestUnknownCommandsCapped(t *testing.T) {
+	resetState()
+	unknownCommands.Lock()
+	old := unknownCommands.counts
+	unknownCommands.counts = map[string]int{"purg": 1}
+	for i := len(unknownCommands.counts); i < maxUnknownCommands; i++ {
+		unknownCommands.counts[strconv.Itoa(i)] = 1
+	}
+	unknownCommands.Unlock()
+	defer func() {
+		unknownCommands.Lock()
+		unknownCommands.counts = old
+		unknownCommands.Unlock()
+	}()
+
+	f := newFakeSession()
+	f.run(testUserID, "purg")
+	f.run(testUserID, "somethingnew")
+
+	unknownCommands.Lock()
+	defer unknownCommands.Unlock()
+	if len(unknownCommands.counts) != maxUnknownCommands {
+		t.Errorf("expected at most %d names to be counted, got %d", maxUnknownCommands, len(unknownCommands.counts))
+	}
+	if unknownCommands.counts["purg"] != 2 {
+		t.Errorf("expected names already counted to keep counting, got %d", unknownCommands.counts["purg"])
+	}
+}
@@ -11,21 +11,38 @@ import (
 	"github.com/go-chi/chi"
 )
 
-//From Necroforger's dgwidgets
-func nextReactionAdd(s *discordgo.Session) chan *discordgo.MessageReactionAdd {
-	out := make(chan *discordgo.MessageReactionAdd)
-	s.AddHandlerOnce(func(_ *discordgo.Session, e *discordgo.MessageReactionAdd) {
+// nextMessageCreate returns a channel that gets the next message sent
+// anywhere, and a func that removes the handler if it's no longer wanted.
+// The buffer lets the handler finish even if nothing is waiting any more.
+func nextMessageCreate(s session) (chan *discordgo.MessageCreate, func()) {
+	out := make(chan *discordgo.MessageCreate, 1)
+	remove := s.AddHandlerOnce(func(_ *discordgo.Session, e *discordgo.MessageCreate) {
 		out <- e
 	})
-	return out
-}
-
-func nextMessageCreate(s *discordgo.Session) chan *discordgo.MessageCreate {
-	out := make(chan *discordgo.MessageCreate)
-	s.AddHandlerOnce(func(_ *discordgo.Session, e *discordgo.MessageCreate) {
-		out <- e
-	})
-	return out
+	return out, remove
+}
+
+// How long confirmReply waits for an answer
+var confirmTimeout = time.Minute
+
+// confirmReply waits for the author of m to reply in the same channel,
+// returning whether they said yes. No answer within confirmTimeout is a no.
+func confirmReply(s session, m *discordgo.MessageCreate) bool {
+	timeout := time.After(confirmTimeout)
+	for {
+		next, remove := nextMessageCreate(s)
+		select {
+		case reply := <-next:
+			if reply.Author.ID != m.Author.ID || reply.ChannelID != m.ChannelID {
+				continue
+			}
+			return strings.EqualFold(strings.TrimSpace(reply.Content), "yes")
+		case <-timeout:
+			// Otherwise it'd be left waiting for a message nobody will read
+			remove()
+			return false
+		}
+	}
 }
 
 func randRange(min, max int) int {
@@ -92,14 +109,14 @@ func trimSlice(s []string) (ret []string) {
 	return
 }
 
-func deleteMessage(m *discordgo.Message, s *discordgo.Session) {
+func deleteMessage(m *discordgo.Message, s session) {
 	if m != nil {
 		s.ChannelMessageDelete(m.ChannelID, m.ID)
 	}
 }
 
-func channelDetails(channelID string, s *discordgo.Session) (channelDetails *discordgo.Channel, err error) {
-	channelDetails, err = s.State.Channel(channelID)
+func channelDetails(channelID string, s session) (channelDetails *discordgo.Channel, err error) {
+	channelDetails, err = s.state().Channel(channelID)
 	if err != nil {
 		if err == discordgo.ErrStateNotFound {
 			channelDetails, err = s.Channel(channelID)
@@ -111,8 +128,8 @@ func channelDetails(channelID string, s *discordgo.Session) (channelDetails *dis
 	return
 }
 
-func permissionDetails(authorID, channelID string, s *discordgo.Session) (perms int, err error) {
-	perms, err = s.State.UserChannelPermissions(authorID, channelID)
+func permissionDetails(authorID, channelID string, s session) (perms int, err error) {
+	perms, err = s.state().UserChannelPermissions(authorID, channelID)
 	if err != nil {
 		if err == discordgo.ErrStateNotFound {
 			perms, err = s.UserChannelPermissions(authorID, channelID)
@@ -124,7 +141,7 @@ func permissionDetails(authorID, channelID string, s *discordgo.Session) (perms
 	return
 }
 
-func userDetails(memberID string, s *discordgo.Session) (user *discordgo.User, err error) {
+func userDetails(memberID string, s session) (user *discordgo.User, err error) {
 	user, err = s.User(memberID)
 	if err != nil {
 		log.Error("error getting user details", err)
@@ -132,20 +149,31 @@ func userDetails(memberID string, s *discordgo.Session) (user *discordgo.User, e
 	return
 }
 
-func activePrefix(channelID string, s *discordgo.Session) (prefix string, err error) {
-	prefix = conf.Prefix
-	guild, err := guildDetails(channelID, "", s)
+// activePrefix returns the prefix used in the channel. This is the global
+// prefix in DMs and in guilds that haven't set their own.
+func activePrefix(channelID string, s session) (prefix string, err error) {
+	prefix = globalPrefix()
+	channel, err := channelDetails(channelID, s)
+	if err != nil {
+		s.ChannelMessageSend(channelID, "There was an issue executing the command :( Try again please~")
+		return
+	}
+
+	if channel.GuildID == "" {
+		return prefix, nil
+	}
+
+	guild, err := guildDetails(channelID, channel.GuildID, s)
 	if err != nil {
 		s.ChannelMessageSend(channelID, "There was an issue executing the command :( Try again please~")
 		return
-	} else if val, ok := sMap.server(guild.ID); ok && val.Prefix != "" {
-		prefix = val.Prefix
 	}
+	sMap.view(guild.ID, func(val *server) { prefix = val.prefix() })
 	return prefix, nil
 }
 
-func memberDetails(guildID, memberID string, s *discordgo.Session) (member *discordgo.Member, err error) {
-	member, err = s.State.Member(guildID, memberID)
+func memberDetails(guildID, memberID string, s session) (member *discordgo.Member, err error) {
+	member, err = s.state().Member(guildID, memberID)
 	if err != nil {
 		if err == discordgo.ErrStateNotFound {
 			member, err = s.GuildMember(guildID, memberID)
@@ -157,7 +185,7 @@ func memberDetails(guildID, memberID string, s *discordgo.Session) (member *disc
 	return
 }
 
-func guildDetails(channelID, guildID string, s *discordgo.Session) (guildDetails *discordgo.Guild, err error) {
+func guildDetails(channelID, guildID string, s session) (guildDetails *discordgo.Guild, err error) {
 	if guildID == "" {
 		var channel *discordgo.Channel
 		channel, err = channelDetails(channelID, s)
@@ -168,7 +196,7 @@ func guildDetails(channelID, guildID string, s *discordgo.Session) (guildDetails
 		guildID = channel.GuildID
 	}
 
-	guildDetails, err = s.State.Guild(guildID)
+	guildDetails, err = s.state().Guild(guildID)
 	if err != nil {
 		if err == discordgo.ErrStateNotFound {
 			guildDetails, err = s.Guild(guildID)
@@ -184,7 +212,7 @@ func isInServer(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	id := chi.URLParam(r, "id")
-	guild, err := guildDetails(serverID, "", dg)
+	guild, err := guildDetails(conf().HomeServer, "", discordSession{dg})
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return